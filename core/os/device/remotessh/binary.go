@@ -0,0 +1,273 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"context"
+	"debug/pe"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+)
+
+const (
+	// ErrNotAPEBinary is returned by GetPEInfo when the file is not a
+	// Portable Executable.
+	ErrNotAPEBinary = fault.Const("Not a PE binary")
+
+	// defaultDependencyDepth is the default maximum depth of the graph
+	// returned by GetDependencyGraph.
+	defaultDependencyDepth = 5
+	// lddSeparator separates the ldd output of each library in a batch.
+	lddSeparator = "==gapid-ldd== "
+)
+
+// PEInfo describes the headers of a Portable Executable (Windows) binary.
+type PEInfo struct {
+	// Machine is the target architecture, for example 0x8664 for x64.
+	Machine uint16
+	// Subsystem is the required Windows subsystem, for example
+	// "WINDOWS_CUI" for console applications.
+	Subsystem string
+	// TimeDateStamp is the link time, in RFC 3339 format.
+	TimeDateStamp string
+	// ImportedDLLs are the DLLs the binary imports symbols from.
+	ImportedDLLs []string
+}
+
+// peSubsystems are the names of the IMAGE_SUBSYSTEM_* values.
+var peSubsystems = map[uint16]string{
+	0:  "UNKNOWN",
+	1:  "NATIVE",
+	2:  "WINDOWS_GUI",
+	3:  "WINDOWS_CUI",
+	5:  "OS2_CUI",
+	7:  "POSIX_CUI",
+	9:  "WINDOWS_CE_GUI",
+	10: "EFI_APPLICATION",
+	11: "EFI_BOOT_SERVICE_DRIVER",
+	12: "EFI_RUNTIME_DRIVER",
+	13: "EFI_ROM",
+	14: "XBOX",
+	16: "WINDOWS_BOOT_APPLICATION",
+}
+
+// parsePE reads the headers and imports of the PE binary data.
+func parsePE(data []byte) (*PEInfo, error) {
+	if !bytes.HasPrefix(data, []byte("MZ")) {
+		return nil, ErrNotAPEBinary
+	}
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotAPEBinary
+	}
+	defer f.Close()
+
+	info := &PEInfo{
+		Machine:       f.Machine,
+		TimeDateStamp: time.Unix(int64(f.TimeDateStamp), 0).UTC().Format(time.RFC3339),
+		ImportedDLLs:  []string{},
+	}
+	subsystem := uint16(0)
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		subsystem = h.Subsystem
+	case *pe.OptionalHeader64:
+		subsystem = h.Subsystem
+	}
+	if name, ok := peSubsystems[subsystem]; ok {
+		info.Subsystem = name
+	} else {
+		info.Subsystem = fmt.Sprintf("UNKNOWN(%d)", subsystem)
+	}
+
+	// Imported symbols are listed as "<symbol>:<dll>".
+	symbols, err := f.ImportedSymbols()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, s := range symbols {
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			if dll := s[i+1:]; !seen[strings.ToLower(dll)] {
+				seen[strings.ToLower(dll)] = true
+				info.ImportedDLLs = append(info.ImportedDLLs, dll)
+			}
+		}
+	}
+	return info, nil
+}
+
+// GetPEInfo returns the headers of the Portable Executable binary at path on
+// the remote machine. The binary is copied and parsed locally, so nothing
+// needs to be installed on the remote machine.
+func (b binding) GetPEInfo(ctx context.Context, path string) (*PEInfo, error) {
+	data := bytes.Buffer{}
+	if err := b.ReadFile(ctx, path, &data); err != nil {
+		return nil, err
+	}
+	return parsePE(data.Bytes())
+}
+
+// DepGraph is a directed graph of shared library dependencies.
+type DepGraph struct {
+	// Nodes are the paths of the binary and its libraries. Libraries that
+	// could not be found are listed by name.
+	Nodes []string `json:"nodes"`
+	// Edges are pairs of nodes, where the first depends on the second.
+	Edges [][2]string `json:"edges"`
+}
+
+// DependencyOption is an optional setting for GetDependencyGraph.
+type DependencyOption func(*dependencyOptions)
+
+type dependencyOptions struct {
+	maxDepth int
+}
+
+// WithMaxDepth returns a DependencyOption that limits the dependency graph
+// to libraries at most depth links away from the binary.
+func WithMaxDepth(depth int) DependencyOption {
+	return func(o *dependencyOptions) { o.maxDepth = depth }
+}
+
+// parseLdd returns the libraries listed in the output of ldd. Libraries that
+// were not found are returned by name, and the vDSO is skipped.
+func parseLdd(out string) []string {
+	libs := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, " ("); i >= 0 {
+			line = line[:i]
+		}
+		if parts := strings.SplitN(line, " => ", 2); len(parts) == 2 {
+			if parts[1] == "not found" {
+				libs = append(libs, parts[0])
+			} else {
+				libs = append(libs, parts[1])
+			}
+		} else if strings.HasPrefix(line, "/") {
+			libs = append(libs, line)
+		}
+	}
+	return libs
+}
+
+// parseLddBatch splits the output of running ldd over several files, where
+// the output for each is preceded by lddSeparator and the file path.
+func parseLddBatch(out string) map[string][]string {
+	deps := map[string][]string{}
+	for _, section := range strings.Split(out, lddSeparator)[1:] {
+		lines := strings.SplitN(section, "\n", 2)
+		body := ""
+		if len(lines) == 2 {
+			body = lines[1]
+		}
+		deps[strings.TrimSpace(lines[0])] = parseLdd(body)
+	}
+	return deps
+}
+
+// buildDepGraph returns the graph of the libraries reachable from root.
+// deps holds the full list of libraries that each expanded node loads, as
+// reported by ldd. As ldd lists indirect dependencies too, edges implied by
+// a path through another library are left out.
+func buildDepGraph(root string, deps map[string][]string) *DepGraph {
+	g := &DepGraph{Nodes: []string{root}, Edges: [][2]string{}}
+	seen := map[string]bool{root: true}
+	contains := func(list []string, s string) bool {
+		for _, l := range list {
+			if l == s {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < len(g.Nodes); i++ {
+		node := g.Nodes[i]
+		libs, ok := deps[node]
+		if !ok {
+			continue
+		}
+		for _, lib := range libs {
+			if lib == node {
+				continue
+			}
+			indirect := false
+			for _, other := range libs {
+				if other != lib && other != node && contains(deps[other], lib) {
+					indirect = true
+					break
+				}
+			}
+			if indirect {
+				continue
+			}
+			g.Edges = append(g.Edges, [2]string{node, lib})
+			if !seen[lib] {
+				seen[lib] = true
+				g.Nodes = append(g.Nodes, lib)
+			}
+		}
+	}
+	return g
+}
+
+// GetDependencyGraph returns the graph of the shared libraries that binary
+// loads on the remote machine, as resolved by ldd. By default the graph is
+// limited to libraries at most 5 links away from the binary.
+func (b binding) GetDependencyGraph(ctx context.Context, binary string, opts ...DependencyOption) (*DepGraph, error) {
+	o := dependencyOptions{maxDepth: defaultDependencyDepth}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	deps := map[string][]string{}
+	level := []string{binary}
+	for depth := 0; depth < o.maxDepth && len(level) > 0; depth++ {
+		script := ""
+		for _, f := range level {
+			script += fmt.Sprintf("echo %s; ldd %s 2>&1; ", posixQuote(lddSeparator+f), posixQuote(f))
+		}
+		out, err := callStdout(ctx, b.posixShell(script+"true"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run ldd")
+		}
+		next := []string{}
+		for f, libs := range parseLddBatch(out) {
+			deps[f] = libs
+			for _, lib := range libs {
+				if _, done := deps[lib]; !done && strings.HasPrefix(lib, "/") {
+					deps[lib] = nil
+					next = append(next, lib)
+				}
+			}
+		}
+		level = next
+	}
+	// Libraries beyond the maximum depth were never expanded.
+	for lib, libs := range deps {
+		if libs == nil {
+			delete(deps, lib)
+		}
+	}
+	if _, ok := deps[binary]; !ok {
+		return nil, log.Errf(ctx, nil, "Could not list the libraries of %s", binary)
+	}
+	return buildDepGraph(binary, deps), nil
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestParsePE(t *testing.T) {
+	ctx := log.Testing(t)
+
+	// A PE32+ image with headers only.
+	const peOffset = 0x40
+	buf := bytes.Buffer{}
+	dos := make([]byte, peOffset)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], peOffset)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		TimeDateStamp:        1527854400,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE,
+	})
+	binary.Write(&buf, binary.LittleEndian, pe.OptionalHeader64{
+		Magic:               0x20b,
+		Subsystem:           pe.IMAGE_SUBSYSTEM_WINDOWS_CUI,
+		NumberOfRvaAndSizes: 16,
+	})
+
+	info, err := parsePE(buf.Bytes())
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "info").That(info).DeepEquals(&PEInfo{
+		Machine:       pe.IMAGE_FILE_MACHINE_AMD64,
+		Subsystem:     "WINDOWS_CUI",
+		TimeDateStamp: "2018-06-01T12:00:00Z",
+		ImportedDLLs:  []string{},
+	})
+
+	_, err = parsePE([]byte("\x7fELF\x02\x01\x01"))
+	assert.For(ctx, "ELF").ThatError(err).Equals(ErrNotAPEBinary)
+	_, err = parsePE([]byte("MZ truncated"))
+	assert.For(ctx, "truncated").ThatError(err).Equals(ErrNotAPEBinary)
+}
+
+func TestDependencyGraph(t *testing.T) {
+	ctx := log.Testing(t)
+
+	deps := parseLddBatch(`==gapid-ldd== /usr/bin/app
+	linux-vdso.so.1 (0x00007ffc5a7f2000)
+	libvulkan.so.1 => /usr/lib/libvulkan.so.1 (0x00007f1c2b000000)
+	libmissing.so => not found
+	libc.so.6 => /usr/lib/libc.so.6 (0x00007f1c2a000000)
+	/lib64/ld-linux-x86-64.so.2 (0x00007f1c2c000000)
+==gapid-ldd== /usr/lib/libvulkan.so.1
+	linux-vdso.so.1 (0x00007ffc5a7f2000)
+	libc.so.6 => /usr/lib/libc.so.6 (0x00007f1c2a000000)
+	/lib64/ld-linux-x86-64.so.2 (0x00007f1c2c000000)
+==gapid-ldd== /usr/lib/libc.so.6
+	/lib64/ld-linux-x86-64.so.2 (0x00007f1c2c000000)
+==gapid-ldd== /lib64/ld-linux-x86-64.so.2
+	statically linked
+`)
+	assert.For(ctx, "app libs").ThatSlice(deps["/usr/bin/app"]).Equals([]string{
+		"/usr/lib/libvulkan.so.1", "libmissing.so", "/usr/lib/libc.so.6", "/lib64/ld-linux-x86-64.so.2",
+	})
+
+	g := buildDepGraph("/usr/bin/app", deps)
+	assert.For(ctx, "graph").That(g).DeepEquals(&DepGraph{
+		Nodes: []string{"/usr/bin/app", "/usr/lib/libvulkan.so.1", "libmissing.so", "/usr/lib/libc.so.6", "/lib64/ld-linux-x86-64.so.2"},
+		Edges: [][2]string{
+			{"/usr/bin/app", "/usr/lib/libvulkan.so.1"},
+			{"/usr/bin/app", "libmissing.so"},
+			{"/usr/lib/libvulkan.so.1", "/usr/lib/libc.so.6"},
+			{"/usr/lib/libc.so.6", "/lib64/ld-linux-x86-64.so.2"},
+		},
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+// Feature is an optional capability of the remote machine.
+type Feature string
+
+const (
+	// FeatureSFTP is set when the server supports SFTP, which file transfers
+	// then use.
+	FeatureSFTP = Feature("sftp")
+	// FeatureInotify is set when inotifywait is installed, which WatchFile
+	// needs on Linux.
+	FeatureInotify = Feature("inotify")
+	// FeatureSudo is set when sudo runs commands without asking for a
+	// password.
+	FeatureSudo = Feature("sudo")
+	// FeatureGzip is set when gzip is installed.
+	FeatureGzip = Feature("gzip")
+)
+
+// featureProbes are the shell commands that succeed if the remote machine
+// has the features that are not known from the connection.
+var featureProbes = map[Feature]string{
+	FeatureInotify: "command -v inotifywait",
+	FeatureSudo:    "sudo -n true",
+	FeatureGzip:    "command -v gzip",
+}
+
+// FeatureSet is the set of features that the remote machine has. It is not
+// to be confused with the CapabilitySet of the Linux capabilities of a
+// container.
+type FeatureSet map[Feature]bool
+
+// Has returns true if the set holds f.
+func (s FeatureSet) Has(f Feature) bool {
+	return s[f]
+}
+
+// probeScript returns the script that prints a "<feature>=<true|false>" line
+// for each of the features.
+func probeScript(features []Feature) string {
+	lines := []string{}
+	for _, f := range features {
+		lines = append(lines, "if "+featureProbes[f]+" >/dev/null 2>&1; "+
+			"then echo "+string(f)+"=true; else echo "+string(f)+"=false; fi")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseProbes parses the output of a probeScript.
+func parseProbes(out string) FeatureSet {
+	set := FeatureSet{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, ok := featureProbes[Feature(parts[0])]; ok {
+			set[Feature(parts[0])] = parts[1] == "true"
+		}
+	}
+	return set
+}
+
+// probe returns which of the features the remote machine has, in a single
+// command. Windows machines have none of them.
+func (b binding) probe(ctx context.Context, features []Feature) (FeatureSet, error) {
+	if b.os == device.Windows {
+		set := FeatureSet{}
+		for _, f := range features {
+			set[f] = false
+		}
+		return set, nil
+	}
+	out, err := callStdout(ctx, b.posixShell(probeScript(features)))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not probe the capabilities")
+	}
+	set := parseProbes(out)
+	for _, f := range features {
+		if _, ok := set[f]; !ok {
+			return nil, log.Errf(ctx, nil, "No result for the %s probe", f)
+		}
+	}
+	return set, nil
+}
+
+// SupportsFeature returns true if the remote machine has the feature f. The
+// result is probed once, and then remembered by the binding.
+func (b binding) SupportsFeature(ctx context.Context, f Feature) (bool, error) {
+	if f == FeatureSFTP {
+		return b.sftpClient != nil, nil
+	}
+	if _, ok := featureProbes[f]; !ok {
+		return false, log.Errf(ctx, nil, "Unknown feature %q", f)
+	}
+	v, err := b.info.get("feature "+string(f), func() (string, error) {
+		set, err := b.probe(ctx, []Feature{f})
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(set[f]), nil
+	})
+	return v == "true", err
+}
+
+// ProbeCapabilities probes all the known features of the remote machine in
+// a single command, and remembers them for SupportsFeature.
+func (b binding) ProbeCapabilities(ctx context.Context) (FeatureSet, error) {
+	features := []Feature{}
+	for f := range featureProbes {
+		features = append(features, f)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	set, err := b.probe(ctx, features)
+	if err != nil {
+		return nil, err
+	}
+	for f, has := range set {
+		b.info.set("feature "+string(f), strconv.FormatBool(has))
+	}
+	set[FeatureSFTP] = b.sftpClient != nil
+	return set, nil
+}
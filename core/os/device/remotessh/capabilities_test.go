@@ -0,0 +1,95 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseProbes(t *testing.T) {
+	ctx := log.Testing(t)
+
+	set := parseProbes("gzip=true\nsudo=false\nunknown=true\nnoise\n")
+	assert.For(ctx, "set").That(set).DeepEquals(FeatureSet{FeatureGzip: true, FeatureSudo: false})
+	assert.For(ctx, "Has gzip").That(set.Has(FeatureGzip)).Equals(true)
+	assert.For(ctx, "Has sudo").That(set.Has(FeatureSudo)).Equals(false)
+	assert.For(ctx, "Has inotify").That(set.Has(FeatureInotify)).Equals(false)
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The test server runs commands locally, so the PATH only holds sh, a
+	// fake inotifywait, and a sudo that asks for a password.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	sh, err := exec.LookPath("sh")
+	assert.For(ctx, "LookPath").ThatError(err).Succeeded()
+	assert.For(ctx, "Symlink").ThatError(os.Symlink(sh, filepath.Join(bin, "sh"))).Succeeded()
+	inotifywait := filepath.Join(bin, "inotifywait")
+	assert.For(ctx, "inotifywait").ThatError(ioutil.WriteFile(inotifywait, []byte("#!/bin/sh\n"), 0700)).Succeeded()
+	sudo := []byte("#!/bin/sh\necho 'sudo: a password is required' >&2\nexit 1\n")
+	assert.For(ctx, "sudo").ThatError(ioutil.WriteFile(filepath.Join(bin, "sudo"), sudo, 0700)).Succeeded()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv().Set("PATH", bin), os: device.Linux, info: &infoCache{}}
+
+	set, err := b.ProbeCapabilities(ctx)
+	assert.For(ctx, "ProbeCapabilities").ThatError(err).Succeeded()
+	assert.For(ctx, "set").That(set).DeepEquals(FeatureSet{
+		FeatureSFTP:    false,
+		FeatureInotify: true,
+		FeatureSudo:    false,
+		FeatureGzip:    false,
+	})
+	server.mutex.Lock()
+	assert.For(ctx, "sessions").ThatInteger(server.totalSessions).Equals(1)
+	server.mutex.Unlock()
+
+	// The probed features are remembered.
+	assert.For(ctx, "Remove").ThatError(os.Remove(inotifywait)).Succeeded()
+	has, err := b.SupportsFeature(ctx, FeatureInotify)
+	assert.For(ctx, "SupportsFeature").ThatError(err).Succeeded()
+	assert.For(ctx, "cached inotify").That(has).Equals(true)
+
+	// Features can also be probed alone.
+	b.info = &infoCache{}
+	has, err = b.SupportsFeature(ctx, FeatureInotify)
+	assert.For(ctx, "SupportsFeature alone").ThatError(err).Succeeded()
+	assert.For(ctx, "inotify").That(has).Equals(false)
+
+	_, err = b.SupportsFeature(ctx, Feature("teleport"))
+	assert.For(ctx, "unknown").ThatError(err).Failed()
+}
@@ -16,6 +16,7 @@ package remotessh
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -23,116 +24,488 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/gapid/core/app/crash"
 	"github.com/google/gapid/core/event/task"
+	"github.com/google/gapid/core/fault"
 	"github.com/google/gapid/core/log"
 	"github.com/google/gapid/core/os/device"
 	"github.com/google/gapid/core/os/shell"
 	"github.com/google/gapid/core/text"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
+const (
+	// ErrNotFound is returned when a file does not exist on the remote
+	// machine.
+	ErrNotFound = fault.Const("File not found")
+	// ErrAlreadyExists is returned when creating a directory on the remote
+	// machine where something already exists.
+	ErrAlreadyExists = fault.Const("File already exists")
+	// ErrConnectionLost is returned by the Wait of a remote process whose
+	// connection was lost, or replaced by Reconnect, before it exited.
+	ErrConnectionLost = fault.Const("Connection lost")
+	// ErrSudoNotSupported is returned when starting a command with sudo on a
+	// Windows machine.
+	ErrSudoNotSupported = fault.Const("sudo is not supported on Windows")
+	// ErrNotInteractive is returned when writing to the standard input of a
+	// remote process that was not started with Cmd.Interactive.
+	ErrNotInteractive = fault.Const("Process was not started interactively")
+
+	// defaultOutputBuffer is how much of the most recent output of a
+	// remote process is kept for RecentOutput, unless the command sets it.
+	defaultOutputBuffer = 64 * 1024
+
+	// killGracePeriod is how long Kill waits for the process to exit after
+	// asking it to terminate, before killing it.
+	killGracePeriod = 3 * time.Second
+
+	// connectionLostDelay is how long a process whose session ended without
+	// an exit status waits to learn whether the connection was lost.
+	connectionLostDelay = 500 * time.Millisecond
+)
+
+// RemoteProcess is a process running on a remote machine. The processes
+// started by the Shell of a Device can be cast to RemoteProcess.
+type RemoteProcess interface {
+	shell.Process
+	// Pid returns the process ID of the process on the remote machine, or 0
+	// if it is not known, as is the case on Windows.
+	Pid() int
+	// SendSignal sends sig to the process.
+	SendSignal(sig ssh.Signal) error
+	// IsAlive returns false once the process has exited, or its connection
+	// has been lost.
+	IsAlive() bool
+	// WriteStdin writes data to the standard input of an interactive
+	// process.
+	WriteStdin(data []byte) (int, error)
+	// CloseStdin closes the standard input of an interactive process.
+	CloseStdin() error
+	// RecentOutput returns the last n bytes of the standard output and
+	// standard error of the process.
+	RecentOutput(n int) string
+}
+
 // remoteProcess is the interface to a running process, as started by a Target.
 type remoteProcess struct {
 	session *ssh.Session
+	pid     int
 	wg      sync.WaitGroup
+	// done is closed once the remote process has exited, after which err
+	// holds its exit status.
+	done chan struct{}
+	err  error
+	// lost is closed when the connection the process runs on is lost or
+	// closed. It is nil if the binding does not track its connection.
+	lost <-chan struct{}
+	// op is the command, and stderr the end of its standard error, for the
+	// RemoteError returned if it fails.
+	op     string
+	stderr *ringBuffer
+	// output keeps the end of the standard output and standard error, as
+	// they were received.
+	output *ringBuffer
+	// stdin is the standard input of an interactive process, or nil.
+	stdin io.WriteCloser
 }
 
+// Kill asks the process to terminate with SIGTERM, and sends SIGKILL if it
+// has not exited after a short grace period.
 func (r *remoteProcess) Kill() error {
-	return r.session.Signal(ssh.SIGSEGV)
+	return r.KillGraceful(context.Background(), killGracePeriod)
 }
 
+// KillGraceful asks the process to terminate with SIGTERM, and sends SIGKILL
+// if it has not exited within timeout, or when ctx is cancelled.
+func (r *remoteProcess) KillGraceful(ctx context.Context, timeout time.Duration) error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	if err := r.SendSignal(ssh.SIGTERM); err != nil {
+		return err
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+	return r.SendSignal(ssh.SIGKILL)
+}
+
+// SendSignal sends sig to the process. The ssh.Signal constants are the
+// POSIX signal names without the SIG prefix, which the server maps to its
+// own signal numbers. On Linux these are:
+//
+//	SIGHUP  1    SIGINT  2    SIGQUIT 3    SIGILL  4    SIGABRT 6
+//	SIGFPE  8    SIGKILL 9    SIGUSR1 10   SIGSEGV 11   SIGUSR2 12
+//	SIGPIPE 13   SIGALRM 14   SIGTERM 15
+//
+// Servers may ignore signals: OpenSSH only delivers them since version 7.9.
+func (r *remoteProcess) SendSignal(sig ssh.Signal) error {
+	return r.session.Signal(sig)
+}
+
+// Pid returns the process ID of the process on the remote machine, or 0 if
+// it is not known.
+func (r *remoteProcess) Pid() int {
+	return r.pid
+}
+
+// IsAlive returns false once the process has exited, or the connection it
+// runs on has been lost.
+func (r *remoteProcess) IsAlive() bool {
+	select {
+	case <-r.done:
+		return false
+	case <-r.lost:
+		return false
+	default:
+		return true
+	}
+}
+
+// WriteStdin writes data to the standard input of the process, which must
+// have been started with Cmd.Interactive, returning ErrNotInteractive
+// otherwise.
+func (r *remoteProcess) WriteStdin(data []byte) (int, error) {
+	if r.stdin == nil {
+		return 0, ErrNotInteractive
+	}
+	return r.stdin.Write(data)
+}
+
+// CloseStdin closes the standard input of a process started with
+// Cmd.Interactive, so that it reads the end of its input.
+func (r *remoteProcess) CloseStdin() error {
+	if r.stdin == nil {
+		return ErrNotInteractive
+	}
+	return r.stdin.Close()
+}
+
+// RecentOutput returns the last n bytes of the standard output and standard
+// error of the process, interleaved as they were received, or all those that
+// were kept if there are fewer. The amount kept is set by
+// Cmd.WithOutputBuffer, and is 64KiB otherwise.
+func (r *remoteProcess) RecentOutput(n int) string {
+	return r.output.Last(n)
+}
+
+// Wait waits for the process to exit. If ctx is cancelled first, for
+// example because the command timed out, the process is killed and the
+// reason ctx was cancelled is returned in a RemoteError instead of its exit
+// status. If the server ignores the signals, the session is closed.
 func (r *remoteProcess) Wait(ctx context.Context) error {
-	ret := r.session.Wait()
+	select {
+	case <-r.done:
+	case <-task.ShouldStop(ctx):
+		log.W(ctx, "Killing remote process (context cancelled)")
+		r.Kill()
+		select {
+		case <-r.done:
+		default:
+			r.session.Close()
+		}
+		return newRemoteError(r.op, r.stderr.String(), task.StopReason(ctx))
+	}
 	r.wg.Wait()
-	return ret
+	if r.err == nil || r.err == ErrConnectionLost {
+		return r.err
+	}
+	return newRemoteError(r.op, r.stderr.String(), r.err)
 }
 
-var _ shell.Process = (*remoteProcess)(nil)
+var _ RemoteProcess = (*remoteProcess)(nil)
 
 type sshShellTarget struct{ b *binding }
 
+var _ shell.ContextTarget = sshShellTarget{}
+
 // Start starts the given command in the remote shell.
 func (t sshShellTarget) Start(cmd shell.Cmd) (shell.Process, error) {
-	session, err := t.b.connection.NewSession()
+	return t.StartContext(context.Background(), cmd)
+}
+
+// StartContext starts the given command in the remote shell, giving up if
+// ctx is cancelled while it waits for a session.
+func (t sshShellTarget) StartContext(ctx context.Context, cmd shell.Cmd) (shell.Process, error) {
+	if cmd.Sudo && t.b.os == device.Windows {
+		return nil, ErrSudoNotSupported
+	}
+	session, err := t.b.newSession(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if t.b.forwardAgent {
+		// Like OpenSSH, run the command even if the server refuses to
+		// forward the agent.
+		agent.RequestAgentForwarding(session)
+	}
 	p := &remoteProcess{
 		session: session,
 		wg:      sync.WaitGroup{},
+		done:    make(chan struct{}),
+		op:      strings.TrimSpace(cmd.Name + " " + strings.Join(cmd.Args, " ")),
+		stderr:  newRingBuffer(maxRemoteErrorStderr),
+		output:  newRingBuffer(defaultOutputBuffer),
+	}
+	if cmd.Sudo {
+		p.op = "sudo " + p.op
+	}
+	if cmd.OutputBuffer > 0 {
+		p.output = newRingBuffer(cmd.OutputBuffer)
+	}
+	if t.b.alive != nil {
+		p.lost = t.b.alive.Done()
 	}
 
-	if cmd.Stdin != nil {
+	input := cmd.Stdin
+	password := ""
+	if cmd.Sudo && cmd.SudoPassword != "" {
+		// sudo reads the password from the first line of the input.
+		password = cmd.SudoPassword + "\n"
+	}
+	if input == nil && cmd.Interactive {
+		// The input is written by WriteStdin, once the password has been.
+		if p.stdin, err = session.StdinPipe(); err != nil {
+			t.b.releaseSession(session)
+			return nil, err
+		}
+	} else if password != "" {
+		if input != nil {
+			input = io.MultiReader(strings.NewReader(password), input)
+		} else {
+			input = strings.NewReader(password)
+		}
+	}
+	if input != nil {
 		stdin, err := session.StdinPipe()
 		if err != nil {
+			t.b.releaseSession(session)
 			return nil, err
 		}
 		crash.Go(func() {
 			defer stdin.Close()
-			io.Copy(stdin, cmd.Stdin)
+			io.Copy(stdin, input)
 		})
 	}
 
-	if cmd.Stdout != nil {
-		stdout, err := session.StdoutPipe()
-		if err != nil {
-			return nil, err
-		}
-		p.wg.Add(1)
-		crash.Go(func() {
-			io.Copy(cmd.Stdout, stdout)
-			p.wg.Done()
-		})
+	// On POSIX machines the command reports its PID on the first line of
+	// its standard output, which is read before the rest is passed on.
+	reportPid := t.b.os == device.Linux || t.b.os == device.OSX
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.b.releaseSession(session)
+		return nil, err
 	}
 
+	// The end of the standard error is kept for the RemoteError, and of
+	// both outputs for RecentOutput.
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		t.b.releaseSession(session)
+		return nil, err
+	}
+	var stderrDst io.Writer = io.MultiWriter(p.output, p.stderr)
 	if cmd.Stderr != nil {
-		stderr, err := session.StderrPipe()
-		if err != nil {
-			return nil, err
-		}
-		p.wg.Add(1)
-		crash.Go(func() {
-			io.Copy(cmd.Stderr, stderr)
-			p.wg.Done()
-		})
+		stderrDst = io.MultiWriter(p.output, p.stderr, cmd.Stderr)
+	}
+	p.wg.Add(1)
+	crash.Go(func() {
+		io.Copy(stderrDst, stderr)
+		p.wg.Done()
+	})
+
+	val := t.b.commandLine(cmd)
+	if reportPid {
+		// exec keeps the PID of the shell that reported it, whatever the
+		// command is.
+		val = "echo $$; exec sh -c " + posixQuote(val)
+	}
+	if err := session.Start(val); err != nil {
+		t.b.releaseSession(session)
+		return nil, err
+	}
+	if p.stdin != nil && password != "" {
+		// If this fails the command does too, which Wait reports.
+		io.WriteString(p.stdin, password)
+	}
+	if reportPid {
+		// If the PID cannot be read the command failed to start, which
+		// Wait reports.
+		p.pid, _ = readPid(stdout)
 	}
+	var stdoutDst io.Writer = p.output
+	if cmd.Stdout != nil {
+		stdoutDst = io.MultiWriter(p.output, cmd.Stdout)
+	}
+	p.wg.Add(1)
+	crash.Go(func() {
+		io.Copy(stdoutDst, stdout)
+		p.wg.Done()
+	})
+	crash.Go(func() {
+		p.err = p.waitSession()
+		t.b.releaseSession(p.session)
+		close(p.done)
+	})
 
+	return p, nil
+}
+
+// shellBuiltins are the commands that POSIX shells run themselves, rather
+// than as a process of their own. Some also exist as programs, which may
+// behave differently, such as pwd that resolves symbolic links.
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "[": true, "alias": true, "break": true, "cd": true,
+	"command": true, "continue": true, "echo": true, "eval": true, "exec": true,
+	"exit": true, "export": true, "false": true, "getopts": true, "hash": true,
+	"kill": true, "printf": true, "pwd": true, "read": true, "readonly": true,
+	"return": true, "set": true, "shift": true, "source": true, "test": true,
+	"times": true, "trap": true, "true": true, "type": true, "ulimit": true,
+	"umask": true, "unalias": true, "unset": true, "wait": true,
+}
+
+// commandLine returns the command line that runs cmd on the remote machine.
+// Except on Windows, the directory, environment values, name and arguments
+// are quoted, so that they reach the command as they are whatever characters
+// they hold. Use posixShell to run a shell script.
+// sudo is given the -n flag, so that it fails rather than waiting for a
+// password, unless the command has a password, which sudo then always reads
+// from the first line of the standard input. sudo usually resets the
+// environment of the command.
+func (b binding) commandLine(cmd shell.Cmd) string {
+	if b.os == device.Windows {
+		return b.windowsCommandLine(cmd)
+	}
 	prefix := ""
 	if cmd.Dir != "" {
-		prefix += "cd " + cmd.Dir + "; "
+		prefix += "cd " + posixQuote(cmd.Dir) + " && "
 	}
-
-	for _, e := range cmd.Environment.Keys() {
-		if e != "" {
-			val := text.Quote([]string{cmd.Environment.Get(e)})[0]
-			prefix = prefix + strings.TrimSpace(e) + "=" + val + " "
+	for _, env := range []*shell.Env{cmd.Environment, b.env} {
+		for _, e := range env.Keys() {
+			if e != "" {
+				prefix += strings.TrimSpace(e) + "=" + posixQuote(env.Get(e)) + " "
+			}
 		}
 	}
+	words := []string{}
+	if cmd.Sudo || !shellBuiltins[cmd.Name] {
+		// The shell is replaced by the command, so that the PID reported for
+		// the process is that of the command.
+		words = append(words, "exec")
+	}
+	switch {
+	case cmd.Sudo && cmd.SudoPassword != "":
+		words = append(words, "sudo", "-k", "-S", "-p", "''")
+	case cmd.Sudo:
+		words = append(words, "sudo", "-n")
+	}
+	words = append(words, posixQuote(cmd.Name))
+	for _, arg := range cmd.Args {
+		words = append(words, posixQuote(arg))
+	}
+	return prefix + strings.Join(words, " ")
+}
 
-	for _, e := range t.b.env.Keys() {
-		if e != "" {
-			val := text.Quote([]string{t.b.env.Get(e)})[0]
-			prefix = prefix + strings.TrimSpace(e) + "=" + val + " "
+// windowsCommandLine returns the command line that runs cmd on a Windows
+// machine. Only the environment values are quoted, as the rules depend on the
+// shell the server uses: scripts are given to powerShell encoded instead.
+func (b binding) windowsCommandLine(cmd shell.Cmd) string {
+	prefix := ""
+	if cmd.Dir != "" {
+		prefix += "cd " + cmd.Dir + "; "
+	}
+	for _, env := range []*shell.Env{cmd.Environment, b.env} {
+		for _, e := range env.Keys() {
+			if e != "" {
+				val := text.Quote([]string{env.Get(e)})[0]
+				prefix = prefix + strings.TrimSpace(e) + "=" + val + " "
+			}
 		}
 	}
+	return prefix + cmd.Name + " " + strings.Join(cmd.Args, " ")
+}
 
-	val := prefix + cmd.Name + " " + strings.Join(cmd.Args, " ")
-	if err := session.Start(val); err != nil {
-		return nil, err
+// waitSession waits for the session of the process to end, returning
+// ErrConnectionLost if it ended without an exit status because the
+// connection was lost.
+func (r *remoteProcess) waitSession() error {
+	err := r.session.Wait()
+	if _, exited := err.(*ssh.ExitError); err == nil || exited || r.lost == nil {
+		return err
+	}
+	// The sessions end just before the loss of the connection is noticed.
+	select {
+	case <-r.lost:
+		return ErrConnectionLost
+	case <-time.After(connectionLostDelay):
+		return err
 	}
-
-	return p, nil
 }
 
+// String returns the user and host the commands run on. The commands and
+// their sudo passwords are not part of it, so it can be logged.
 func (t sshShellTarget) String() string {
 	c := t.b.configuration
 	return c.User + "@" + c.Host + ": " + t.b.String()
 }
 
+// readPid reads the line holding the PID reported by a command, without
+// reading any of the output that follows it.
+func readPid(r io.Reader) (int, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strconv.Atoi(strings.TrimSpace(string(line)))
+}
+
+// callStdout runs cmd, returning only what it wrote to standard output.
+// If the command fails, its standard error is included in the returned error.
+func callStdout(ctx context.Context, cmd shell.Cmd) (string, error) {
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	if err := cmd.Capture(&stdout, &stderr).Run(ctx); err != nil {
+		return "", log.Errf(ctx, err, "%s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// posixQuote quotes s so that it is passed as a single word to a POSIX shell.
+func posixQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// posixShell returns a command that runs script with sh on the remote
+// machine. This is used where pipes, redirection or control flow are needed.
+func (b binding) posixShell(script string) shell.Cmd {
+	return b.Shell("sh", "-c", script)
+}
+
+// hasCommand returns true if the given command can be found on the remote
+// machine.
+func (b binding) hasCommand(ctx context.Context, name string) bool {
+	_, err := b.Shell("command", "-v", name).Call(ctx)
+	return err == nil
+}
+
 // Shell implements the Device interface returning commands that will error if run.
 func (b binding) Shell(name string, args ...string) shell.Cmd {
 	return shell.Command(name, args...).On(sshShellTarget{&b})
@@ -150,10 +523,6 @@ func (b binding) createPosixTempDirectory(ctx context.Context) (string, func(con
 	return dir, func(ctx context.Context) { b.destroyPosixDirectory(ctx, dir) }, nil
 }
 
-func (b binding) createWindowsTempDirectory(ctx context.Context) (string, func(ctx context.Context), error) {
-	return "", nil, fmt.Errorf("Windows remote targets are not yet supported.")
-}
-
 // MakeTempDir creates a temporary directory on the remote machine. It returns the
 // full path, and a function that can be called to clean up the directory.
 func (b binding) MakeTempDir(ctx context.Context) (string, func(ctx context.Context), error) {
@@ -169,19 +538,140 @@ func (b binding) MakeTempDir(ctx context.Context) (string, func(ctx context.Cont
 
 // WriteFile moves the contents of io.Reader into the given file on the remote machine.
 // The file is given the mode as described by the unix filemode string.
-func (b binding) WriteFile(ctx context.Context, contents io.Reader, mode os.FileMode, destPath string) error {
-	perm := fmt.Sprintf("%4o", mode.Perm())
-	_, err := b.Shell("cat", ">", destPath, "; chmod ", perm, " ", destPath).Read(contents).Call(ctx)
-	return err
+// Missing parent directories are created. SFTP is used if the server supports
+// it, otherwise the contents are piped through cat. If contents is a file, the
+// total given to the WithProgress callback is its size.
+// The contents are written to a temporary file next to destPath, which is
+// then renamed to destPath, so that destPath is never left partially written.
+// An existing destPath is replaced rather than overwritten.
+func (b binding) WriteFile(ctx context.Context, contents io.Reader, mode os.FileMode, destPath string, opts ...TransferOption) error {
+	if dir := path.Dir(destPath); dir != "." {
+		if err := b.MkDirAll(ctx, dir); err != nil {
+			return err
+		}
+	}
+	contents = b.limiter.reader(ctx, getTransferOptions(opts).reader(contents, readerSize(contents)))
+	if b.sftpClient != nil {
+		return b.sftpWriteFile(ctx, contents, mode, destPath)
+	}
+
+	// cat cannot tell the end of the contents from an interrupted transfer,
+	// so if reading the contents fails, the script is killed before its input
+	// is closed, and so before it can rename the file.
+	started := &writeStarted{started: make(chan struct{})}
+	done := make(chan struct{})
+	input := &abortingReader{r: contents, abort: func() {
+		select {
+		case <-started.started:
+			b.Shell("kill", "-9", started.pid).Call(ctx)
+		case <-done:
+		}
+	}}
+	stderr := bytes.Buffer{}
+	dest := posixQuote(destPath)
+	err := b.posixShell(`t=$(mktemp `+posixQuote(destPath+".tmp.XXXXXX")+`) && printf '%s %s\n' "$$" "$t" && `+
+		`cat > "$t" && chmod `+octalPerm(mode)+` "$t" && mv -f "$t" `+dest+` || { rm -f "$t"; exit 1; }`).
+		Read(input).Capture(started, &stderr).Run(ctx)
+	close(done)
+	if err != nil {
+		err = log.Errf(ctx, err, "%s", strings.TrimSpace(stderr.String()))
+	} else {
+		err = input.Err()
+	}
+	if err != nil {
+		if input.Err() != nil && started.tmp != "" {
+			// The killed script could not remove its temporary file.
+			b.Shell("rm", "-f", started.tmp).Call(ctx)
+		}
+		return log.Errf(ctx, err, "Could not write %s", destPath)
+	}
+	return nil
+}
+
+// writeStarted records the first line written by the WriteFile script, which
+// holds its pid and temporary file, and closes started once it is complete.
+type writeStarted struct {
+	line    []byte
+	started chan struct{}
+	pid     string
+	tmp     string
+}
+
+func (w *writeStarted) Write(buf []byte) (int, error) {
+	if w.pid != "" {
+		return len(buf), nil
+	}
+	w.line = append(w.line, buf...)
+	if i := bytes.IndexByte(w.line, '\n'); i >= 0 {
+		fields := strings.SplitN(string(w.line[:i]), " ", 2)
+		if len(fields) == 2 {
+			w.pid, w.tmp = fields[0], fields[1]
+			close(w.started)
+		}
+	}
+	return len(buf), nil
+}
+
+// abortingReader is an io.Reader that calls abort before returning the first
+// error other than io.EOF returned by r, and remembers that error.
+type abortingReader struct {
+	r     io.Reader
+	abort func()
+	mutex sync.Mutex
+	err   error
+}
+
+func (r *abortingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if err != nil && err != io.EOF {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.err == nil {
+			r.err = err
+			r.abort()
+		}
+	}
+	return n, err
+}
+
+// Err returns the first error returned by the reader, other than io.EOF.
+func (r *abortingReader) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// readerSize returns the number of bytes left to read from r if it is a
+// file, or -1 if it is not known.
+func readerSize(r io.Reader) int64 {
+	f, ok := r.(*os.File)
+	if !ok {
+		return -1
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return -1
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	return info.Size() - offset
+}
+
+// octalPerm formats the permission bits of mode as an octal chmod argument.
+func octalPerm(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", mode.Perm())
 }
 
 // PushFile copies a file from a local path to the remote machine. Permissions are
 // maintained across.
-func (b binding) PushFile(ctx context.Context, source, dest string) error {
+func (b binding) PushFile(ctx context.Context, source, dest string, opts ...TransferOption) error {
 	infile, err := os.Open(source)
 	if err != nil {
 		return err
 	}
+	defer infile.Close()
 	permission, err := os.Stat(source)
 	if err != nil {
 		return err
@@ -195,74 +685,238 @@ func (b binding) PushFile(ctx context.Context, source, dest string) error {
 		mode |= 0550
 	}
 
-	return b.WriteFile(ctx, infile, mode, dest)
+	return b.WriteFile(ctx, infile, mode, dest, opts...)
+}
+
+// PullFile copies a file from the remote machine to a local path. Permissions
+// are maintained across.
+func (b binding) PullFile(ctx context.Context, source, dest string) error {
+	statFormat := []string{"-c", "%a"}
+	if b.os == device.OSX {
+		statFormat = []string{"-f", "%Lp"}
+	}
+	perm, err := callStdout(ctx, b.Shell("stat", append(statFormat, source)...))
+	if err != nil {
+		return log.Errf(ctx, err, "Could not stat %s", source)
+	}
+	m, err := strconv.ParseUint(strings.TrimSpace(perm), 8, 32)
+	if err != nil {
+		return log.Errf(ctx, err, "Unexpected permissions %q for %s", perm, source)
+	}
+	mode := os.FileMode(m).Perm()
+	// If we are on windows pulling from Linux, we lose the executable
+	// bit, keep it.
+	if (b.os == device.Linux ||
+		b.os == device.OSX) &&
+		runtime.GOOS == "windows" {
+		mode |= 0550
+	}
+
+	outfile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	stderr := bytes.Buffer{}
+	err = b.Shell("cat", source).Capture(outfile, &stderr).Run(ctx)
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return log.Errf(ctx, err, "Could not pull %s: %s", source, strings.TrimSpace(stderr.String()))
+	}
+	// The mode given to OpenFile is masked by the umask, and ignored if the
+	// file already existed.
+	return os.Chmod(dest, mode)
+}
+
+// parseFileSize parses the size printed by GetFileSize's script, which
+// prints nothing if the file does not exist.
+func parseFileSize(out string) (int64, error) {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return 0, ErrNotFound
+	}
+	return strconv.ParseInt(out, 10, 64)
+}
+
+// GetFileSize returns the size in bytes of the remote file at path, without
+// transferring its contents. ErrNotFound is returned if there is no such
+// file.
+func (b binding) GetFileSize(ctx context.Context, path string) (int64, error) {
+	var cmd shell.Cmd
+	switch b.os {
+	case device.Windows:
+		cmd = b.powerShell("$i = Get-Item -ErrorAction SilentlyContinue " + literalPath(path) +
+			"; if ($i -is [System.IO.FileInfo]) { $i.Length }")
+	case device.OSX:
+		cmd = b.posixShell("if [ -e " + posixQuote(path) + " ]; then stat -f %z " + posixQuote(path) + "; fi")
+	default:
+		cmd = b.posixShell("if [ -e " + posixQuote(path) + " ]; then stat -c %s " + posixQuote(path) + "; fi")
+	}
+	out, err := callStdout(ctx, cmd)
+	if err != nil {
+		return 0, log.Errf(ctx, err, "Could not get the size of %s", path)
+	}
+	size, err := parseFileSize(out)
+	if err == ErrNotFound {
+		return 0, err
+	}
+	if err != nil {
+		return 0, log.Errf(ctx, err, "Unexpected size %q for %s", out, path)
+	}
+	return size, nil
 }
 
 // doTunnel tunnels a single connection through the SSH connection.
-func (b binding) doTunnel(ctx context.Context, local net.Conn, remotePort int) error {
-	remote, err := b.connection.Dial("tcp", fmt.Sprintf("localhost:%d", remotePort))
+// remoteAddr is dialed from the remote machine.
+func (b binding) doTunnel(ctx context.Context, local net.Conn, remoteAddr string) error {
+	remote, err := b.connection.Dial("tcp", remoteAddr)
 	if err != nil {
 		local.Close()
 		return err
 	}
+	b.bridge(ctx, local, remote)
+	return nil
+}
+
+// defaultTunnelBufferSize is the size of the buffers used to copy the data
+// of tunnelled connections, unless the configuration gives one.
+const defaultTunnelBufferSize = 256 * 1024
+
+// tunnelBufferSize returns the size of the buffers used to copy the data of
+// tunnelled connections.
+func (b binding) tunnelBufferSize() int {
+	if b.configuration != nil && b.configuration.TunnelBufferSize > 0 {
+		return b.configuration.TunnelBufferSize
+	}
+	return defaultTunnelBufferSize
+}
 
+// tunnelCopy copies from reader to writer through a buffer of bufferSize
+// bytes. It returns io.ErrShortWrite if writer does not take all the data
+// it is given.
+func tunnelCopy(writer io.Writer, reader io.Reader, bufferSize int) error {
+	// Hide any ReaderFrom or WriterTo, which would use their own buffer.
+	_, err := io.CopyBuffer(struct{ io.Writer }{writer}, struct{ io.Reader }{reader}, make([]byte, bufferSize))
+	return err
+}
+
+// bridge copies data both ways between the local and remote connections,
+// closing them once both directions are done.
+func (b binding) bridge(ctx context.Context, local net.Conn, remote net.Conn) {
 	wg := sync.WaitGroup{}
+	bufferSize := b.tunnelBufferSize()
+	// closed is set once a connection has been closed by the bridge, after
+	// which the copy the other way fails as expected.
+	closed := int32(0)
 
 	copy := func(writer net.Conn, reader net.Conn) {
-		// Use the same buffer size used in io.Copy
-		buf := make([]byte, 32*1024)
-		var err error
-		for {
-			nr, er := reader.Read(buf)
-			if nr > 0 {
-				nw, ew := writer.Write(buf[0:nr])
-				if ew != nil {
-					err = ew
-					break
-				}
-				if nr != nw {
-					err = fmt.Errorf("short write")
-					break
-				}
-			}
-			if er != nil {
-				if er != io.EOF {
-					err = er
-				}
-				break
-			}
+		defer wg.Done()
+		err := tunnelCopy(writer, reader, bufferSize)
+		// Only close the writing side, so that the copy the other way can
+		// finish. TCP connections and SSH channels support this.
+		if w, ok := writer.(interface {
+			CloseWrite() error
+		}); ok {
+			w.CloseWrite()
+		} else {
+			atomic.StoreInt32(&closed, 1)
+			writer.Close()
 		}
-		writer.Close()
-		if err != nil {
+		if err != nil && atomic.LoadInt32(&closed) == 0 {
 			log.E(ctx, "Copy Error %s", err)
 		}
-		wg.Done()
 	}
 
 	wg.Add(2)
 	crash.Go(func() { copy(local, remote) })
 	crash.Go(func() { copy(remote, local) })
 
+	// The connections are closed once both copies are done.
 	crash.Go(func() {
-		defer local.Close()
-		defer remote.Close()
 		wg.Wait()
+		local.Close()
+		remote.Close()
 	})
-	return nil
 }
 
 // SetupLocalPort forwards a local TCP port to the remote machine on the remote port.
 // The local port that was opened is returned.
 func (b binding) SetupLocalPort(ctx context.Context, remotePort int) (int, error) {
-	listener, err := net.Listen("tcp", ":0")
+	return b.SetupLocalPortNetwork(ctx, "tcp", remotePort)
+}
+
+// SetupLocalPortNetwork is like SetupLocalPort, with the local port opened on
+// network, which is one of tcp, tcp4 or tcp6.
+func (b binding) SetupLocalPortNetwork(ctx context.Context, network string, remotePort int) (int, error) {
+	return b.setupLocalTunnel(ctx, network, "", localhostAddr(remotePort))
+}
+
+// SetupLocalPortAt forwards the local TCP address localAddr, given as
+// host:port, to the remote machine on the remote port. If the port is empty
+// or 0, a free port is chosen. The local port that was opened is returned.
+func (b binding) SetupLocalPortAt(ctx context.Context, remotePort int, localAddr string) (int, error) {
+	if _, _, err := net.SplitHostPort(localAddr); err != nil {
+		// Just a host.
+		localAddr = net.JoinHostPort(localAddr, "0")
+	}
+	return b.setupLocalTunnel(ctx, "tcp", localAddr, localhostAddr(remotePort))
+}
+
+// localhostAddr returns the address of port on localhost.
+func localhostAddr(port int) string {
+	return net.JoinHostPort("localhost", strconv.Itoa(port))
+}
+
+// listenLocal opens a local TCP port on address. If address is empty, it
+// listens on a free port on all the local addresses of network. On
+// dual-stack machines, tcp listens on both IPv4 and IPv6.
+func listenLocal(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp":
+		if address != "" {
+			return net.Listen(network, address)
+		}
+		if listener, err := net.Listen(network, "[::]:0"); err == nil {
+			return listener, nil
+		}
+		// IPv6 is not available.
+		return net.Listen(network, "0.0.0.0:0")
+	case "tcp4", "tcp6":
+		if address == "" {
+			address = ":0"
+		}
+		return net.Listen(network, address)
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+}
+
+// setupLocalTunnel forwards the local TCP address localAddr, opened on
+// network, to remoteAddr, which may be any address reachable from the remote
+// machine. See listenLocal for localAddr. The local port that was opened is
+// returned.
+func (b binding) setupLocalTunnel(ctx context.Context, network, localAddr, remoteAddr string) (int, error) {
+	listener, err := listenLocal(network, localAddr)
 
 	if err != nil {
 		return 0, err
 	}
+	t := &localTunnel{ctx: ctx, network: network, remoteAddr: remoteAddr, listener: listener}
+	b.tunnels.add(t)
 	crash.Go(func() {
 		<-task.ShouldStop(ctx)
-		listener.Close()
+		b.tunnels.remove(t)
 	})
+	b.serveTunnel(t, listener)
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// serveTunnel forwards the connections accepted by listener through the
+// binding's connection, until the listener is closed or the connection lost.
+func (b binding) serveTunnel(t *localTunnel, listener net.Listener) {
 	crash.Go(func() {
 		defer listener.Close()
 		for {
@@ -270,18 +924,117 @@ func (b binding) SetupLocalPort(ctx context.Context, remotePort int) (int, error
 			if err != nil {
 				return
 			}
-			if err = b.doTunnel(ctx, local, remotePort); err != nil {
+			if err = b.doTunnel(t.ctx, local, t.remoteAddr); err != nil {
 				return
 			}
 		}
 	})
+}
 
-	return listener.Addr().(*net.TCPAddr).Port, nil
+// localTunnel is a local port forwarded to the remote machine.
+type localTunnel struct {
+	ctx        context.Context
+	network    string
+	remoteAddr string
+	listener   net.Listener
+}
+
+// tunnelSet holds the open local tunnels of a binding, so that Reconnect
+// can forward them through the new connection. A nil tunnelSet only closes
+// the tunnels.
+type tunnelSet struct {
+	mutex   sync.Mutex
+	tunnels map[*localTunnel]struct{}
+}
+
+func (s *tunnelSet) add(t *localTunnel) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tunnels == nil {
+		s.tunnels = map[*localTunnel]struct{}{}
+	}
+	s.tunnels[t] = struct{}{}
+}
+
+// remove closes the tunnel, and forgets it.
+func (s *tunnelSet) remove(t *localTunnel) {
+	if s == nil {
+		t.listener.Close()
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.tunnels, t)
+	t.listener.Close()
+}
+
+// reopen closes the listener of each tunnel, and serves a new one on the
+// same local address with serve. The tunnels that cannot be reopened are
+// forgotten, and the first error is returned.
+func (s *tunnelSet) reopen(serve func(t *localTunnel, listener net.Listener)) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var firstErr error
+	for t := range s.tunnels {
+		t.listener.Close()
+		listener, err := listenLocal(t.network, t.listener.Addr().String())
+		if err != nil {
+			delete(s.tunnels, t)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		t.listener = listener
+		serve(t, listener)
+	}
+	return firstErr
+}
+
+// SetupReversePort forwards the remote port on the remote machine to the
+// local TCP port, so that the remote machine can connect to a service
+// listening locally, as with ssh -R. The remote port is closed when ctx is
+// cancelled.
+func (b binding) SetupReversePort(ctx context.Context, localPort int, remotePort int) error {
+	listener, err := b.connection.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", remotePort))
+	if err != nil {
+		return log.Errf(ctx, err, "Could not listen on remote port %d", remotePort)
+	}
+	crash.Go(func() {
+		<-task.ShouldStop(ctx)
+		listener.Close()
+	})
+	crash.Go(func() {
+		defer listener.Close()
+		for {
+			remote, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			local, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+			if err != nil {
+				log.E(ctx, "Could not connect to local port %d: %v", localPort, err)
+				remote.Close()
+				continue
+			}
+			b.bridge(ctx, local, remote)
+		}
+	})
+	return nil
 }
 
 // TempFile creates a temporary file on the given Device. It returns the
 // path to the file, and a function that can be called to clean it up.
 func (b binding) TempFile(ctx context.Context) (string, func(ctx context.Context), error) {
+	if b.os == device.Windows {
+		return b.createWindowsTempFile(ctx)
+	}
 	res, err := b.Shell("mktemp").Call(ctx)
 	if err != nil {
 		return "", nil, err
@@ -291,13 +1044,34 @@ func (b binding) TempFile(ctx context.Context) (string, func(ctx context.Context
 	}, nil
 }
 
-// FileContents returns the contents of a given file on the Device.
+// FileContents returns the contents of a given file on the Device, without
+// leading and trailing white space. Use ReadFile for large files.
 func (b binding) FileContents(ctx context.Context, path string) (string, error) {
-	return b.Shell("cat", path).Call(ctx)
+	out := strings.Builder{}
+	err := b.ReadFile(ctx, path, &out)
+	return strings.TrimSpace(out.String()), err
+}
+
+// ReadFile writes the contents of the file at src on the remote machine to
+// dst as they are received, so that large files are not held in memory.
+func (b binding) ReadFile(ctx context.Context, src string, dst io.Writer) error {
+	cmd := b.Shell("cat", src)
+	if b.os == device.Windows {
+		cmd = b.powerShell("$f = [System.IO.File]::OpenRead(" + powerShellQuote(windowsPath(src)) + "); " +
+			"$o = [Console]::OpenStandardOutput(); $f.CopyTo($o); $o.Flush(); $f.Close()")
+	}
+	stderr := bytes.Buffer{}
+	if err := cmd.Capture(dst, &stderr).Run(ctx); err != nil {
+		return log.Errf(ctx, err, "Could not read %s: %s", src, strings.TrimSpace(stderr.String()))
+	}
+	return nil
 }
 
 // RemoveFile removes the given file from the device
 func (b binding) RemoveFile(ctx context.Context, path string) error {
+	if b.os == device.Windows {
+		return b.removeWindowsFile(ctx, path)
+	}
 	_, err := b.Shell("rm", "-f", path).Call(ctx)
 	return err
 }
@@ -321,9 +1095,12 @@ func (b binding) ListExecutables(ctx context.Context, inPath string) ([]string,
 	if inPath == "" {
 		inPath = b.GetURIRoot()
 	}
+	if b.os == device.Windows {
+		return b.listWindowsExecutables(ctx, inPath)
+	}
 	// 'find' may partially succeed. Redirect the error messages to /dev/null,
 	// only process the successfully found executables.
-	files, _ := b.Shell("find", `"`+inPath+`"`, "-mindepth", "1", "-maxdepth", "1", "-type", "f", "-executable", "-printf", `%f\\n`, "2>/dev/null").Call(ctx)
+	files, _ := b.posixShell("find " + posixQuote(inPath) + ` -mindepth 1 -maxdepth 1 -type f -executable -printf '%f\n' 2>/dev/null`).Call(ctx)
 	scanner := bufio.NewScanner(strings.NewReader(files))
 	out := []string{}
 	for scanner.Scan() {
@@ -338,9 +1115,12 @@ func (b binding) ListDirectories(ctx context.Context, inPath string) ([]string,
 	if inPath == "" {
 		inPath = b.GetURIRoot()
 	}
+	if b.os == device.Windows {
+		return b.listWindowsDirectories(ctx, inPath)
+	}
 	// 'find' may partially succeed. Redirect the error messages to /dev/null,
 	// only process the successfully found directories.
-	dirs, _ := b.Shell("find", `"`+inPath+`"`, "-mindepth", "1", "-maxdepth", "1", "-type", "d", "-printf", `%f\\n`, "2>/dev/null").Call(ctx)
+	dirs, _ := b.posixShell("find " + posixQuote(inPath) + ` -mindepth 1 -maxdepth 1 -type d -printf '%f\n' 2>/dev/null`).Call(ctx)
 	scanner := bufio.NewScanner(strings.NewReader(dirs))
 	out := []string{}
 	for scanner.Scan() {
@@ -350,26 +1130,75 @@ func (b binding) ListDirectories(ctx context.Context, inPath string) ([]string,
 	return out, nil
 }
 
+// ListSocketFiles returns the paths of the UNIX domain sockets found under dir
+func (b binding) ListSocketFiles(ctx context.Context, dir string) ([]string, error) {
+	// 'find' may partially succeed. Redirect the error messages to /dev/null,
+	// only process the successfully found sockets.
+	sockets, _ := b.posixShell("find " + posixQuote(dir) + " -type s 2>/dev/null").Call(ctx)
+	scanner := bufio.NewScanner(strings.NewReader(sockets))
+	out := []string{}
+	for scanner.Scan() {
+		out = append(out, scanner.Text())
+	}
+	return out, nil
+}
+
+// IsSocketListening returns true if something is accepting connections on
+// the UNIX domain socket at socketPath. socat is preferred, as only some
+// versions of nc can connect to UNIX domain sockets: the GNU and traditional
+// ones, the defaults of Debian and Ubuntu, reject -U.
+func (b binding) IsSocketListening(ctx context.Context, socketPath string) (bool, error) {
+	switch {
+	case b.hasCommand(ctx, "socat"):
+		_, err := b.Shell("socat", "-u", "OPEN:/dev/null", "UNIX-CONNECT:"+socketPath).Call(ctx)
+		return err == nil, nil
+	case b.ncSupportsUnixSockets(ctx):
+		_, err := b.Shell("nc", "-U", "-z", socketPath).Call(ctx)
+		return err == nil, nil
+	default:
+		return false, fmt.Errorf("Neither socat nor a nc that supports -U is available on the remote machine")
+	}
+}
+
+// ncSupportsUnixSockets returns true if the remote machine has a nc that
+// connects to UNIX domain sockets with -U, as those of OpenBSD and nmap do.
+func (b binding) ncSupportsUnixSockets(ctx context.Context) bool {
+	if !b.hasCommand(ctx, "nc") {
+		return false
+	}
+	// Not all versions of nc exit successfully after printing their help.
+	help, _ := b.posixShell("nc -h 2>&1 || true").Call(ctx)
+	return strings.Contains(help, "-U")
+}
+
 // IsFile returns true if the given path is a file
 func (b binding) IsFile(ctx context.Context, inPath string) (bool, error) {
-	dir, err := b.IsDirectory(ctx, inPath)
-	if err == nil && dir {
+	if b.os == device.Windows {
+		return b.testWindowsPath(ctx, inPath, "Leaf")
+	}
+	info, err := b.GetFileMetadata(ctx, inPath)
+	if err == ErrNotFound {
 		return false, nil
 	}
-	_, err = b.Shell("stat", `"`+inPath+`"`).Call(ctx)
 	if err != nil {
-		return false, nil
+		return false, err
 	}
-	return true, nil
+	return !info.IsDir(), nil
 }
 
 // IsDirectory returns true if the given path is a directory
 func (b binding) IsDirectory(ctx context.Context, inPath string) (bool, error) {
-	_, err := b.Shell("cd", `"`+inPath+`"`).Call(ctx)
-	if err != nil {
+	if b.os == device.Windows {
+		return b.testWindowsPath(ctx, inPath, "Container")
+	}
+	info, err := b.GetFileMetadata(ctx, inPath)
+	if err == ErrNotFound {
 		return false, nil
 	}
-	return true, nil
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
 }
 
 // GetWorkingDirectory returns the directory that this device considers CWD
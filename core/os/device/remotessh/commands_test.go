@@ -0,0 +1,1004 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKillExitedProcess(t *testing.T) {
+	ctx := log.Testing(t)
+
+	// Killing a process that has already exited must not signal it.
+	p := &remoteProcess{done: make(chan struct{})}
+	close(p.done)
+	assert.For(ctx, "Kill").ThatError(p.Kill()).Succeeded()
+	assert.For(ctx, "Kill again").ThatError(p.Kill()).Succeeded()
+	assert.For(ctx, "Wait").ThatError(p.Wait(ctx)).Succeeded()
+}
+
+func TestParseFileSize(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		out  string
+		size int64
+		err  error
+	}{
+		{"4194304\n", 4194304, nil},
+		{"0\r\n", 0, nil},
+		{"", 0, ErrNotFound},
+		{"\n", 0, ErrNotFound},
+	} {
+		size, err := parseFileSize(test.out)
+		assert.For(ctx, "%q err", test.out).ThatError(err).Equals(test.err)
+		assert.For(ctx, "%q size", test.out).That(size).Equals(test.size)
+	}
+	_, err := parseFileSize("stat: cannot stat")
+	assert.For(ctx, "garbage").ThatError(err).Failed()
+}
+
+// newEchoService starts a TCP service on address that echoes what it is
+// sent.
+func newEchoService(t *testing.T, network, address string) net.Listener {
+	service, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return service
+}
+
+// testEcho sends message over conn, and checks that it is echoed back.
+func testEcho(ctx context.Context, name string, conn net.Conn, message string) {
+	conn.Write([]byte(message))
+	got := make([]byte, len(message))
+	_, err := io.ReadFull(conn, got)
+	assert.For(ctx, "%v ReadFull", name).ThatError(err).Succeeded()
+	assert.For(ctx, "%v echo", name).ThatString(string(got)).Equals(message)
+}
+
+func TestSetupLocalPort(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The tunnel logs the close of the connection as an error, which would
+	// fail the test.
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := binding{connection: client}
+
+	service := newEchoService(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+	remotePort := service.Addr().(*net.TCPAddr).Port
+	for _, network := range []string{"tcp", "tcp4"} {
+		port, err := b.SetupLocalPortNetwork(tunnelCtx, network, remotePort)
+		assert.For(ctx, "%v SetupLocalPortNetwork", network).ThatError(err).Succeeded()
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		assert.For(ctx, "%v Dial", network).ThatError(err).Succeeded()
+		if err == nil {
+			testEcho(ctx, network, conn, "hello "+network)
+			conn.Close()
+		}
+	}
+
+	port, err := b.SetupLocalPort(tunnelCtx, remotePort)
+	assert.For(ctx, "SetupLocalPort").ThatError(err).Succeeded()
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.For(ctx, "Dial").ThatError(err).Succeeded()
+	if err == nil {
+		testEcho(ctx, "SetupLocalPort", conn, "hello")
+		conn.Close()
+	}
+
+	_, err = b.SetupLocalPortNetwork(tunnelCtx, "udp", remotePort)
+	assert.For(ctx, "udp").ThatError(err).Failed()
+
+	// IPv6 is tested both locally and remotely, if the machine has it.
+	service6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Log("IPv6 is not available")
+		return
+	}
+	service6.Close()
+	service6 = newEchoService(t, "tcp6", "[::1]:0")
+	defer service6.Close()
+	port, err = b.setupLocalTunnel(tunnelCtx, "tcp6", "", service6.Addr().String())
+	assert.For(ctx, "tcp6 setupLocalTunnel").ThatError(err).Succeeded()
+	conn, err = net.Dial("tcp6", fmt.Sprintf("[::1]:%d", port))
+	assert.For(ctx, "tcp6 Dial").ThatError(err).Succeeded()
+	if err == nil {
+		testEcho(ctx, "tcp6", conn, "hello tcp6")
+		conn.Close()
+	}
+}
+
+// freePort returns a free local TCP port.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestSetupLocalPortAt(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The tunnel logs the close of the connection as an error, which would
+	// fail the test.
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := binding{connection: client}
+
+	service := newEchoService(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+	remotePort := service.Addr().(*net.TCPAddr).Port
+
+	fixed := freePort(t)
+	for _, test := range []struct {
+		localAddr string
+		port      int
+	}{
+		{"127.0.0.1:0", 0},
+		{"127.0.0.1:", 0},
+		{"127.0.0.1", 0},
+		{fmt.Sprintf("127.0.0.1:%d", fixed), fixed},
+	} {
+		port, err := b.SetupLocalPortAt(tunnelCtx, remotePort, test.localAddr)
+		assert.For(ctx, "%v SetupLocalPortAt", test.localAddr).ThatError(err).Succeeded()
+		if test.port != 0 {
+			assert.For(ctx, "%v port", test.localAddr).ThatInteger(port).Equals(test.port)
+		}
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		assert.For(ctx, "%v Dial", test.localAddr).ThatError(err).Succeeded()
+		if err == nil {
+			testEcho(ctx, test.localAddr, conn, "hello")
+			conn.Close()
+		}
+	}
+
+	// The fixed port is now in use.
+	_, err = b.SetupLocalPortAt(tunnelCtx, remotePort, fmt.Sprintf("127.0.0.1:%d", fixed))
+	assert.For(ctx, "port in use").ThatError(err).Failed()
+
+	// A port opened on 127.0.0.1 cannot be reached through another address
+	// of the machine, where there is one.
+	other, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Log("127.0.0.2 is not available")
+		return
+	}
+	other.Close()
+	port, err := b.SetupLocalPortAt(tunnelCtx, remotePort, "127.0.0.1:0")
+	assert.For(ctx, "SetupLocalPortAt").ThatError(err).Succeeded()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.2:%d", port))
+	if err == nil {
+		conn.Close()
+	}
+	assert.For(ctx, "other interface").ThatError(err).Failed()
+}
+
+// maxWriter records the size of the largest write to it.
+type maxWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *maxWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		w.max = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+// shortWriter takes at most one byte of each write.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) { return 1, nil }
+
+func TestTunnelCopy(t *testing.T) {
+	ctx := log.Testing(t)
+
+	data := make([]byte, 10*1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, size := range []int{1000, defaultTunnelBufferSize} {
+		// bytes.Reader is a WriterTo, which must not be used.
+		w := &maxWriter{}
+		err := tunnelCopy(w, bytes.NewReader(data), size)
+		assert.For(ctx, "%v tunnelCopy", size).ThatError(err).Succeeded()
+		assert.For(ctx, "%v data", size).That(bytes.Equal(w.Bytes(), data)).Equals(true)
+		assert.For(ctx, "%v max write", size).ThatInteger(w.max).Equals(size)
+	}
+
+	err := tunnelCopy(shortWriter{}, bytes.NewReader(data), 1000)
+	assert.For(ctx, "short write").ThatError(err).Equals(io.ErrShortWrite)
+}
+
+func TestTunnelBufferSize(t *testing.T) {
+	ctx := log.Testing(t)
+	assert.For(ctx, "no configuration").ThatInteger(binding{}.tunnelBufferSize()).Equals(defaultTunnelBufferSize)
+	b := binding{configuration: &Configuration{}}
+	assert.For(ctx, "default").ThatInteger(b.tunnelBufferSize()).Equals(defaultTunnelBufferSize)
+	b.configuration.TunnelBufferSize = 4096
+	assert.For(ctx, "configured").ThatInteger(b.tunnelBufferSize()).Equals(4096)
+}
+
+func TestBridgeLargeTransfer(t *testing.T) {
+	ctx := log.Testing(t)
+
+	data := make([]byte, 10*1024*1024)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	client, local := net.Pipe()
+	remote, service := net.Pipe()
+	b := binding{configuration: &Configuration{TunnelBufferSize: 64 * 1024}}
+	// The tunnel logs the close of the connection as an error, which would
+	// fail the test.
+	b.bridge(context.Background(), local, remote)
+
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	got, err := ioutil.ReadAll(service)
+	assert.For(ctx, "ReadAll").ThatError(err).Succeeded()
+	assert.For(ctx, "size").ThatInteger(len(got)).Equals(len(data))
+	assert.For(ctx, "data").That(bytes.Equal(got, data)).Equals(true)
+	service.Close()
+}
+
+// tcpPair returns both ends of a local TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestBridgeNoErrors(t *testing.T) {
+	// Any error logged by the bridge fails the test.
+	ctx := log.Testing(t)
+	b := binding{configuration: &Configuration{TunnelBufferSize: 4 * 1024}}
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	// Both ways through TCP connections, which are half closed.
+	const tunnels = 8
+	wg := sync.WaitGroup{}
+	for i := 0; i < tunnels; i++ {
+		client, local := tcpPair(t)
+		remote, service := tcpPair(t)
+		b.bridge(ctx, local, remote)
+		go func() {
+			io.Copy(service, service)
+			service.Close()
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			go func() {
+				client.Write(data)
+				client.(*net.TCPConn).CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(client)
+			assert.For(ctx, "ReadAll").ThatError(err).Succeeded()
+			assert.For(ctx, "echo").That(bytes.Equal(got, data)).Equals(true)
+		}()
+	}
+	wg.Wait()
+
+	// One way through pipes, which can only be closed completely.
+	client, local := net.Pipe()
+	remote, service := net.Pipe()
+	b.bridge(ctx, local, remote)
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	got, err := ioutil.ReadAll(service)
+	assert.For(ctx, "pipe ReadAll").ThatError(err).Succeeded()
+	assert.For(ctx, "pipe data").That(bytes.Equal(got, data)).Equals(true)
+	service.Close()
+	// Give the bridge time to report errors.
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestSetupReversePort(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	service := newEchoService(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+
+	remotePort := freePort(t)
+
+	// The tunnel logs the close of the connection as an error, which would
+	// fail the test.
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	b := binding{connection: client}
+	err = b.SetupReversePort(tunnelCtx, service.Addr().(*net.TCPAddr).Port, remotePort)
+	assert.For(ctx, "SetupReversePort").ThatError(err).Succeeded()
+
+	remoteAddr := fmt.Sprintf("127.0.0.1:%d", remotePort)
+	conn, err := net.Dial("tcp", remoteAddr)
+	assert.For(ctx, "Dial").ThatError(err).Succeeded()
+	if err == nil {
+		testEcho(ctx, "reverse", conn, "hello")
+		conn.Close()
+	}
+
+	// Cancelling the context closes the remote port.
+	cancel()
+	closed := false
+	for i := 0; i < 100 && !closed; i++ {
+		if conn, err := net.Dial("tcp", remoteAddr); err == nil {
+			conn.Close()
+			time.Sleep(10 * time.Millisecond)
+		} else {
+			closed = true
+		}
+	}
+	assert.For(ctx, "closed").That(closed).Equals(true)
+}
+
+func TestReadFile(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv()}
+
+	data := make([]byte, 12*1024*1024)
+	rand.Read(data)
+	large := filepath.Join(dir, "large trace.bin")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(large, data, 0644)).Succeeded()
+
+	hash := sha256.New()
+	assert.For(ctx, "ReadFile").ThatError(b.ReadFile(ctx, large, hash)).Succeeded()
+	expected := sha256.Sum256(data)
+	assert.For(ctx, "sha256").ThatSlice(hash.Sum(nil)).Equals(expected[:])
+
+	small := filepath.Join(dir, "port")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(small, []byte("1234\n"), 0644)).Succeeded()
+	contents, err := b.FileContents(ctx, small)
+	assert.For(ctx, "FileContents").ThatError(err).Succeeded()
+	assert.For(ctx, "contents").ThatString(contents).Equals("1234")
+
+	err = b.ReadFile(ctx, filepath.Join(dir, "missing"), &bytes.Buffer{})
+	assert.For(ctx, "missing").ThatError(err).Failed()
+}
+
+// rootCause follows the Cause chain of err to the original error.
+func rootCause(err error) error {
+	for {
+		cause := nextCause(err)
+		if cause == nil {
+			return err
+		}
+		err = cause
+	}
+}
+
+// failingReader returns data, and then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(buf []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(buf, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	sftpClient, cleanup := newPipeSFTPClient(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		name string
+		b    binding
+	}{
+		{"shell", binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}},
+		{"sftp", binding{sftpClient: sftpClient, os: device.Linux}},
+	} {
+		out := filepath.Join(dir, test.name)
+		assert.For(ctx, "Mkdir").ThatError(os.Mkdir(out, 0700)).Succeeded()
+		dest := filepath.Join(out, "agent bin")
+		assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(dest, []byte("old"), 0600)).Succeeded()
+
+		// An existing file is replaced.
+		err := test.b.WriteFile(ctx, strings.NewReader("new contents"), 0750, dest)
+		assert.For(ctx, "%v write", test.name).ThatError(err).Succeeded()
+		got, _ := ioutil.ReadFile(dest)
+		assert.For(ctx, "%v contents", test.name).ThatString(string(got)).Equals("new contents")
+		info, err := os.Stat(dest)
+		assert.For(ctx, "%v Stat", test.name).ThatError(err).Succeeded()
+		if err == nil {
+			assert.For(ctx, "%v mode", test.name).That(info.Mode()).Equals(os.FileMode(0750))
+		}
+
+		// An interrupted transfer leaves the file as it was.
+		err = test.b.WriteFile(ctx, &failingReader{[]byte("partial"), io.ErrUnexpectedEOF}, 0750, dest)
+		assert.For(ctx, "%v interrupted", test.name).ThatError(err).Failed()
+		got, _ = ioutil.ReadFile(dest)
+		assert.For(ctx, "%v unchanged", test.name).ThatString(string(got)).Equals("new contents")
+
+		// No temporary files are left behind.
+		files, _ := filepath.Glob(filepath.Join(out, "*"))
+		assert.For(ctx, "%v files", test.name).ThatSlice(files).Equals([]string{dest})
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	ctx := log.Testing(t)
+
+	cmd := shell.Command("ls", "-l", "a b", "it's").In("/tmp/x; y")
+	b := binding{env: shell.NewEnv(), os: device.Linux}
+	assert.For(ctx, "posix").ThatString(b.commandLine(cmd)).Equals(`cd '/tmp/x; y' && exec 'ls' '-l' 'a b' 'it'\''s'`)
+
+	// Shell builtins are not replaced by a program of the same name.
+	assert.For(ctx, "builtin").ThatString(b.commandLine(shell.Command("pwd").In("/tmp"))).Equals(`cd '/tmp' && 'pwd'`)
+
+	assert.For(ctx, "sudo").ThatString(b.commandLine(shell.Command("id").AsSudo())).Equals(`exec sudo -n 'id'`)
+	assert.For(ctx, "sudo password").ThatString(b.commandLine(shell.Command("id").AsSudoWithPassword("secret"))).
+		Equals(`exec sudo -k -S -p '' 'id'`)
+
+	// Windows commands are passed on as they are.
+	b.os = device.Windows
+	assert.For(ctx, "windows").ThatString(b.commandLine(cmd)).Equals("cd /tmp/x; y; ls -l a b it's")
+}
+
+func TestShellQuoting(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	pwned := filepath.Join(dir, "pwned")
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv().Set("INJECTED", "$(touch "+pwned+")"), os: device.Linux}
+
+	// Each argument reaches the command unchanged.
+	args := []string{"; touch " + pwned, "`touch " + pwned + "`", "$(touch " + pwned + ")", "&& rm -rf /", "a  b", "it's", "*"}
+	out, err := b.Shell("printf", append([]string{`%s\n`}, args...)...).Call(ctx)
+	assert.For(ctx, "args").ThatError(err).Succeeded()
+	assert.For(ctx, "args output").ThatSlice(strings.Split(out, "\n")).Equals(args)
+
+	// So do the directory and environment.
+	weird := filepath.Join(dir, "a; b $(c) `d` #")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(weird, 0700)).Succeeded()
+	out, err = b.Shell("pwd").In(weird).Call(ctx)
+	assert.For(ctx, "dir").ThatError(err).Succeeded()
+	assert.For(ctx, "dir output").ThatString(out).Equals(weird)
+	out, err = b.posixShell(`printf %s "$INJECTED"`).Call(ctx)
+	assert.For(ctx, "env").ThatError(err).Succeeded()
+	assert.For(ctx, "env output").ThatString(out).Equals("$(touch " + pwned + ")")
+
+	_, err = os.Stat(pwned)
+	assert.For(ctx, "injected").That(os.IsNotExist(err)).Equals(true)
+}
+
+const fakeSudo = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-S) read -r password; [ "$password" = secret ] || { echo "Sorry, try again." >&2; exit 1; }; shift ;;
+	-p) shift 2 ;;
+	-*) shift ;;
+	*) break ;;
+	esac
+done
+echo privileged
+exec "$@"
+`
+
+func TestShellSudo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The test server runs commands locally, so a fake sudo is put first on
+	// the PATH.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	err = ioutil.WriteFile(filepath.Join(bin, "sudo"), []byte(fakeSudo), 0700)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	env := shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+
+	out, err := b.Shell("echo", "hello").AsSudo().Call(ctx)
+	assert.For(ctx, "sudo").ThatError(err).Succeeded()
+	assert.For(ctx, "sudo output").ThatString(out).Equals("privileged\nhello")
+
+	// The password is read before the input of the command.
+	out, err = b.Shell("cat").AsSudoWithPassword("secret").Read(strings.NewReader("input")).Call(ctx)
+	assert.For(ctx, "password").ThatError(err).Succeeded()
+	assert.For(ctx, "password output").ThatString(out).Equals("privileged\ninput")
+
+	cmd := b.Shell("echo", "hello").AsSudoWithPassword("wrong")
+	_, err = cmd.Call(ctx)
+	assert.For(ctx, "wrong password").ThatError(err).Failed()
+	assert.For(ctx, "wrong password ExitCode").That(ExitCode(err)).Equals(1)
+	for _, s := range []string{fmt.Sprint(cmd), fmt.Sprint(cmd.Target), err.Error()} {
+		assert.For(ctx, "redacted").That(strings.Contains(s, "wrong")).Equals(false)
+	}
+
+	b.os = device.Windows
+	_, err = b.Shell("echo", "hello").AsSudo().Call(ctx)
+	assert.For(ctx, "windows").ThatError(rootCause(err)).Equals(ErrSudoNotSupported)
+}
+
+func TestShellTimeout(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv()}
+
+	out, err := b.Shell("echo", "quick").WithTimeout(5 * time.Second).Call(ctx)
+	assert.For(ctx, "quick").ThatError(err).Succeeded()
+	assert.For(ctx, "quick output").ThatString(out).Equals("quick")
+
+	start := time.Now()
+	_, err = b.Shell("sleep", "30").WithTimeout(100 * time.Millisecond).Call(ctx)
+	assert.For(ctx, "killed").That(time.Since(start) < killGracePeriod).Equals(true)
+	assert.For(ctx, "timeout").ThatError(rootCause(err)).Equals(context.DeadlineExceeded)
+	assert.For(ctx, "timeout RemoteError").That(asRemoteError(err) != nil).Equals(true)
+	assert.For(ctx, "timeout ExitCode").That(ExitCode(err)).Equals(-1)
+}
+
+func TestSendSignal(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv()}
+
+	script := `trap 'echo reloaded' HUP; trap 'echo stopping; exit 0' USR1; echo ready; while :; do sleep 0.1; done`
+	r, w := io.Pipe()
+	p, err := sshShellTarget{&b}.Start(shell.Command("exec", "sh", "-c", script).Capture(w, nil))
+	assert.For(ctx, "Start").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	process := p.(*remoteProcess)
+	lines := bufio.NewScanner(r)
+	next := func() string {
+		lines.Scan()
+		return lines.Text()
+	}
+
+	assert.For(ctx, "ready").ThatString(next()).Equals("ready")
+	assert.For(ctx, "SIGHUP").ThatError(process.SendSignal(ssh.SIGHUP)).Succeeded()
+	assert.For(ctx, "trapped SIGHUP").ThatString(next()).Equals("reloaded")
+	assert.For(ctx, "SIGUSR1").ThatError(process.SendSignal(ssh.SIGUSR1)).Succeeded()
+	assert.For(ctx, "trapped SIGUSR1").ThatString(next()).Equals("stopping")
+	assert.For(ctx, "Wait").ThatError(process.Wait(ctx)).Succeeded()
+}
+
+func TestReadPid(t *testing.T) {
+	ctx := log.Testing(t)
+
+	r := bytes.NewBufferString("1234\nrest of the output")
+	pid, err := readPid(r)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "pid").ThatInteger(pid).Equals(1234)
+	assert.For(ctx, "rest").ThatString(r.String()).Equals("rest of the output")
+
+	for _, out := range []string{"", "1234", "not a pid\n"} {
+		_, err := readPid(bytes.NewBufferString(out))
+		assert.For(ctx, "%q", out).ThatError(err).Failed()
+	}
+}
+
+func TestRemoteProcessStdin(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	// Each line written to cat is echoed before the next is written.
+	r, w := io.Pipe()
+	defer r.Close()
+	p, err := sshShellTarget{&b}.Start(shell.Command("cat").AsInteractive().Capture(w, nil))
+	assert.For(ctx, "Start").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	process := p.(RemoteProcess)
+	out := bufio.NewReader(r)
+	for _, line := range []string{"one\n", "two words\n"} {
+		n, err := process.WriteStdin([]byte(line))
+		assert.For(ctx, "WriteStdin").ThatError(err).Succeeded()
+		assert.For(ctx, "written").ThatInteger(n).Equals(len(line))
+		echoed, err := out.ReadString('\n')
+		assert.For(ctx, "ReadString").ThatError(err).Succeeded()
+		assert.For(ctx, "echoed").ThatString(echoed).Equals(line)
+	}
+	// cat exits at the end of its input.
+	assert.For(ctx, "CloseStdin").ThatError(process.CloseStdin()).Succeeded()
+	assert.For(ctx, "Wait").ThatError(p.Wait(ctx)).Succeeded()
+
+	p, err = sshShellTarget{&b}.Start(shell.Command("true"))
+	assert.For(ctx, "Start not interactive").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	_, err = p.(RemoteProcess).WriteStdin([]byte("lost\n"))
+	assert.For(ctx, "not interactive").ThatError(err).Equals(ErrNotInteractive)
+	assert.For(ctx, "Wait not interactive").ThatError(p.Wait(ctx)).Succeeded()
+}
+
+func TestRemoteProcessRecentOutput(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	// The output is kept even though it is not captured, and the PID line
+	// is not part of it.
+	script := "for i in 0 1 2 3 4 5 6 7 8 9; do printf 'line %s\\n' $i; done; exit 1"
+	p, err := sshShellTarget{&b}.Start(b.posixShell(script).WithOutputBuffer(14))
+	assert.For(ctx, "Start").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	assert.For(ctx, "Wait").ThatError(p.Wait(ctx)).Failed()
+	process := p.(RemoteProcess)
+	assert.For(ctx, "recent").ThatString(process.RecentOutput(-1)).Equals("line 8\nline 9\n")
+	assert.For(ctx, "last").ThatString(process.RecentOutput(7)).Equals("line 9\n")
+
+	// So is the standard error.
+	p, err = sshShellTarget{&b}.Start(b.posixShell("echo failed >&2"))
+	assert.For(ctx, "Start stderr").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	assert.For(ctx, "Wait stderr").ThatError(p.Wait(ctx)).Succeeded()
+	assert.For(ctx, "stderr").ThatString(p.(RemoteProcess).RecentOutput(-1)).Equals("failed\n")
+
+	// By default the whole of a short output is kept, alongside a capture.
+	out := &bytes.Buffer{}
+	p, err = sshShellTarget{&b}.Start(shell.Command("echo", "hello").Capture(out, nil))
+	assert.For(ctx, "Start default").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	assert.For(ctx, "Wait default").ThatError(p.Wait(ctx)).Succeeded()
+	assert.For(ctx, "captured").ThatString(out.String()).Equals("hello\n")
+	assert.For(ctx, "default").ThatString(p.(RemoteProcess).RecentOutput(100)).Equals("hello\n")
+}
+
+func TestRemoteProcessPid(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	// The command sees its own PID, and its output is not changed.
+	out := &bytes.Buffer{}
+	p, err := sshShellTarget{&b}.Start(shell.Command("exec", "sh", "-c", "x=1; echo $$").Capture(out, nil))
+	assert.For(ctx, "Start").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	pid := p.(RemoteProcess).Pid()
+	assert.For(ctx, "pid").That(pid > 0).Equals(true)
+	assert.For(ctx, "Wait").ThatError(p.Wait(ctx)).Succeeded()
+	assert.For(ctx, "output").ThatString(out.String()).Equals(fmt.Sprintf("%d\n", pid))
+
+	// The PID is that of the command, not of the shell that sets up its
+	// directory and environment.
+	b.env = shell.NewEnv().Set("GAPID_TEST", "1")
+	out.Reset()
+	p, err = sshShellTarget{&b}.Start(b.posixShell("x=1; echo $$").In(dir).Capture(out, nil))
+	assert.For(ctx, "Start in dir").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	pid = p.(RemoteProcess).Pid()
+	assert.For(ctx, "Wait in dir").ThatError(p.Wait(ctx)).Succeeded()
+	assert.For(ctx, "output in dir").ThatString(out.String()).Equals(fmt.Sprintf("%d\n", pid))
+
+	// The PID is read even when the output is not captured.
+	p, err = sshShellTarget{&b}.Start(shell.Command("true"))
+	assert.For(ctx, "Start without stdout").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	assert.For(ctx, "pid without stdout").That(p.(RemoteProcess).Pid() > 0).Equals(true)
+	assert.For(ctx, "Wait without stdout").ThatError(p.Wait(ctx)).Succeeded()
+}
+
+func TestIsSocketListening(t *testing.T) {
+	ctx := log.Testing(t)
+
+	// The fake nc and socat connect to the sockets with Python.
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not available")
+	}
+	connect := python + ` -c 'import socket, sys
+s = socket.socket(socket.AF_UNIX)
+try:
+    s.connect(sys.argv[1])
+except OSError:
+    sys.exit(1)'`
+	tools := map[string]string{
+		"openbsd-nc": "if [ \"$1\" = -h ]; then echo '\t-U\t\tUse UNIX domain socket'; exit 1; fi\n" +
+			"[ \"$1\" = -U ] && [ \"$2\" = -z ] || exit 2\n" +
+			"exec " + connect + " \"$3\"\n",
+		"gnu-nc": "if [ \"$1\" = -h ]; then echo '\t-u, --udp\t\tUDP mode'; exit 0; fi\n" +
+			"echo \"nc: invalid option -- 'U'\" >&2\nexit 1\n",
+		"socat": "exec " + connect + " \"${3#UNIX-CONNECT:}\"\n",
+	}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	listening := filepath.Join(dir, "listening.sock")
+	listener, err := net.Listen("unix", listening)
+	assert.For(ctx, "Listen").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+	// A socket that nothing listens on any more is left behind.
+	stale := filepath.Join(dir, "stale.sock")
+	closed, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	assert.For(ctx, "Listen stale").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	closed.SetUnlinkOnClose(false)
+	closed.Close()
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	for _, test := range []struct {
+		name  string
+		nc    string
+		socat bool
+		works bool
+	}{
+		{"OpenBSD nc", "openbsd-nc", false, true},
+		{"socat", "gnu-nc", true, true},
+		{"GNU nc", "gnu-nc", false, false},
+		{"none", "", false, false},
+	} {
+		// The fake tools are first on the PATH, and the real ones would be
+		// found when there is no fake.
+		if _, err := exec.LookPath("socat"); err == nil && !test.socat {
+			continue
+		}
+		if _, err := exec.LookPath("nc"); err == nil && test.nc == "" {
+			continue
+		}
+		bin := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1))
+		assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+		if test.nc != "" {
+			err := ioutil.WriteFile(filepath.Join(bin, "nc"), []byte("#!/bin/sh\n"+tools[test.nc]), 0700)
+			assert.For(ctx, "%v nc", test.name).ThatError(err).Succeeded()
+		}
+		if test.socat {
+			err := ioutil.WriteFile(filepath.Join(bin, "socat"), []byte("#!/bin/sh\n"+tools["socat"]), 0700)
+			assert.For(ctx, "%v socat", test.name).ThatError(err).Succeeded()
+		}
+		b := binding{connection: client, configuration: &c, env: shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH")), os: device.Linux}
+
+		ok, err := b.IsSocketListening(ctx, listening)
+		if !test.works {
+			assert.For(ctx, "%v err", test.name).ThatError(err).Failed()
+			continue
+		}
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v listening", test.name).That(ok).Equals(true)
+		ok, err = b.IsSocketListening(ctx, stale)
+		assert.For(ctx, "%v stale err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v stale", test.name).That(ok).Equals(false)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+)
+
+const (
+	// ErrOpenCLNotFound is returned by GetOpenCLPlatforms when clinfo is not
+	// installed on the remote machine.
+	ErrOpenCLNotFound = fault.Const("clinfo not found")
+	// ErrROCmNotFound is returned by GetROCmInfo when ROCm is not installed on
+	// the remote machine.
+	ErrROCmNotFound = fault.Const("ROCm not found")
+	// ErrCUDANotFound is returned by GetCUDAVersion when neither nvcc nor
+	// nvidia-smi is installed on the remote machine.
+	ErrCUDANotFound = fault.Const("CUDA not found")
+
+	rocmRoot = "/opt/rocm"
+)
+
+// OpenCLPlatform describes an OpenCL platform installed on the remote machine.
+type OpenCLPlatform struct {
+	Name    string
+	Vendor  string
+	Version string
+	Devices []*OpenCLDevice
+}
+
+// OpenCLDevice describes a device exposed by an OpenCL platform.
+type OpenCLDevice struct {
+	Name            string
+	MaxComputeUnits int
+}
+
+// clinfoOutput is the subset of the JSON document written by clinfo --json
+// that is used by the binding. The devices list has one entry per platform.
+type clinfoOutput struct {
+	Platforms []struct {
+		Name    string `json:"CL_PLATFORM_NAME"`
+		Vendor  string `json:"CL_PLATFORM_VENDOR"`
+		Version string `json:"CL_PLATFORM_VERSION"`
+	} `json:"platforms"`
+	Devices []struct {
+		Online []struct {
+			Name            string `json:"CL_DEVICE_NAME"`
+			MaxComputeUnits int    `json:"CL_DEVICE_MAX_COMPUTE_UNITS"`
+		} `json:"online"`
+	} `json:"devices"`
+}
+
+// parseOpenCLPlatforms parses the output of clinfo --json.
+func parseOpenCLPlatforms(out string) ([]*OpenCLPlatform, error) {
+	info := clinfoOutput{}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return nil, err
+	}
+	platforms := make([]*OpenCLPlatform, len(info.Platforms))
+	for i, p := range info.Platforms {
+		platforms[i] = &OpenCLPlatform{
+			Name:    p.Name,
+			Vendor:  p.Vendor,
+			Version: p.Version,
+			Devices: []*OpenCLDevice{},
+		}
+		if i < len(info.Devices) {
+			for _, d := range info.Devices[i].Online {
+				platforms[i].Devices = append(platforms[i].Devices, &OpenCLDevice{
+					Name:            d.Name,
+					MaxComputeUnits: d.MaxComputeUnits,
+				})
+			}
+		}
+	}
+	return platforms, nil
+}
+
+// GetOpenCLPlatforms returns the OpenCL platforms, and their devices, that
+// are installed on the remote machine.
+func (b binding) GetOpenCLPlatforms(ctx context.Context) ([]*OpenCLPlatform, error) {
+	if !b.hasCommand(ctx, "clinfo") {
+		return nil, ErrOpenCLNotFound
+	}
+	out, err := callStdout(ctx, b.Shell("clinfo", "--json"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not run clinfo")
+	}
+	platforms, err := parseOpenCLPlatforms(out)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not parse clinfo output")
+	}
+	return platforms, nil
+}
+
+// ROCmInfo describes the ROCm installation on the remote machine.
+type ROCmInfo struct {
+	// RuntimeVersion is the version of the HSA runtime.
+	RuntimeVersion string
+	// ROCmVersion is the version of the ROCm release.
+	ROCmVersion string
+	// Agents are the HSA agents (CPUs and GPUs) found by the runtime.
+	Agents []ROCmAgent
+}
+
+// ROCmAgent describes a single HSA agent.
+type ROCmAgent struct {
+	Name         string
+	ComputeUnits int
+	// MemoryMB is the size of the agent's global memory pool.
+	MemoryMB int
+}
+
+// parseROCmInfo parses the output of rocminfo.
+func parseROCmInfo(out string) *ROCmInfo {
+	info := &ROCmInfo{Agents: []ROCmAgent{}}
+	var agent *ROCmAgent
+	inGlobalPool := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Agent ") && !strings.Contains(line, ":") {
+			info.Agents = append(info.Agents, ROCmAgent{})
+			agent = &info.Agents[len(info.Agents)-1]
+			inGlobalPool = false
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case key == "Runtime Version" && agent == nil:
+			info.RuntimeVersion = value
+		case agent == nil:
+		case key == "Name" && agent.Name == "":
+			agent.Name = value
+		case key == "Compute Unit" && agent.ComputeUnits == 0:
+			agent.ComputeUnits, _ = strconv.Atoi(value)
+		case key == "Segment":
+			inGlobalPool = strings.HasPrefix(value, "GLOBAL")
+		case key == "Size" && inGlobalPool && agent.MemoryMB == 0:
+			// Size is formatted as "65768328(0x3eb8a88) KB".
+			if i := strings.IndexAny(value, "( "); i > 0 {
+				value = value[:i]
+			}
+			kb, _ := strconv.Atoi(value)
+			agent.MemoryMB = kb / 1024
+		}
+	}
+	return info
+}
+
+// GetROCmInfo returns information about the ROCm installation on the remote
+// machine, including the HSA agents that are available.
+func (b binding) GetROCmInfo(ctx context.Context) (*ROCmInfo, error) {
+	rocminfo := "rocminfo"
+	if !b.hasCommand(ctx, rocminfo) {
+		rocminfo = rocmRoot + "/bin/rocminfo"
+		if !b.hasCommand(ctx, rocminfo) {
+			return nil, ErrROCmNotFound
+		}
+	}
+	out, err := callStdout(ctx, b.Shell(rocminfo))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not run rocminfo")
+	}
+	info := parseROCmInfo(out)
+	if version, err := b.FileContents(ctx, rocmRoot+"/.info/version"); err == nil {
+		info.ROCmVersion = version
+	}
+	return info, nil
+}
+
+// CUDAInfo describes the CUDA environment on the remote machine.
+type CUDAInfo struct {
+	// DriverVersion is the version of the NVIDIA driver.
+	DriverVersion string
+	// RuntimeVersion is the version of the CUDA toolkit if nvcc is installed,
+	// otherwise it is the highest CUDA version supported by the driver.
+	RuntimeVersion string
+	// ComputeCapabilities lists the distinct compute capabilities of the
+	// installed GPUs, for example "8.6".
+	ComputeCapabilities []string
+}
+
+// parseNvccVersion returns the CUDA release from the output of nvcc --version.
+func parseNvccVersion(out string) string {
+	// Looks for: "Cuda compilation tools, release 12.2, V12.2.140"
+	const marker = "release "
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, marker); i >= 0 {
+			version := line[i+len(marker):]
+			if j := strings.Index(version, ","); j >= 0 {
+				version = version[:j]
+			}
+			return strings.TrimSpace(version)
+		}
+	}
+	return ""
+}
+
+// parseNvidiaSmiCUDAVersion returns the CUDA version reported in the header
+// of the nvidia-smi output.
+func parseNvidiaSmiCUDAVersion(out string) string {
+	const marker = "CUDA Version:"
+	if i := strings.Index(out, marker); i >= 0 {
+		fields := strings.Fields(out[i+len(marker):])
+		if len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// parseNvidiaSmiGPUs parses the output of
+// nvidia-smi --query-gpu=driver_version,compute_cap --format=csv,noheader
+func parseNvidiaSmiGPUs(out string) (driver string, caps []string) {
+	caps = []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			continue
+		}
+		driver = strings.TrimSpace(fields[0])
+		if c := strings.TrimSpace(fields[1]); c != "" && !seen[c] {
+			seen[c] = true
+			caps = append(caps, c)
+		}
+	}
+	return driver, caps
+}
+
+// GetCUDAVersion returns the NVIDIA driver version, CUDA version and GPU
+// compute capabilities of the remote machine.
+func (b binding) GetCUDAVersion(ctx context.Context) (*CUDAInfo, error) {
+	hasNvcc := b.hasCommand(ctx, "nvcc")
+	hasSmi := b.hasCommand(ctx, "nvidia-smi")
+	if !hasNvcc && !hasSmi {
+		return nil, ErrCUDANotFound
+	}
+	info := &CUDAInfo{ComputeCapabilities: []string{}}
+	if hasSmi {
+		out, err := callStdout(ctx, b.Shell("nvidia-smi", "--query-gpu=driver_version,compute_cap", "--format=csv,noheader"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run nvidia-smi")
+		}
+		info.DriverVersion, info.ComputeCapabilities = parseNvidiaSmiGPUs(out)
+	}
+	if hasNvcc {
+		out, err := callStdout(ctx, b.Shell("nvcc", "--version"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run nvcc")
+		}
+		info.RuntimeVersion = parseNvccVersion(out)
+	} else if out, err := callStdout(ctx, b.Shell("nvidia-smi")); err == nil {
+		info.RuntimeVersion = parseNvidiaSmiCUDAVersion(out)
+	}
+	return info, nil
+}
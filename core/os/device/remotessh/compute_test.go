@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestParseOpenCLPlatforms(t *testing.T) {
+	ctx := log.Testing(t)
+
+	input := `{
+	"platforms": [
+		{ "CL_PLATFORM_NAME": "NVIDIA CUDA", "CL_PLATFORM_VENDOR": "NVIDIA Corporation", "CL_PLATFORM_VERSION": "OpenCL 3.0 CUDA 12.2.138" },
+		{ "CL_PLATFORM_NAME": "Clover", "CL_PLATFORM_VENDOR": "Mesa", "CL_PLATFORM_VERSION": "OpenCL 1.1 Mesa 23.0.4" }
+	],
+	"devices": [
+		{ "online": [ { "CL_DEVICE_NAME": "NVIDIA GeForce RTX 3080", "CL_DEVICE_MAX_COMPUTE_UNITS": 68 } ] },
+		{ "online": [] }
+	]
+}`
+	platforms, err := parseOpenCLPlatforms(input)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "platforms").That(platforms).DeepEquals([]*OpenCLPlatform{
+		{
+			Name:    "NVIDIA CUDA",
+			Vendor:  "NVIDIA Corporation",
+			Version: "OpenCL 3.0 CUDA 12.2.138",
+			Devices: []*OpenCLDevice{{Name: "NVIDIA GeForce RTX 3080", MaxComputeUnits: 68}},
+		},
+		{
+			Name:    "Clover",
+			Vendor:  "Mesa",
+			Version: "OpenCL 1.1 Mesa 23.0.4",
+			Devices: []*OpenCLDevice{},
+		},
+	})
+}
+
+func TestParseROCmInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	input := `ROCk module is loaded
+=====================
+HSA System Attributes
+=====================
+Runtime Version:         1.1
+System Timestamp Freq.:  1000.000000MHz
+==========
+HSA Agents
+==========
+*******
+Agent 1
+*******
+  Name:                    AMD Ryzen 9 5950X 16-Core Processor
+  Marketing Name:          AMD Ryzen 9 5950X 16-Core Processor
+  Compute Unit:            32
+  Pool Info:
+    Pool 1
+      Segment:                 GLOBAL; FLAGS: FINE GRAINED
+      Size:                    65768328(0x3eb8a88) KB
+*******
+Agent 2
+*******
+  Name:                    gfx1030
+  Marketing Name:          AMD Radeon RX 6800 XT
+  Compute Unit:            72
+  Pool Info:
+    Pool 1
+      Segment:                 GROUP
+      Size:                    64(0x40) KB
+    Pool 2
+      Segment:                 GLOBAL; FLAGS: COARSE GRAINED
+      Size:                    16760832(0xffc000) KB
+  ISA Info:
+    ISA 1
+      Name:                    amdgcn-amd-amdhsa--gfx1030
+*** Done ***
+`
+	info := parseROCmInfo(input)
+	assert.For(ctx, "info").That(info).DeepEquals(&ROCmInfo{
+		RuntimeVersion: "1.1",
+		Agents: []ROCmAgent{
+			{Name: "AMD Ryzen 9 5950X 16-Core Processor", ComputeUnits: 32, MemoryMB: 64226},
+			{Name: "gfx1030", ComputeUnits: 72, MemoryMB: 16368},
+		},
+	})
+}
+
+func TestParseCUDAVersion(t *testing.T) {
+	ctx := log.Testing(t)
+
+	nvcc := `nvcc: NVIDIA (R) Cuda compiler driver
+Copyright (c) 2005-2023 NVIDIA Corporation
+Built on Tue_Aug_15_22:02:13_PDT_2023
+Cuda compilation tools, release 12.2, V12.2.140
+Build cuda_12.2.r12.2/compiler.33191640_0`
+	assert.For(ctx, "nvcc").ThatString(parseNvccVersion(nvcc)).Equals("12.2")
+
+	smi := `+---------------------------------------------------------------------------------------+
+| NVIDIA-SMI 535.104.05             Driver Version: 535.104.05   CUDA Version: 12.2     |
+|-----------------------------------------+----------------------+----------------------+`
+	assert.For(ctx, "nvidia-smi").ThatString(parseNvidiaSmiCUDAVersion(smi)).Equals("12.2")
+
+	driver, caps := parseNvidiaSmiGPUs("535.104.05, 8.6\n535.104.05, 8.6\n535.104.05, 7.5\n")
+	assert.For(ctx, "driver").ThatString(driver).Equals("535.104.05")
+	assert.For(ctx, "caps").ThatSlice(caps).Equals([]string{"8.6", "7.5"})
+}
@@ -15,9 +15,15 @@
 package remotessh
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
 	"os/user"
+	"time"
+
+	"github.com/google/gapid/core/log"
 )
 
 // Configuration represents a configuration for connecting
@@ -36,38 +42,247 @@ type Configuration struct {
 	// The pem encoded public key file to use for the connection.
 	// If not specified uses ~/.ssh/id_rsa
 	Keyfile string
+	// CertFile is the SSH certificate, signed by a certificate authority
+	// trusted by the host, to authenticate with. It certifies the public key
+	// of Keyfile. Optional.
+	CertFile string
 	// The known_hosts file to use for authentication. Defaults to
-	// ~/.ssh/known_hosts
+	// ~/.ssh/known_hosts. Hosts that are not in the file are trusted on
+	// first use, and added to it.
 	KnownHosts string
+	// AgentSocket is the path of the unix socket of the SSH agent to use.
+	// If empty, SSH_AUTH_SOCK is used. When set, the agent is also
+	// forwarded to the remote machine, so commands run there can use it to
+	// connect to other hosts. Only set this for trusted remote machines, as
+	// their administrators can use the forwarded agent too.
+	AgentSocket string
 	// Environment variables to set on the connection
 	Env []string
+	// ProxyHosts are the bastion hosts to connect through, in order, to
+	// reach Host. Each has its own credentials and known_hosts file.
+	ProxyHosts []Configuration
+	// RetryPolicy controls how connecting is retried if it fails.
+	RetryPolicy RetryPolicy
+	// KeepAliveInterval is how often to check that the connection is still
+	// alive. 0 disables the checks. Nanoseconds when read from JSON.
+	KeepAliveInterval time.Duration
+	// KeepAliveMaxMissed is how many consecutive checks may go unanswered
+	// before the connection is considered dead and closed. Defaults to 3.
+	KeepAliveMaxMissed int
+	// TunnelBufferSize is the size in bytes of the buffers used to copy the
+	// data of forwarded ports. Defaults to 256KB.
+	TunnelBufferSize int
+	// MaxOpenSessions is the number of commands that may run at once on the
+	// connection. Further commands wait for one to finish. Defaults to 9,
+	// which with the SFTP session is the default limit of OpenSSH servers.
+	MaxOpenSessions int
+	// MinAvailableMemory is the memory in bytes that should be available on
+	// the remote machine to trace on it. A warning is logged when connecting
+	// if there is less. 0 disables the check.
+	MinAvailableMemory int64
+	// Compression asks for the zlib@openssh.com compression of the
+	// connection, which trades CPU time for bandwidth on slow links. It
+	// currently has no effect, as the SSH transport only supports "none".
+	// Archives of whole directories are gzipped regardless.
+	Compression bool
+	// CompressionLevel is the zlib level, from 1 to 9, used if Compression
+	// is set. Defaults to 6.
+	CompressionLevel int
+}
+
+// RetryPolicy controls how an operation is retried if it fails. The delay
+// between attempts starts at InitialDelay and doubles after each failure,
+// up to MaxDelay. Durations are in nanoseconds when read from JSON.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts. Values less than 2
+	// disable retrying.
+	MaxAttempts int
+	// InitialDelay is the delay before the second attempt.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between attempts. 0 means no cap.
+	MaxDelay time.Duration
+}
+
+// Option changes the configuration of a binding made by NewBinding. The
+// options override the fields of the Configuration it is given.
+type Option func(*binding)
+
+// WithRetryPolicy sets how connecting is retried if it fails.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(b *binding) { b.configuration.RetryPolicy = p }
+}
+
+// WithKeepalive sets how often the connection is checked, and how many
+// consecutive checks may go unanswered before it is closed. An interval of 0
+// disables the checks, and a maxMissed of 0 uses the default of 3.
+func WithKeepalive(interval time.Duration, maxMissed int) Option {
+	return func(b *binding) {
+		b.configuration.KeepAliveInterval = interval
+		b.configuration.KeepAliveMaxMissed = maxMissed
+	}
+}
+
+// WithBufferSize sets the size in bytes of the buffers used to copy the data
+// of forwarded ports. 0 uses the default of 256KB.
+func WithBufferSize(size int) Option {
+	return func(b *binding) { b.configuration.TunnelBufferSize = size }
+}
+
+// WithKnownHostsFile sets the known_hosts file that the host key is checked
+// against.
+func WithKnownHostsFile(path string) Option {
+	return func(b *binding) { b.configuration.KnownHosts = path }
+}
+
+// WithRateLimit limits the total rate of the file uploads of the binding,
+// such as WriteFile, PushFile and PushDir, to bytesPerSecond, so that they
+// do not starve the other commands. Concurrent uploads share the limit.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(b *binding) { b.limiter = newRateLimiter(bytesPerSecond) }
+}
+
+// check returns an error if a field of c cannot be used.
+func (c *Configuration) check() error {
+	switch {
+	case c.RetryPolicy.MaxAttempts < 0 || c.RetryPolicy.InitialDelay < 0 || c.RetryPolicy.MaxDelay < 0:
+		return fmt.Errorf("Invalid retry policy %+v", c.RetryPolicy)
+	case c.KeepAliveInterval < 0 || c.KeepAliveMaxMissed < 0:
+		return fmt.Errorf("Invalid keepalive of %v with %d missed", c.KeepAliveInterval, c.KeepAliveMaxMissed)
+	case c.TunnelBufferSize < 0:
+		return fmt.Errorf("Invalid buffer size %d", c.TunnelBufferSize)
+	case c.CompressionLevel < 0 || c.CompressionLevel > 9:
+		return fmt.Errorf("Invalid compression level %d", c.CompressionLevel)
+	}
+	return nil
+}
+
+// delay returns the delay to wait before the given attempt, where the
+// first attempt is 0, with up to half of it removed at random so that
+// clients retrying together spread out.
+func (p RetryPolicy) delay(attempt int, rnd *rand.Rand) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay == 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	return d - time.Duration(rnd.Int63n(int64(d/2)+1))
+}
+
+// setDefaults fills in the fields of c that were not given from defaults.
+// The Name and Host are left as they are.
+func (c *Configuration) setDefaults(defaults Configuration) {
+	if c.User == "" {
+		c.User = defaults.User
+	}
+	if c.Port == 0 {
+		c.Port = defaults.Port
+	}
+	if c.Keyfile == "" {
+		c.Keyfile = defaults.Keyfile
+	}
+	if c.CertFile == "" {
+		c.CertFile = defaults.CertFile
+	}
+	if c.KnownHosts == "" {
+		c.KnownHosts = defaults.KnownHosts
+	}
+	if c.AgentSocket == "" {
+		c.AgentSocket = defaults.AgentSocket
+	}
+	if c.Env == nil {
+		c.Env = defaults.Env
+	}
+	if c.ProxyHosts == nil {
+		c.ProxyHosts = defaults.ProxyHosts
+	}
+	if c.RetryPolicy.MaxAttempts == 0 {
+		c.RetryPolicy.MaxAttempts = defaults.RetryPolicy.MaxAttempts
+	}
+	if c.KeepAliveInterval == 0 {
+		c.KeepAliveInterval = defaults.KeepAliveInterval
+	}
+	if c.KeepAliveMaxMissed == 0 {
+		c.KeepAliveMaxMissed = defaults.KeepAliveMaxMissed
+	}
+}
+
+// setSSHConfigDefaults fills in the fields of c that were not given from
+// the OpenSSH configuration files for its Host, which may be an alias.
+func (c *Configuration) setSSHConfigDefaults(u *user.User, files []string) error {
+	if c.Host == "" {
+		return nil
+	}
+	sshCfg, err := loadSSHConfig(c.Host, u, files, 0)
+	if err != nil {
+		return err
+	}
+	c.Host = sshCfg.Host
+	c.setDefaults(*sshCfg)
+	return nil
+}
+
+// setProxyDefaults fills in the fields of the proxy hosts that were not
+// given, using the same defaults as for the main host.
+func (c *Configuration) setProxyDefaults(defaults Configuration) {
+	for i := range c.ProxyHosts {
+		c.ProxyHosts[i].setDefaults(defaults)
+	}
 }
 
 // ReadConfigurations reads a set of configurations from then
 // given reader, and returns the configurations to the user.
+// Fields that are not given are read from the OpenSSH configuration
+// files, ~/.ssh/config and /etc/ssh/ssh_config, as with LoadSSHConfig.
+// The hosts whose OpenSSH configuration cannot be read are given none of
+// it. Use ReadConfigurationsContext to log why.
 func ReadConfigurations(r io.Reader) ([]Configuration, error) {
+	return ReadConfigurationsContext(context.Background(), r)
+}
+
+// ReadConfigurationsContext is like ReadConfigurations, but logs a warning
+// to ctx for each host whose OpenSSH configuration cannot be read.
+func ReadConfigurationsContext(ctx context.Context, r io.Reader) ([]Configuration, error) {
 	u, err := user.Current()
 	if err != nil {
 		return nil, err
 	}
+	return readConfigurations(ctx, r, u, sshConfigFiles(u))
+}
 
+func readConfigurations(ctx context.Context, r io.Reader, u *user.User, sshConfigFiles []string) ([]Configuration, error) {
 	cfgs := []Configuration{}
 	d := json.NewDecoder(r)
 	if _, err := d.Token(); err != nil {
 		return nil, err
 	}
+	defaults := Configuration{
+		User:       u.Username,
+		Port:       22,
+		Keyfile:    u.HomeDir + "/.ssh/id_rsa",
+		KnownHosts: u.HomeDir + "/.ssh/known_hosts",
+	}
 	for d.More() {
-		cfg := Configuration{
-			Name:       "",
-			Host:       "",
-			User:       u.Username,
-			Port:       22,
-			Keyfile:    u.HomeDir + "/.ssh/id_rsa",
-			KnownHosts: u.HomeDir + "/.ssh/known_hosts",
-		}
+		cfg := Configuration{}
 		if err := d.Decode(&cfg); err != nil {
 			return nil, err
 		}
+		// The OpenSSH configuration only provides defaults, so the JSON
+		// alone is enough if it cannot be read.
+		if err := cfg.setSSHConfigDefaults(u, sshConfigFiles); err != nil {
+			log.W(ctx, "Ignoring the OpenSSH configuration of %s: %v", cfg.Host, err)
+		}
+		for i := range cfg.ProxyHosts {
+			if err := cfg.ProxyHosts[i].setSSHConfigDefaults(u, sshConfigFiles); err != nil {
+				log.W(ctx, "Ignoring the OpenSSH configuration of %s: %v", cfg.ProxyHosts[i].Host, err)
+			}
+		}
+		cfg.setDefaults(defaults)
+		cfg.setProxyDefaults(defaults)
 		cfgs = append(cfgs, cfg)
 	}
 	if _, err := d.Token(); err != nil {
@@ -16,6 +16,7 @@ package remotessh_test
 
 import (
 	"bytes"
+	"os/user"
 	"testing"
 
 	"github.com/google/gapid/core/assert"
@@ -50,7 +51,9 @@ func TestReadConfiguration(t *testing.T) {
 		"Keyfile": "id_dsa",
 		"KnownHosts": "someFile",
 		"UseSSHAgent": false,
-		"User": "me"
+		"User": "me",
+		"Compression": true,
+		"CompressionLevel": 9
 	}
 ]
 `
@@ -77,14 +80,58 @@ func TestReadConfiguration(t *testing.T) {
 			KnownHosts: "~/.ssh/known_hosts",
 		},
 		remotessh.Configuration{
-			Name:       "Connection2",
-			User:       "me",
-			Host:       "",
-			Port:       22,
-			Keyfile:    "id_dsa",
-			KnownHosts: "someFile",
+			Name:             "Connection2",
+			User:             "me",
+			Host:             "",
+			Port:             22,
+			Keyfile:          "id_dsa",
+			KnownHosts:       "someFile",
+			Compression:      true,
+			CompressionLevel: 9,
 		},
 	} {
 		assert.For(ctx, "configs[%v]", i).That(configs[i]).DeepEquals(test)
 	}
 }
+
+func TestReadConfigurationProxyHosts(t *testing.T) {
+	ctx := log.Testing(t)
+
+	input := `
+[
+	{
+		"Name": "farm",
+		"Host": "device.internal",
+		"User": "me",
+		"Keyfile": "id_rsa",
+		"KnownHosts": "known_hosts",
+		"ProxyHosts": [
+			{ "Host": "bastion.example.com", "User": "jump", "Port": 2222 },
+			{ "Host": "gateway.internal", "Keyfile": "gateway_rsa", "KnownHosts": "gateway_hosts" }
+		]
+	}
+]
+`
+	configs, err := remotessh.ReadConfigurations(bytes.NewReader([]byte(input)))
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "configs").ThatInteger(len(configs)).Equals(1)
+
+	u, err := user.Current()
+	assert.For(ctx, "user").ThatError(err).Succeeded()
+	assert.For(ctx, "ProxyHosts").That(configs[0].ProxyHosts).DeepEquals([]remotessh.Configuration{
+		{
+			Host:       "bastion.example.com",
+			User:       "jump",
+			Port:       2222,
+			Keyfile:    u.HomeDir + "/.ssh/id_rsa",
+			KnownHosts: u.HomeDir + "/.ssh/known_hosts",
+		},
+		{
+			Host:       "gateway.internal",
+			User:       u.Username,
+			Port:       22,
+			Keyfile:    "gateway_rsa",
+			KnownHosts: "gateway_hosts",
+		},
+	})
+}
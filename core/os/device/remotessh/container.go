@@ -0,0 +1,268 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gapid/core/app/crash"
+	"github.com/google/gapid/core/log"
+)
+
+// containerMemoryPollInterval is how often MonitorContainerMemory samples
+// the memory usage of the container.
+const containerMemoryPollInterval = 5 * time.Second
+
+// dockerDefaultCapabilities are the capabilities granted to a Docker
+// container unless they are explicitly dropped.
+var dockerDefaultCapabilities = []string{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL",
+	"MKNOD", "NET_BIND_SERVICE", "NET_RAW", "SETFCAP", "SETGID", "SETPCAP",
+	"SETUID", "SYS_CHROOT",
+}
+
+// CapabilitySet holds the Linux capabilities of a Docker container, relative
+// to Docker's default set. Capability names do not have the CAP_ prefix.
+type CapabilitySet struct {
+	// Privileged is true if the container was started with --privileged, and
+	// so has all capabilities.
+	Privileged bool
+	// Added are the capabilities added with --cap-add.
+	Added []string
+	// Dropped are the capabilities removed with --cap-drop. This may be
+	// "ALL".
+	Dropped []string
+}
+
+// Has returns true if the container has the given capability, which may be
+// given with or without the CAP_ prefix.
+func (c *CapabilitySet) Has(capability string) bool {
+	capability = normalizeCapability(capability)
+	contains := func(list []string, s string) bool {
+		for _, l := range list {
+			if l == s {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case c.Privileged, contains(c.Added, capability), contains(c.Added, "ALL"):
+		return true
+	case contains(c.Dropped, capability), contains(c.Dropped, "ALL"):
+		return false
+	default:
+		return contains(dockerDefaultCapabilities, capability)
+	}
+}
+
+func normalizeCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(capability)), "CAP_")
+}
+
+var dockerListRE = regexp.MustCompile(`\[([^\]]*)\]`)
+
+// parseDockerCapabilities parses the output of docker inspect with the format
+// '{{.HostConfig.Privileged}} {{.HostConfig.CapAdd}} {{.HostConfig.CapDrop}}',
+// for example "false [SYS_PTRACE] [ALL]".
+func parseDockerCapabilities(out string) (*CapabilitySet, error) {
+	out = strings.TrimSpace(out)
+	lists := dockerListRE.FindAllStringSubmatch(out, -1)
+	if len(lists) != 2 {
+		return nil, fmt.Errorf("Unexpected docker inspect output %q", out)
+	}
+	c := &CapabilitySet{
+		Privileged: strings.HasPrefix(out, "true"),
+		Added:      []string{},
+		Dropped:    []string{},
+	}
+	for _, capability := range strings.Fields(lists[0][1]) {
+		c.Added = append(c.Added, normalizeCapability(capability))
+	}
+	for _, capability := range strings.Fields(lists[1][1]) {
+		c.Dropped = append(c.Dropped, normalizeCapability(capability))
+	}
+	return c, nil
+}
+
+// GetContainerCapabilities returns the Linux capabilities of the Docker
+// container with the given ID or name.
+func (b binding) GetContainerCapabilities(ctx context.Context, containerID string) (*CapabilitySet, error) {
+	out, err := callStdout(ctx, b.Shell("docker", "inspect", containerID, "--format",
+		"{{.HostConfig.Privileged}} {{.HostConfig.CapAdd}} {{.HostConfig.CapDrop}}"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not inspect container %s", containerID)
+	}
+	return parseDockerCapabilities(out)
+}
+
+// HasCapability returns true if the Docker container with the given ID or
+// name has the given capability, for example "CAP_SYS_PTRACE".
+func (b binding) HasCapability(ctx context.Context, containerID, capability string) (bool, error) {
+	caps, err := b.GetContainerCapabilities(ctx, containerID)
+	if err != nil {
+		return false, err
+	}
+	return caps.Has(capability), nil
+}
+
+// ContainerMemStats holds the memory usage of a Docker container.
+type ContainerMemStats struct {
+	UsageBytes int64
+	LimitBytes int64
+	// CacheBytes is the page cache charged to the container, or -1 if it
+	// could not be read.
+	CacheBytes int64
+	// UsagePct is the usage as a percentage of the limit.
+	UsagePct float64
+}
+
+// MemAlert is sent by MonitorContainerMemory when the memory usage of a
+// container exceeds the threshold.
+type MemAlert struct {
+	Timestamp time.Time
+	Stats     ContainerMemStats
+}
+
+// dockerSizeUnits are the suffixes docker uses for sizes, longest first.
+var dockerSizeUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseDockerSize parses a size as printed by docker, for example "9.5MiB".
+func parseDockerSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	for _, u := range dockerSizeUnits {
+		if strings.HasSuffix(size, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(size, u.suffix), 64)
+			if err != nil {
+				break
+			}
+			return int64(v * u.scale), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid size %q", size)
+}
+
+// parseDockerStats parses the output of docker stats --format '{{json .}}'.
+func parseDockerStats(out string) (*ContainerMemStats, error) {
+	stats := struct {
+		MemUsage string
+		MemPerc  string
+	}{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out)), &stats); err != nil {
+		return nil, err
+	}
+	// For example "9.5MiB / 7.667GiB".
+	parts := strings.SplitN(stats.MemUsage, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid memory usage %q", stats.MemUsage)
+	}
+	usage, err := parseDockerSize(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseDockerSize(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(stats.MemPerc), "%"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid memory percentage %q", stats.MemPerc)
+	}
+	return &ContainerMemStats{UsageBytes: usage, LimitBytes: limit, CacheBytes: -1, UsagePct: pct}, nil
+}
+
+// parseCgroupCache returns the page cache from the contents of the cgroup
+// memory.stat file, which is "file" for cgroup v2 and "cache" for v1.
+func parseCgroupCache(out string) int64 {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[0] == "file" || fields[0] == "cache") {
+			if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return v
+			}
+		}
+	}
+	return -1
+}
+
+// GetContainerMemoryStats returns the memory usage of the Docker container
+// with the given ID or name.
+func (b binding) GetContainerMemoryStats(ctx context.Context, containerID string) (*ContainerMemStats, error) {
+	out, err := callStdout(ctx, b.Shell("docker", "stats", containerID, "--no-stream", "--format", "{{json .}}"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not get stats of container %s", containerID)
+	}
+	stats, err := parseDockerStats(out)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not parse stats of container %s", containerID)
+	}
+	// docker stats does not report the cache, so read it from the cgroup
+	// inside the container when possible.
+	if out, err := b.posixShell("docker exec " + posixQuote(containerID) +
+		" cat /sys/fs/cgroup/memory.stat /sys/fs/cgroup/memory/memory.stat 2>/dev/null").Call(ctx); out != "" || err == nil {
+		stats.CacheBytes = parseCgroupCache(out)
+	}
+	return stats, nil
+}
+
+// MonitorContainerMemory samples the memory usage of the Docker container
+// with the given ID or name every few seconds, and sends an alert each time
+// the usage rises above threshold percent of the limit. Monitoring stops and
+// the channel is closed when ctx is cancelled or the container cannot be
+// sampled.
+func (b binding) MonitorContainerMemory(ctx context.Context, containerID string, threshold float64) (<-chan MemAlert, error) {
+	stats, err := b.GetContainerMemoryStats(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	alerts := make(chan MemAlert)
+	crash.Go(func() {
+		defer close(alerts)
+		above := false
+		for {
+			if stats.UsagePct >= threshold && !above {
+				select {
+				case alerts <- MemAlert{Timestamp: time.Now(), Stats: *stats}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			above = stats.UsagePct >= threshold
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(containerMemoryPollInterval):
+			}
+			if stats, err = b.GetContainerMemoryStats(ctx, containerID); err != nil {
+				log.W(ctx, "Stopped monitoring container %s: %v", containerID, err)
+				return
+			}
+		}
+	})
+	return alerts, nil
+}
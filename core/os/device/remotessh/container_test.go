@@ -0,0 +1,66 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestContainerCapabilities(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		inspect    string
+		capability string
+		expected   bool
+	}{
+		{"false [] []", "CAP_SYS_PTRACE", false},
+		{"false [] []", "CAP_CHOWN", true},
+		{"false [SYS_PTRACE] []", "CAP_SYS_PTRACE", true},
+		{"false [CAP_SYS_PTRACE] [ALL]", "sys_ptrace", true},
+		{"false [] [ALL]", "CHOWN", false},
+		{"false [] [CHOWN NET_RAW]", "NET_RAW", false},
+		{"true [] []", "SYS_ADMIN", true},
+	} {
+		caps, err := parseDockerCapabilities(test.inspect)
+		assert.For(ctx, "%v err", test.inspect).ThatError(err).Succeeded()
+		assert.For(ctx, "%v has %v", test.inspect, test.capability).That(caps.Has(test.capability)).Equals(test.expected)
+	}
+
+	_, err := parseDockerCapabilities("Error: No such object: foo")
+	assert.For(ctx, "bad output").ThatError(err).Failed()
+}
+
+func TestParseDockerStats(t *testing.T) {
+	ctx := log.Testing(t)
+
+	stats, err := parseDockerStats(`{"BlockIO":"0B / 0B","CPUPerc":"0.00%","Container":"3f2a","ID":"3f2a","MemPerc":"25.00%","MemUsage":"512MiB / 2GiB","Name":"gapid","NetIO":"796B / 0B","PIDs":"1"}`)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "stats").That(stats).DeepEquals(&ContainerMemStats{
+		UsageBytes: 512 << 20,
+		LimitBytes: 2 << 30,
+		CacheBytes: -1,
+		UsagePct:   25,
+	})
+
+	_, err = parseDockerStats(`{"MemPerc":"--","MemUsage":"-- / --"}`)
+	assert.For(ctx, "stopped").ThatError(err).Failed()
+
+	assert.For(ctx, "v2 cache").That(parseCgroupCache("anon 1048576\nfile 4096\n")).Equals(int64(4096))
+	assert.For(ctx, "v1 cache").That(parseCgroupCache("cache 8192\nrss 1024\n")).Equals(int64(8192))
+}
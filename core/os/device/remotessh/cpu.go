@@ -0,0 +1,281 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+// parseCPUList parses a Linux CPU list, for example "0-3,8,10-11".
+func parseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return cpus, nil
+	}
+	for _, r := range strings.Split(list, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("Invalid CPU list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// formatCPUList returns cpus as a comma separated list.
+func formatCPUList(cpus []int) string {
+	list := make([]string, len(cpus))
+	for i, cpu := range cpus {
+		list[i] = strconv.Itoa(cpu)
+	}
+	return strings.Join(list, ",")
+}
+
+// GetCPUAffinity returns the CPUs the process with the given PID may run on.
+func (b binding) GetCPUAffinity(ctx context.Context, pid int) ([]int, error) {
+	out, err := callStdout(ctx, b.Shell("taskset", "-cp", strconv.Itoa(pid)))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not get the CPU affinity of %d", pid)
+	}
+	// For example "pid 1234's current affinity list: 0-3,8".
+	i := strings.LastIndex(out, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("Unexpected taskset output %q", out)
+	}
+	return parseCPUList(out[i+1:])
+}
+
+// SetCPUAffinity restricts the process with the given PID to run on cpus.
+func (b binding) SetCPUAffinity(ctx context.Context, pid int, cpus []int) error {
+	if len(cpus) == 0 {
+		return fmt.Errorf("No CPUs given")
+	}
+	if _, err := callStdout(ctx, b.Shell("taskset", "-cp", formatCPUList(cpus), strconv.Itoa(pid))); err != nil {
+		return log.Errf(ctx, err, "Could not set the CPU affinity of %d", pid)
+	}
+	return nil
+}
+
+// GetOptimalCPUsForGPU returns the CPUs of the NUMA node that the PCI device
+// with the given bus/device/function address is attached to. All the online
+// CPUs are returned if the machine does not have multiple NUMA nodes.
+func (b binding) GetOptimalCPUsForGPU(ctx context.Context, gpuBDF string) ([]int, error) {
+	if !bdfRE.MatchString(gpuBDF) {
+		return nil, ErrInvalidBDF
+	}
+	node, err := b.FileContents(ctx, pciDevices+"/"+gpuBDF+"/numa_node")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read the NUMA node of %s", gpuBDF)
+	}
+	cpulist := "/sys/devices/system/cpu/online"
+	if n, err := strconv.Atoi(strings.TrimSpace(node)); err == nil && n >= 0 {
+		cpulist = fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", n)
+	}
+	out, err := b.FileContents(ctx, cpulist)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read %s", cpulist)
+	}
+	return parseCPUList(out)
+}
+
+// CPUInfo describes the processors of the remote machine.
+type CPUInfo struct {
+	// Cores is the number of logical processors.
+	Cores     int
+	ModelName string
+	// Architecture is one of "x86", "x86_64", "armv7a", "arm64", "mips" or
+	// "mips64", or the name reported by the machine if it is none of them.
+	Architecture string
+	// FrequencyMHz is the clock speed, or 0 if unknown.
+	FrequencyMHz float64
+}
+
+// architectureNames maps the names that uname and Windows use for processor
+// architectures to the names used by CPUInfo.
+var architectureNames = map[string]string{
+	"i386":    "x86",
+	"i486":    "x86",
+	"i586":    "x86",
+	"i686":    "x86",
+	"x86":     "x86",
+	"x86_64":  "x86_64",
+	"amd64":   "x86_64",
+	"x64":     "x86_64",
+	"arm":     "armv7a",
+	"armv7":   "armv7a",
+	"armv7a":  "armv7a",
+	"armv7l":  "armv7a",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv8":   "arm64",
+	"armv8l":  "arm64",
+	"mips":    "mips",
+	"mips64":  "mips64",
+}
+
+var cpuArchitectures = map[string]device.Architecture{
+	"x86":    device.X86,
+	"x86_64": device.X86_64,
+	"armv7a": device.ARMv7a,
+	"arm64":  device.ARMv8a,
+	"mips":   device.MIPS,
+	"mips64": device.MIPS64,
+}
+
+// win32Architectures maps the Architecture of Win32_Processor to its name.
+var win32Architectures = map[string]string{
+	"0":  "x86",
+	"5":  "arm",
+	"9":  "x64",
+	"12": "arm64",
+}
+
+func normalizeArchitecture(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if n, ok := architectureNames[name]; ok {
+		return n
+	}
+	return name
+}
+
+// DeviceArchitecture returns the device.Architecture of the processors.
+func (c *CPUInfo) DeviceArchitecture() device.Architecture {
+	if a, ok := cpuArchitectures[c.Architecture]; ok {
+		return a
+	}
+	return device.UnknownArchitecture
+}
+
+// parseCPUInfo parses the contents of /proc/cpuinfo, which lists the
+// fields of each processor, and the output of uname -m.
+func parseCPUInfo(cpuinfo, arch string) *CPUInfo {
+	info := &CPUInfo{Architecture: normalizeArchitecture(arch)}
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "processor":
+			info.Cores++
+		case "model name", "Processor", "Hardware", "Model":
+			// x86 lists the model name of each processor. ARM may only
+			// name the machine or the board.
+			if info.ModelName == "" {
+				info.ModelName = value
+			}
+		case "cpu MHz":
+			if info.FrequencyMHz == 0 {
+				info.FrequencyMHz, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+	}
+	return info
+}
+
+// parseMacCPUInfo parses the output of sysctl -n for machdep.cpu.brand_string
+// and hw.ncpu, of sysctl -n hw.cpufrequency, and of uname -m.
+func parseMacCPUInfo(sysctl, frequency, arch string) (*CPUInfo, error) {
+	lines := strings.Split(strings.TrimSpace(sysctl), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("Unexpected sysctl output %q", sysctl)
+	}
+	cores, err := strconv.Atoi(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CPU count %q", lines[1])
+	}
+	info := &CPUInfo{
+		Cores:        cores,
+		ModelName:    strings.TrimSpace(lines[0]),
+		Architecture: normalizeArchitecture(arch),
+	}
+	if hz, err := strconv.ParseFloat(strings.TrimSpace(frequency), 64); err == nil {
+		info.FrequencyMHz = hz / 1e6
+	}
+	return info, nil
+}
+
+// parseWin32Processor parses the logical processor count, architecture,
+// maximum clock speed and name of Win32_Processor, each on its own line.
+func parseWin32Processor(out string) (*CPUInfo, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 {
+		return nil, fmt.Errorf("Unexpected processor information %q", out)
+	}
+	cores, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CPU count %q", lines[0])
+	}
+	arch := strings.TrimSpace(lines[1])
+	if name, ok := win32Architectures[arch]; ok {
+		arch = name
+	}
+	mhz, _ := strconv.ParseFloat(strings.TrimSpace(lines[2]), 64)
+	return &CPUInfo{
+		Cores:        cores,
+		ModelName:    strings.TrimSpace(lines[3]),
+		Architecture: normalizeArchitecture(arch),
+		FrequencyMHz: mhz,
+	}, nil
+}
+
+// GetCPUInfo returns the number, model, architecture and frequency of the
+// processors of the remote machine.
+func (b binding) GetCPUInfo(ctx context.Context) (*CPUInfo, error) {
+	if b.os == device.Windows {
+		out, err := callStdout(ctx, b.powerShell("$p = @(Get-WmiObject Win32_Processor); "+
+			"($p | Measure-Object -Sum NumberOfLogicalProcessors).Sum; "+
+			"$p[0].Architecture; $p[0].MaxClockSpeed; $p[0].Name"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not get the processor information")
+		}
+		return parseWin32Processor(out)
+	}
+	arch, err := callStdout(ctx, b.Shell("uname", "-m"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not get the architecture")
+	}
+	if b.os == device.OSX {
+		out, err := callStdout(ctx, b.Shell("sysctl", "-n", "machdep.cpu.brand_string", "hw.ncpu"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not get the processor information")
+		}
+		// Apple processors do not report their frequency.
+		frequency, _ := b.Shell("sysctl", "-n", "hw.cpufrequency").Call(ctx)
+		return parseMacCPUInfo(out, frequency, arch)
+	}
+	cpuinfo, err := b.FileContents(ctx, "/proc/cpuinfo")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read /proc/cpuinfo")
+	}
+	return parseCPUInfo(cpuinfo, arch), nil
+}
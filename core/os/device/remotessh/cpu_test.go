@@ -0,0 +1,121 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+func TestParseCPUList(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		list     string
+		expected []int
+	}{
+		{"", []int{}},
+		{"0\n", []int{0}},
+		{"0-3,8", []int{0, 1, 2, 3, 8}},
+		{" 2,4-5,10-11", []int{2, 4, 5, 10, 11}},
+	} {
+		cpus, err := parseCPUList(test.list)
+		assert.For(ctx, "%q err", test.list).ThatError(err).Succeeded()
+		assert.For(ctx, "%q", test.list).ThatSlice(cpus).Equals(test.expected)
+	}
+
+	for _, list := range []string{"a", "3-1", "1-b"} {
+		_, err := parseCPUList(list)
+		assert.For(ctx, "%q", list).ThatError(err).Failed()
+	}
+
+	assert.For(ctx, "format").ThatString(formatCPUList([]int{0, 1, 8})).Equals("0,1,8")
+}
+
+func TestParseCPUInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info := parseCPUInfo(`processor	: 0
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-8700K CPU @ 3.70GHz
+cpu MHz		: 4300.012
+
+processor	: 1
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-8700K CPU @ 3.70GHz
+cpu MHz		: 800.000
+`, "x86_64\n")
+	assert.For(ctx, "x86").That(info).DeepEquals(&CPUInfo{
+		Cores:        2,
+		ModelName:    "Intel(R) Core(TM) i7-8700K CPU @ 3.70GHz",
+		Architecture: "x86_64",
+		FrequencyMHz: 4300.012,
+	})
+	assert.For(ctx, "x86 arch").That(info.DeviceArchitecture()).Equals(device.X86_64)
+
+	info = parseCPUInfo(`processor	: 0
+BogoMIPS	: 108.00
+CPU part	: 0xd08
+
+processor	: 1
+BogoMIPS	: 108.00
+CPU part	: 0xd08
+
+Hardware	: BCM2835
+Model		: Raspberry Pi 4 Model B Rev 1.4
+`, "aarch64\n")
+	assert.For(ctx, "arm").That(info).DeepEquals(&CPUInfo{
+		Cores:        2,
+		ModelName:    "BCM2835",
+		Architecture: "arm64",
+	})
+	assert.For(ctx, "arm arch").That(info.DeviceArchitecture()).Equals(device.ARMv8a)
+
+	info, err := parseMacCPUInfo("Apple M1 Pro\n10\n", "", "arm64\n")
+	assert.For(ctx, "mac err").ThatError(err).Succeeded()
+	assert.For(ctx, "mac").That(info).DeepEquals(&CPUInfo{
+		Cores:        10,
+		ModelName:    "Apple M1 Pro",
+		Architecture: "arm64",
+	})
+	info, err = parseMacCPUInfo("Intel(R) Core(TM) i9-9880H CPU @ 2.30GHz\n16\n", "2300000000\n", "x86_64\n")
+	assert.For(ctx, "intel mac err").ThatError(err).Succeeded()
+	assert.For(ctx, "intel mac frequency").ThatFloat(info.FrequencyMHz).Equals(2300, 0)
+
+	info, err = parseWin32Processor("16\r\n9\r\n3600\r\nAMD Ryzen 7 3700X 8-Core Processor\r\n")
+	assert.For(ctx, "win32 err").ThatError(err).Succeeded()
+	assert.For(ctx, "win32").That(info).DeepEquals(&CPUInfo{
+		Cores:        16,
+		ModelName:    "AMD Ryzen 7 3700X 8-Core Processor",
+		Architecture: "x86_64",
+		FrequencyMHz: 3600,
+	})
+	_, err = parseWin32Processor("16\r\n")
+	assert.For(ctx, "win32 short").ThatError(err).Failed()
+
+	for name, expected := range map[string]string{
+		"i686":     "x86",
+		"armv7l":   "armv7a",
+		"AMD64":    "x86_64",
+		"riscv64 ": "riscv64",
+	} {
+		assert.For(ctx, name).ThatString(normalizeArchitecture(name)).Equals(expected)
+	}
+	unknown := &CPUInfo{Architecture: "riscv64"}
+	assert.For(ctx, "unknown arch").That(unknown.DeviceArchitecture()).Equals(device.UnknownArchitecture)
+}
@@ -20,33 +20,350 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/google/gapid/core/app/crash"
 	"github.com/google/gapid/core/app/layout"
+	"github.com/google/gapid/core/fault"
 	"github.com/google/gapid/core/log"
 	"github.com/google/gapid/core/os/device"
 	"github.com/google/gapid/core/os/device/bind"
 	"github.com/google/gapid/core/os/shell"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // Device extends the bind.Device interface with capabilities specific to
-// remote SSH clients
+// remote SSH clients. The queries of the remote machine, such as those of
+// its GPUs, are in the smaller interfaces below, which the devices returned
+// by GetConnectedDevice also implement.
 type Device interface {
 	bind.Device
 	// PushFile will transfer the local file at sourcePath to the remote
 	// machine at destPath
-	PushFile(ctx context.Context, sourcePath, destPath string) error
+	PushFile(ctx context.Context, sourcePath, destPath string, opts ...TransferOption) error
+	// PullFile will transfer the remote file at sourcePath to the local
+	// machine at destPath
+	PullFile(ctx context.Context, sourcePath, destPath string) error
+	// RunScript runs a multi-line script in a single session, returning its
+	// standard output and standard error.
+	RunScript(ctx context.Context, script string) (string, string, error)
+	// RunScriptFile runs a local script file on the remote machine,
+	// returning its standard output and standard error.
+	RunScriptFile(ctx context.Context, localScriptPath string) (string, string, error)
+	// RunLocalScript runs a local executable script on the remote machine
+	// with args, returning its standard output and standard error.
+	RunLocalScript(ctx context.Context, localPath string, args ...string) (string, string, error)
+	// ReadFile writes the contents of the remote file at src to dst as they
+	// are received.
+	ReadFile(ctx context.Context, src string, dst io.Writer) error
+	// GetFileSize returns the size in bytes of the remote file at path, or
+	// ErrNotFound if it does not exist.
+	GetFileSize(ctx context.Context, path string) (int64, error)
+	// FileExists returns true if anything exists at the given path.
+	FileExists(ctx context.Context, path string) (bool, error)
+	// Stat returns information about the remote file at path.
+	Stat(ctx context.Context, path string) (RemoteFileInfo, error)
+	// GetFileMetadata returns information about a file on the remote
+	// machine, including its owner, following symbolic links.
+	GetFileMetadata(ctx context.Context, path string) (*RemoteFileInfo, error)
+	// MkDir creates a directory on the remote machine.
+	MkDir(ctx context.Context, path string) error
+	// MkDirAll creates a directory, and any missing parents, on the remote
+	// machine.
+	MkDirAll(ctx context.Context, path string) error
+	// CopyFile copies a file within the remote machine.
+	CopyFile(ctx context.Context, src, dst string) error
+	// MoveFile moves a file within the remote machine.
+	MoveFile(ctx context.Context, src, dst string) error
+	// Chmod changes the permissions of a file on the remote machine.
+	Chmod(ctx context.Context, path string, mode os.FileMode) error
+	// Chown changes the owner of a file on the remote machine.
+	Chown(ctx context.Context, path string, user, group string) error
+	// WatchFile reports the changes to a remote file or directory.
+	WatchFile(ctx context.Context, path string, events FileEventMask) (<-chan FileEvent, error)
+	// CreateSymlink creates a symbolic link pointing to target.
+	CreateSymlink(ctx context.Context, target, link string) error
+	// ReadSymlink returns the target of a symbolic link.
+	ReadSymlink(ctx context.Context, path string) (string, error)
+	// IsSymlink returns true if there is a symbolic link at path.
+	IsSymlink(ctx context.Context, path string) (bool, error)
+	// ListFiles returns the files in a directory on the remote machine.
+	ListFiles(ctx context.Context, dir string, opts ListOptions) ([]RemoteFileInfo, error)
 	// MakeTempDir makes a temporary directory, and returns the
 	// path, as well as a function to call to clean it up.
 	MakeTempDir(ctx context.Context) (string, func(ctx context.Context), error)
 	// WriteFile writes the given file into the given location on the remote device
-	WriteFile(ctx context.Context, contents io.Reader, mode os.FileMode, destPath string) error
+	WriteFile(ctx context.Context, contents io.Reader, mode os.FileMode, destPath string, opts ...TransferOption) error
+	// PullDirectory copies the contents of the remote directory remoteDir
+	// into the local directory localDir.
+	PullDirectory(ctx context.Context, remoteDir, localDir string, opts ...TransferOption) error
+	// PullDir copies the contents of the remote directory src into the
+	// local directory dst, without compressing them.
+	PullDir(ctx context.Context, src, dst string, opts ...TransferOption) error
+	// PushDir copies the contents of the local directory src into the
+	// remote directory dst.
+	PushDir(ctx context.Context, src, dst string, opts ...TransferOption) error
+	// SetupLocalPortNetwork forwards a local port, opened on network, to the
+	// remote machine on the remote port, and returns the local port.
+	SetupLocalPortNetwork(ctx context.Context, network string, remotePort int) (int, error)
+	// SetupLocalPortAt forwards the given local address to the remote
+	// machine on the remote port, and returns the local port.
+	SetupLocalPortAt(ctx context.Context, remotePort int, localAddr string) (int, error)
+	// SetupReversePort forwards the remote port on the remote machine to
+	// the local port, until ctx is cancelled.
+	SetupReversePort(ctx context.Context, localPort int, remotePort int) error
+	// SetupSOCKSProxy starts a local SOCKS5 proxy whose connections are made
+	// from the remote machine, and returns its port.
+	SetupSOCKSProxy(ctx context.Context) (int, error)
+	// GetEnvVar returns the value of an environment variable on the remote
+	// machine.
+	GetEnvVar(ctx context.Context, name string) (string, error)
+	// SetEnvVar sets an environment variable for the commands run on the
+	// remote machine, and persists it for future sessions.
+	SetEnvVar(ctx context.Context, name, value string) error
+	// UnsetEnv removes an environment variable set by SetEnvVar.
+	UnsetEnv(ctx context.Context, name string) error
+	// ListSocketFiles returns the paths of the UNIX domain sockets under dir.
+	ListSocketFiles(ctx context.Context, dir string) ([]string, error)
+	// IsSocketListening returns true if the UNIX domain socket at socketPath
+	// is accepting connections.
+	IsSocketListening(ctx context.Context, socketPath string) (bool, error)
+	// Done returns a channel that is closed once the connection is closed
+	// or lost.
+	Done() <-chan struct{}
+	// Ping checks that the remote machine still runs commands.
+	Ping(ctx context.Context) error
+	// IsAlive returns true if the remote machine answers a Ping.
+	IsAlive(ctx context.Context) bool
+	// Reconnect connects again to the remote machine, after the connection
+	// was lost.
+	Reconnect(ctx context.Context) error
+	// SetSessionPrealloc sets the number of SSH sessions to open in advance.
+	SetSessionPrealloc(n int)
+	// Close closes the connection to the remote machine.
+	Close() error
+}
+
+// SystemInfo is implemented by the devices that can describe the operating
+// system and the binaries of the remote machine.
+type SystemInfo interface {
+	// GetOSVersion returns the version of the operating system.
+	GetOSVersion(ctx context.Context) (string, error)
+	// GetKernelVersion returns the dotted version of the kernel.
+	GetKernelVersion(ctx context.Context) (string, error)
+	// GetKernelTaintStatus returns whether the kernel is tainted, and why.
+	GetKernelTaintStatus(ctx context.Context) (*TaintStatus, error)
+	// GetHostname returns the short hostname of the remote machine.
+	GetHostname(ctx context.Context) (string, error)
+	// GetFQDN returns the fully qualified domain name of the remote machine.
+	GetFQDN(ctx context.Context) (string, error)
+	// SupportsFeature returns true if the remote machine has the feature.
+	SupportsFeature(ctx context.Context, f Feature) (bool, error)
+	// ProbeCapabilities returns all the known features of the remote
+	// machine.
+	ProbeCapabilities(ctx context.Context) (FeatureSet, error)
+	// GetPEInfo returns the headers of a Portable Executable binary.
+	GetPEInfo(ctx context.Context, path string) (*PEInfo, error)
+	// GetDependencyGraph returns the graph of the shared libraries loaded by
+	// a binary.
+	GetDependencyGraph(ctx context.Context, binary string, opts ...DependencyOption) (*DepGraph, error)
+}
+
+// HardwareInfo is implemented by the devices that can query and configure
+// the processors, memory and platform of the remote machine.
+type HardwareInfo interface {
+	// GetCPUInfo returns the number, model, architecture and frequency of
+	// the processors.
+	GetCPUInfo(ctx context.Context) (*CPUInfo, error)
+	// GetCPUAffinity returns the CPUs a process may run on.
+	GetCPUAffinity(ctx context.Context, pid int) ([]int, error)
+	// SetCPUAffinity restricts a process to run on the given CPUs.
+	SetCPUAffinity(ctx context.Context, pid int, cpus []int) error
+	// GetOptimalCPUsForGPU returns the CPUs closest to the given PCI device.
+	GetOptimalCPUsForGPU(ctx context.Context, gpuBDF string) ([]int, error)
+	// GetMemoryInfo returns the total, free and available physical memory.
+	GetMemoryInfo(ctx context.Context) (*MemoryInfo, error)
+	// WarnIfLowMemory logs a warning if little memory is available.
+	WarnIfLowMemory(ctx context.Context)
+	// GetHugeTLBInfo returns the state of the huge page pool.
+	GetHugeTLBInfo(ctx context.Context) (*HugeTLBInfo, error)
+	// AllocateHugePages resizes the huge page pool.
+	AllocateHugePages(ctx context.Context, count int) error
+	// FreeHugePages releases the unused pages of the huge page pool.
+	FreeHugePages(ctx context.Context) error
+	// GetPlatformSecurityFeatures returns the state of Secure Boot, kernel
+	// lockdown and the TPM.
+	GetPlatformSecurityFeatures(ctx context.Context) (*SecurityFeatures, error)
+	// GetRASEvents returns the hardware errors reported since the given time.
+	GetRASEvents(ctx context.Context, since time.Time) ([]RASEvent, error)
+	// GetSMBIOSInfo returns information identifying the hardware platform.
+	GetSMBIOSInfo(ctx context.Context) (*SMBIOSInfo, error)
+	// GetPowerConsumption returns the current power draw of the CPUs and
+	// GPUs.
+	GetPowerConsumption(ctx context.Context) ([]PowerMeter, error)
+}
+
+// PCIInfo is implemented by the devices that can query the PCI devices of
+// the remote machine, and bind them to VFIO.
+type PCIInfo interface {
+	// GetPCIeBandwidth returns the negotiated PCIe link of the given device.
+	GetPCIeBandwidth(ctx context.Context, deviceBDF string) (*PCIeInfo, error)
+	// GetIommuGroups returns the IOMMU groups and the devices in each.
+	GetIommuGroups(ctx context.Context) ([]*IommuGroup, error)
+	// GetDeviceIommuGroup returns the IOMMU group of the given device.
+	GetDeviceIommuGroup(ctx context.Context, deviceBDF string) (int, error)
+	// GetVFIODevices returns the PCI devices bound to the vfio-pci driver.
+	GetVFIODevices(ctx context.Context) ([]*VFIODevice, error)
+	// BindDeviceToVFIO binds the given PCI device to the vfio-pci driver.
+	BindDeviceToVFIO(ctx context.Context, bdf string) error
+	// UnbindDeviceFromVFIO unbinds the given PCI device from the vfio-pci
+	// driver.
+	UnbindDeviceFromVFIO(ctx context.Context, bdf string) error
+}
+
+// GPUInfo is implemented by the devices that can query and configure the
+// GPUs of the remote machine, and the graphics and compute APIs they
+// support.
+type GPUInfo interface {
+	// GetVulkanDeviceFeatures returns the features of the Vulkan physical
+	// device with the given index.
+	GetVulkanDeviceFeatures(ctx context.Context, deviceIndex int) (*VulkanFeatures, error)
+	// SupportsFeatureSet returns true if the first Vulkan physical device
+	// supports all of the required features, along with the names of the
+	// features that are not supported.
+	SupportsFeatureSet(ctx context.Context, required VulkanFeatureSet) (bool, []string)
+	// GetVulkanMemoryProperties returns the memory heaps and types of the
+	// Vulkan physical device with the given index.
+	GetVulkanMemoryProperties(ctx context.Context, deviceIndex int) (*VulkanMemoryProps, error)
+	// GetVulkanQueueFamilies returns the queue families of a Vulkan physical
+	// device.
+	GetVulkanQueueFamilies(ctx context.Context, deviceIndex int) ([]*VulkanQueueFamily, error)
+	// GetOpenCLPlatforms returns the installed OpenCL platforms and their
+	// devices.
+	GetOpenCLPlatforms(ctx context.Context) ([]*OpenCLPlatform, error)
+	// GetROCmInfo returns information about the ROCm installation.
+	GetROCmInfo(ctx context.Context) (*ROCmInfo, error)
+	// GetCUDAVersion returns information about the CUDA environment.
+	GetCUDAVersion(ctx context.Context) (*CUDAInfo, error)
+	// GetMetalVersion returns the Metal support of the GPU on macOS.
+	GetMetalVersion(ctx context.Context) (*MetalInfo, error)
+	// GetDirectXVersion returns the Direct3D support of the display adapters
+	// on Windows.
+	GetDirectXVersion(ctx context.Context) (*DirectXInfo, error)
+	// GetGPUClock returns the graphics clocks of the GPUs.
+	GetGPUClock(ctx context.Context) ([]GPUClock, error)
+	// SetGPUClock locks the graphics clock of the given GPU.
+	SetGPUClock(ctx context.Context, deviceIndex, clockMHz int) error
+	// ResetGPUClock unlocks the graphics clock of the given GPU.
+	ResetGPUClock(ctx context.Context, deviceIndex int) error
+	// StreamGPUMetrics periodically samples the performance counters of the
+	// GPUs until ctx is cancelled.
+	StreamGPUMetrics(ctx context.Context, interval time.Duration) (<-chan GPUMetricSample, error)
+	// GetFragmentationStats returns estimates of the VRAM and system memory
+	// fragmentation.
+	GetFragmentationStats(ctx context.Context) (*FragStats, error)
+	// ListGPUDebugFSEntries returns the debugfs entries of the GPU driver.
+	ListGPUDebugFSEntries(ctx context.Context) ([]string, error)
+	// ReadGPUDebugFSEntry returns the contents of a debugfs entry of the GPU
+	// driver.
+	ReadGPUDebugFSEntry(ctx context.Context, entry string) (string, error)
+}
+
+// MediaInfo is implemented by the devices that can query the displays and
+// audio devices of the remote machine, and start virtual displays.
+type MediaInfo interface {
+	// GetAudioDevices returns the audio output devices.
+	GetAudioDevices(ctx context.Context) ([]*AudioDevice, error)
+	// SetDefaultAudioSink makes the given PulseAudio sink the default output.
+	SetDefaultAudioSink(ctx context.Context, deviceName string) error
+	// CreateVirtualDisplay starts a headless X11 display, and sets DISPLAY
+	// for subsequent commands.
+	CreateVirtualDisplay(ctx context.Context, width, height, refreshHz int) (*VirtualDisplay, error)
+	// CreateWaylandDisplay starts a headless Wayland compositor, and sets
+	// WAYLAND_DISPLAY for subsequent commands.
+	CreateWaylandDisplay(ctx context.Context, width, height int) (*VirtualDisplay, error)
+	// GetDRMFormatModifiers returns the formats and modifiers of the
+	// framebuffers being displayed.
+	GetDRMFormatModifiers(ctx context.Context) ([]*FormatModifier, error)
+	// GetDisplayRefreshRate returns the refresh rate of an X11 output.
+	GetDisplayRefreshRate(ctx context.Context, displayName string) (int, error)
+}
+
+// ProcessInfo is implemented by the devices that can query and signal the
+// processes of the remote machine.
+type ProcessInfo interface {
+	// ListProcesses returns the processes running on the remote machine.
+	ListProcesses(ctx context.Context) ([]RemoteProcessInfo, error)
+	// FindProcess returns the running processes with the given name.
+	FindProcess(ctx context.Context, name string) ([]RemoteProcessInfo, error)
+	// KillProcess sends a signal to the process with the given PID.
+	KillProcess(ctx context.Context, pid int, sig os.Signal) error
+	// GetProcessIOStats returns the I/O counters of a process.
+	GetProcessIOStats(ctx context.Context, pid int) (*IOStats, error)
+	// SampleIOStats repeatedly reads the I/O counters of a process.
+	SampleIOStats(ctx context.Context, pid int, interval time.Duration, count int) ([]*IOStatsSample, error)
+	// GetMMappedFiles returns the shared memory mappings of a process.
+	GetMMappedFiles(ctx context.Context, pid int) ([]*SharedMemInfo, error)
+	// GetSHMSegments returns the System V shared memory segments.
+	GetSHMSegments(ctx context.Context) ([]*SHMSegment, error)
+}
+
+// StorageInfo is implemented by the devices that can query and configure
+// the filesystems and block devices of the remote machine.
+type StorageInfo interface {
+	// GetDiskUsage returns the size and usage of the filesystem containing
+	// a path.
+	GetDiskUsage(ctx context.Context, path string) (*DiskUsage, error)
+	// GetPathSize returns the size of a file or directory tree.
+	GetPathSize(ctx context.Context, path string) (int64, error)
+	// GetFileSystemType returns the type of the filesystem containing path.
+	GetFileSystemType(ctx context.Context, path string) (string, error)
+	// GetIOScheduler returns the current I/O scheduler of a block device.
+	GetIOScheduler(ctx context.Context, device string) (string, error)
+	// SetIOScheduler changes the I/O scheduler of a block device.
+	SetIOScheduler(ctx context.Context, device, scheduler string) error
+	// CreateLVMSnapshot creates a snapshot of an LVM logical volume.
+	CreateLVMSnapshot(ctx context.Context, vgName, lvName, snapshotName string, sizeGB int) (*LVMSnapshot, error)
+	// MountSnapshot mounts an LVM snapshot read-only.
+	MountSnapshot(ctx context.Context, snap *LVMSnapshot, mountPoint, fsType string) (func(context.Context), error)
+}
+
+// NetworkInfo is implemented by the devices that can query and configure
+// the network adapters of the remote machine.
+type NetworkInfo interface {
+	// GetNetworkInterfaces returns the network interfaces and their
+	// addresses.
+	GetNetworkInterfaces(ctx context.Context) ([]RemoteInterface, error)
+	// GetRDMADevices returns the RDMA network adapters of the remote machine.
+	GetRDMADevices(ctx context.Context) ([]*RDMADevice, error)
+	// GetNetworkQoS returns the traffic control configuration of a network
+	// interface.
+	GetNetworkQoS(ctx context.Context, iface string) (*QoSConfig, error)
+	// SetNetworkRateLimit limits the egress rate of a network interface.
+	SetNetworkRateLimit(ctx context.Context, iface string, bitsPerSecond int64) error
+}
+
+// ContainerInfo is implemented by the devices that can query the Docker
+// containers of the remote machine.
+type ContainerInfo interface {
+	// GetContainerCapabilities returns the Linux capabilities of the given
+	// Docker container.
+	GetContainerCapabilities(ctx context.Context, containerID string) (*CapabilitySet, error)
+	// HasCapability returns true if the given Docker container has the
+	// given capability.
+	HasCapability(ctx context.Context, containerID, capability string) (bool, error)
+	// GetContainerMemoryStats returns the memory usage of a Docker container.
+	GetContainerMemoryStats(ctx context.Context, containerID string) (*ContainerMemStats, error)
+	// MonitorContainerMemory sends an alert when the memory usage of a
+	// Docker container rises above a threshold.
+	MonitorContainerMemory(ctx context.Context, containerID string, threshold float64) (<-chan MemAlert, error)
 }
 
 // binding represents an attached SSH client.
@@ -56,16 +373,45 @@ type binding struct {
 	connection    *ssh.Client
 	configuration *Configuration
 	env           *shell.Env
+	// sftpClient is nil if the server does not support SFTP.
+	sftpClient *sftp.Client
+	// sessions limits the number of sessions open at once.
+	sessions *sessionPool
+	// forwardAgent is true if the SSH agent is forwarded to the commands
+	// run on the remote machine.
+	forwardAgent bool
+	// alive is cancelled when the binding is closed, or the connection is
+	// lost.
+	alive  context.Context
+	cancel context.CancelFunc
+	// tunnels are the local ports forwarded with SetupLocalPort.
+	tunnels *tunnelSet
+	// info remembers the properties of the remote machine that do not
+	// change, such as its OS version.
+	info *infoCache
+	// limiter limits the rate of the uploads, if set.
+	limiter *rateLimiter
 	// We duplicate OS here because we need to use it
 	// before we get the rest of the information
 	os device.OSKind
 }
 
-var _ Device = &binding{}
+var (
+	_ Device        = &binding{}
+	_ SystemInfo    = &binding{}
+	_ HardwareInfo  = &binding{}
+	_ PCIInfo       = &binding{}
+	_ GPUInfo       = &binding{}
+	_ MediaInfo     = &binding{}
+	_ ProcessInfo   = &binding{}
+	_ StorageInfo   = &binding{}
+	_ NetworkInfo   = &binding{}
+	_ ContainerInfo = &binding{}
+)
 
 // Devices returns the list of reachable SSH devices.
 func Devices(ctx context.Context, configuration io.Reader) ([]bind.Device, error) {
-	configurations, err := ReadConfigurations(configuration)
+	configurations, err := ReadConfigurationsContext(ctx, configuration)
 	if err != nil {
 		return nil, err
 	}
@@ -81,33 +427,101 @@ func Devices(ctx context.Context, configuration io.Reader) ([]bind.Device, error
 	return devices, nil
 }
 
-// getSSHAgent returns a connection to a local SSH agent, if one exists.
-func getSSHAgent() ssh.AuthMethod {
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+// getSSHAgent returns a connection to the local SSH agent listening on
+// socket, or on SSH_AUTH_SOCK if socket is empty. It returns nil if there is
+// no agent.
+func getSSHAgent(socket string) agent.ExtendedAgent {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if sshAgent, err := net.Dial("unix", socket); err == nil {
+		return agent.NewClient(sshAgent)
 	}
 	return nil
 }
 
+// forwardSSHAgent serves requests for the SSH agent from the remote machine
+// with the agent listening on socket. It returns false if socket is empty or
+// no agent is listening on it.
+func forwardSSHAgent(ctx context.Context, connection *ssh.Client, socket string) (bool, error) {
+	if socket == "" {
+		return false, nil
+	}
+	sshAgent := getSSHAgent(socket)
+	if sshAgent == nil {
+		return false, nil
+	}
+	if err := agent.ForwardToAgent(connection, sshAgent); err != nil {
+		return false, log.Errf(ctx, err, "Could not forward the SSH agent")
+	}
+	return true, nil
+}
+
 // This returns an SSH auth for the given private key.
 // It will fail if the private key was encrypted.
 func getPrivateKeyAuth(path string) (ssh.AuthMethod, error) {
+	signer, err := getPrivateKeySigner(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+func getPrivateKeySigner(path string) (ssh.Signer, error) {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return ssh.ParsePrivateKey(bytes)
+}
 
-	signer, err := ssh.ParsePrivateKey(bytes)
+// getCertificateAuth returns an SSH auth for the certificate at certPath,
+// which certifies the private key at keyPath. It fails if the certificate
+// is not valid at the given time, rather than letting the server reject it.
+func getCertificateAuth(certPath, keyPath string, now time.Time) (ssh.AuthMethod, error) {
+	bytes, err := ioutil.ReadFile(certPath)
 	if err != nil {
 		return nil, err
 	}
-	return ssh.PublicKeys(signer), nil
+	key, _, _, _, err := ssh.ParseAuthorizedKey(bytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", certPath)
+	}
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return nil, ErrCertificateNotYetValid
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return nil, ErrCertificateExpired
+	}
+	signer, err := getPrivateKeySigner(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(certSigner), nil
 }
 
-// GetConnectedDevice returns a device that matches the given configuration.
-func GetConnectedDevice(ctx context.Context, c Configuration) (Device, error) {
+// sshClientConfig returns the client configuration used to authenticate
+// with the host described by c.
+func sshClientConfig(ctx context.Context, c Configuration) (*ssh.ClientConfig, error) {
 	auths := []ssh.AuthMethod{}
 
+	if c.CertFile != "" {
+		auth, err := getCertificateAuth(c.CertFile, c.Keyfile, time.Now())
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not use the certificate %s", c.CertFile)
+		}
+		auths = append(auths, auth)
+	}
+
 	if c.Keyfile != "" {
 		// This returns an SSH auth for the given private key.
 		// It will fail if the private key was encrypted.
@@ -116,39 +530,317 @@ func GetConnectedDevice(ctx context.Context, c Configuration) (Device, error) {
 		}
 	}
 
-	if agent := getSSHAgent(); agent != nil {
-		auths = append(auths, agent)
+	if sshAgent := getSSHAgent(c.AgentSocket); sshAgent != nil {
+		auths = append(auths, ssh.PublicKeysCallback(sshAgent.Signers))
+	} else if c.AgentSocket != "" {
+		log.W(ctx, "Could not connect to the SSH agent at %s", c.AgentSocket)
 	}
 
 	if len(auths) == 0 {
 		return nil, log.Errf(ctx, nil, "No valid authentication method for SSH connection %s", c.Name)
 	}
 
-	hosts, err := knownhosts.New(c.KnownHosts)
+	hosts, err := hostKeyCallback(ctx, c.KnownHosts)
 	if err != nil {
 		return nil, log.Errf(ctx, err, "Could not read known hosts")
 	}
 
-	sshConfig := &ssh.ClientConfig{
+	return &ssh.ClientConfig{
 		User:            c.User,
 		Auth:            auths,
 		HostKeyCallback: hosts,
+	}, nil
+}
+
+// dialSSH connects to the host described by c. If c has proxy hosts, each
+// one is connected to in turn through the previous one, as ssh -J does, and
+// the host is connected to through the last one.
+func dialSSH(ctx context.Context, c Configuration) (*ssh.Client, error) {
+	hops := append(append([]Configuration{}, c.ProxyHosts...), c)
+	var client *ssh.Client
+	for _, hop := range hops {
+		sshConfig, err := sshClientConfig(ctx, hop)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, err
+		}
+		addr := fmt.Sprintf("%s:%d", hop.Host, hop.Port)
+		if client == nil {
+			client, err = ssh.Dial("tcp", addr, sshConfig)
+			if err != nil {
+				return nil, log.Errf(ctx, err, "Dial tcp: %s:%d with sshConfig: %v failed", hop.Host, hop.Port, sshConfig)
+			}
+			continue
+		}
+		proxy := client
+		conn, err := proxy.Dial("tcp", addr)
+		if err != nil {
+			proxy.Close()
+			return nil, log.Errf(ctx, err, "Dial tcp: %s:%d through %s failed", hop.Host, hop.Port, proxy.RemoteAddr())
+		}
+		clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+		if err != nil {
+			conn.Close()
+			proxy.Close()
+			return nil, log.Errf(ctx, err, "SSH handshake with %s:%d through %s failed", hop.Host, hop.Port, proxy.RemoteAddr())
+		}
+		next := ssh.NewClient(clientConn, chans, reqs)
+		// The proxy connection is only needed for as long as the
+		// connection it carries.
+		crash.Go(func() {
+			next.Wait()
+			proxy.Close()
+		})
+		client = next
 	}
+	return client, nil
+}
+
+const (
+	// ErrCertificateExpired is returned when connecting with a certificate
+	// whose validity period has ended.
+	ErrCertificateExpired = fault.Const("SSH certificate has expired")
+	// ErrCertificateNotYetValid is returned when connecting with a
+	// certificate whose validity period has not started.
+	ErrCertificateNotYetValid = fault.Const("SSH certificate is not yet valid")
+
+	keepAliveRequest          = "keepalive@openssh.com"
+	defaultKeepAliveMaxMissed = 3
+
+	// pingTimeout is how long Ping waits for the remote machine to answer.
+	pingTimeout = 5 * time.Second
+)
 
-	connection, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port), sshConfig)
+// keepAlive sends a keepalive request to the server every interval, until
+// ctx is done. It returns an error if maxMissed consecutive requests go
+// unanswered within the interval, or the connection fails.
+func keepAlive(ctx context.Context, client *ssh.Client, interval time.Duration, maxMissed int) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		crash.Go(func() {
+			// Any reply, even a failure, shows the server is alive.
+			_, _, err := client.SendRequest(keepAliveRequest, true, nil)
+			reply <- err
+		})
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-reply:
+			if err != nil {
+				return err
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= maxMissed {
+				return fmt.Errorf("%d keepalive requests were not answered", missed)
+			}
+		}
+	}
+}
+
+// monitorConnection cancels the binding's alive context once the connection
+// is lost. If keepalives are enabled, a connection that stops responding is
+// closed.
+func (b binding) monitorConnection(ctx context.Context) {
+	crash.Go(func() {
+		b.connection.Wait()
+		b.cancel()
+	})
+	c := b.configuration
+	if c.KeepAliveInterval <= 0 {
+		return
+	}
+	maxMissed := c.KeepAliveMaxMissed
+	if maxMissed <= 0 {
+		maxMissed = defaultKeepAliveMaxMissed
+	}
+	crash.Go(func() {
+		if err := keepAlive(b.alive, b.connection, c.KeepAliveInterval, maxMissed); err != nil {
+			log.W(ctx, "Connection to %s is dead: %v", c.Name, err)
+			b.cancel()
+			b.connection.Close()
+		}
+	})
+}
+
+// Done returns a channel that is closed when the binding is closed or its
+// connection is lost.
+func (b binding) Done() <-chan struct{} {
+	return b.alive.Done()
+}
+
+// Ping checks that the remote machine still runs commands, by opening a
+// session that runs one that does nothing. ErrConnectionLost is returned at
+// once if the connection is known to be lost. Ping fails if the machine does
+// not answer within pingTimeout.
+// So that no session is opened on a dead connection, a keepalive request is
+// sent first, which is only answered if the connection is still readable.
+// A zero-byte read with a deadline cannot check this: ssh.Client does not
+// expose its net.Conn, which its own goroutine reads, and such a read
+// returns at once without reaching the connection.
+func (b binding) Ping(ctx context.Context) error {
+	if b.alive != nil && b.alive.Err() != nil {
+		return ErrConnectionLost
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	cmd := b.Shell("true")
+	if b.os == device.Windows {
+		cmd = b.Shell("exit", "0")
+	}
+	done := make(chan error, 1)
+	crash.Go(func() {
+		if _, _, err := b.connection.SendRequest(keepAliveRequest, true, nil); err != nil {
+			done <- ErrConnectionLost
+			return
+		}
+		done <- cmd.Run(ctx)
+	})
+	select {
+	case err := <-done:
+		if err != nil && err != ErrConnectionLost {
+			return log.Errf(ctx, err, "Could not ping %s", b.configuration.Name)
+		}
+		return err
+	case <-ctx.Done():
+		return log.Errf(ctx, ctx.Err(), "Could not ping %s", b.configuration.Name)
+	}
+}
+
+// IsAlive returns true if the remote machine answers a Ping.
+func (b binding) IsAlive(ctx context.Context) bool {
+	return b.Ping(ctx) == nil
+}
+
+// Close closes the connection to the remote machine.
+func (b binding) Close() error {
+	b.cancel()
+	if b.sessions != nil {
+		b.sessions.close()
+	}
+	if b.sftpClient != nil {
+		b.sftpClient.Close()
+	}
+	return b.connection.Close()
+}
+
+// connect connects to the machine of the binding's configuration, following
+// its retry policy, and opens the SFTP client and session pool on the new
+// connection.
+func (b *binding) connect(ctx context.Context) error {
+	c := *b.configuration
+	var connection *ssh.Client
+	err := retry(ctx, c.RetryPolicy, func() error {
+		var err error
+		connection, err = dialSSH(ctx, c)
+		return err
+	})
 	if err != nil {
-		return nil, log.Errf(ctx, err, "Dial tcp: %s:%d with sshConfig: %v failed", c.Host, c.Port, sshConfig)
+		return err
 	}
+
+	forwardAgent, err := forwardSSHAgent(ctx, connection, c.AgentSocket)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	alive, cancel := context.WithCancel(context.Background())
+	b.connection = connection
+	b.sftpClient = newSFTPClient(ctx, connection)
+	b.sessions = newSessionPool(connection, c.MaxOpenSessions, alive.Done())
+	b.forwardAgent = forwardAgent
+	b.alive = alive
+	b.cancel = cancel
+	return nil
+}
+
+// Reconnect closes the connection to the remote machine, for example after
+// it was lost, and connects again following the retry policy of the
+// configuration. The local ports forwarded with SetupLocalPort are then
+// forwarded through the new connection. The processes that were running are
+// lost: IsAlive returns false, and Wait ErrConnectionLost. Reconnect must not
+// be called while the binding is in use.
+func (b *binding) Reconnect(ctx context.Context) error {
+	next, err := b.reconnected(ctx)
+	if next != nil {
+		*b = *next
+	}
+	return err
+}
+
+// reconnected closes the binding, and returns a copy of it connected again
+// as Reconnect does, leaving the binding itself unchanged. The copy is nil
+// if it could not connect.
+func (b *binding) reconnected(ctx context.Context) (*binding, error) {
+	prealloc := 0
+	if b.sessions != nil {
+		b.sessions.mutex.Lock()
+		prealloc = b.sessions.prealloc
+		b.sessions.mutex.Unlock()
+	}
+	b.Close()
+	next := *b
+	if err := next.connect(ctx); err != nil {
+		return nil, log.Errf(ctx, err, "Could not reconnect to %s", b.configuration.Name)
+	}
+	next.monitorConnection(ctx)
+	if prealloc > 0 {
+		next.SetSessionPrealloc(prealloc)
+	}
+	if err := next.tunnels.reopen(next.serveTunnel); err != nil {
+		return &next, log.Errf(ctx, err, "Could not reopen the forwarded ports")
+	}
+	return &next, nil
+}
+
+// retry calls fn until it succeeds, following the retry policy. Each failure
+// is logged as a warning. It stops early if ctx is cancelled, returning the
+// error of the last attempt.
+func retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts {
+			return err
+		}
+		delay := policy.delay(attempt, rnd)
+		log.W(ctx, "Attempt %d of %d failed, retrying in %v: %v", attempt, policy.MaxAttempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// NewBinding returns a binding for config, changed by opts in order. It is
+// not connected to the remote machine.
+func NewBinding(config Configuration, opts ...Option) (*binding, error) {
 	env := shell.NewEnv()
 
-	for _, e := range c.Env {
+	for _, e := range config.Env {
 		env.Add(e)
 	}
 
 	b := &binding{
-		connection:    connection,
-		configuration: &c,
+		configuration: &config,
 		env:           env,
+		tunnels:       &tunnelSet{},
+		info:          &infoCache{},
 		Simple: bind.Simple{
 			To: &device.Instance{
 				Serial:        "",
@@ -157,6 +849,37 @@ func GetConnectedDevice(ctx context.Context, c Configuration) (Device, error) {
 			LastStatus: bind.Status_Online,
 		},
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if err := b.configuration.check(); err != nil {
+		return nil, err
+	}
+	if b.limiter != nil && b.limiter.rate <= 0 {
+		return nil, fmt.Errorf("Invalid rate limit %d", b.limiter.rate)
+	}
+	return b, nil
+}
+
+// GetConnectedDevice returns a device that matches the given configuration,
+// changed by opts.
+func GetConnectedDevice(ctx context.Context, c Configuration, opts ...Option) (Device, error) {
+	b, err := NewBinding(c, opts...)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Invalid configuration for %s", c.Name)
+	}
+	if b.configuration.Compression {
+		log.W(ctx, "SSH compression is not supported, so %s is connected without it", c.Name)
+	}
+	if err := b.connect(ctx); err != nil {
+		return nil, err
+	}
+	connected := false
+	defer func() {
+		if !connected {
+			b.Close()
+		}
+	}()
 
 	kind := device.UnknownOS
 
@@ -170,8 +893,11 @@ func GetConnectedDevice(ctx context.Context, c Configuration) (Device, error) {
 	}
 
 	if kind == device.UnknownOS {
-		// Try to get the OS string for Windows
-		if osName, err := b.Shell("ver").Call(ctx); err == nil {
+		// Try to get the OS string for Windows, whose shell does not take
+		// the quoted commands of POSIX machines.
+		windows := *b
+		windows.os = device.Windows
+		if osName, err := windows.Shell("ver").Call(ctx); err == nil {
 			if strings.Contains(osName, "Windows") {
 				kind = device.Windows
 			}
@@ -226,6 +952,11 @@ func GetConnectedDevice(ctx context.Context, c Configuration) (Device, error) {
 	}
 
 	b.To = &device
+	b.monitorConnection(ctx)
+	// The device is connected to in order to trace on it, which needs
+	// memory.
+	b.WarnIfLowMemory(ctx)
 
+	connected = true
 	return b, nil
 }
@@ -0,0 +1,978 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// TestMain hides the SSH agent of the user running the tests, so that the
+// test hosts only see the keys the tests give them.
+func TestMain(m *testing.M) {
+	sock, set := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", "")
+	code := m.Run()
+	if set {
+		os.Setenv("SSH_AUTH_SOCK", sock)
+	} else {
+		os.Unsetenv("SSH_AUTH_SOCK")
+	}
+	os.Exit(code)
+}
+
+// testSSHServer is an SSH server that accepts a single user key, and
+// forwards direct-tcpip channels so that it can be used as a proxy.
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	// dropKeepAlives stops the server replying to keepalive requests.
+	dropKeepAlives bool
+
+	mutex    sync.Mutex
+	users    []string
+	forwards []string
+	conns    []*ssh.ServerConn
+	// reverse are the listeners of the tcpip-forward requests, by port.
+	reverse map[uint32]net.Listener
+	// sessions is the number of open sessions, maxSessions the most that
+	// were open at once, and totalSessions the number ever opened.
+	sessions      int
+	maxSessions   int
+	totalSessions int
+	// rejectSessions is the number of the next sessions to reject, as
+	// servers do when they run out of channels.
+	rejectSessions int
+}
+
+func newTestSigner(t *testing.T) (ssh.Signer, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+// acceptKey returns a public key callback that only accepts userKey.
+func acceptKey(userKey ssh.PublicKey) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !bytes.Equal(key.Marshal(), userKey.Marshal()) {
+			return nil, fmt.Errorf("unknown key for %s", c.User())
+		}
+		return nil, nil
+	}
+}
+
+func newTestSSHServer(t *testing.T, userKey ssh.PublicKey) *testSSHServer {
+	return newTestSSHServerAuth(t, acceptKey(userKey))
+}
+
+// newTestSSHServerAuth starts a test server that authenticates the users
+// with auth.
+func newTestSSHServerAuth(t *testing.T, auth func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) *testSSHServer {
+	hostSigner, _ := newTestSigner(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{
+		listener: listener,
+		hostKey:  hostSigner.PublicKey(),
+		reverse:  map[uint32]net.Listener{},
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := auth(c, key)
+			if err != nil {
+				return nil, err
+			}
+			s.mutex.Lock()
+			s.users = append(s.users, c.User())
+			s.mutex.Unlock()
+			return perms, nil
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+	go s.serve()
+	return s
+}
+
+func (s *testSSHServer) port() uint16 {
+	return uint16(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns = append(s.conns, sconn)
+			s.mutex.Unlock()
+			go func() {
+				for req := range reqs {
+					if req.Type == keepAliveRequest && s.dropKeepAlives {
+						continue
+					}
+					switch req.Type {
+					case "tcpip-forward":
+						s.tcpipForward(sconn, req)
+						continue
+					case "cancel-tcpip-forward":
+						s.cancelTCPIPForward(req)
+						continue
+					}
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+				}
+			}()
+			for newChannel := range chans {
+				switch newChannel.ChannelType() {
+				case "direct-tcpip":
+					go s.forward(newChannel)
+				case "session":
+					s.mutex.Lock()
+					reject := s.rejectSessions > 0
+					if reject {
+						s.rejectSessions--
+					}
+					s.mutex.Unlock()
+					if reject {
+						newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+						continue
+					}
+					go s.session(newChannel)
+				default:
+					newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+				}
+			}
+		}()
+	}
+}
+
+func (s *testSSHServer) forward(newChannel ssh.NewChannel) {
+	target := struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+	s.mutex.Lock()
+	s.forwards = append(s.forwards, addr)
+	s.mutex.Unlock()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	io.Copy(conn, channel)
+	conn.Close()
+}
+
+// session serves a session channel, executing commands with the local sh.
+func (s *testSSHServer) session(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	s.sessions++
+	s.totalSessions++
+	if s.sessions > s.maxSessions {
+		s.maxSessions = s.sessions
+	}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.sessions--
+		s.mutex.Unlock()
+		channel.Close()
+	}()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		command := struct{ Command string }{}
+		ssh.Unmarshal(req.Payload, &command)
+		cmd := exec.Command("sh", "-c", command.Command)
+		cmd.Stdout, cmd.Stderr = channel, channel.Stderr()
+		// Signals are sent to the whole command, not just sh.
+		newProcessGroup(cmd)
+		// Like sshd, do not wait for the client to close stdin once the
+		// command has exited.
+		stdin, err := cmd.StdinPipe()
+		if err != nil || cmd.Start() != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		go func() {
+			io.Copy(stdin, channel)
+			stdin.Close()
+		}()
+		go func() {
+			for req := range reqs {
+				signal := struct{ Signal string }{}
+				if req.Type == "signal" && ssh.Unmarshal(req.Payload, &signal) == nil {
+					signalProcessGroup(cmd, ssh.Signal(signal.Signal))
+				}
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}()
+		status := uint32(0)
+		if err := cmd.Wait(); err != nil {
+			status = 255
+			if exit, ok := err.(*exec.ExitError); ok {
+				status = uint32(exit.ExitCode())
+			}
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// tcpipForwardAddr is the payload of the tcpip-forward and
+// cancel-tcpip-forward requests.
+type tcpipForwardAddr struct {
+	Host string
+	Port uint32
+}
+
+// tcpipForward listens on the requested port, and forwards the connections
+// to it back to the client.
+func (s *testSSHServer) tcpipForward(sconn *ssh.ServerConn, req *ssh.Request) {
+	addr := tcpipForwardAddr{}
+	if err := ssh.Unmarshal(req.Payload, &addr); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", addr.Port))
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	s.mutex.Lock()
+	s.reverse[addr.Port] = listener
+	s.mutex.Unlock()
+	req.Reply(true, nil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			origin := conn.RemoteAddr().(*net.TCPAddr)
+			payload := ssh.Marshal(struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}{addr.Host, addr.Port, origin.IP.String(), uint32(origin.Port)})
+			channel, reqs, err := sconn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(channel, conn)
+				channel.CloseWrite()
+			}()
+			go func() {
+				io.Copy(conn, channel)
+				conn.Close()
+			}()
+		}
+	}()
+}
+
+func (s *testSSHServer) cancelTCPIPForward(req *ssh.Request) {
+	addr := tcpipForwardAddr{}
+	if err := ssh.Unmarshal(req.Payload, &addr); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	s.mutex.Lock()
+	listener, ok := s.reverse[addr.Port]
+	delete(s.reverse, addr.Port)
+	s.mutex.Unlock()
+	if ok {
+		listener.Close()
+	}
+	req.Reply(ok, nil)
+}
+
+// newTestHost starts a test SSH server, and returns the configuration
+// needed to connect to it, with its key and known_hosts files in dir.
+func newTestHost(t *testing.T, dir, name string) (Configuration, *testSSHServer) {
+	signer, keyPEM := newTestSigner(t)
+	return newTestHostAuth(t, dir, name, keyPEM, acceptKey(signer.PublicKey()))
+}
+
+// newTestHostAuth is like newTestHost, with the user key keyPEM and a server
+// that authenticates the users with auth.
+func newTestHostAuth(t *testing.T, dir, name string, keyPEM []byte,
+	auth func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) (Configuration, *testSSHServer) {
+	server := newTestSSHServerAuth(t, auth)
+	c := Configuration{
+		Name:       name,
+		Host:       "127.0.0.1",
+		Port:       server.port(),
+		User:       "user-" + name,
+		Keyfile:    filepath.Join(dir, name+"_rsa"),
+		KnownHosts: filepath.Join(dir, name+"_known_hosts"),
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", c.Port)
+	known := knownhosts.Line([]string{addr}, server.hostKey) + "\n"
+	if err := ioutil.WriteFile(c.Keyfile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.KnownHosts, []byte(known), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c, server
+}
+
+// fakeCommands writes the given shell scripts to dir/bin, named after the
+// commands they replace, and returns an environment with them first on the
+// PATH. The test server runs the commands locally, so they are found before
+// the real ones.
+func fakeCommands(t *testing.T, dir string, scripts map[string]string) *shell.Env {
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDialSSHProxyChain(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	// Each hop has its own user key and known_hosts file.
+	hops := make([]Configuration, 3)
+	servers := make([]*testSSHServer, 3)
+	for i := range hops {
+		hops[i], servers[i] = newTestHost(t, dir, fmt.Sprintf("hop%d", i))
+		defer servers[i].listener.Close()
+	}
+
+	c := hops[2]
+	c.ProxyHosts = hops[:2]
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	defer client.Close()
+
+	// Each hop must have authenticated its own user, and each proxy must
+	// have forwarded to the next hop.
+	for i, s := range servers {
+		s.mutex.Lock()
+		assert.For(ctx, "hop%d users", i).ThatSlice(s.users).Equals([]string{hops[i].User})
+		if i < 2 {
+			next := fmt.Sprintf("127.0.0.1:%d", hops[i+1].Port)
+			assert.For(ctx, "hop%d forwards", i).ThatSlice(s.forwards).Equals([]string{next})
+		}
+		s.mutex.Unlock()
+	}
+
+	// A proxy that does not trust the key fails the whole chain.
+	c.ProxyHosts = []Configuration{hops[0], hops[0]}
+	c.ProxyHosts[1].Keyfile = hops[1].Keyfile
+	_, err = dialSSH(ctx, c)
+	assert.For(ctx, "bad key").ThatError(err).Failed()
+}
+
+func TestNewBinding(t *testing.T) {
+	ctx := log.Testing(t)
+
+	config := Configuration{
+		Name:              "device",
+		KnownHosts:        "known_hosts",
+		Env:               []string{"A=1"},
+		KeepAliveInterval: time.Minute,
+		TunnelBufferSize:  1024,
+	}
+	policy := RetryPolicy{MaxAttempts: 5, InitialDelay: time.Second}
+	b, err := NewBinding(config,
+		WithRetryPolicy(policy),
+		WithBufferSize(4096),
+		WithKeepalive(10*time.Second, 2),
+		// Later options override earlier ones.
+		WithBufferSize(8192),
+		WithKnownHostsFile("other_hosts"))
+	assert.For(ctx, "NewBinding").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	c := b.configuration
+	assert.For(ctx, "Name").ThatString(c.Name).Equals("device")
+	assert.For(ctx, "RetryPolicy").That(c.RetryPolicy).Equals(policy)
+	assert.For(ctx, "KeepAliveInterval").That(c.KeepAliveInterval).Equals(10 * time.Second)
+	assert.For(ctx, "KeepAliveMaxMissed").ThatInteger(c.KeepAliveMaxMissed).Equals(2)
+	assert.For(ctx, "tunnelBufferSize").ThatInteger(b.tunnelBufferSize()).Equals(8192)
+	assert.For(ctx, "KnownHosts").ThatString(c.KnownHosts).Equals("other_hosts")
+	assert.For(ctx, "env").ThatString(b.env.Get("A")).Equals("1")
+	assert.For(ctx, "given configuration").ThatString(config.KnownHosts).Equals("known_hosts")
+
+	// Without options the configuration is used as it is, with the defaults
+	// for the fields it leaves unset.
+	b, err = NewBinding(Configuration{KeepAliveInterval: time.Minute})
+	assert.For(ctx, "NewBinding without options").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	assert.For(ctx, "default KeepAliveInterval").That(b.configuration.KeepAliveInterval).Equals(time.Minute)
+	assert.For(ctx, "default tunnelBufferSize").ThatInteger(b.tunnelBufferSize()).Equals(defaultTunnelBufferSize)
+
+	_, err = NewBinding(config, WithBufferSize(-1))
+	assert.For(ctx, "invalid buffer size").ThatError(err).Failed()
+	_, err = NewBinding(config, WithKeepalive(-time.Second, 0))
+	assert.For(ctx, "invalid keepalive").ThatError(err).Failed()
+	_, err = NewBinding(config, WithRetryPolicy(RetryPolicy{MaxAttempts: -1}))
+	assert.For(ctx, "invalid retry policy").ThatError(err).Failed()
+	_, err = NewBinding(Configuration{Compression: true, CompressionLevel: 10})
+	assert.For(ctx, "invalid compression level").ThatError(err).Failed()
+
+	b, err = NewBinding(config, WithRateLimit(1000))
+	assert.For(ctx, "rate limit").ThatError(err).Succeeded()
+	if err == nil {
+		assert.For(ctx, "limiter").That(b.limiter.rate).Equals(int64(1000))
+	}
+	_, err = NewBinding(config, WithRateLimit(0))
+	assert.For(ctx, "invalid rate limit").ThatError(err).Failed()
+}
+
+func TestGetConnectedDeviceClosesOnError(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	// The test server runs commands locally, so a fake uname that reports
+	// an unknown system is put first on the PATH.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	err = ioutil.WriteFile(filepath.Join(bin, "uname"), []byte("#!/bin/sh\necho Plan9\n"), 0700)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	c.Env = []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+	_, err = GetConnectedDevice(ctx, c)
+	assert.For(ctx, "GetConnectedDevice").ThatError(err).Failed()
+
+	server.mutex.Lock()
+	conns := append([]*ssh.ServerConn{}, server.conns...)
+	server.mutex.Unlock()
+	assert.For(ctx, "conns").ThatSlice(conns).IsLength(1)
+	for _, conn := range conns {
+		closed := make(chan struct{})
+		go func() {
+			conn.Wait()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The connection was not closed")
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	ctx := log.Testing(t)
+
+	p := RetryPolicy{MaxAttempts: 10, InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	rnd := mrand.New(mrand.NewSource(1))
+	for _, test := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{9, time.Second},
+	} {
+		d := p.delay(test.attempt, rnd)
+		assert.For(ctx, "attempt %d min", test.attempt).That(d >= test.max/2).Equals(true)
+		assert.For(ctx, "attempt %d max", test.attempt).That(d <= test.max).Equals(true)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := log.Testing(t)
+
+	policy := RetryPolicy{MaxAttempts: 4, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	failure := errors.New("connection refused")
+
+	calls := 0
+	err := retry(ctx, policy, func() error {
+		calls++
+		if calls < 3 {
+			return failure
+		}
+		return nil
+	})
+	assert.For(ctx, "eventual success").ThatError(err).Succeeded()
+	assert.For(ctx, "eventual success calls").ThatInteger(calls).Equals(3)
+
+	calls = 0
+	err = retry(ctx, policy, func() error { calls++; return failure })
+	assert.For(ctx, "exhausted").ThatError(err).Equals(failure)
+	assert.For(ctx, "exhausted calls").ThatInteger(calls).Equals(4)
+
+	calls = 0
+	err = retry(ctx, RetryPolicy{}, func() error { calls++; return failure })
+	assert.For(ctx, "no policy").ThatError(err).Equals(failure)
+	assert.For(ctx, "no policy calls").ThatInteger(calls).Equals(1)
+
+	// Cancelling the context aborts the wait between attempts.
+	cancelled, cancel := context.WithCancel(ctx)
+	policy = RetryPolicy{MaxAttempts: 3, InitialDelay: time.Hour}
+	calls = 0
+	start := time.Now()
+	err = retry(cancelled, policy, func() error {
+		calls++
+		cancel()
+		return failure
+	})
+	assert.For(ctx, "cancelled").ThatError(err).Equals(failure)
+	assert.For(ctx, "cancelled calls").ThatInteger(calls).Equals(1)
+	assert.For(ctx, "cancelled promptly").That(time.Since(start) < time.Minute).Equals(true)
+}
+
+func TestKeepAlive(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	const interval = 20 * time.Millisecond
+	for _, drop := range []bool{false, true} {
+		c, server := newTestHost(t, dir, "host")
+		defer server.listener.Close()
+		server.dropKeepAlives = drop
+
+		client, err := dialSSH(ctx, c)
+		assert.For(ctx, "drop=%v dial", drop).ThatError(err).Succeeded()
+		defer client.Close()
+
+		alive, cancel := context.WithTimeout(ctx, 10*interval)
+		err = keepAlive(alive, client, interval, 3)
+		cancel()
+		if drop {
+			assert.For(ctx, "drop=%v", drop).ThatError(err).Failed()
+		} else {
+			assert.For(ctx, "drop=%v", drop).ThatError(err).Succeeded()
+		}
+	}
+}
+
+func TestMonitorConnection(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	server.dropKeepAlives = true
+	c.KeepAliveInterval = 20 * time.Millisecond
+
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dial").ThatError(err).Succeeded()
+	alive, cancel := context.WithCancel(context.Background())
+	b := binding{connection: client, configuration: &c, alive: alive, cancel: cancel}
+	b.monitorConnection(ctx)
+
+	// The dead connection is detected and the binding's context cancelled.
+	select {
+	case <-b.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Dead connection was not detected")
+	}
+	_, _, err = client.SendRequest(keepAliveRequest, true, nil)
+	assert.For(ctx, "closed").ThatError(err).Failed()
+}
+
+func TestReconnect(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	b := &binding{configuration: &c, env: shell.NewEnv(), tunnels: &tunnelSet{}, os: device.Linux}
+	err = b.connect(ctx)
+	assert.For(ctx, "connect").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	b.monitorConnection(ctx)
+	defer func() { b.Close() }()
+
+	// The tunnel logs the close of the connection as an error, which would
+	// fail the test.
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service := newEchoService(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+	port, err := b.SetupLocalPortNetwork(tunnelCtx, "tcp4", service.Addr().(*net.TCPAddr).Port)
+	assert.For(ctx, "SetupLocalPort").ThatError(err).Succeeded()
+
+	// Like Shell, the processes are started on a copy of the binding.
+	started := *b
+	p, err := sshShellTarget{&started}.Start(shell.Command("sleep", "5"))
+	assert.For(ctx, "Start").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	process := p.(RemoteProcess)
+	assert.For(ctx, "alive before").That(process.IsAlive()).Equals(true)
+
+	assert.For(ctx, "Reconnect").ThatError(b.Reconnect(ctx)).Succeeded()
+	assert.For(ctx, "alive after").That(process.IsAlive()).Equals(false)
+	assert.For(ctx, "Wait").ThatError(process.Wait(ctx)).Equals(ErrConnectionLost)
+	server.mutex.Lock()
+	assert.For(ctx, "connections").That(len(server.conns)).Equals(2)
+	server.mutex.Unlock()
+
+	out, err := b.Shell("echo", "hello").Call(ctx)
+	assert.For(ctx, "Call").ThatError(err).Succeeded()
+	assert.For(ctx, "output").ThatString(out).Equals("hello")
+
+	// The local port is still forwarded.
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.For(ctx, "Dial").ThatError(err).Succeeded()
+	if err == nil {
+		testEcho(ctx, "tunnel", conn, "hello again")
+		conn.Close()
+	}
+
+	// Processes that exit normally are not reported as lost.
+	started = *b
+	p, err = sshShellTarget{&started}.Start(shell.Command("exit", "3"))
+	assert.For(ctx, "Start exit").ThatError(err).Succeeded()
+	if err == nil {
+		err = p.Wait(ctx)
+		assert.For(ctx, "exit status").ThatError(err).Failed()
+		assert.For(ctx, "not lost").That(err == ErrConnectionLost).Equals(false)
+		assert.For(ctx, "exited").That(p.(RemoteProcess).IsAlive()).Equals(false)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	alive, cancel := context.WithCancel(context.Background())
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), alive: alive, cancel: cancel, os: device.Linux}
+
+	assert.For(ctx, "Ping").ThatError(b.Ping(ctx)).Succeeded()
+	assert.For(ctx, "IsAlive").That(b.IsAlive(ctx)).Equals(true)
+
+	// A connection that answers is not enough, the command must run.
+	server.mutex.Lock()
+	server.rejectSessions = 1
+	server.mutex.Unlock()
+	assert.For(ctx, "sessions refused").ThatError(b.Ping(ctx)).Failed()
+	assert.For(ctx, "sessions accepted again").ThatError(b.Ping(ctx)).Succeeded()
+
+	// A server that does not answer fails the ping once ctx is done.
+	silentConfig, silent := newTestHost(t, dir, "silent")
+	defer silent.listener.Close()
+	silent.dropKeepAlives = true
+	silentClient, err := dialSSH(ctx, silentConfig)
+	assert.For(ctx, "dialSSH silent").ThatError(err).Succeeded()
+	if err == nil {
+		defer silentClient.Close()
+		s := binding{connection: silentClient, configuration: &silentConfig, env: shell.NewEnv(), os: device.Linux}
+		timeout, cancelTimeout := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancelTimeout()
+		assert.For(ctx, "unanswered").ThatError(s.Ping(timeout)).Failed()
+	}
+
+	// A closed connection is reported without running the command.
+	client.Close()
+	b.alive = context.Background()
+	assert.For(ctx, "closed").ThatError(b.Ping(ctx)).Equals(ErrConnectionLost)
+	b.alive = alive
+	cancel()
+	assert.For(ctx, "lost").ThatError(b.Ping(ctx)).Equals(ErrConnectionLost)
+	assert.For(ctx, "IsAlive lost").That(b.IsAlive(ctx)).Equals(false)
+}
+
+func TestAgentSocket(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	// Serve an agent holding the only key the server accepts.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.For(ctx, "GenerateKey").ThatError(err).Succeeded()
+	keyring := agent.NewKeyring()
+	assert.For(ctx, "Add").ThatError(keyring.Add(agent.AddedKey{PrivateKey: key})).Succeeded()
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.For(ctx, "Listen").ThatError(err).Succeeded()
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	// Only the configuration is used, the server must accept the agent's key.
+	c, unused := newTestHost(t, dir, "host")
+	unused.listener.Close()
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.For(ctx, "NewSignerFromKey").ThatError(err).Succeeded()
+	server := newTestSSHServer(t, signer.PublicKey())
+	defer server.listener.Close()
+	c.Port = server.port()
+	known := knownhosts.Line([]string{fmt.Sprintf("127.0.0.1:%d", c.Port)}, server.hostKey) + "\n"
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(c.KnownHosts, []byte(known), 0600)).Succeeded()
+	c.Keyfile = ""
+	c.AgentSocket = socket
+
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dial").ThatError(err).Succeeded()
+	defer client.Close()
+
+	forwarded, err := forwardSSHAgent(ctx, client, socket)
+	assert.For(ctx, "forward err").ThatError(err).Succeeded()
+	assert.For(ctx, "forwarded").That(forwarded).Equals(true)
+
+	// The remote end can use the forwarded agent.
+	server.mutex.Lock()
+	sconn := server.conns[0]
+	server.mutex.Unlock()
+	channel, reqs, err := sconn.OpenChannel("auth-agent@openssh.com", nil)
+	assert.For(ctx, "OpenChannel").ThatError(err).Succeeded()
+	go ssh.DiscardRequests(reqs)
+	keys, err := agent.NewClient(channel).List()
+	assert.For(ctx, "List").ThatError(err).Succeeded()
+	assert.For(ctx, "keys").ThatInteger(len(keys)).Equals(1)
+	assert.For(ctx, "key").That(bytes.Equal(keys[0].Marshal(), signer.PublicKey().Marshal())).Equals(true)
+	channel.Close()
+
+	forwarded, err = forwardSSHAgent(ctx, client, "")
+	assert.For(ctx, "no socket err").ThatError(err).Succeeded()
+	assert.For(ctx, "no socket").That(forwarded).Equals(false)
+}
+
+func TestCertificateAuth(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	ca, _ := newTestSigner(t)
+	user, userPEM := newTestSigner(t)
+	// The server only trusts keys certified by the CA.
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	c, server := newTestHostAuth(t, dir, "host", userPEM, checker.Authenticate)
+	defer server.listener.Close()
+
+	now := time.Now()
+	writeCert := func(name string, validAfter, validBefore time.Time) string {
+		cert := &ssh.Certificate{
+			Key:             user.PublicKey(),
+			CertType:        ssh.UserCert,
+			KeyId:           name,
+			ValidPrincipals: []string{c.User},
+			ValidAfter:      uint64(validAfter.Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name+"-cert.pub")
+		if err := ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	c.CertFile = writeCert("valid", now.Add(-time.Hour), now.Add(time.Hour))
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "valid").ThatError(err).Succeeded()
+	if client != nil {
+		client.Close()
+	}
+
+	// Without the certificate the raw key is not accepted.
+	c.CertFile = ""
+	_, err = dialSSH(ctx, c)
+	assert.For(ctx, "no certificate").ThatError(err).Failed()
+
+	for _, test := range []struct {
+		name        string
+		validAfter  time.Time
+		validBefore time.Time
+		err         error
+	}{
+		{"expired", now.Add(-2 * time.Hour), now.Add(-time.Hour), ErrCertificateExpired},
+		{"future", now.Add(time.Hour), now.Add(2 * time.Hour), ErrCertificateNotYetValid},
+	} {
+		cert := writeCert(test.name, test.validAfter, test.validBefore)
+		_, err := getCertificateAuth(cert, c.Keyfile, now)
+		assert.For(ctx, test.name).ThatError(err).Equals(test.err)
+		c.CertFile = cert
+		_, err = dialSSH(ctx, c)
+		assert.For(ctx, "%v dial", test.name).ThatError(err).Failed()
+	}
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	c.KnownHosts = filepath.Join(dir, "new_known_hosts")
+
+	// The first connection adds the key, the second uses it.
+	for _, name := range []string{"first", "second"} {
+		client, err := dialSSH(ctx, c)
+		assert.For(ctx, "%v dial", name).ThatError(err).Succeeded()
+		if client != nil {
+			client.Close()
+		}
+		known, err := ioutil.ReadFile(c.KnownHosts)
+		assert.For(ctx, "ReadFile").ThatError(err).Succeeded()
+		addr := fmt.Sprintf("127.0.0.1:%d", c.Port)
+		assert.For(ctx, "%v known_hosts", name).ThatString(string(known)).Equals(
+			knownhosts.Line([]string{addr}, server.hostKey) + "\n")
+	}
+
+	// A different key for the same host is rejected.
+	other, _ := newTestSigner(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", c.Port)
+	known := knownhosts.Line([]string{addr}, other.PublicKey()) + "\n"
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(c.KnownHosts, []byte(known), 0600)).Succeeded()
+	_, err = dialSSH(ctx, c)
+	assert.For(ctx, "mismatch dial").ThatError(err).Failed()
+
+	callback, err := hostKeyCallback(ctx, c.KnownHosts)
+	assert.For(ctx, "hostKeyCallback").ThatError(err).Succeeded()
+	remote, _ := net.ResolveTCPAddr("tcp", addr)
+	err = callback(addr, remote, server.hostKey)
+	mismatch, ok := err.(*HostKeyMismatchError)
+	assert.For(ctx, "mismatch").That(ok).Equals(true)
+	if ok {
+		assert.For(ctx, "cause").ThatError(mismatch.Cause()).Equals(ErrHostKeyMismatch)
+		assert.For(ctx, "presented").ThatString(mismatch.Presented).Equals(ssh.FingerprintSHA256(server.hostKey))
+		assert.For(ctx, "known").ThatSlice(mismatch.Known).Equals([]string{ssh.FingerprintSHA256(other.PublicKey())})
+	}
+}
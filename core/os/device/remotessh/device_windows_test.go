@@ -0,0 +1,31 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newProcessGroup does nothing, as Windows has no process groups to signal.
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup kills cmd, as Windows processes cannot be signalled.
+func signalProcessGroup(cmd *exec.Cmd, signal ssh.Signal) {
+	if signal == ssh.SIGTERM || signal == ssh.SIGKILL {
+		cmd.Process.Kill()
+	}
+}
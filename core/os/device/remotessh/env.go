@@ -0,0 +1,120 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+// ErrEnvVarNotSet is returned by GetEnvVar when the variable is not set.
+const ErrEnvVarNotSet = fault.Const("Environment variable not set")
+
+// profileMarker ends the lines that SetEnvVar adds to ~/.profile, so that
+// they can be found again.
+const profileMarker = "# set by gapid"
+
+// envVarName matches the names of environment variables that shells accept.
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkEnvVarName(ctx context.Context, name string) error {
+	if !envVarName.MatchString(name) {
+		return log.Errf(ctx, nil, "Invalid environment variable name %q", name)
+	}
+	return nil
+}
+
+// GetEnvVar returns the value of the environment variable name, as seen by
+// the commands run on the remote machine. ErrEnvVarNotSet is returned if it
+// is not set.
+func (b binding) GetEnvVar(ctx context.Context, name string) (string, error) {
+	if err := checkEnvVarName(ctx, name); err != nil {
+		return "", err
+	}
+	cmd := b.Shell("printenv", name)
+	if b.os == device.Windows {
+		cmd = b.powerShell("$v = [Environment]::GetEnvironmentVariable(" + powerShellQuote(name) + "); " +
+			"if ($v -eq $null) { exit 1 }; [Console]::Out.Write($v)")
+	}
+	out, err := callStdout(ctx, cmd)
+	if status, ok := exitStatus(err); ok && status == 1 {
+		return "", ErrEnvVarNotSet
+	}
+	if err != nil {
+		return "", log.Errf(ctx, err, "Could not get %s", name)
+	}
+	return strings.TrimSuffix(out, "\n"), nil
+}
+
+// removeProfileVarScript removes the line that SetEnvVar added to
+// ~/.profile for the variable, keeping the file itself so that its
+// permissions and links are unchanged.
+func removeProfileVarScript(name string) string {
+	pattern := posixQuote("^export " + name + "=.* " + profileMarker + "$")
+	return `f="$HOME/.profile"; touch "$f" && ` +
+		`{ grep -v ` + pattern + ` "$f" > "$f.tmp"; [ $? -le 1 ]; } && ` +
+		`cat "$f.tmp" > "$f" && rm -f "$f.tmp"`
+}
+
+// SetEnvVar sets the environment variable name to value for the commands
+// run by the binding, and persists it in ~/.profile, or the user environment
+// on Windows, for the future sessions. Setting a variable again replaces its
+// value.
+func (b binding) SetEnvVar(ctx context.Context, name, value string) error {
+	if err := checkEnvVarName(ctx, name); err != nil {
+		return err
+	}
+	cmd := b.powerShell("[Environment]::SetEnvironmentVariable(" + powerShellQuote(name) + ", " +
+		powerShellQuote(value) + ", 'User')")
+	if b.os != device.Windows {
+		if strings.ContainsAny(value, "\n\r") {
+			return log.Errf(ctx, nil, "Value of %s holds a line break", name)
+		}
+		line := "export " + name + "=" + posixQuote(value) + " " + profileMarker
+		cmd = b.posixShell(removeProfileVarScript(name) + ` && printf '%s\n' ` + posixQuote(line) + ` >> "$HOME/.profile"`)
+	}
+	if _, err := callStdout(ctx, cmd); err != nil {
+		return log.Errf(ctx, err, "Could not set %s", name)
+	}
+	if b.env != nil {
+		b.env.Set(name, value)
+	}
+	return nil
+}
+
+// UnsetEnv removes the environment variable name that was set by SetEnvVar.
+// Variables set by the remote machine's own configuration are not changed.
+// Unsetting a variable that is not set does nothing.
+func (b binding) UnsetEnv(ctx context.Context, name string) error {
+	if err := checkEnvVarName(ctx, name); err != nil {
+		return err
+	}
+	cmd := b.posixShell(removeProfileVarScript(name))
+	if b.os == device.Windows {
+		cmd = b.powerShell("[Environment]::SetEnvironmentVariable(" + powerShellQuote(name) + ", $null, 'User')")
+	}
+	if _, err := callStdout(ctx, cmd); err != nil {
+		return log.Errf(ctx, err, "Could not unset %s", name)
+	}
+	if b.env != nil {
+		b.env.Unset(name)
+	}
+	return nil
+}
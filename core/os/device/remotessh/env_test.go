@@ -0,0 +1,83 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestEnvVars(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	// The test server runs commands locally, so HOME is moved to the
+	// temporary directory.
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv().Set("HOME", dir), os: device.Linux}
+	profile := filepath.Join(dir, ".profile")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(profile, []byte("umask 022\n"), 0600)).Succeeded()
+
+	_, err = b.GetEnvVar(ctx, "REMOTESSH_TEST_VAR")
+	assert.For(ctx, "unset").ThatError(err).Equals(ErrEnvVarNotSet)
+
+	// Setting a variable again replaces it.
+	for _, value := range []string{"first", "/lib/libgapii.so it's"} {
+		assert.For(ctx, "SetEnvVar %q", value).ThatError(b.SetEnvVar(ctx, "REMOTESSH_TEST_VAR", value)).Succeeded()
+		got, err := b.GetEnvVar(ctx, "REMOTESSH_TEST_VAR")
+		assert.For(ctx, "GetEnvVar %q", value).ThatError(err).Succeeded()
+		assert.For(ctx, "value %q", value).ThatString(got).Equals(value)
+	}
+	contents, _ := ioutil.ReadFile(profile)
+	assert.For(ctx, "profile").ThatString(string(contents)).Equals(
+		"umask 022\nexport REMOTESSH_TEST_VAR='/lib/libgapii.so it'\\''s' " + profileMarker + "\n")
+
+	// The profile sets the variable for login shells.
+	login := b
+	login.env = shell.NewEnv().Set("HOME", dir)
+	out, err := login.posixShell(`. "$HOME/.profile"; printf %s "$REMOTESSH_TEST_VAR"`).Call(ctx)
+	assert.For(ctx, "login").ThatError(err).Succeeded()
+	assert.For(ctx, "login value").ThatString(out).Equals("/lib/libgapii.so it's")
+
+	for i := 0; i < 2; i++ {
+		assert.For(ctx, "UnsetEnv %d", i).ThatError(b.UnsetEnv(ctx, "REMOTESSH_TEST_VAR")).Succeeded()
+		_, err = b.GetEnvVar(ctx, "REMOTESSH_TEST_VAR")
+		assert.For(ctx, "unset %d", i).ThatError(err).Equals(ErrEnvVarNotSet)
+	}
+	contents, _ = ioutil.ReadFile(profile)
+	assert.For(ctx, "profile after unset").ThatString(string(contents)).Equals("umask 022\n")
+
+	for _, name := range []string{"", "A B", "X;rm", "1X"} {
+		assert.For(ctx, "name %q", name).ThatError(b.SetEnvVar(ctx, name, "v")).Failed()
+	}
+	assert.For(ctx, "line break").ThatError(b.SetEnvVar(ctx, "REMOTESSH_TEST_VAR", "a\nb")).Failed()
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// commandNotFoundStatus is the exit status of POSIX shells when the
+	// command does not exist.
+	commandNotFoundStatus = 127
+
+	// maxRemoteErrorStderr is how much of the end of the standard error of a
+	// failed command is kept in its RemoteError.
+	maxRemoteErrorStderr = 4096
+)
+
+// RemoteError is returned by the Wait of a remote process that failed. It is
+// usually wrapped by the callers, and found with the IsExitError, ExitCode
+// and IsNotFound helpers.
+type RemoteError struct {
+	// ExitCode is the exit status of the command, or -1 if it did not
+	// report one, for example because it was killed.
+	ExitCode int
+	// Stderr is the end of what the command wrote to standard error.
+	Stderr string
+	// Op is the command that was run.
+	Op string
+	// Cause is the error returned by the SSH session.
+	Cause error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Cause)
+}
+
+// newRemoteError wraps err, returned by the session running op, in a
+// RemoteError.
+func newRemoteError(op string, stderr string, err error) *RemoteError {
+	code := -1
+	if exit, ok := err.(*ssh.ExitError); ok {
+		code = exit.ExitStatus()
+	}
+	return &RemoteError{ExitCode: code, Stderr: stderr, Op: op, Cause: err}
+}
+
+// nextCause returns the error that caused err, or nil if there is none.
+func nextCause(err error) error {
+	if remote, ok := err.(*RemoteError); ok {
+		return remote.Cause
+	}
+	if cause, ok := err.(interface {
+		Cause() error
+	}); ok {
+		return cause.Cause()
+	}
+	return nil
+}
+
+// asRemoteError returns the RemoteError in the Cause chain of err, or nil.
+func asRemoteError(err error) *RemoteError {
+	for ; err != nil; err = nextCause(err) {
+		if remote, ok := err.(*RemoteError); ok {
+			return remote
+		}
+	}
+	return nil
+}
+
+// IsExitError returns true if err was caused by a remote command exiting
+// with a non-zero status, rather than by the connection or the transport.
+func IsExitError(err error) bool {
+	_, ok := exitStatus(err)
+	return ok
+}
+
+// ExitCode returns the exit status of the remote command that caused err, or
+// -1 if err was not caused by a command exiting.
+func ExitCode(err error) int {
+	if status, ok := exitStatus(err); ok {
+		return status
+	}
+	return -1
+}
+
+// IsNotFound returns true if err was caused by a missing remote file, or by
+// a command that does not exist or was given a path that does not exist.
+func IsNotFound(err error) bool {
+	for e := err; e != nil; e = nextCause(e) {
+		if e == ErrNotFound {
+			return true
+		}
+	}
+	remote := asRemoteError(err)
+	if remote == nil {
+		return false
+	}
+	if remote.ExitCode == commandNotFoundStatus {
+		return true
+	}
+	stderr := strings.ToLower(remote.Stderr)
+	return strings.Contains(stderr, "no such file or directory") ||
+		strings.Contains(stderr, "cannot find the path") ||
+		strings.Contains(stderr, "does not exist")
+}
+
+// ringBuffer keeps the last bytes written to it, up to its capacity, in a
+// circular buffer that is allocated on the first write.
+type ringBuffer struct {
+	mutex    sync.Mutex
+	capacity int
+	data     []byte
+	// end is where the next byte is written, and full is set once data has
+	// wrapped around.
+	end  int
+	full bool
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{capacity: capacity}
+}
+
+func (r *ringBuffer) Write(b []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := len(b)
+	if r.capacity <= 0 {
+		return n, nil
+	}
+	if r.data == nil {
+		r.data = make([]byte, r.capacity)
+	}
+	if len(b) > len(r.data) {
+		b = b[len(b)-len(r.data):]
+	}
+	for len(b) > 0 {
+		c := copy(r.data[r.end:], b)
+		b, r.end = b[c:], r.end+c
+		if r.end == len(r.data) {
+			r.end, r.full = 0, true
+		}
+	}
+	return n, nil
+}
+
+// Last returns the last n bytes written, or all those kept if there are
+// fewer or n is negative.
+func (r *ringBuffer) Last(n int) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	held := r.end
+	if r.full {
+		held = len(r.data)
+	}
+	if n < 0 || n > held {
+		n = held
+	}
+	out := make([]byte, 0, n)
+	start := r.end - n
+	if start < 0 {
+		out = append(out, r.data[len(r.data)+start:]...)
+		start = 0
+	}
+	return string(append(out, r.data[start:r.end]...))
+}
+
+func (r *ringBuffer) String() string {
+	return r.Last(-1)
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestRingBuffer(t *testing.T) {
+	ctx := log.Testing(t)
+	b := newRingBuffer(4)
+	assert.For(ctx, "empty").ThatString(b.String()).Equals("")
+	b.Write([]byte("ab"))
+	assert.For(ctx, "short").ThatString(b.String()).Equals("ab")
+	b.Write([]byte("cdef"))
+	assert.For(ctx, "tail").ThatString(b.String()).Equals("cdef")
+	b.Write([]byte("gh"))
+	assert.For(ctx, "wrapped").ThatString(b.String()).Equals("efgh")
+	assert.For(ctx, "last").ThatString(b.Last(3)).Equals("fgh")
+	assert.For(ctx, "more than kept").ThatString(b.Last(10)).Equals("efgh")
+	n, _ := b.Write([]byte("0123456789"))
+	assert.For(ctx, "written").ThatInteger(n).Equals(10)
+	assert.For(ctx, "longer than capacity").ThatString(b.String()).Equals("6789")
+
+	none := newRingBuffer(0)
+	none.Write([]byte("ab"))
+	assert.For(ctx, "no capacity").ThatString(none.String()).Equals("")
+}
+
+func TestRemoteErrors(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	for _, test := range []struct {
+		command  string
+		code     int
+		notFound bool
+		stderr   string
+	}{
+		{"exit 3", 3, false, ""},
+		{"echo denied >&2; exit 1", 1, false, "denied"},
+		{"no-such-command-remotessh", 127, true, "not found"},
+		{"cat " + dir + "/missing", 1, true, "No such file or directory"},
+	} {
+		// The error is wrapped by Run, as it is for all the commands.
+		err := b.posixShell(test.command).Run(ctx)
+		assert.For(ctx, "%v IsExitError", test.command).That(IsExitError(err)).Equals(true)
+		assert.For(ctx, "%v ExitCode", test.command).That(ExitCode(err)).Equals(test.code)
+		assert.For(ctx, "%v IsNotFound", test.command).That(IsNotFound(err)).Equals(test.notFound)
+		remote := asRemoteError(err)
+		assert.For(ctx, "%v RemoteError", test.command).That(remote != nil).Equals(true)
+		if remote != nil {
+			assert.For(ctx, "%v Op", test.command).ThatString(remote.Op).Equals("sh -c " + test.command)
+			assert.For(ctx, "%v Stderr", test.command).That(strings.Contains(remote.Stderr, test.stderr)).Equals(true)
+		}
+	}
+
+	assert.For(ctx, "success").ThatError(b.Shell("true").Run(ctx)).Succeeded()
+
+	for _, err := range []error{nil, fmt.Errorf("network is unreachable"), ErrConnectionLost} {
+		assert.For(ctx, "%v IsExitError", err).That(IsExitError(err)).Equals(false)
+		assert.For(ctx, "%v ExitCode", err).That(ExitCode(err)).Equals(-1)
+		assert.For(ctx, "%v IsNotFound", err).That(IsNotFound(err)).Equals(false)
+	}
+	assert.For(ctx, "ErrNotFound").That(IsNotFound(log.Errf(ctx, ErrNotFound, "wrapped"))).Equals(true)
+}
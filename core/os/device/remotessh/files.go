@@ -0,0 +1,609 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit statuses used by the scripts run by the file operations to report
+// failures that are returned as errors of their own.
+const (
+	// notFoundStatus is used when a source path does not exist. It is the
+	// value of ENOENT.
+	notFoundStatus = 2
+	// existsStatus is used when a path to be created already exists. It is
+	// the value of EEXIST.
+	existsStatus = 17
+)
+
+// exitStatus returns the exit status of the remote command that caused err,
+// if err was caused by the command exiting with a non-zero status.
+func exitStatus(err error) (int, bool) {
+	for ; err != nil; err = nextCause(err) {
+		if exit, ok := err.(*ssh.ExitError); ok {
+			return exit.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+// FileExists returns true if something exists at the given path, whether it
+// is a file, a directory or a special file.
+func (b binding) FileExists(ctx context.Context, path string) (bool, error) {
+	if b.os == device.Windows {
+		return b.testWindowsPath(ctx, path, "Any")
+	}
+	_, err := b.GetFileMetadata(ctx, path)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoteFileInfo describes a file on the remote machine, as returned by
+// Stat. It implements os.FileInfo.
+type RemoteFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	owner   string
+	group   string
+}
+
+var _ os.FileInfo = RemoteFileInfo{}
+
+// Name returns the base name of the file, or for files returned by
+// ListFiles, the path relative to the listed directory.
+func (i RemoteFileInfo) Name() string { return i.name }
+
+// Size returns the length in bytes of a regular file.
+func (i RemoteFileInfo) Size() int64 { return i.size }
+
+// Mode returns the file's mode and permission bits.
+func (i RemoteFileInfo) Mode() os.FileMode { return i.mode }
+
+// ModTime returns the time the file was last modified.
+func (i RemoteFileInfo) ModTime() time.Time { return i.modTime }
+
+// IsDir returns true if the file is a directory.
+func (i RemoteFileInfo) IsDir() bool { return i.mode.IsDir() }
+
+// Sys returns nil, as there is no underlying data source.
+func (i RemoteFileInfo) Sys() interface{} { return nil }
+
+// Owner returns the name of the user that owns the file. It is empty on
+// Windows, and for files returned by ListFiles.
+func (i RemoteFileInfo) Owner() string { return i.owner }
+
+// Group returns the name of the group that owns the file. It is empty on
+// Windows, and for files returned by ListFiles.
+func (i RemoteFileInfo) Group() string { return i.group }
+
+// Unix file type bits of st_mode.
+const (
+	unixTypeMask   = 0170000
+	unixTypeSocket = 0140000
+	unixTypeLink   = 0120000
+	unixTypeFile   = 0100000
+	unixTypeBlock  = 0060000
+	unixTypeDir    = 0040000
+	unixTypeChar   = 0020000
+	unixTypeFIFO   = 0010000
+)
+
+// unixFileMode converts a unix st_mode to an os.FileMode.
+func unixFileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	switch m & unixTypeMask {
+	case unixTypeSocket:
+		mode |= os.ModeSocket
+	case unixTypeLink:
+		mode |= os.ModeSymlink
+	case unixTypeBlock:
+		mode |= os.ModeDevice
+	case unixTypeDir:
+		mode |= os.ModeDir
+	case unixTypeChar:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unixTypeFIFO:
+		mode |= os.ModeNamedPipe
+	}
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// parseStat parses the "<size> <hex st_mode> <unix mtime> [<owner>|<group>]"
+// line printed by Stat's script, which prints nothing if the file does not
+// exist. The owner and group, which may contain spaces, are not printed on
+// Windows.
+func parseStat(name, out string) (RemoteFileInfo, error) {
+	if strings.TrimSpace(out) == "" {
+		return RemoteFileInfo{}, ErrNotFound
+	}
+	fields := strings.Fields(out)
+	owner, group := "", ""
+	if len(fields) > 3 {
+		fields = splitFields(out, 4)
+		parts := strings.Split(fields[3], "|")
+		if len(parts) != 2 {
+			return RemoteFileInfo{}, fmt.Errorf("Unexpected stat output %q", out)
+		}
+		owner, group = parts[0], parts[1]
+	}
+	if len(fields) < 3 {
+		return RemoteFileInfo{}, fmt.Errorf("Unexpected stat output %q", out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return RemoteFileInfo{}, err
+	}
+	mode, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return RemoteFileInfo{}, err
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return RemoteFileInfo{}, err
+	}
+	return RemoteFileInfo{
+		name:    name,
+		size:    size,
+		mode:    unixFileMode(uint32(mode)),
+		modTime: time.Unix(mtime, 0),
+		owner:   owner,
+		group:   group,
+	}, nil
+}
+
+// Stat returns information about the file at the given path on the remote
+// machine. Symbolic links are not followed. ErrNotFound is returned if there
+// is no such file.
+func (b binding) Stat(ctx context.Context, inPath string) (RemoteFileInfo, error) {
+	return b.stat(ctx, inPath, false)
+}
+
+// GetFileMetadata returns information about the file at the given path on
+// the remote machine, including its owner and group, in a single command.
+// Symbolic links are followed. ErrNotFound is returned if there is no such
+// file, or the link's target does not exist.
+func (b binding) GetFileMetadata(ctx context.Context, path string) (*RemoteFileInfo, error) {
+	info, err := b.stat(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// stat returns information about the file at inPath. Symbolic links are
+// followed if follow is true. Windows links are always followed.
+func (b binding) stat(ctx context.Context, inPath string, follow bool) (RemoteFileInfo, error) {
+	exists := "[ -e " + posixQuote(inPath) + " ]"
+	link := ""
+	if follow {
+		link = "-L "
+	} else {
+		// A dangling link only exists if it is not followed.
+		exists += " || [ -L " + posixQuote(inPath) + " ]"
+	}
+	var cmd shell.Cmd
+	name := path.Base(inPath)
+	switch b.os {
+	case device.Windows:
+		// Windows has no mode bits, so the mode is built from the type and
+		// read-only attribute.
+		name = path.Base(slashPath(inPath))
+		cmd = b.powerShell("$i = Get-Item -Force -ErrorAction SilentlyContinue " + literalPath(inPath) + "; " +
+			"if ($i) { " +
+			"$m = if ($i.PSIsContainer) { 0x41ED } else { 0x81A4 }; " +
+			"if ($i.Attributes -band [System.IO.FileAttributes]::ReadOnly) { $m = $m -band -bnot 0x92 }; " +
+			"$l = if ($i.PSIsContainer) { 0 } else { $i.Length }; " +
+			"'{0} {1:x} {2}' -f $l, $m, [DateTimeOffset]::new($i.LastWriteTimeUtc).ToUnixTimeSeconds() }")
+	case device.OSX:
+		cmd = b.posixShell("if " + exists + "; then " +
+			"stat " + link + "-f '%z %Xp %m %Su|%Sg' " + posixQuote(inPath) + "; fi")
+	default:
+		cmd = b.posixShell("if " + exists + "; then " +
+			"stat " + link + "-c '%s %f %Y %U|%G' " + posixQuote(inPath) + "; fi")
+	}
+	out, err := callStdout(ctx, cmd)
+	if err != nil {
+		return RemoteFileInfo{}, log.Errf(ctx, err, "Could not stat %s", inPath)
+	}
+	info, err := parseStat(name, out)
+	if err == ErrNotFound {
+		return RemoteFileInfo{}, err
+	}
+	if err != nil {
+		return RemoteFileInfo{}, log.Errf(ctx, err, "Could not stat %s", inPath)
+	}
+	return info, nil
+}
+
+// MkDir creates the directory at path on the remote machine. Its parent must
+// already exist. ErrAlreadyExists is returned if something already exists at
+// path.
+func (b binding) MkDir(ctx context.Context, path string) error {
+	return b.mkDir(ctx, path, false)
+}
+
+// MkDirAll creates the directory at path on the remote machine, along with
+// any missing parents. It succeeds if the directory already exists, and
+// returns ErrAlreadyExists if something other than a directory exists at
+// path.
+func (b binding) MkDirAll(ctx context.Context, path string) error {
+	return b.mkDir(ctx, path, true)
+}
+
+func (b binding) mkDir(ctx context.Context, inPath string, all bool) error {
+	if b.sftpClient != nil {
+		return b.sftpMkDir(ctx, inPath, all)
+	}
+	var cmd shell.Cmd
+	switch {
+	case b.os == device.Windows && all:
+		cmd = b.powerShell("$ErrorActionPreference = 'Stop'; " +
+			"if (Test-Path -PathType Leaf " + literalPath(inPath) + ") { exit " + strconv.Itoa(existsStatus) + " }; " +
+			"New-Item -ItemType Directory -Force -Path " + powerShellQuote(windowsPath(inPath)) + " | Out-Null")
+	case b.os == device.Windows:
+		// New-Item creates missing parents, so check for the parent first.
+		cmd = b.powerShell("$ErrorActionPreference = 'Stop'; " +
+			"if (Test-Path " + literalPath(inPath) + ") { exit " + strconv.Itoa(existsStatus) + " }; " +
+			"if (!(Test-Path -PathType Container " + literalPath(path.Dir(slashPath(inPath))) + ")) { exit 2 }; " +
+			"New-Item -ItemType Directory -Path " + powerShellQuote(windowsPath(inPath)) + " | Out-Null")
+	case all:
+		cmd = b.posixShell("if [ -e " + posixQuote(inPath) + " ] && [ ! -d " + posixQuote(inPath) + " ]; then " +
+			"exit " + strconv.Itoa(existsStatus) + "; fi; mkdir -p " + posixQuote(inPath))
+	default:
+		cmd = b.posixShell("if [ -e " + posixQuote(inPath) + " ]; then " +
+			"exit " + strconv.Itoa(existsStatus) + "; fi; mkdir " + posixQuote(inPath))
+	}
+	_, err := callStdout(ctx, cmd)
+	if status, ok := exitStatus(err); ok && status == existsStatus {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		return log.Errf(ctx, err, "Could not create directory %s", inPath)
+	}
+	return nil
+}
+
+// fileOpScript returns the script that copies or moves src to dst on the
+// given OS. The script exits with notFoundStatus if src does not exist.
+func fileOpScript(kind device.OSKind, move bool, src, dst string) string {
+	if kind == device.Windows {
+		op := "Copy-Item"
+		if move {
+			op = "Move-Item"
+		}
+		return "$ErrorActionPreference = 'Stop'; " +
+			"if (!(Test-Path " + literalPath(src) + ")) { exit " + strconv.Itoa(notFoundStatus) + " }; " +
+			op + " -Force " + literalPath(src) + " -Destination " + powerShellQuote(windowsPath(dst))
+	}
+	op := "cp -f"
+	if move {
+		op = "mv -f"
+	}
+	return "if [ ! -e " + posixQuote(src) + " ]; then exit " + strconv.Itoa(notFoundStatus) + "; fi; " +
+		op + " " + posixQuote(src) + " " + posixQuote(dst)
+}
+
+func (b binding) fileOp(ctx context.Context, move bool, src, dst string) error {
+	var cmd shell.Cmd
+	if b.os == device.Windows {
+		cmd = b.powerShell(fileOpScript(b.os, move, src, dst))
+	} else {
+		cmd = b.posixShell(fileOpScript(b.os, move, src, dst))
+	}
+	_, err := callStdout(ctx, cmd)
+	if status, ok := exitStatus(err); ok && status == notFoundStatus {
+		return ErrNotFound
+	}
+	if err != nil {
+		op := "copy"
+		if move {
+			op = "move"
+		}
+		return log.Errf(ctx, err, "Could not %s %s to %s", op, src, dst)
+	}
+	return nil
+}
+
+// CopyFile copies the file at src to dst, both on the remote machine, without
+// transferring it through the local machine. ErrNotFound is returned if src
+// does not exist.
+func (b binding) CopyFile(ctx context.Context, src, dst string) error {
+	return b.fileOp(ctx, false, src, dst)
+}
+
+// MoveFile moves the file at src to dst on the remote machine. ErrNotFound is
+// returned if src does not exist.
+func (b binding) MoveFile(ctx context.Context, src, dst string) error {
+	return b.fileOp(ctx, true, src, dst)
+}
+
+// Chmod changes the permission bits of the file at path on the remote
+// machine. It does nothing on Windows, which has no permission bits.
+func (b binding) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	if b.os == device.Windows {
+		return nil
+	}
+	if b.sftpClient != nil {
+		if err := b.sftpClient.Chmod(path, mode.Perm()); err != nil {
+			return log.Errf(ctx, err, "Could not change the mode of %s", path)
+		}
+		return nil
+	}
+	if _, err := callStdout(ctx, b.Shell("chmod", octalPerm(mode), path)); err != nil {
+		return log.Errf(ctx, err, "Could not change the mode of %s", path)
+	}
+	return nil
+}
+
+// Chown changes the owning user and group of the file at path on the remote
+// machine. Either may be empty to leave it unchanged. It does nothing on
+// Windows, where ownership is managed through ACLs.
+func (b binding) Chown(ctx context.Context, path string, user, group string) error {
+	if b.os == device.Windows || (user == "" && group == "") {
+		return nil
+	}
+	owner := user
+	if group != "" {
+		owner += ":" + group
+	}
+	if _, err := callStdout(ctx, b.Shell("chown", owner, path)); err != nil {
+		return log.Errf(ctx, err, "Could not change the owner of %s", path)
+	}
+	return nil
+}
+
+// CreateSymlink creates a symbolic link at link that points to target,
+// replacing any link or file already at link. On Windows this needs the
+// SeCreateSymbolicLinkPrivilege, or developer mode.
+func (b binding) CreateSymlink(ctx context.Context, target, link string) error {
+	cmd := b.Shell("ln", "-sfn", target, link)
+	if b.os == device.Windows {
+		cmd = b.powerShell("$ErrorActionPreference = 'Stop'; " +
+			"New-Item -ItemType SymbolicLink -Force -Path " + powerShellQuote(windowsPath(link)) +
+			" -Target " + powerShellQuote(windowsPath(target)) + " | Out-Null")
+	}
+	if _, err := callStdout(ctx, cmd); err != nil {
+		return log.Errf(ctx, err, "Could not create symbolic link %s", link)
+	}
+	return nil
+}
+
+// ReadSymlink returns the target of the symbolic link at path, as it was
+// given when the link was created. Relative targets are not resolved.
+func (b binding) ReadSymlink(ctx context.Context, path string) (string, error) {
+	cmd := b.Shell("readlink", path)
+	if b.os == device.Windows {
+		cmd = b.powerShell("$ErrorActionPreference = 'Stop'; " +
+			"$i = Get-Item -Force " + literalPath(path) + "; " +
+			"if ($i.LinkType -ne 'SymbolicLink') { exit 1 }; $i.Target")
+	}
+	out, err := callStdout(ctx, cmd)
+	if err != nil {
+		return "", log.Errf(ctx, err, "Could not read symbolic link %s", path)
+	}
+	return strings.TrimRight(out, "\r\n"), nil
+}
+
+// IsSymlink returns true if there is a symbolic link at path. Links are not
+// followed, so it is true even if the link's target does not exist.
+func (b binding) IsSymlink(ctx context.Context, path string) (bool, error) {
+	cmd := b.Shell("test", "-L", path)
+	if b.os == device.Windows {
+		cmd = b.powerShell("$i = Get-Item -Force -ErrorAction SilentlyContinue " + literalPath(path) + "; " +
+			"if (!$i -or $i.LinkType -ne 'SymbolicLink') { exit 1 }")
+	}
+	_, err := cmd.Call(ctx)
+	if status, ok := exitStatus(err); ok && status == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, log.Errf(ctx, err, "Could not test for %s", path)
+	}
+	return true, nil
+}
+
+// FileType selects the types of file returned by ListFiles.
+type FileType int
+
+const (
+	// FileTypeAny lists files of every type.
+	FileTypeAny FileType = iota
+	// FileTypeRegular lists only regular files.
+	FileTypeRegular
+	// FileTypeDirectory lists only directories.
+	FileTypeDirectory
+)
+
+// ListOptions controls the files returned by ListFiles.
+type ListOptions struct {
+	// MaxDepth is the number of levels of subdirectories to descend into.
+	// 0 lists only the entries of the directory itself, and a negative
+	// value descends without limit.
+	MaxDepth int
+	// Type restricts the listing to files of the given type.
+	Type FileType
+	// IncludeHidden lists dot files, and on Windows, files with the hidden
+	// attribute. Hidden directories are not descended into otherwise.
+	IncludeHidden bool
+}
+
+// listFilesScript returns the script run by ListFiles. Each file is printed
+// on a line of the form "<size> <type> <octal perm> <unix mtime> <name>".
+// The type is a letter as printed by find -printf %y, or the first letter
+// of ls -l on OSX.
+func listFilesScript(kind device.OSKind, dir string, opts ListOptions) string {
+	if kind == device.Windows {
+		gci := "Get-ChildItem " + literalPath(dir)
+		if opts.MaxDepth != 0 {
+			gci += " -Recurse"
+			if opts.MaxDepth > 0 {
+				gci += " -Depth " + strconv.Itoa(opts.MaxDepth)
+			}
+		}
+		switch opts.Type {
+		case FileTypeRegular:
+			gci += " -File"
+		case FileTypeDirectory:
+			gci += " -Directory"
+		}
+		if opts.IncludeHidden {
+			gci += " -Force"
+		}
+		return "if (!(Test-Path -PathType Container " + literalPath(dir) + ")) { exit " + strconv.Itoa(notFoundStatus) + " }; " +
+			"$root = (Get-Item " + literalPath(dir) + ").FullName.TrimEnd('\\'); " +
+			gci + " -ErrorAction SilentlyContinue | Select-Object Name,Length,Mode,LastWriteTime,FullName,PSIsContainer | ForEach-Object { " +
+			"$t = if ($_.PSIsContainer) { 'd' } else { 'f' }; " +
+			"$p = if ($_.PSIsContainer) { 755 } else { 644 }; " +
+			"if ($_.Mode -match 'r') { $p -= 222 }; " +
+			"$l = if ($_.PSIsContainer) { 0 } else { $_.Length }; " +
+			"'{0} {1} {2} {3} {4}' -f $l, $t, $p, [DateTimeOffset]::new($_.LastWriteTime.ToUniversalTime()).ToUnixTimeSeconds(), $_.FullName.Substring($root.Length + 1) }"
+	}
+	find := "find " + posixQuote(dir) + " -mindepth 1"
+	if opts.MaxDepth >= 0 {
+		find += " -maxdepth " + strconv.Itoa(opts.MaxDepth+1)
+	}
+	if !opts.IncludeHidden {
+		find += ` \( -name '.*' -prune \) -o`
+	}
+	find += ` \(`
+	switch opts.Type {
+	case FileTypeRegular:
+		find += " -type f"
+	case FileTypeDirectory:
+		find += " -type d"
+	}
+	if kind == device.OSX {
+		// BSD find has no -printf.
+		find += ` -exec stat -f '%z %Sp %Lp %m %N' {} +`
+	} else {
+		find += ` -printf '%s %y %m %T@ %P\n'`
+	}
+	find += ` \)`
+	return "if [ ! -d " + posixQuote(dir) + " ]; then exit " + strconv.Itoa(notFoundStatus) + "; fi; " +
+		find + " 2>/dev/null; exit 0"
+}
+
+// listFileTypes maps the type letters printed by listFilesScript to the
+// file type bits of an os.FileMode.
+var listFileTypes = map[byte]os.FileMode{
+	'f': 0,
+	'-': 0,
+	'd': os.ModeDir,
+	'l': os.ModeSymlink,
+	's': os.ModeSocket,
+	'p': os.ModeNamedPipe,
+	'c': os.ModeDevice | os.ModeCharDevice,
+	'b': os.ModeDevice,
+}
+
+// parseFileList parses the output of listFilesScript. prefix is removed
+// from the start of each name, to make the names relative to the listed
+// directory where the script prints full paths.
+func parseFileList(out, prefix string) ([]RemoteFileInfo, error) {
+	files := []RemoteFileInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 5)
+		if len(fields) != 5 || fields[1] == "" {
+			return nil, fmt.Errorf("Unexpected file listing %q", line)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		fileType, ok := listFileTypes[fields[1][0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown file type %q", fields[1])
+		}
+		perm, err := strconv.ParseUint(fields[2], 8, 32)
+		if err != nil {
+			return nil, err
+		}
+		mtime, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, RemoteFileInfo{
+			name:    strings.TrimPrefix(fields[4], prefix),
+			size:    size,
+			mode:    fileType | os.FileMode(perm).Perm(),
+			modTime: time.Unix(int64(mtime), 0),
+		})
+	}
+	return files, nil
+}
+
+// ListFiles returns the files found in dir on the remote machine, with
+// their metadata, in a single round trip. The names of the returned files
+// are relative to dir, using forward slashes.
+func (b binding) ListFiles(ctx context.Context, dir string, opts ListOptions) ([]RemoteFileInfo, error) {
+	var cmd shell.Cmd
+	prefix := ""
+	switch b.os {
+	case device.Windows:
+		cmd = b.powerShell(listFilesScript(b.os, dir, opts))
+	case device.OSX:
+		cmd = b.posixShell(listFilesScript(b.os, dir, opts))
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	default:
+		cmd = b.posixShell(listFilesScript(b.os, dir, opts))
+	}
+	out, err := callStdout(ctx, cmd)
+	if status, ok := exitStatus(err); ok && status == notFoundStatus {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not list %s", dir)
+	}
+	if b.os == device.Windows {
+		out = slashPath(out)
+	}
+	files, err := parseFileList(out, prefix)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not list %s", dir)
+	}
+	return files, nil
+}
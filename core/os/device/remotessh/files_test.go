@@ -0,0 +1,230 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseStat(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		out     string
+		size    int64
+		mode    os.FileMode
+		isDir   bool
+		modTime int64
+	}{
+		{"1048576 81ed 1528000000\n", 1048576, 0755, false, 1528000000},
+		{"4096 41ed 1528000001", 4096, os.ModeDir | 0755, true, 1528000001},
+		{"11 a1ff 1528000002", 11, os.ModeSymlink | 0777, false, 1528000002},
+		{"0 c1ed 1528000003", 0, os.ModeSocket | 0755, false, 1528000003},
+		{"0 43ff 1528000004", 0, os.ModeDir | os.ModeSticky | 0777, true, 1528000004},
+	} {
+		info, err := parseStat("name", test.out)
+		assert.For(ctx, "%q err", test.out).ThatError(err).Succeeded()
+		assert.For(ctx, "%q Name", test.out).ThatString(info.Name()).Equals("name")
+		assert.For(ctx, "%q Size", test.out).That(info.Size()).Equals(test.size)
+		assert.For(ctx, "%q Mode", test.out).That(info.Mode()).Equals(test.mode)
+		assert.For(ctx, "%q IsDir", test.out).That(info.IsDir()).Equals(test.isDir)
+		assert.For(ctx, "%q ModTime", test.out).That(info.ModTime().Equal(time.Unix(test.modTime, 0))).Equals(true)
+	}
+
+	info, err := parseStat("name", "1048576 81a4 1528000000 Domain User|domain users\n")
+	assert.For(ctx, "owner err").ThatError(err).Succeeded()
+	assert.For(ctx, "Owner").ThatString(info.Owner()).Equals("Domain User")
+	assert.For(ctx, "Group").ThatString(info.Group()).Equals("domain users")
+	assert.For(ctx, "owner Mode").That(info.Mode()).Equals(os.FileMode(0644))
+	_, err = parseStat("name", "1048576 81a4 1528000000 nobody")
+	assert.For(ctx, "no group").ThatError(err).Failed()
+
+	_, err = parseStat("name", "")
+	assert.For(ctx, "missing").ThatError(err).Equals(ErrNotFound)
+	_, err = parseStat("name", "stat: cannot stat 'name'")
+	assert.For(ctx, "garbage").ThatError(err).Failed()
+}
+
+func TestFileOpScript(t *testing.T) {
+	ctx := log.Testing(t)
+
+	src, dst := "/tmp/my trace's.gfxtrace", "/tmp/$HOME copy"
+	assert.For(ctx, "copy").ThatString(fileOpScript(device.Linux, false, src, dst)).Equals(
+		`if [ ! -e '/tmp/my trace'\''s.gfxtrace' ]; then exit 2; fi; ` +
+			`cp -f '/tmp/my trace'\''s.gfxtrace' '/tmp/$HOME copy'`)
+	assert.For(ctx, "move").ThatString(fileOpScript(device.OSX, true, src, dst)).Equals(
+		`if [ ! -e '/tmp/my trace'\''s.gfxtrace' ]; then exit 2; fi; ` +
+			`mv -f '/tmp/my trace'\''s.gfxtrace' '/tmp/$HOME copy'`)
+
+	src, dst = "C:/Users/me/my trace's.gfxtrace", "D:/[backup]/trace"
+	assert.For(ctx, "windows copy").ThatString(fileOpScript(device.Windows, false, src, dst)).Equals(
+		`$ErrorActionPreference = 'Stop'; ` +
+			`if (!(Test-Path -LiteralPath 'C:\Users\me\my trace''s.gfxtrace')) { exit 2 }; ` +
+			`Copy-Item -Force -LiteralPath 'C:\Users\me\my trace''s.gfxtrace' -Destination 'D:\[backup]\trace'`)
+}
+
+func TestListFilesScript(t *testing.T) {
+	ctx := log.Testing(t)
+
+	assert.For(ctx, "default").ThatString(listFilesScript(device.Linux, "/data/my traces", ListOptions{})).Equals(
+		`if [ ! -d '/data/my traces' ]; then exit 2; fi; ` +
+			`find '/data/my traces' -mindepth 1 -maxdepth 1 \( -name '.*' -prune \) -o \( -printf '%s %y %m %T@ %P\n' \) 2>/dev/null; exit 0`)
+	assert.For(ctx, "recursive").ThatString(listFilesScript(device.Linux, "/data", ListOptions{
+		MaxDepth:      -1,
+		Type:          FileTypeRegular,
+		IncludeHidden: true,
+	})).Equals(
+		`if [ ! -d '/data' ]; then exit 2; fi; ` +
+			`find '/data' -mindepth 1 \( -type f -printf '%s %y %m %T@ %P\n' \) 2>/dev/null; exit 0`)
+	assert.For(ctx, "osx").ThatString(listFilesScript(device.OSX, "/data", ListOptions{MaxDepth: 2, Type: FileTypeDirectory})).Equals(
+		`if [ ! -d '/data' ]; then exit 2; fi; ` +
+			`find '/data' -mindepth 1 -maxdepth 3 \( -name '.*' -prune \) -o \( -type d -exec stat -f '%z %Sp %Lp %m %N' {} + \) 2>/dev/null; exit 0`)
+}
+
+func TestParseFileList(t *testing.T) {
+	ctx := log.Testing(t)
+
+	linux := "4096 d 755 1528000000.5000000000 sub\n" +
+		"1048576 f 644 1528000001.0000000000 sub/trace file.gfxtrace\n" +
+		"7 l 777 1528000002.0000000000 link\n"
+	files, err := parseFileList(linux, "")
+	assert.For(ctx, "linux err").ThatError(err).Succeeded()
+	assert.For(ctx, "linux").That(files).DeepEquals([]RemoteFileInfo{
+		{name: "sub", size: 4096, mode: os.ModeDir | 0755, modTime: time.Unix(1528000000, 0)},
+		{name: "sub/trace file.gfxtrace", size: 1048576, mode: 0644, modTime: time.Unix(1528000001, 0)},
+		{name: "link", size: 7, mode: os.ModeSymlink | 0777, modTime: time.Unix(1528000002, 0)},
+	})
+
+	osx := "96 drwxr-xr-x 755 1528000000 /data/sub\n" +
+		"10 -rwxr-x--- 750 1528000001 /data/sub/tool\n"
+	files, err = parseFileList(osx, "/data/")
+	assert.For(ctx, "osx err").ThatError(err).Succeeded()
+	assert.For(ctx, "osx").That(files).DeepEquals([]RemoteFileInfo{
+		{name: "sub", size: 96, mode: os.ModeDir | 0755, modTime: time.Unix(1528000000, 0)},
+		{name: "sub/tool", size: 10, mode: 0750, modTime: time.Unix(1528000001, 0)},
+	})
+
+	files, err = parseFileList("", "")
+	assert.For(ctx, "empty err").ThatError(err).Succeeded()
+	assert.For(ctx, "empty").ThatInteger(len(files)).Equals(0)
+
+	_, err = parseFileList("garbage\n", "")
+	assert.For(ctx, "garbage").ThatError(err).Failed()
+}
+
+func TestSymlinks(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	file := filepath.Join(dir, "lib one.so")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(file, []byte("lib"), 0600)).Succeeded()
+	link := filepath.Join(dir, "link")
+	for _, target := range []string{file, "lib one.so", "missing"} {
+		assert.For(ctx, "CreateSymlink %v", target).ThatError(b.CreateSymlink(ctx, target, link)).Succeeded()
+		got, err := b.ReadSymlink(ctx, link)
+		assert.For(ctx, "ReadSymlink %v err", target).ThatError(err).Succeeded()
+		assert.For(ctx, "ReadSymlink %v", target).ThatString(got).Equals(target)
+		isLink, err := b.IsSymlink(ctx, link)
+		assert.For(ctx, "IsSymlink %v err", target).ThatError(err).Succeeded()
+		assert.For(ctx, "IsSymlink %v", target).That(isLink).Equals(true)
+	}
+
+	isLink, err := b.IsSymlink(ctx, file)
+	assert.For(ctx, "file err").ThatError(err).Succeeded()
+	assert.For(ctx, "file").That(isLink).Equals(false)
+	_, err = b.ReadSymlink(ctx, file)
+	assert.For(ctx, "ReadSymlink file").ThatError(err).Failed()
+}
+
+func TestGetFileMetadata(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	file := filepath.Join(dir, "a file")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(file, []byte("contents"), 0640)).Succeeded()
+	link := filepath.Join(dir, "link")
+	assert.For(ctx, "Symlink").ThatError(os.Symlink(file, link)).Succeeded()
+	dangling := filepath.Join(dir, "dangling")
+	assert.For(ctx, "Symlink").ThatError(os.Symlink(filepath.Join(dir, "missing"), dangling)).Succeeded()
+	u, err := user.Current()
+	assert.For(ctx, "user").ThatError(err).Succeeded()
+
+	// Links are followed.
+	info, err := b.GetFileMetadata(ctx, link)
+	assert.For(ctx, "GetFileMetadata").ThatError(err).Succeeded()
+	if err == nil {
+		assert.For(ctx, "Size").That(info.Size()).Equals(int64(8))
+		assert.For(ctx, "Mode").That(info.Mode()).Equals(os.FileMode(0640))
+		assert.For(ctx, "Owner").ThatString(info.Owner()).Equals(u.Username)
+	}
+	_, err = b.GetFileMetadata(ctx, dangling)
+	assert.For(ctx, "dangling").ThatError(err).Equals(ErrNotFound)
+
+	for _, test := range []struct {
+		path          string
+		exists, isDir bool
+	}{
+		{file, true, false},
+		{link, true, false},
+		{dir, true, true},
+		{dangling, false, false},
+	} {
+		exists, err := b.FileExists(ctx, test.path)
+		assert.For(ctx, "FileExists %v err", test.path).ThatError(err).Succeeded()
+		assert.For(ctx, "FileExists %v", test.path).That(exists).Equals(test.exists)
+		isFile, err := b.IsFile(ctx, test.path)
+		assert.For(ctx, "IsFile %v err", test.path).ThatError(err).Succeeded()
+		assert.For(ctx, "IsFile %v", test.path).That(isFile).Equals(test.exists && !test.isDir)
+		isDir, err := b.IsDirectory(ctx, test.path)
+		assert.For(ctx, "IsDirectory %v err", test.path).ThatError(err).Succeeded()
+		assert.For(ctx, "IsDirectory %v", test.path).That(isDir).Equals(test.isDir)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+const (
+	// ErrMetalUnavailable is returned by GetMetalVersion when the remote
+	// machine is not running macOS, or has no Metal capable GPU.
+	ErrMetalUnavailable = fault.Const("Metal is not available")
+	// ErrDirectXUnavailable is returned by GetDirectXVersion when the remote
+	// machine is not running Windows.
+	ErrDirectXUnavailable = fault.Const("DirectX is not available")
+	// ErrDebugFSNotMounted is returned by ListGPUDebugFSEntries and
+	// ReadGPUDebugFSEntry when the DRM debugfs directory cannot be accessed,
+	// either because debugfs is not mounted or for lack of permission.
+	ErrDebugFSNotMounted = fault.Const("GPU debugfs not accessible")
+
+	dxdiagReport = `%TEMP%\gapid-dxdiag.txt`
+	driDebugFS   = "/sys/kernel/debug/dri"
+)
+
+// MetalInfo describes the Metal support of the GPU on a macOS remote machine.
+type MetalInfo struct {
+	// GPUFamily is the model of the GPU, for example "Apple M1 Pro".
+	GPUFamily string
+	// MetalVersion is the Metal feature set supported by the GPU, for example
+	// "Metal 3".
+	MetalVersion string
+	// SupportsRayTracing and SupportsMeshShaders are derived from the
+	// MetalVersion, as both are available from Metal 3 onwards.
+	SupportsRayTracing  bool
+	SupportsMeshShaders bool
+}
+
+// spDisplays is the subset of the JSON document written by
+// system_profiler SPDisplaysDataType -json that is used by the binding.
+type spDisplays struct {
+	Displays []struct {
+		Model string `json:"sppci_model"`
+		// Written by macOS 13 and later, for example "spdisplays_metal3".
+		FamilySupport string `json:"spdisplays_mtlgpufamilysupport"`
+		// Written by older versions of macOS, for example
+		// "spdisplays_metal2" or "spdisplays_supported".
+		Metal string `json:"spdisplays_metal"`
+	} `json:"SPDisplaysDataType"`
+}
+
+// parseMetalInfo parses the output of system_profiler SPDisplaysDataType
+// -json, returning the information for the first Metal capable GPU.
+func parseMetalInfo(out string) (*MetalInfo, error) {
+	sp := spDisplays{}
+	if err := json.Unmarshal([]byte(out), &sp); err != nil {
+		return nil, err
+	}
+	for _, d := range sp.Displays {
+		support := d.FamilySupport
+		if support == "" {
+			support = d.Metal
+		}
+		support = strings.TrimPrefix(support, "spdisplays_")
+		if !strings.HasPrefix(support, "metal") && support != "supported" {
+			continue
+		}
+		info := &MetalInfo{GPUFamily: d.Model, MetalVersion: "Metal"}
+		if v := strings.TrimPrefix(support, "metal"); v != "" && v != support {
+			info.MetalVersion = "Metal " + v
+			if n, err := strconv.Atoi(v); err == nil && n >= 3 {
+				info.SupportsRayTracing = true
+				info.SupportsMeshShaders = true
+			}
+		}
+		return info, nil
+	}
+	return nil, ErrMetalUnavailable
+}
+
+// GetMetalVersion returns the Metal support of the GPU on a macOS remote
+// machine. ErrMetalUnavailable is returned for other operating systems.
+func (b binding) GetMetalVersion(ctx context.Context) (*MetalInfo, error) {
+	if b.os != device.OSX {
+		return nil, ErrMetalUnavailable
+	}
+	out, err := callStdout(ctx, b.Shell("system_profiler", "SPDisplaysDataType", "-json"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not run system_profiler")
+	}
+	return parseMetalInfo(out)
+}
+
+// DirectXInfo describes the Direct3D support of a Windows remote machine.
+type DirectXInfo struct {
+	Adapters []D3DAdapter
+}
+
+// D3DAdapter describes a single display adapter.
+type D3DAdapter struct {
+	Name string
+	// FeatureLevel is the highest D3D_FEATURE_LEVEL supported by the adapter,
+	// for example 0xc100 for D3D_FEATURE_LEVEL_12_1.
+	FeatureLevel uint32
+	// DedicatedVRAMMB is the amount of dedicated video memory.
+	DedicatedVRAMMB int64
+}
+
+// parseD3DFeatureLevel converts a dxdiag feature level such as "12_1" to its
+// D3D_FEATURE_LEVEL value.
+func parseD3DFeatureLevel(level string) uint32 {
+	parts := strings.SplitN(strings.TrimSpace(level), "_", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0
+	}
+	return uint32(major<<12 | minor<<8)
+}
+
+// parseDxDiag parses the text report written by dxdiag /t.
+func parseDxDiag(out string) *DirectXInfo {
+	info := &DirectXInfo{Adapters: []D3DAdapter{}}
+	var adapter *D3DAdapter
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case key == "Card name":
+			info.Adapters = append(info.Adapters, D3DAdapter{Name: value})
+			adapter = &info.Adapters[len(info.Adapters)-1]
+		case adapter == nil:
+		case key == "Dedicated Memory":
+			if fields := strings.Fields(value); len(fields) > 0 {
+				adapter.DedicatedVRAMMB, _ = strconv.ParseInt(fields[0], 10, 64)
+			}
+		case key == "Feature Levels":
+			// The levels are listed from highest to lowest.
+			adapter.FeatureLevel = parseD3DFeatureLevel(strings.Split(value, ",")[0])
+		}
+	}
+	return info
+}
+
+// GetDirectXVersion returns the Direct3D feature levels of the display
+// adapters of a Windows remote machine. ErrDirectXUnavailable is returned for
+// other operating systems.
+func (b binding) GetDirectXVersion(ctx context.Context) (*DirectXInfo, error) {
+	if b.os != device.Windows {
+		return nil, ErrDirectXUnavailable
+	}
+	// dxdiag is a GUI application, so start /wait is needed for the report to
+	// be complete before it is read.
+	if _, err := b.Shell("start", "/wait", "dxdiag", "/t", dxdiagReport).Call(ctx); err != nil {
+		return nil, log.Errf(ctx, err, "Could not run dxdiag")
+	}
+	defer b.Shell("del", dxdiagReport).Call(ctx)
+	out, err := callStdout(ctx, b.Shell("type", dxdiagReport))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read dxdiag report")
+	}
+	return parseDxDiag(strings.Replace(out, "\r\n", "\n", -1)), nil
+}
+
+// gpuDebugFSDir returns the debugfs directory of the first DRM device, which
+// is named after either the minor number or the card.
+func (b binding) gpuDebugFSDir(ctx context.Context) (string, error) {
+	for _, dir := range []string{driDebugFS + "/0", driDebugFS + "/card0"} {
+		if _, err := b.Shell("test", "-r", dir, "-a", "-x", dir).Call(ctx); err == nil {
+			return dir, nil
+		}
+	}
+	return "", ErrDebugFSNotMounted
+}
+
+// ListGPUDebugFSEntries returns the names of the debugfs entries of the
+// first DRM device. This usually requires root on the remote machine.
+func (b binding) ListGPUDebugFSEntries(ctx context.Context) ([]string, error) {
+	dir, err := b.gpuDebugFSDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := callStdout(ctx, b.Shell("ls", "-1A", dir))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not list %s", dir)
+	}
+	entries := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// ReadGPUDebugFSEntry returns the contents of the given debugfs entry of the
+// first DRM device, for example "amdgpu_fence_info" or "i915_frequency_info".
+func (b binding) ReadGPUDebugFSEntry(ctx context.Context, entry string) (string, error) {
+	if clean := path.Clean("/" + entry); clean == "/" || clean != "/"+entry {
+		return "", log.Errf(ctx, nil, "Invalid debugfs entry %q", entry)
+	}
+	dir, err := b.gpuDebugFSDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	out, err := callStdout(ctx, b.Shell("cat", dir+"/"+entry))
+	if err != nil {
+		return "", log.Errf(ctx, err, "Could not read %s", entry)
+	}
+	return out, nil
+}
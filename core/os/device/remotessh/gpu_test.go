@@ -0,0 +1,130 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+func TestParseMetalInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info, err := parseMetalInfo(`{
+	"SPDisplaysDataType": [{
+		"_name": "Apple M1 Pro",
+		"sppci_model": "Apple M1 Pro",
+		"spdisplays_mtlgpufamilysupport": "spdisplays_metal3"
+	}]
+}`)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "info").That(info).DeepEquals(&MetalInfo{
+		GPUFamily:           "Apple M1 Pro",
+		MetalVersion:        "Metal 3",
+		SupportsRayTracing:  true,
+		SupportsMeshShaders: true,
+	})
+
+	info, err = parseMetalInfo(`{
+	"SPDisplaysDataType": [{
+		"sppci_model": "Intel Iris Plus Graphics 655",
+		"spdisplays_metal": "spdisplays_metal2"
+	}]
+}`)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "info").That(info).DeepEquals(&MetalInfo{
+		GPUFamily:    "Intel Iris Plus Graphics 655",
+		MetalVersion: "Metal 2",
+	})
+
+	_, err = parseMetalInfo(`{"SPDisplaysDataType": [{"sppci_model": "Old GPU"}]}`)
+	assert.For(ctx, "err").ThatError(err).Equals(ErrMetalUnavailable)
+}
+
+func TestGetMetalVersion(t *testing.T) {
+	ctx := log.Testing(t)
+
+	// system_profiler is not run on other operating systems.
+	_, err := binding{os: device.Linux}.GetMetalVersion(ctx)
+	assert.For(ctx, "Linux").ThatError(err).Equals(ErrMetalUnavailable)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	for _, test := range []struct {
+		name   string
+		script string
+		info   *MetalInfo
+		err    error
+	}{
+		{"supported", `echo '{"SPDisplaysDataType": [{"sppci_model": "AMD Radeon Pro 560X", "spdisplays_metal": "spdisplays_supported"}]}'`,
+			&MetalInfo{GPUFamily: "AMD Radeon Pro 560X", MetalVersion: "Metal"}, nil},
+		{"no Metal", `echo '{"SPDisplaysDataType": []}'`, nil, ErrMetalUnavailable},
+		{"malformed", `echo 'Graphics/Displays:'`, nil, nil},
+		{"failed", `exit 1`, nil, nil},
+	} {
+		env := fakeCommands(t, dir, map[string]string{"system_profiler": test.script + "\n"})
+		b := binding{connection: client, configuration: &c, env: env, os: device.OSX}
+		info, err := b.GetMetalVersion(ctx)
+		switch {
+		case test.info != nil:
+			assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+			assert.For(ctx, "%v info", test.name).That(info).DeepEquals(test.info)
+		case test.err != nil:
+			assert.For(ctx, "%v err", test.name).ThatError(err).Equals(test.err)
+		default:
+			assert.For(ctx, "%v err", test.name).ThatError(err).Failed()
+		}
+	}
+}
+
+func TestParseDxDiag(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info := parseDxDiag(`
+---------------
+Display Devices
+---------------
+           Card name: NVIDIA GeForce RTX 3080
+        Manufacturer: NVIDIA
+    Dedicated Memory: 10053 MB
+      Feature Levels: 12_1,12_0,11_1,11_0,10_1,10_0,9_3,9_2,9_1
+
+           Card name: Intel(R) UHD Graphics 630
+    Dedicated Memory: 128 MB
+      Feature Levels: 12_1,12_0,11_1
+`)
+	assert.For(ctx, "info").That(info).DeepEquals(&DirectXInfo{
+		Adapters: []D3DAdapter{
+			{Name: "NVIDIA GeForce RTX 3080", FeatureLevel: 0xc100, DedicatedVRAMMB: 10053},
+			{Name: "Intel(R) UHD Graphics 630", FeatureLevel: 0xc100, DedicatedVRAMMB: 128},
+		},
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyMismatch is the cause of a HostKeyMismatchError.
+const ErrHostKeyMismatch = fault.Const("Host key mismatch")
+
+// HostKeyMismatchError is returned when a host presents a different key to
+// the one recorded in the known_hosts file, which may mean that the
+// connection is being intercepted.
+type HostKeyMismatchError struct {
+	// Host is the host that was connected to.
+	Host string
+	// Known are the SHA256 fingerprints of the recorded keys.
+	Known []string
+	// Presented is the SHA256 fingerprint of the key the host presented.
+	Presented string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("%v: %s presented key %s, but known_hosts has %s",
+		ErrHostKeyMismatch, e.Host, e.Presented, strings.Join(e.Known, ", "))
+}
+
+// Cause returns ErrHostKeyMismatch.
+func (e *HostKeyMismatchError) Cause() error { return ErrHostKeyMismatch }
+
+// knownHostsMutex serializes appending to known_hosts files.
+var knownHostsMutex sync.Mutex
+
+// hostKeyCallback returns a callback that checks host keys against the
+// known_hosts file at path, creating it if needed. Keys of hosts not in the
+// file are trusted on first use: they are accepted and added to the file.
+// Keys that differ from the recorded ones are rejected with a
+// HostKeyMismatchError.
+func hostKeyCallback(ctx context.Context, path string) (ssh.HostKeyCallback, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	known, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			mismatch := &HostKeyMismatchError{Host: hostname, Presented: ssh.FingerprintSHA256(key)}
+			for _, k := range keyErr.Want {
+				mismatch.Known = append(mismatch.Known, ssh.FingerprintSHA256(k.Key))
+			}
+			return mismatch
+		}
+		if err := appendKnownHost(path, hostname, key); err != nil {
+			return log.Errf(ctx, err, "Could not add %s to %s", hostname, path)
+		}
+		log.W(ctx, "Permanently added %s key %s for %s to %s", key.Type(), ssh.FingerprintSHA256(key), hostname, path)
+		return nil
+	}, nil
+}
+
+// appendKnownHost adds key for hostname to the known_hosts file at path.
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
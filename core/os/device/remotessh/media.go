@@ -0,0 +1,383 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+)
+
+const (
+	// ErrNoAudioSystem is returned when neither PulseAudio nor ALSA is
+	// available on the remote machine.
+	ErrNoAudioSystem = fault.Const("No audio system found")
+	// ErrNoDisplay is returned by GetDisplayRefreshRate when the remote
+	// machine has no X11 display, or the display is not active.
+	ErrNoDisplay = fault.Const("No display found")
+
+	// ErrNoDisplayServer is returned by CreateVirtualDisplay and
+	// CreateWaylandDisplay when the display server is not installed on the
+	// remote machine.
+	ErrNoDisplayServer = fault.Const("Display server not found")
+
+	// virtualDisplayDepth is the color depth of virtual X11 displays.
+	virtualDisplayDepth = 24
+
+	// drmModifierInvalid is DRM_FORMAT_MOD_INVALID.
+	drmModifierInvalid = 0x00ffffffffffffff
+)
+
+// AudioDevice describes an audio output device on the remote machine.
+type AudioDevice struct {
+	// Name is the name used to address the device. For PulseAudio this is
+	// the sink name, for ALSA it is the hardware device, for example
+	// "hw:0,0".
+	Name string
+	// Driver is the PulseAudio module, or "alsa".
+	Driver string
+	// Channels and SampleRateHz are zero if they are not known.
+	Channels     int
+	SampleRateHz int
+}
+
+// parsePulseAudioSinks parses the output of pactl list sinks short, where
+// each line is formatted as:
+// <index>\t<name>\t<driver>\t<format> <channels>ch <rate>Hz\t<state>
+func parsePulseAudioSinks(out string) []*AudioDevice {
+	devices := []*AudioDevice{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			continue
+		}
+		d := &AudioDevice{Name: fields[1], Driver: fields[2]}
+		for _, spec := range strings.Fields(fields[3]) {
+			switch {
+			case strings.HasSuffix(spec, "ch"):
+				d.Channels, _ = strconv.Atoi(strings.TrimSuffix(spec, "ch"))
+			case strings.HasSuffix(spec, "Hz"):
+				d.SampleRateHz, _ = strconv.Atoi(strings.TrimSuffix(spec, "Hz"))
+			}
+		}
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+var aplayDeviceRE = regexp.MustCompile(`^card (\d+): .*, device (\d+): `)
+
+// parseALSADevices parses the output of aplay -l, where each playback device
+// is listed as:
+// card 0: PCH [HDA Intel PCH], device 0: ALC892 Analog [ALC892 Analog]
+func parseALSADevices(out string) []*AudioDevice {
+	devices := []*AudioDevice{}
+	for _, line := range strings.Split(out, "\n") {
+		m := aplayDeviceRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		devices = append(devices, &AudioDevice{
+			Name:   fmt.Sprintf("hw:%s,%s", m[1], m[2]),
+			Driver: "alsa",
+		})
+	}
+	return devices
+}
+
+// GetAudioDevices returns the audio output devices of the remote machine.
+// PulseAudio sinks are listed if PulseAudio is available, otherwise the ALSA
+// playback devices are listed.
+func (b binding) GetAudioDevices(ctx context.Context) ([]*AudioDevice, error) {
+	if b.hasCommand(ctx, "pactl") {
+		out, err := callStdout(ctx, b.Shell("pactl", "list", "sinks", "short"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list PulseAudio sinks")
+		}
+		return parsePulseAudioSinks(out), nil
+	}
+	if b.hasCommand(ctx, "aplay") {
+		out, err := callStdout(ctx, b.Shell("aplay", "-l"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list ALSA devices")
+		}
+		return parseALSADevices(out), nil
+	}
+	return nil, ErrNoAudioSystem
+}
+
+// SetDefaultAudioSink makes the PulseAudio sink with the given name the
+// default audio output.
+func (b binding) SetDefaultAudioSink(ctx context.Context, deviceName string) error {
+	if !b.hasCommand(ctx, "pactl") {
+		return ErrNoAudioSystem
+	}
+	_, err := b.Shell("pactl", "set-default-sink", deviceName).Call(ctx)
+	return err
+}
+
+// VirtualDisplay is a headless display server running on the remote machine.
+type VirtualDisplay struct {
+	// DisplayNum is the number of the display.
+	DisplayNum int
+	// Name is the value of DISPLAY or WAYLAND_DISPLAY used to connect to the
+	// display, for example ":99".
+	Name    string
+	cleanup func(context.Context)
+}
+
+// Close stops the display server, and removes it from the binding's
+// environment.
+func (d *VirtualDisplay) Close(ctx context.Context) {
+	d.cleanup(ctx)
+}
+
+// startDisplayServer picks a display number with find, starts the display
+// server returned by start in the background and waits until socket, also
+// returned by start, is ready for connections. The PID of the server is
+// returned. ErrNoDisplayServer is returned if server is not installed.
+func (b binding) startDisplayServer(ctx context.Context, server, find string, start func(n int) (cmd, socket string)) (int, int, error) {
+	if !b.hasCommand(ctx, server) {
+		return 0, 0, ErrNoDisplayServer
+	}
+	out, err := b.posixShell(find).Call(ctx)
+	if err != nil {
+		return 0, 0, log.Errf(ctx, err, "Could not find a free display")
+	}
+	n, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, 0, log.Errf(ctx, err, "Could not find a free display")
+	}
+	cmd, socket := start(n)
+	out, err = b.posixShell("nohup " + cmd + " >/dev/null 2>&1 & echo $!").Call(ctx)
+	if err != nil {
+		return 0, 0, log.Errf(ctx, err, "Could not start display server")
+	}
+	pid, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, 0, log.Errf(ctx, err, "Could not start display server")
+	}
+	wait := fmt.Sprintf(`for i in $(seq 50); do [ -S %s ] && exit 0; sleep 0.1; done; exit 1`, socket)
+	if _, err := b.posixShell(wait).Call(ctx); err != nil {
+		b.Shell("kill", strconv.Itoa(pid)).Call(ctx)
+		return 0, 0, log.Errf(ctx, err, "Display server did not start")
+	}
+	return n, pid, nil
+}
+
+// newVirtualDisplay returns a VirtualDisplay for the server with the given
+// PID, setting the environment variable key to name on the binding.
+func (b binding) newVirtualDisplay(n, pid int, key, name string) *VirtualDisplay {
+	b.env.Set(key, name)
+	return &VirtualDisplay{
+		DisplayNum: n,
+		Name:       name,
+		cleanup: func(ctx context.Context) {
+			b.Shell("kill", strconv.Itoa(pid)).Call(ctx)
+			if b.env.Get(key) == name {
+				b.env.Unset(key)
+			}
+		},
+	}
+}
+
+// CreateVirtualDisplay starts an Xvfb X11 server with a single screen of the
+// given size on the remote machine. DISPLAY is set in the binding's
+// environment so that subsequent commands render to the new display.
+func (b binding) CreateVirtualDisplay(ctx context.Context, width, height, refreshHz int) (*VirtualDisplay, error) {
+	n, pid, err := b.startDisplayServer(ctx, "Xvfb",
+		`n=99; while [ -e /tmp/.X$n-lock ]; do n=$((n+1)); done; echo $n`,
+		func(n int) (string, string) {
+			return fmt.Sprintf("Xvfb :%d -screen 0 %dx%dx%d -fakescreenfps %d -nolisten tcp",
+					n, width, height, virtualDisplayDepth, refreshHz),
+				fmt.Sprintf("/tmp/.X11-unix/X%d", n)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return b.newVirtualDisplay(n, pid, "DISPLAY", fmt.Sprintf(":%d", n)), nil
+}
+
+// CreateWaylandDisplay starts a headless Weston compositor with an output of
+// the given size on the remote machine. WAYLAND_DISPLAY is set in the
+// binding's environment so that subsequent commands render to the new
+// display.
+func (b binding) CreateWaylandDisplay(ctx context.Context, width, height int) (*VirtualDisplay, error) {
+	n, pid, err := b.startDisplayServer(ctx, "weston",
+		`n=0; while [ -e "$XDG_RUNTIME_DIR/gapid-$n" ]; do n=$((n+1)); done; echo $n`,
+		func(n int) (string, string) {
+			return fmt.Sprintf("weston --backend=headless-backend.so --width=%d --height=%d --socket=gapid-%d",
+					width, height, n),
+				fmt.Sprintf(`"$XDG_RUNTIME_DIR/gapid-%d"`, n)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return b.newVirtualDisplay(n, pid, "WAYLAND_DISPLAY", fmt.Sprintf("gapid-%d", n)), nil
+}
+
+// FormatModifier is a DRM pixel format and the modifier describing the
+// tiling and compression layout of the buffer.
+type FormatModifier struct {
+	// Format is the DRM fourcc code, for example 0x34325258 for XR24.
+	Format uint64
+	// Modifier is the DRM format modifier, for example 0 for a linear
+	// buffer.
+	Modifier uint64
+	// Name is the name of the modifier, for example "I915_Y_TILED".
+	Name string
+}
+
+// drmModifierVendors are the vendor names of the top 8 bits of a DRM format
+// modifier, from drm_fourcc.h.
+var drmModifierVendors = []string{
+	"NONE", "INTEL", "AMD", "NVIDIA", "SAMSUNG", "QCOM", "VIVANTE",
+	"BROADCOM", "ARM", "ALLWINNER", "AMLOGIC",
+}
+
+// drmModifierNames are the names of the fixed modifiers from drm_fourcc.h.
+// Modifiers with vendor specific bitfields, such as AMD and ARM ones, are
+// only named by vendor.
+var drmModifierNames = map[uint64]string{
+	0:                  "LINEAR",
+	drmModifierInvalid: "INVALID",
+	1<<56 | 1:          "I915_X_TILED",
+	1<<56 | 2:          "I915_Y_TILED",
+	1<<56 | 3:          "I915_Yf_TILED",
+	1<<56 | 4:          "I915_Y_TILED_CCS",
+	1<<56 | 5:          "I915_Yf_TILED_CCS",
+	1<<56 | 6:          "I915_Y_TILED_GEN12_RC_CCS",
+	1<<56 | 7:          "I915_Y_TILED_GEN12_MC_CCS",
+	1<<56 | 8:          "I915_Y_TILED_GEN12_RC_CCS_CC",
+	1<<56 | 9:          "I915_4_TILED",
+	4<<56 | 1:          "SAMSUNG_64_32_TILE",
+	4<<56 | 2:          "SAMSUNG_16_16_TILE",
+	5<<56 | 1:          "QCOM_COMPRESSED",
+	6<<56 | 1:          "VIVANTE_TILED",
+	6<<56 | 2:          "VIVANTE_SUPER_TILED",
+	7<<56 | 1:          "BROADCOM_VC4_T_TILED",
+	9<<56 | 1:          "ALLWINNER_TILED",
+}
+
+// drmModifierName returns the name of a DRM format modifier, similar to
+// drmGetFormatModifierName.
+func drmModifierName(modifier uint64) string {
+	if name, ok := drmModifierNames[modifier]; ok {
+		return name
+	}
+	vendor := "UNKNOWN"
+	if v := int(modifier >> 56); v < len(drmModifierVendors) {
+		vendor = drmModifierVendors[v]
+	}
+	return fmt.Sprintf("%s(0x%x)", vendor, modifier&drmModifierInvalid)
+}
+
+var (
+	drmStateFormatRE   = regexp.MustCompile(`^\s*format=.*\((0x[0-9a-fA-F]+)\)`)
+	drmStateModifierRE = regexp.MustCompile(`^\s*modifier=(0x[0-9a-fA-F]+)`)
+)
+
+// parseDRMState returns the distinct format and modifier pairs of the
+// framebuffers listed in the contents of the DRM debugfs state file, where
+// each framebuffer has lines such as "format=XR24 little-endian (0x34325258)"
+// followed by "modifier=0x100000000000002".
+func parseDRMState(out string) []*FormatModifier {
+	list := []*FormatModifier{}
+	seen := map[[2]uint64]bool{}
+	format, haveFormat := uint64(0), false
+	for _, line := range strings.Split(out, "\n") {
+		if m := drmStateFormatRE.FindStringSubmatch(line); m != nil {
+			f, err := strconv.ParseUint(m[1], 0, 64)
+			format, haveFormat = f, err == nil
+			continue
+		}
+		m := drmStateModifierRE.FindStringSubmatch(line)
+		if m == nil || !haveFormat {
+			continue
+		}
+		modifier, err := strconv.ParseUint(m[1], 0, 64)
+		haveFormat = false
+		if err != nil || seen[[2]uint64{format, modifier}] {
+			continue
+		}
+		seen[[2]uint64{format, modifier}] = true
+		list = append(list, &FormatModifier{Format: format, Modifier: modifier, Name: drmModifierName(modifier)})
+	}
+	return list
+}
+
+// GetDRMFormatModifiers returns the formats and modifiers of the
+// framebuffers currently displayed on the first DRM device of the remote
+// machine, as reported by debugfs. This requires root on the remote machine.
+func (b binding) GetDRMFormatModifiers(ctx context.Context) ([]*FormatModifier, error) {
+	state, err := b.FileContents(ctx, driDebugFS+"/0/state")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read the DRM state")
+	}
+	return parseDRMState(state), nil
+}
+
+// parseXrandrRefreshRate returns the refresh rate of the current mode of the
+// named output in the output of xrandr --query, where the current mode is
+// marked with "*". If name is empty, the first active output is used.
+func parseXrandrRefreshRate(out, name string) (int, error) {
+	inOutput := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			// An output line, for example "HDMI-1 connected primary ...".
+			inOutput = len(fields) > 1 && fields[1] == "connected" && (name == "" || fields[0] == name)
+			continue
+		}
+		if !inOutput {
+			continue
+		}
+		// A mode line, for example "1920x1080 60.00*+ 50.00 59.94".
+		for _, f := range fields[1:] {
+			if !strings.Contains(f, "*") {
+				continue
+			}
+			rate, err := strconv.ParseFloat(strings.TrimRight(f, "*+"), 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid refresh rate %q", f)
+			}
+			return int(rate + 0.5), nil
+		}
+	}
+	return 0, ErrNoDisplay
+}
+
+// GetDisplayRefreshRate returns the refresh rate in Hz of the current mode
+// of the named X11 output, for example "HDMI-1". If displayName is empty, the
+// first active output is used.
+func (b binding) GetDisplayRefreshRate(ctx context.Context, displayName string) (int, error) {
+	if !b.hasCommand(ctx, "xrandr") {
+		return 0, ErrNoDisplay
+	}
+	out, err := callStdout(ctx, b.Shell("xrandr", "--query"))
+	if err != nil {
+		// xrandr fails when there is no X server to connect to.
+		return 0, ErrNoDisplay
+	}
+	return parseXrandrRefreshRate(out, displayName)
+}
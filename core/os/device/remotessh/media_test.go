@@ -0,0 +1,207 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseAudioDevices(t *testing.T) {
+	ctx := log.Testing(t)
+
+	pulse := parsePulseAudioSinks("0\talsa_output.pci-0000_00_1f.3.analog-stereo\tmodule-alsa-card.c\ts16le 2ch 44100Hz\tSUSPENDED\n" +
+		"1\thdmi\tmodule-alsa-card.c\ts32le 6ch 48000Hz\tRUNNING\n")
+	assert.For(ctx, "pulse").That(pulse).DeepEquals([]*AudioDevice{
+		{Name: "alsa_output.pci-0000_00_1f.3.analog-stereo", Driver: "module-alsa-card.c", Channels: 2, SampleRateHz: 44100},
+		{Name: "hdmi", Driver: "module-alsa-card.c", Channels: 6, SampleRateHz: 48000},
+	})
+
+	alsa := parseALSADevices(`**** List of PLAYBACK Hardware Devices ****
+card 0: PCH [HDA Intel PCH], device 0: ALC892 Analog [ALC892 Analog]
+  Subdevices: 1/1
+  Subdevice #0: subdevice #0
+card 1: NVidia [HDA NVidia], device 3: HDMI 0 [HDMI 0]
+`)
+	assert.For(ctx, "alsa").That(alsa).DeepEquals([]*AudioDevice{
+		{Name: "hw:0,0", Driver: "alsa"},
+		{Name: "hw:1,3", Driver: "alsa"},
+	})
+}
+
+func TestParseDRMState(t *testing.T) {
+	ctx := log.Testing(t)
+
+	list := parseDRMState(`plane[31]: plane-0
+	crtc=crtc-0
+	fb=95
+		allocated by = Xorg
+		refcount=2
+		format=XR24 little-endian (0x34325258)
+		modifier=0x100000000000002
+		size=1920x1080
+plane[40]: plane-1
+	crtc=(null)
+	fb=0
+plane[49]: cursor-0
+	crtc=crtc-0
+	fb=101
+		format=AR24 little-endian (0x34325241)
+		modifier=0x0
+plane[58]: plane-2
+	fb=102
+		format=AR24 little-endian (0x34325241)
+		modifier=0x0
+plane[67]: plane-3
+	fb=103
+		format=AB24 little-endian (0x34324241)
+		modifier=0x200000000401b01
+`)
+	assert.For(ctx, "list").That(list).DeepEquals([]*FormatModifier{
+		{Format: 0x34325258, Modifier: 0x100000000000002, Name: "I915_Y_TILED"},
+		{Format: 0x34325241, Modifier: 0, Name: "LINEAR"},
+		{Format: 0x34324241, Modifier: 0x200000000401b01, Name: "AMD(0x401b01)"},
+	})
+}
+
+func TestParseXrandrRefreshRate(t *testing.T) {
+	ctx := log.Testing(t)
+
+	out := `Screen 0: minimum 8 x 8, current 3840 x 1080, maximum 32767 x 32767
+HDMI-1 connected primary 1920x1080+0+0 (normal left inverted right x axis y axis) 531mm x 299mm
+   1920x1080     60.00 +  50.00    59.94*
+   1280x720      60.00    50.00
+DP-1 disconnected (normal left inverted right x axis y axis)
+DP-2 connected 1920x1080+1920+0 (normal left inverted right x axis y axis) 527mm x 296mm
+   1920x1080     60.00 + 144.00*  120.00
+`
+	for _, test := range []struct {
+		name string
+		rate int
+	}{
+		{"", 60},
+		{"HDMI-1", 60},
+		{"DP-2", 144},
+	} {
+		rate, err := parseXrandrRefreshRate(out, test.name)
+		assert.For(ctx, "%q err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%q rate", test.name).ThatInteger(rate).Equals(test.rate)
+	}
+
+	_, err := parseXrandrRefreshRate(out, "DP-1")
+	assert.For(ctx, "disconnected").ThatError(err).Equals(ErrNoDisplay)
+}
+
+// fakeXvfb is an Xvfb that listens on the socket of its display and holds its
+// lock file until it is stopped.
+const fakeXvfb = `exec python3 - "$@" <<'EOF'
+import os, signal, socket, sys, time
+n = sys.argv[1][1:]
+os.makedirs("/tmp/.X11-unix", exist_ok=True)
+path, lock = "/tmp/.X11-unix/X" + n, "/tmp/.X%s-lock" % n
+with open(lock, "w") as f:
+    f.write(str(os.getpid()))
+s = socket.socket(socket.AF_UNIX)
+s.bind(path)
+s.listen(1)
+def stop(*_):
+    os.unlink(path)
+    os.unlink(lock)
+    sys.exit(0)
+signal.signal(signal.SIGTERM, stop)
+while True:
+    time.sleep(1)
+EOF
+`
+
+func TestCreateVirtualDisplay(t *testing.T) {
+	ctx := log.Testing(t)
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	env := fakeCommands(t, dir, map[string]string{"Xvfb": fakeXvfb})
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+	d, err := b.CreateVirtualDisplay(ctx, 640, 480, 60)
+	assert.For(ctx, "CreateVirtualDisplay").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	assert.For(ctx, "DISPLAY").ThatString(env.Get("DISPLAY")).Equals(d.Name)
+	lock := fmt.Sprintf("/tmp/.X%d-lock", d.DisplayNum)
+	_, err = os.Stat(lock)
+	assert.For(ctx, "lock").ThatError(err).Succeeded()
+
+	// Closing the display stops the server, which removes its lock file.
+	d.Close(ctx)
+	assert.For(ctx, "DISPLAY after").ThatString(env.Get("DISPLAY")).Equals("")
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(lock); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.For(ctx, "lock after").That(os.IsNotExist(err)).Equals(true)
+}
+
+func TestCreateVirtualDisplayMissingServer(t *testing.T) {
+	ctx := log.Testing(t)
+	if _, err := exec.LookPath("Xvfb"); err == nil {
+		t.Skip("Xvfb is installed")
+	}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	env := shell.NewEnv().Set("PATH", os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+	start := time.Now()
+	_, err = b.CreateVirtualDisplay(ctx, 640, 480, 60)
+	assert.For(ctx, "CreateVirtualDisplay").ThatError(err).Equals(ErrNoDisplayServer)
+	assert.For(ctx, "fails fast").That(time.Since(start) < 5*time.Second).Equals(true)
+	assert.For(ctx, "DISPLAY").ThatString(env.Get("DISPLAY")).Equals("")
+}
@@ -0,0 +1,446 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+const (
+	// fragmentationOrder is the buddy allocator order of the blocks that
+	// fragmentation is measured against: 2^9 4KiB pages is a 2MiB huge page.
+	fragmentationOrder = 9
+	fragmentationBlock = 4096 << fragmentationOrder
+
+	nrHugePages = "/proc/sys/vm/nr_hugepages"
+)
+
+// FragStats holds memory fragmentation estimates. Ratios range from 0 (no
+// fragmentation) to 1 (fully fragmented), and are -1 when unknown.
+type FragStats struct {
+	// GPUFragRatio is the fraction of allocated VRAM that is held in objects
+	// smaller than 2MiB. It is only available for AMD GPUs, with root.
+	GPUFragRatio float64
+	// SysFragRatio is the fraction of free system memory that cannot be used
+	// for 2MiB allocations.
+	SysFragRatio float64
+	// GPUUsedMB and GPUFreeMB are the VRAM usage of the first GPU, or -1 if
+	// unknown.
+	GPUUsedMB int64
+	GPUFreeMB int64
+}
+
+// parseBuddyInfo returns the unusable free space index of the contents of
+// /proc/buddyinfo, where each line lists the number of free blocks of each
+// order for a zone, for example "Node 0, zone Normal 12 8 4 ...".
+func parseBuddyInfo(out string) float64 {
+	total, usable := int64(0), int64(0)
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, "zone")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i:])
+		if len(fields) < 3 {
+			continue
+		}
+		for order, f := range fields[2:] {
+			n, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				continue
+			}
+			pages := n << uint(order)
+			total += pages
+			if order >= fragmentationOrder {
+				usable += pages
+			}
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+	return float64(total-usable) / float64(total)
+}
+
+// parseAMDGemInfo returns the fraction of VRAM held in small objects from
+// the contents of amdgpu_gem_info, where each object is listed as
+// "0x00000001:      2097152 byte VRAM ...".
+func parseAMDGemInfo(out string) float64 {
+	total, small := int64(0), int64(0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "byte" || fields[3] != "VRAM" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		total += size
+		if size < fragmentationBlock {
+			small += size
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+	return float64(small) / float64(total)
+}
+
+// GetFragmentationStats returns estimates of the VRAM and system memory
+// fragmentation of the remote machine.
+func (b binding) GetFragmentationStats(ctx context.Context) (*FragStats, error) {
+	buddyinfo, err := b.FileContents(ctx, "/proc/buddyinfo")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read /proc/buddyinfo")
+	}
+	stats := &FragStats{
+		GPUFragRatio: -1,
+		SysFragRatio: parseBuddyInfo(buddyinfo),
+		GPUUsedMB:    -1,
+		GPUFreeMB:    -1,
+	}
+	if gem, err := b.FileContents(ctx, driDebugFS+"/0/amdgpu_gem_info"); err == nil {
+		stats.GPUFragRatio = parseAMDGemInfo(gem)
+	}
+	if b.hasCommand(ctx, "nvidia-smi") {
+		out, err := callStdout(ctx, b.Shell("nvidia-smi", "--query-gpu=memory.used,memory.free", "--format=csv,noheader,nounits"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run nvidia-smi")
+		}
+		if rows := parseNvidiaSmiCSV(out); len(rows) > 0 && len(rows[0]) == 2 {
+			stats.GPUUsedMB, _ = strconv.ParseInt(rows[0][0], 10, 64)
+			stats.GPUFreeMB, _ = strconv.ParseInt(rows[0][1], 10, 64)
+		}
+	}
+	return stats, nil
+}
+
+// parseMeminfo parses the contents of /proc/meminfo, or of other /proc files
+// with "<name>: <value> [unit]" lines, into a map of field name to value.
+// Sizes in /proc/meminfo are in KiB, and page counts have no unit.
+func parseMeminfo(out string) map[string]int64 {
+	fields := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Fields(parts[1])
+		if len(value) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(value[0], 10, 64); err == nil {
+			fields[strings.TrimSpace(parts[0])] = v
+		}
+	}
+	return fields
+}
+
+// MemoryInfo describes the physical memory of the remote machine.
+type MemoryInfo struct {
+	TotalBytes int64
+	// FreeBytes is the memory that is not used at all.
+	FreeBytes int64
+	// AvailableBytes is the memory that can be used without swapping,
+	// including caches that the system would reclaim.
+	AvailableBytes int64
+}
+
+func parseMemoryInfo(meminfo string) *MemoryInfo {
+	m := parseMeminfo(meminfo)
+	available, ok := m["MemAvailable"]
+	if !ok {
+		// Kernels older than 3.14 do not estimate the available memory.
+		available = m["MemFree"] + m["Buffers"] + m["Cached"]
+	}
+	return &MemoryInfo{
+		TotalBytes:     m["MemTotal"] * 1024,
+		FreeBytes:      m["MemFree"] * 1024,
+		AvailableBytes: available * 1024,
+	}
+}
+
+var vmStatPageSize = regexp.MustCompile(`page size of (\d+) bytes`)
+
+// parseVMStat parses the output of the macOS vm_stat, which counts pages,
+// for example "Pages free:      12345.", and the memory size from sysctl.
+func parseVMStat(vmstat, memsize string) (*MemoryInfo, error) {
+	total, err := strconv.ParseInt(strings.TrimSpace(memsize), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid memory size %q", strings.TrimSpace(memsize))
+	}
+	match := vmStatPageSize.FindStringSubmatch(vmstat)
+	if match == nil {
+		return nil, fmt.Errorf("No page size in vm_stat output")
+	}
+	pageSize, _ := strconv.ParseInt(match[1], 10, 64)
+	m := parseMeminfo(strings.Replace(vmstat, ".", "", -1))
+	free := m["Pages free"] - m["Pages speculative"]
+	return &MemoryInfo{
+		TotalBytes:     total,
+		FreeBytes:      free * pageSize,
+		AvailableBytes: (free + m["Pages speculative"] + m["Pages inactive"] + m["Pages purgeable"]) * pageSize,
+	}, nil
+}
+
+// parseWin32Memory parses the total and free memory in KiB from
+// Win32_OperatingSystem, each on its own line.
+func parseWin32Memory(out string) (*MemoryInfo, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Invalid memory information %q", out)
+	}
+	total, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	free, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	// Windows counts the standby list, its cache, as free.
+	return &MemoryInfo{
+		TotalBytes:     total * 1024,
+		FreeBytes:      free * 1024,
+		AvailableBytes: free * 1024,
+	}, nil
+}
+
+// GetMemoryInfo returns the total, free and available physical memory of
+// the remote machine.
+func (b binding) GetMemoryInfo(ctx context.Context) (*MemoryInfo, error) {
+	switch b.os {
+	case device.Windows:
+		out, err := callStdout(ctx, b.powerShell("$o = Get-WmiObject Win32_OperatingSystem; "+
+			"$o.TotalVisibleMemorySize; $o.FreePhysicalMemory"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not get the memory information")
+		}
+		return parseWin32Memory(out)
+	case device.OSX:
+		vmstat, err := callStdout(ctx, b.Shell("vm_stat"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run vm_stat")
+		}
+		memsize, err := callStdout(ctx, b.Shell("sysctl", "-n", "hw.memsize"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not get the memory size")
+		}
+		return parseVMStat(vmstat, memsize)
+	default:
+		meminfo, err := b.FileContents(ctx, "/proc/meminfo")
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not read /proc/meminfo")
+		}
+		return parseMemoryInfo(meminfo), nil
+	}
+}
+
+// WarnIfLowMemory logs a warning if the remote machine has less available
+// memory than the MinAvailableMemory of its configuration.
+func (b binding) WarnIfLowMemory(ctx context.Context) {
+	min := b.configuration.MinAvailableMemory
+	if min <= 0 {
+		return
+	}
+	info, err := b.GetMemoryInfo(ctx)
+	if err != nil {
+		log.W(ctx, "Could not check the available memory: %v", err)
+		return
+	}
+	if info.AvailableBytes < min {
+		log.W(ctx, "Only %d MiB of memory is available on %v, less than the %d MiB expected",
+			info.AvailableBytes>>20, b, min>>20)
+	}
+}
+
+// HugeTLBInfo describes the pool of default sized huge pages.
+type HugeTLBInfo struct {
+	Total    int64
+	Free     int64
+	Reserved int64
+	Surplus  int64
+	// PageSizeKB is the size of a huge page in KiB, for example 2048.
+	PageSizeKB int64
+}
+
+func parseHugeTLBInfo(meminfo string) *HugeTLBInfo {
+	m := parseMeminfo(meminfo)
+	return &HugeTLBInfo{
+		Total:      m["HugePages_Total"],
+		Free:       m["HugePages_Free"],
+		Reserved:   m["HugePages_Rsvd"],
+		Surplus:    m["HugePages_Surp"],
+		PageSizeKB: m["Hugepagesize"],
+	}
+}
+
+// GetHugeTLBInfo returns the state of the huge page pool of the remote
+// machine.
+func (b binding) GetHugeTLBInfo(ctx context.Context) (*HugeTLBInfo, error) {
+	meminfo, err := b.FileContents(ctx, "/proc/meminfo")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read /proc/meminfo")
+	}
+	return parseHugeTLBInfo(meminfo), nil
+}
+
+// setHugePages resizes the huge page pool to count pages.
+func (b binding) setHugePages(ctx context.Context, count int) error {
+	if _, err := callStdout(ctx, b.posixShell(fmt.Sprintf("echo %d > %s", count, nrHugePages))); err != nil {
+		return log.Errf(ctx, err, "Could not set the number of huge pages")
+	}
+	return nil
+}
+
+// AllocateHugePages resizes the huge page pool to count pages. The kernel
+// may not find enough contiguous memory, in which case an error is returned
+// and the pool holds as many pages as could be allocated. This requires root
+// on the remote machine.
+func (b binding) AllocateHugePages(ctx context.Context, count int) error {
+	if err := b.setHugePages(ctx, count); err != nil {
+		return err
+	}
+	out, err := b.FileContents(ctx, nrHugePages)
+	if err != nil {
+		return log.Errf(ctx, err, "Could not read %s", nrHugePages)
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(out)); err != nil || n < count {
+		return fmt.Errorf("Only %s of %d huge pages could be allocated", strings.TrimSpace(out), count)
+	}
+	return nil
+}
+
+// FreeHugePages releases all the unused pages of the huge page pool. This
+// requires root on the remote machine.
+func (b binding) FreeHugePages(ctx context.Context) error {
+	return b.setHugePages(ctx, 0)
+}
+
+// SharedMemInfo is a shared memory mapping of a process.
+type SharedMemInfo struct {
+	// Name is the path of the mapped file, for example "/dev/shm/ring" or
+	// "/memfd:wayland-shm".
+	Name      string
+	StartAddr uint64
+	EndAddr   uint64
+	SizeBytes int64
+	// Perm are the mapping permissions, for example "rw-s".
+	Perm string
+}
+
+// parseSharedMaps returns the POSIX shared memory and memfd mappings listed
+// in the contents of /proc/<pid>/maps, where each line is formatted as
+// "<start>-<end> <perm> <offset> <dev> <inode> [path]".
+func parseSharedMaps(out string) []*SharedMemInfo {
+	list := []*SharedMemInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		// The path may contain spaces.
+		name := strings.TrimSuffix(strings.Join(fields[5:], " "), " (deleted)")
+		if !strings.HasPrefix(name, "/dev/shm/") && !strings.HasPrefix(name, "/memfd:") {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			continue
+		}
+		start, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		list = append(list, &SharedMemInfo{
+			Name:      name,
+			StartAddr: start,
+			EndAddr:   end,
+			SizeBytes: int64(end - start),
+			Perm:      fields[1],
+		})
+	}
+	return list
+}
+
+// GetMMappedFiles returns the POSIX shared memory and memfd mappings of the
+// process with the given PID.
+func (b binding) GetMMappedFiles(ctx context.Context, pid int) ([]*SharedMemInfo, error) {
+	file := fmt.Sprintf("/proc/%d/maps", pid)
+	out, err := b.FileContents(ctx, file)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read %s", file)
+	}
+	return parseSharedMaps(out), nil
+}
+
+// SHMSegment is a System V shared memory segment.
+type SHMSegment struct {
+	// Key is the IPC key, for example "0x00000000".
+	Key   string
+	ID    int
+	Owner string
+	// Perms are the octal access permissions, for example "600".
+	Perms     string
+	SizeBytes int64
+	// Attached is the number of processes attached to the segment.
+	Attached int
+	// Status is "dest" if the segment is marked for destruction, and may
+	// also list "locked".
+	Status string
+}
+
+// parseIPCSSegments parses the output of ipcs -m.
+func parseIPCSSegments(out string) []*SHMSegment {
+	list := []*SHMSegment{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "0x") {
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		s := &SHMSegment{Key: fields[0], ID: id, Owner: fields[2], Perms: fields[3]}
+		s.SizeBytes, _ = strconv.ParseInt(fields[4], 10, 64)
+		s.Attached, _ = strconv.Atoi(fields[5])
+		s.Status = strings.Join(fields[6:], " ")
+		list = append(list, s)
+	}
+	return list
+}
+
+// GetSHMSegments returns the System V shared memory segments of the remote
+// machine.
+func (b binding) GetSHMSegments(ctx context.Context) ([]*SHMSegment, error) {
+	out, err := callStdout(ctx, b.Shell("ipcs", "-m"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not run ipcs")
+	}
+	return parseIPCSSegments(out), nil
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestParseFragmentation(t *testing.T) {
+	ctx := log.Testing(t)
+
+	// 512 free pages in small blocks, 1536 in 2MiB or larger blocks.
+	sys := parseBuddyInfo(`Node 0, zone      DMA      0      0      0      0      0      0      0      0      0      0      1
+Node 0, zone   Normal    256     32     16     8      2      1      0      0      0      1      0
+`)
+	assert.For(ctx, "sys").ThatFloat(sys).Equals(0.25, 0.0001)
+	assert.For(ctx, "empty").ThatFloat(parseBuddyInfo("")).Equals(-1, 0)
+
+	gpu := parseAMDGemInfo(`pid     1234 command Xorg:
+		0x00000001:      6291456 byte VRAM CPU_ACCESS_REQUIRED
+		0x00000002:      2097152 byte  GTT
+		0x00000003:      1048576 byte VRAM
+		0x00000004:      1048576 byte VRAM NO_CPU_ACCESS
+`)
+	assert.For(ctx, "gpu").ThatFloat(gpu).Equals(0.25, 0.0001)
+}
+
+func TestParseHugeTLBInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info := parseHugeTLBInfo(`MemTotal:       32795812 kB
+MemFree:        20147440 kB
+HugePages_Total:     512
+HugePages_Free:      384
+HugePages_Rsvd:       16
+HugePages_Surp:        2
+Hugepagesize:       2048 kB
+Hugetlb:         1048576 kB
+`)
+	assert.For(ctx, "info").That(info).DeepEquals(&HugeTLBInfo{
+		Total:      512,
+		Free:       384,
+		Reserved:   16,
+		Surplus:    2,
+		PageSizeKB: 2048,
+	})
+}
+
+func TestParseMemoryInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info := parseMemoryInfo(`MemTotal:       32795812 kB
+MemFree:        20147440 kB
+MemAvailable:   27525120 kB
+Buffers:          512000 kB
+`)
+	assert.For(ctx, "meminfo").That(info).DeepEquals(&MemoryInfo{
+		TotalBytes:     32795812 * 1024,
+		FreeBytes:      20147440 * 1024,
+		AvailableBytes: 27525120 * 1024,
+	})
+	info = parseMemoryInfo(`MemTotal:       1000 kB
+MemFree:         100 kB
+Buffers:          20 kB
+Cached:          300 kB
+`)
+	assert.For(ctx, "old meminfo").That(info.AvailableBytes).Equals(int64(420 * 1024))
+
+	info, err := parseVMStat(`Mach Virtual Memory Statistics: (page size of 16384 bytes)
+Pages free:                                9472.
+Pages active:                            420110.
+Pages inactive:                          410368.
+Pages speculative:                         1024.
+Pages throttled:                              0.
+Pages wired down:                        120530.
+Pages purgeable:                          16000.
+"Translation faults":                1236580318.
+`, "17179869184\n")
+	assert.For(ctx, "vm_stat err").ThatError(err).Succeeded()
+	assert.For(ctx, "vm_stat").That(info).DeepEquals(&MemoryInfo{
+		TotalBytes:     17179869184,
+		FreeBytes:      8448 * 16384,
+		AvailableBytes: (9472 + 410368 + 16000) * 16384,
+	})
+	_, err = parseVMStat("Pages free: 9472.", "17179869184")
+	assert.For(ctx, "no page size").ThatError(err).Failed()
+
+	info, err = parseWin32Memory("16658216\r\n9035412\r\n")
+	assert.For(ctx, "win32 err").ThatError(err).Succeeded()
+	assert.For(ctx, "win32").That(info).DeepEquals(&MemoryInfo{
+		TotalBytes:     16658216 * 1024,
+		FreeBytes:      9035412 * 1024,
+		AvailableBytes: 9035412 * 1024,
+	})
+	_, err = parseWin32Memory("")
+	assert.For(ctx, "win32 empty").ThatError(err).Failed()
+}
+
+func TestParseSharedMemory(t *testing.T) {
+	ctx := log.Testing(t)
+
+	maps := parseSharedMaps(`55d4c3a00000-55d4c3a21000 r-xp 00000000 08:02 1837826    /usr/bin/app
+7f1c2a000000-7f1c2a200000 rw-s 00000000 00:19 12345      /dev/shm/gapid ring
+7f1c2b000000-7f1c2b010000 rw-s 00000000 00:01 2048       /memfd:wayland-shm (deleted)
+7ffd1e5d8000-7ffd1e5f9000 rw-p 00000000 00:00 0          [stack]
+`)
+	assert.For(ctx, "maps").That(maps).DeepEquals([]*SharedMemInfo{
+		{Name: "/dev/shm/gapid ring", StartAddr: 0x7f1c2a000000, EndAddr: 0x7f1c2a200000, SizeBytes: 0x200000, Perm: "rw-s"},
+		{Name: "/memfd:wayland-shm", StartAddr: 0x7f1c2b000000, EndAddr: 0x7f1c2b010000, SizeBytes: 0x10000, Perm: "rw-s"},
+	})
+
+	segments := parseIPCSSegments(`
+------ Shared Memory Segments --------
+key        shmid      owner      perms      bytes      nattch     status
+0x00000000 32768      user       600        524288     2          dest
+0x0052e2c1 65537      postgres   600        56         6
+`)
+	assert.For(ctx, "segments").That(segments).DeepEquals([]*SHMSegment{
+		{Key: "0x00000000", ID: 32768, Owner: "user", Perms: "600", SizeBytes: 524288, Attached: 2, Status: "dest"},
+		{Key: "0x0052e2c1", ID: 65537, Owner: "postgres", Perms: "600", SizeBytes: 56, Attached: 6},
+	})
+}
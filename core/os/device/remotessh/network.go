@@ -0,0 +1,491 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+const (
+	// ErrRDMANotAvailable is returned by GetRDMADevices when ibv_devinfo is
+	// not installed on the remote machine.
+	ErrRDMANotAvailable = fault.Const("ibv_devinfo not found")
+)
+
+var ifaceRE = regexp.MustCompile(`^[a-zA-Z0-9_.:@-]+$`)
+
+// RDMADevice is an RDMA capable network adapter, such as an InfiniBand or
+// RoCE host channel adapter.
+type RDMADevice struct {
+	// Name is the HCA identifier, for example "mlx5_0".
+	Name string
+	// NodeGUID and SystemImageGUID are the GUIDs of the adapter, for example
+	// "0c42:a103:0065:b1a4".
+	NodeGUID        string
+	SystemImageGUID string
+	Ports           []RDMAPort
+}
+
+// RDMAPort is a physical port of an RDMADevice.
+type RDMAPort struct {
+	// Speed is the active link speed in Gb/s, across all lanes.
+	Speed int
+	// MTU is the active MTU in bytes.
+	MTU int
+	// State is the port state, for example "PORT_ACTIVE".
+	State string
+	// LinkLayer is either "InfiniBand" or "Ethernet" (for RoCE).
+	LinkLayer string
+}
+
+// parseIBVDevInfo parses the output of ibv_devinfo -v.
+func parseIBVDevInfo(out string) []*RDMADevice {
+	devices := []*RDMADevice{}
+	var dev *RDMADevice
+	var port *RDMAPort
+	width := 0
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+		// Enumerated values are followed by their numeric value, for example
+		// "PORT_ACTIVE (4)".
+		first := value
+		if i := strings.Index(value, " ("); i >= 0 {
+			first = value[:i]
+		}
+		switch {
+		case key == "hca_id":
+			dev = &RDMADevice{Name: value, Ports: []RDMAPort{}}
+			port = nil
+			devices = append(devices, dev)
+		case dev == nil:
+		case key == "node_guid":
+			dev.NodeGUID = value
+		case key == "sys_image_guid":
+			dev.SystemImageGUID = value
+		case key == "port":
+			dev.Ports = append(dev.Ports, RDMAPort{})
+			port = &dev.Ports[len(dev.Ports)-1]
+			width = 1
+		case port == nil:
+		case key == "state":
+			port.State = first
+		case key == "active_mtu":
+			port.MTU, _ = strconv.Atoi(first)
+		case key == "link_layer":
+			port.LinkLayer = first
+		case key == "active_width":
+			// For example "4X (2)".
+			width, _ = strconv.Atoi(strings.TrimSuffix(first, "X"))
+		case key == "active_speed":
+			// For example "25.0 Gbps (32)". The width is listed first.
+			if fields := strings.Fields(first); len(fields) > 0 {
+				if gbps, err := strconv.ParseFloat(fields[0], 64); err == nil {
+					port.Speed = int(gbps * float64(width))
+				}
+			}
+		}
+	}
+	return devices
+}
+
+// GetRDMADevices returns the RDMA adapters of the remote machine.
+func (b binding) GetRDMADevices(ctx context.Context) ([]*RDMADevice, error) {
+	if !b.hasCommand(ctx, "ibv_devinfo") {
+		return nil, ErrRDMANotAvailable
+	}
+	out, err := callStdout(ctx, b.Shell("ibv_devinfo", "-v"))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not run ibv_devinfo")
+	}
+	return parseIBVDevInfo(out), nil
+}
+
+// Qdisc is a traffic control queueing discipline.
+type Qdisc struct {
+	// Kind is the type of the qdisc, for example "tbf" or "htb".
+	Kind string
+	// Handle is the qdisc identifier, for example "8001:".
+	Handle string
+	// Parent is "root" or the class the qdisc is attached to.
+	Parent string
+	// RateBitsPerSecond is the shaping rate, or 0 if the qdisc does not
+	// shape traffic.
+	RateBitsPerSecond int64
+	// Options are the remaining parameters, as printed by tc.
+	Options string
+}
+
+// Class is a traffic control class of a classful qdisc.
+type Class struct {
+	// Kind is the type of the owning qdisc, for example "htb".
+	Kind string
+	// ClassID is the class identifier, for example "1:10".
+	ClassID string
+	// Parent is "root" or the parent class.
+	Parent            string
+	RateBitsPerSecond int64
+	CeilBitsPerSecond int64
+	// Options are the remaining parameters, as printed by tc.
+	Options string
+}
+
+// QoSConfig is the traffic control configuration of a network interface.
+type QoSConfig struct {
+	Qdiscs  []Qdisc
+	Classes []Class
+}
+
+// tcRateUnits are the suffixes tc uses for rates, longest first.
+var tcRateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"tibit", 1 << 40}, {"gibit", 1 << 30}, {"mibit", 1 << 20}, {"kibit", 1 << 10},
+	{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// parseTCRate parses a tc rate, for example "100Mbit", into bits per second.
+func parseTCRate(rate string) (int64, error) {
+	lower := strings.ToLower(rate)
+	for _, u := range tcRateUnits {
+		if strings.HasSuffix(lower, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(lower, u.suffix), 64)
+			if err != nil {
+				break
+			}
+			return int64(v * u.scale), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid rate %q", rate)
+}
+
+// parseTCLine splits a line of tc show output of the form
+// "<qdisc|class> <kind> <id> <root|parent <id>> [options...]".
+func parseTCLine(line, prefix string) (kind, id, parent string, options []string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != prefix {
+		return "", "", "", nil, false
+	}
+	kind, id, options = fields[1], fields[2], fields[3:]
+	switch {
+	case options[0] == "root":
+		parent, options = "root", options[1:]
+	case options[0] == "parent" && len(options) > 1:
+		parent, options = options[1], options[2:]
+	}
+	return kind, id, parent, options, true
+}
+
+// takeTCRate removes the value following key from options and parses it as
+// a rate.
+func takeTCRate(options []string, key string) (int64, []string) {
+	for i := 0; i+1 < len(options); i++ {
+		if options[i] == key {
+			if rate, err := parseTCRate(options[i+1]); err == nil {
+				return rate, append(options[:i:i], options[i+2:]...)
+			}
+		}
+	}
+	return 0, options
+}
+
+// parseTCQdiscs parses the output of tc qdisc show.
+func parseTCQdiscs(out string) []Qdisc {
+	qdiscs := []Qdisc{}
+	for _, line := range strings.Split(out, "\n") {
+		kind, id, parent, options, ok := parseTCLine(line, "qdisc")
+		if !ok {
+			continue
+		}
+		q := Qdisc{Kind: kind, Handle: id, Parent: parent}
+		q.RateBitsPerSecond, options = takeTCRate(options, "rate")
+		q.Options = strings.Join(options, " ")
+		qdiscs = append(qdiscs, q)
+	}
+	return qdiscs
+}
+
+// parseTCClasses parses the output of tc class show.
+func parseTCClasses(out string) []Class {
+	classes := []Class{}
+	for _, line := range strings.Split(out, "\n") {
+		kind, id, parent, options, ok := parseTCLine(line, "class")
+		if !ok {
+			continue
+		}
+		c := Class{Kind: kind, ClassID: id, Parent: parent}
+		c.RateBitsPerSecond, options = takeTCRate(options, "rate")
+		c.CeilBitsPerSecond, options = takeTCRate(options, "ceil")
+		c.Options = strings.Join(options, " ")
+		classes = append(classes, c)
+	}
+	return classes
+}
+
+// GetNetworkQoS returns the traffic control configuration of the given
+// network interface.
+func (b binding) GetNetworkQoS(ctx context.Context, iface string) (*QoSConfig, error) {
+	if !ifaceRE.MatchString(iface) {
+		return nil, fmt.Errorf("Invalid network interface %q", iface)
+	}
+	qdiscs, err := callStdout(ctx, b.Shell("tc", "qdisc", "show", "dev", iface))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not list qdiscs of %s", iface)
+	}
+	classes, err := callStdout(ctx, b.Shell("tc", "class", "show", "dev", iface))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not list classes of %s", iface)
+	}
+	return &QoSConfig{Qdiscs: parseTCQdiscs(qdiscs), Classes: parseTCClasses(classes)}, nil
+}
+
+// SetNetworkRateLimit replaces the root qdisc of the given network interface
+// with a token bucket filter limiting egress to bitsPerSecond. This requires
+// root on the remote machine.
+func (b binding) SetNetworkRateLimit(ctx context.Context, iface string, bitsPerSecond int64) error {
+	if !ifaceRE.MatchString(iface) {
+		return fmt.Errorf("Invalid network interface %q", iface)
+	}
+	if bitsPerSecond <= 0 {
+		return fmt.Errorf("Invalid rate %d", bitsPerSecond)
+	}
+	// The bucket has to hold at least a timer tick worth of data, and at
+	// least one full packet.
+	burst := bitsPerSecond / 8 / 100
+	if burst < 1600 {
+		burst = 1600
+	}
+	_, err := callStdout(ctx, b.Shell("tc", "qdisc", "replace", "dev", iface, "root", "tbf",
+		"rate", fmt.Sprintf("%dbit", bitsPerSecond), "burst", strconv.FormatInt(burst, 10), "latency", "50ms"))
+	if err != nil {
+		return log.Errf(ctx, err, "Could not limit rate of %s", iface)
+	}
+	return nil
+}
+
+// GetHostname returns the hostname of the remote machine, which tells apart
+// machines reached through the same address. It is read once, and then
+// remembered by the binding.
+func (b binding) GetHostname(ctx context.Context) (string, error) {
+	return b.info.get("hostname", func() (string, error) {
+		out, err := callStdout(ctx, b.Shell("hostname"))
+		if err != nil {
+			return "", log.Errf(ctx, err, "Could not get the hostname")
+		}
+		return strings.TrimSpace(out), nil
+	})
+}
+
+// GetFQDN returns the fully qualified domain name of the remote machine, for
+// when its hostname is ambiguous. It is read once, and then remembered by the
+// binding.
+func (b binding) GetFQDN(ctx context.Context) (string, error) {
+	return b.info.get("fqdn", func() (string, error) {
+		cmd := b.Shell("hostname", "-f")
+		if b.os == device.Windows {
+			cmd = b.powerShell("[Console]::Out.Write([System.Net.Dns]::GetHostEntry('').HostName)")
+		}
+		out, err := callStdout(ctx, cmd)
+		if err != nil {
+			return "", log.Errf(ctx, err, "Could not get the fully qualified domain name")
+		}
+		return strings.TrimSpace(out), nil
+	})
+}
+
+// RemoteInterface is a network interface of the remote machine.
+type RemoteInterface struct {
+	// Name is the name of the interface, for example "eth0" or "Ethernet 2".
+	Name string
+	// HardwareAddr is the MAC address in lower case, colon separated form,
+	// or "" if the interface has none.
+	HardwareAddr string
+	// Addrs are the IPv4 and IPv6 addresses of the interface, with their
+	// prefix length, for example "192.168.1.2/24".
+	Addrs []string
+}
+
+// parseIPAddrJSON parses the output of ip -j addr.
+func parseIPAddrJSON(out string) ([]RemoteInterface, error) {
+	links := []struct {
+		Name     string `json:"ifname"`
+		Address  string `json:"address"`
+		AddrInfo []struct {
+			Local     string `json:"local"`
+			PrefixLen int    `json:"prefixlen"`
+		} `json:"addr_info"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &links); err != nil {
+		return nil, err
+	}
+	ifaces := []RemoteInterface{}
+	for _, l := range links {
+		iface := RemoteInterface{Name: l.Name, Addrs: []string{}}
+		if l.Address != "00:00:00:00:00:00" {
+			iface.HardwareAddr = strings.ToLower(l.Address)
+		}
+		for _, a := range l.AddrInfo {
+			if a.Local != "" {
+				iface.Addrs = append(iface.Addrs, fmt.Sprintf("%s/%d", a.Local, a.PrefixLen))
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+// parseIfconfig parses the output of ifconfig for the interface called name,
+// as printed by macOS.
+func parseIfconfig(name, out string) RemoteInterface {
+	iface := RemoteInterface{Name: name, Addrs: []string{}}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "ether":
+			iface.HardwareAddr = strings.ToLower(fields[1])
+		case "inet":
+			// For example "inet 192.168.1.5 netmask 0xffffff00 broadcast ...".
+			prefix := 32
+			for i := 2; i+1 < len(fields); i++ {
+				if fields[i] == "netmask" {
+					if mask, err := strconv.ParseUint(strings.TrimPrefix(fields[i+1], "0x"), 16, 32); err == nil {
+						prefix = bits.OnesCount32(uint32(mask))
+					}
+				}
+			}
+			iface.Addrs = append(iface.Addrs, fmt.Sprintf("%s/%d", fields[1], prefix))
+		case "inet6":
+			// For example "inet6 fe80::1%lo0 prefixlen 64 scopeid 0x1".
+			addr, prefix := strings.SplitN(fields[1], "%", 2)[0], 128
+			for i := 2; i+1 < len(fields); i++ {
+				if fields[i] == "prefixlen" {
+					if n, err := strconv.Atoi(fields[i+1]); err == nil {
+						prefix = n
+					}
+				}
+			}
+			iface.Addrs = append(iface.Addrs, fmt.Sprintf("%s/%d", addr, prefix))
+		}
+	}
+	return iface
+}
+
+// windowsInterfacesScript prints the addresses of Get-NetIPAddress and the
+// MAC addresses of Get-NetAdapter as a JSON object.
+const windowsInterfacesScript = `ConvertTo-Json -InputObject @{` +
+	`Addresses = @(Get-NetIPAddress | Select-Object InterfaceAlias, IPAddress, PrefixLength); ` +
+	`Adapters = @(Get-NetAdapter | Select-Object Name, MacAddress)}`
+
+// parseNetIPAddressJSON parses the output of windowsInterfacesScript.
+func parseNetIPAddressJSON(out string) ([]RemoteInterface, error) {
+	info := struct {
+		Addresses []struct {
+			InterfaceAlias string
+			IPAddress      string
+			PrefixLength   int
+		}
+		Adapters []struct {
+			Name       string
+			MacAddress string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return nil, err
+	}
+	ifaces := []RemoteInterface{}
+	index := map[string]int{}
+	get := func(name string) *RemoteInterface {
+		i, ok := index[name]
+		if !ok {
+			i = len(ifaces)
+			index[name] = i
+			ifaces = append(ifaces, RemoteInterface{Name: name, Addrs: []string{}})
+		}
+		return &ifaces[i]
+	}
+	for _, a := range info.Addresses {
+		iface := get(a.InterfaceAlias)
+		// Link local IPv6 addresses are followed by their zone, for example
+		// "fe80::1%12".
+		addr := strings.SplitN(a.IPAddress, "%", 2)[0]
+		iface.Addrs = append(iface.Addrs, fmt.Sprintf("%s/%d", addr, a.PrefixLength))
+	}
+	for _, a := range info.Adapters {
+		// For example "00-15-5D-01-02-03".
+		get(a.Name).HardwareAddr = strings.ToLower(strings.Replace(a.MacAddress, "-", ":", -1))
+	}
+	return ifaces, nil
+}
+
+// GetNetworkInterfaces returns the network interfaces of the remote machine,
+// and their addresses. It uses ip on Linux, ifconfig on macOS and
+// Get-NetIPAddress on Windows.
+func (b binding) GetNetworkInterfaces(ctx context.Context) ([]RemoteInterface, error) {
+	switch b.os {
+	case device.Linux:
+		out, err := callStdout(ctx, b.Shell("ip", "-j", "addr"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list the network interfaces")
+		}
+		ifaces, err := parseIPAddrJSON(out)
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not parse the output of ip")
+		}
+		return ifaces, nil
+	case device.OSX:
+		out, err := callStdout(ctx, b.Shell("ifconfig", "-l"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list the network interfaces")
+		}
+		ifaces := []RemoteInterface{}
+		for _, name := range strings.Fields(out) {
+			out, err := callStdout(ctx, b.Shell("ifconfig", name))
+			if err != nil {
+				return nil, log.Errf(ctx, err, "Could not get the addresses of %s", name)
+			}
+			ifaces = append(ifaces, parseIfconfig(name, out))
+		}
+		return ifaces, nil
+	case device.Windows:
+		out, err := callStdout(ctx, b.powerShell(windowsInterfacesScript))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list the network interfaces")
+		}
+		ifaces, err := parseNetIPAddressJSON(out)
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not parse the output of Get-NetIPAddress")
+		}
+		return ifaces, nil
+	}
+	return nil, log.Errf(ctx, nil, "Listing network interfaces is not supported on %v", b.os)
+}
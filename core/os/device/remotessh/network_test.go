@@ -0,0 +1,231 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseIBVDevInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	devices := parseIBVDevInfo(`hca_id:	mlx5_0
+	transport:			InfiniBand (0)
+	fw_ver:				16.27.2008
+	node_guid:			0c42:a103:0065:b1a4
+	sys_image_guid:			0c42:a103:0065:b1a4
+	vendor_id:			0x02c9
+	phys_port_cnt:			1
+		port:	1
+			state:			PORT_ACTIVE (4)
+			max_mtu:		4096 (5)
+			active_mtu:		4096 (5)
+			sm_lid:			1
+			active_width:		4X (2)
+			active_speed:		25.0 Gbps (32)
+			phys_state:		LINK_UP (5)
+			link_layer:		InfiniBand
+
+hca_id:	rxe0
+	transport:			InfiniBand (0)
+	node_guid:			5054:00ff:fe12:3456
+	sys_image_guid:			0000:0000:0000:0000
+	phys_port_cnt:			1
+		port:	1
+			state:			PORT_DOWN (1)
+			active_mtu:		1024 (3)
+			active_width:		1X (1)
+			active_speed:		2.5 Gbps (1)
+			link_layer:		Ethernet
+`)
+	assert.For(ctx, "devices").That(devices).DeepEquals([]*RDMADevice{
+		{
+			Name:            "mlx5_0",
+			NodeGUID:        "0c42:a103:0065:b1a4",
+			SystemImageGUID: "0c42:a103:0065:b1a4",
+			Ports:           []RDMAPort{{Speed: 100, MTU: 4096, State: "PORT_ACTIVE", LinkLayer: "InfiniBand"}},
+		},
+		{
+			Name:            "rxe0",
+			NodeGUID:        "5054:00ff:fe12:3456",
+			SystemImageGUID: "0000:0000:0000:0000",
+			Ports:           []RDMAPort{{Speed: 2, MTU: 1024, State: "PORT_DOWN", LinkLayer: "Ethernet"}},
+		},
+	})
+}
+
+func TestParseTC(t *testing.T) {
+	ctx := log.Testing(t)
+
+	qdiscs := parseTCQdiscs(`qdisc htb 1: root refcnt 2 r2q 10 default 0x30 direct_packets_stat 0
+qdisc sfq 10: parent 1:10 limit 127p quantum 1514b depth 127 divisor 1024
+qdisc tbf 8001: parent 1:20 rate 2500Kbit burst 32Kb lat 50ms
+`)
+	assert.For(ctx, "qdiscs").That(qdiscs).DeepEquals([]Qdisc{
+		{Kind: "htb", Handle: "1:", Parent: "root", Options: "refcnt 2 r2q 10 default 0x30 direct_packets_stat 0"},
+		{Kind: "sfq", Handle: "10:", Parent: "1:10", Options: "limit 127p quantum 1514b depth 127 divisor 1024"},
+		{Kind: "tbf", Handle: "8001:", Parent: "1:20", RateBitsPerSecond: 2500000, Options: "burst 32Kb lat 50ms"},
+	})
+
+	classes := parseTCClasses(`class htb 1:1 root rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b
+class htb 1:10 parent 1:1 leaf 10: prio 0 rate 5Mbit ceil 10Mbit burst 1600b cburst 1600b
+`)
+	assert.For(ctx, "classes").That(classes).DeepEquals([]Class{
+		{Kind: "htb", ClassID: "1:1", Parent: "root", RateBitsPerSecond: 1000000000, CeilBitsPerSecond: 1000000000, Options: "burst 1375b cburst 1375b"},
+		{Kind: "htb", ClassID: "1:10", Parent: "1:1", RateBitsPerSecond: 5000000, CeilBitsPerSecond: 10000000, Options: "leaf 10: prio 0 burst 1600b cburst 1600b"},
+	})
+}
+
+func TestParseTCRate(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		rate     string
+		expected int64
+	}{
+		{"800bit", 800},
+		{"100Mbit", 100000000},
+		{"1Kibit", 1024},
+		{"125Kbps", 1000000},
+	} {
+		rate, err := parseTCRate(test.rate)
+		assert.For(ctx, "%v err", test.rate).ThatError(err).Succeeded()
+		assert.For(ctx, "%v", test.rate).That(rate).Equals(test.expected)
+	}
+	_, err := parseTCRate("fast")
+	assert.For(ctx, "invalid").ThatError(err).Failed()
+}
+
+func TestParseNetworkInterfaces(t *testing.T) {
+	ctx := log.Testing(t)
+
+	ifaces, err := parseIPAddrJSON(`[{"ifindex":1,"ifname":"lo","address":"00:00:00:00:00:00",` +
+		`"addr_info":[{"family":"inet","local":"127.0.0.1","prefixlen":8},{"family":"inet6","local":"::1","prefixlen":128}]},` +
+		`{"ifindex":2,"ifname":"eth0","address":"52:54:00:AB:cd:01",` +
+		`"addr_info":[{"family":"inet","local":"192.168.1.2","prefixlen":24,"broadcast":"192.168.1.255"}]},` +
+		`{"ifindex":3,"ifname":"wlan0","address":"52:54:00:ab:cd:02","addr_info":[]}]`)
+	assert.For(ctx, "ip").ThatError(err).Succeeded()
+	assert.For(ctx, "ip interfaces").That(ifaces).DeepEquals([]RemoteInterface{
+		{Name: "lo", Addrs: []string{"127.0.0.1/8", "::1/128"}},
+		{Name: "eth0", HardwareAddr: "52:54:00:ab:cd:01", Addrs: []string{"192.168.1.2/24"}},
+		{Name: "wlan0", HardwareAddr: "52:54:00:ab:cd:02", Addrs: []string{}},
+	})
+	_, err = parseIPAddrJSON("Object \"-j\" is unknown")
+	assert.For(ctx, "ip without JSON").ThatError(err).Failed()
+
+	iface := parseIfconfig("en0", `en0: flags=8863<UP,BROADCAST,SMART,RUNNING,SIMPLEX,MULTICAST> mtu 1500
+	options=6463<RXCSUM,TXCSUM,TSO4,TSO6,CHANNEL_IO,PARTIAL_CSUM,ZEROINVERT_CSUM>
+	ether a4:83:e7:12:34:56
+	inet6 fe80::1c2b:3a4d:5e6f:7081%en0 prefixlen 64 secured scopeid 0xe
+	inet 192.168.1.5 netmask 0xffffff00 broadcast 192.168.1.255
+	nd6 options=201<PERFORMNUD,DAD>
+	media: autoselect
+	status: active
+`)
+	assert.For(ctx, "ifconfig").That(iface).DeepEquals(RemoteInterface{
+		Name:         "en0",
+		HardwareAddr: "a4:83:e7:12:34:56",
+		Addrs:        []string{"fe80::1c2b:3a4d:5e6f:7081/64", "192.168.1.5/24"},
+	})
+
+	ifaces, err = parseNetIPAddressJSON(`{
+    "Adapters":  [
+                     {
+                         "Name":  "Ethernet",
+                         "MacAddress":  "00-15-5D-01-02-03"
+                     }
+                 ],
+    "Addresses":  [
+                      {
+                          "InterfaceAlias":  "Ethernet",
+                          "IPAddress":  "fe80::8d4f:1a2b:3c4d:5e6f%4",
+                          "PrefixLength":  64
+                      },
+                      {
+                          "InterfaceAlias":  "Loopback Pseudo-Interface 1",
+                          "IPAddress":  "127.0.0.1",
+                          "PrefixLength":  8
+                      },
+                      {
+                          "InterfaceAlias":  "Ethernet",
+                          "IPAddress":  "10.0.0.4",
+                          "PrefixLength":  16
+                      }
+                  ]
+}`)
+	assert.For(ctx, "Get-NetIPAddress").ThatError(err).Succeeded()
+	assert.For(ctx, "Get-NetIPAddress interfaces").That(ifaces).DeepEquals([]RemoteInterface{
+		{Name: "Ethernet", HardwareAddr: "00:15:5d:01:02:03", Addrs: []string{"fe80::8d4f:1a2b:3c4d:5e6f/64", "10.0.0.4/16"}},
+		{Name: "Loopback Pseudo-Interface 1", Addrs: []string{"127.0.0.1/8"}},
+	})
+}
+
+const fakeHostname = `#!/bin/sh
+if [ "$1" = -f ]; then echo box.example.com; else echo box; fi
+`
+
+func TestGetHostname(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The test server runs commands locally, so a fake hostname is put
+	// first on the PATH.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	err = ioutil.WriteFile(filepath.Join(bin, "hostname"), []byte(fakeHostname), 0700)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	env := shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux, info: &infoCache{}}
+
+	name, err := b.GetHostname(ctx)
+	assert.For(ctx, "GetHostname").ThatError(err).Succeeded()
+	assert.For(ctx, "hostname").ThatString(name).Equals("box")
+	name, err = b.GetFQDN(ctx)
+	assert.For(ctx, "GetFQDN").ThatError(err).Succeeded()
+	assert.For(ctx, "fqdn").ThatString(name).Equals("box.example.com")
+
+	// The names are only read once.
+	b.env = shell.NewEnv().Set("PATH", filepath.Join(dir, "missing"))
+	name, err = b.GetHostname(ctx)
+	assert.For(ctx, "cached").ThatError(err).Succeeded()
+	assert.For(ctx, "cached hostname").ThatString(name).Equals("box")
+	name, err = b.GetFQDN(ctx)
+	assert.For(ctx, "cached fqdn").ThatError(err).Succeeded()
+	assert.For(ctx, "cached fqdn name").ThatString(name).Equals("box.example.com")
+
+	b.info = nil
+	_, err = b.GetHostname(ctx)
+	assert.For(ctx, "missing hostname").ThatError(err).Failed()
+}
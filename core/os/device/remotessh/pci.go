@@ -0,0 +1,308 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+)
+
+const (
+	// ErrNoIommuGroup is returned by GetDeviceIommuGroup when the device is
+	// not in an IOMMU group.
+	ErrNoIommuGroup = fault.Const("Device is not in an IOMMU group")
+
+	// ErrInvalidBDF is returned when a PCI device address is not of the form
+	// "dddd:bb:dd.f".
+	ErrInvalidBDF = fault.Const("Invalid PCI device address")
+
+	pciDevices  = "/sys/bus/pci/devices"
+	iommuGroups = "/sys/kernel/iommu_groups"
+	vfioDriver  = "/sys/bus/pci/drivers/vfio-pci"
+)
+
+var bdfRE = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+// PCIDevice identifies a PCI device.
+type PCIDevice struct {
+	// BDF is the bus/device/function address, for example "0000:01:00.0".
+	BDF string
+	// VendorID and DeviceID are the hexadecimal PCI IDs, for example
+	// "0x10de".
+	VendorID string
+	DeviceID string
+}
+
+// IommuGroup is a set of devices that the IOMMU can only isolate together.
+type IommuGroup struct {
+	ID      int
+	Devices []PCIDevice
+}
+
+// parsePCIIDs parses the output of grep -H over the vendor and device sysfs
+// files of PCI devices, where each line is formatted as "<path>:<id>". It
+// returns the devices keyed by their address.
+func parsePCIIDs(out string) map[string]*PCIDevice {
+	devices := map[string]*PCIDevice{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":0x", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		bdf := path.Base(path.Dir(parts[0]))
+		d, ok := devices[bdf]
+		if !ok {
+			d = &PCIDevice{BDF: bdf}
+			devices[bdf] = d
+		}
+		switch path.Base(parts[0]) {
+		case "vendor":
+			d.VendorID = "0x" + parts[1]
+		case "device":
+			d.DeviceID = "0x" + parts[1]
+		}
+	}
+	return devices
+}
+
+// getPCIDevices returns all the PCI devices on the remote machine keyed by
+// their address.
+func (b binding) getPCIDevices(ctx context.Context) (map[string]*PCIDevice, error) {
+	out, err := b.posixShell("grep -H . " + pciDevices + "/*/vendor " + pciDevices + "/*/device").Call(ctx)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read PCI devices")
+	}
+	return parsePCIIDs(out), nil
+}
+
+// parseIommuGroups parses the list of device links found under
+// /sys/kernel/iommu_groups, where each line is formatted as
+// "/sys/kernel/iommu_groups/<group>/devices/<bdf>".
+func parseIommuGroups(out string, devices map[string]*PCIDevice) []*IommuGroup {
+	groups := map[int]*IommuGroup{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(line), iommuGroups+"/"), "/")
+		if len(parts) != 3 || parts[1] != "devices" {
+			continue
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		g, ok := groups[id]
+		if !ok {
+			g = &IommuGroup{ID: id, Devices: []PCIDevice{}}
+			groups[id] = g
+		}
+		d := PCIDevice{BDF: parts[2]}
+		if info, ok := devices[d.BDF]; ok {
+			d = *info
+		}
+		g.Devices = append(g.Devices, d)
+	}
+	list := make([]*IommuGroup, 0, len(groups))
+	for _, g := range groups {
+		sort.Slice(g.Devices, func(i, j int) bool { return g.Devices[i].BDF < g.Devices[j].BDF })
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// PCIeInfo describes the negotiated PCI Express link of a device.
+type PCIeInfo struct {
+	// Gen is the PCIe generation of the link speed, for example 3 for 8 GT/s.
+	Gen int
+	// Width is the number of lanes.
+	Width int
+	// TheoreticalBandwidthGBps is the maximum bandwidth of the link in one
+	// direction, after line encoding overhead.
+	TheoreticalBandwidthGBps float64
+}
+
+// pcieGenerations maps the per-lane transfer rate in GT/s to the PCIe
+// generation and the line encoding efficiency.
+var pcieGenerations = []struct {
+	rate       float64
+	gen        int
+	efficiency float64
+}{
+	{2.5, 1, 8.0 / 10.0},
+	{5, 2, 8.0 / 10.0},
+	{8, 3, 128.0 / 130.0},
+	{16, 4, 128.0 / 130.0},
+	{32, 5, 128.0 / 130.0},
+}
+
+// parsePCIeLink computes the PCIe link information from the contents of the
+// current_link_speed (for example "8.0 GT/s PCIe") and current_link_width
+// (for example "16") sysfs files.
+func parsePCIeLink(speed, width string) (*PCIeInfo, error) {
+	fields := strings.Fields(speed)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Invalid link speed %q", speed)
+	}
+	rate, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid link speed %q", speed)
+	}
+	lanes, err := strconv.Atoi(strings.TrimSpace(width))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid link width %q", width)
+	}
+	for _, g := range pcieGenerations {
+		if g.rate == rate {
+			return &PCIeInfo{
+				Gen:   g.gen,
+				Width: lanes,
+				// GT/s is one bit per transfer per lane.
+				TheoreticalBandwidthGBps: rate * g.efficiency * float64(lanes) / 8,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown PCIe link speed %q", speed)
+}
+
+// GetPCIeBandwidth returns the negotiated PCIe link of the device with the
+// given bus/device/function address, for example "0000:01:00.0".
+func (b binding) GetPCIeBandwidth(ctx context.Context, deviceBDF string) (*PCIeInfo, error) {
+	dir := pciDevices + "/" + deviceBDF
+	speed, err := b.FileContents(ctx, dir+"/current_link_speed")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read link speed of %s", deviceBDF)
+	}
+	width, err := b.FileContents(ctx, dir+"/current_link_width")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read link width of %s", deviceBDF)
+	}
+	return parsePCIeLink(speed, width)
+}
+
+// GetIommuGroups returns the IOMMU groups of the remote machine, and the PCI
+// devices in each. The list is empty if the IOMMU is not enabled.
+func (b binding) GetIommuGroups(ctx context.Context) ([]*IommuGroup, error) {
+	devices, err := b.getPCIDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 'find' fails if the IOMMU is disabled, which just means no groups.
+	links, _ := b.posixShell("find " + iommuGroups + " -mindepth 3 -maxdepth 3 2>/dev/null").Call(ctx)
+	return parseIommuGroups(links, devices), nil
+}
+
+// GetDeviceIommuGroup returns the IOMMU group of the device with the given
+// bus/device/function address.
+func (b binding) GetDeviceIommuGroup(ctx context.Context, deviceBDF string) (int, error) {
+	group, err := b.Shell("readlink", pciDevices+"/"+deviceBDF+"/iommu_group").Call(ctx)
+	if err != nil {
+		return 0, ErrNoIommuGroup
+	}
+	return strconv.Atoi(path.Base(group))
+}
+
+// VFIODevice is a PCI device bound to the vfio-pci driver, which makes it
+// available for passthrough to a virtual machine.
+type VFIODevice struct {
+	BDF      string
+	VendorID string
+	DeviceID string
+	// GroupID is the IOMMU group of the device, which is also the name of
+	// its /dev/vfio node.
+	GroupID int
+}
+
+// parseVFIODevices parses lines of the form "<bdf> <group>" listing the
+// devices bound to vfio-pci.
+func parseVFIODevices(out string, devices map[string]*PCIDevice) []*VFIODevice {
+	list := []*VFIODevice{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		group, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		d := &VFIODevice{BDF: fields[0], GroupID: group}
+		if info, ok := devices[d.BDF]; ok {
+			d.VendorID, d.DeviceID = info.VendorID, info.DeviceID
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].BDF < list[j].BDF })
+	return list
+}
+
+// GetVFIODevices returns the PCI devices that are bound to the vfio-pci
+// driver and have a /dev/vfio group node.
+func (b binding) GetVFIODevices(ctx context.Context) ([]*VFIODevice, error) {
+	devices, err := b.getPCIDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := callStdout(ctx, b.posixShell(`for d in `+vfioDriver+`/*:*; do
+	[ -e "$d/iommu_group" ] || continue
+	g=$(basename "$(readlink "$d/iommu_group")")
+	[ -e "/dev/vfio/$g" ] && echo "$(basename "$d") $g"
+done; true`))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not list VFIO devices")
+	}
+	return parseVFIODevices(out, devices), nil
+}
+
+// BindDeviceToVFIO unbinds the device with the given bus/device/function
+// address from its current driver and binds it to vfio-pci. This requires
+// root on the remote machine.
+func (b binding) BindDeviceToVFIO(ctx context.Context, bdf string) error {
+	if !bdfRE.MatchString(bdf) {
+		return ErrInvalidBDF
+	}
+	dev := pciDevices + "/" + bdf
+	script := `modprobe vfio-pci 2>/dev/null
+echo vfio-pci > ` + dev + `/driver_override &&
+if [ -e ` + dev + `/driver ]; then echo ` + bdf + ` > ` + dev + `/driver/unbind; fi &&
+echo ` + bdf + ` > /sys/bus/pci/drivers_probe`
+	if _, err := callStdout(ctx, b.posixShell(script)); err != nil {
+		return log.Errf(ctx, err, "Could not bind %s to vfio-pci", bdf)
+	}
+	return nil
+}
+
+// UnbindDeviceFromVFIO unbinds the device with the given bus/device/function
+// address from vfio-pci and lets the kernel probe its default driver again.
+// This requires root on the remote machine.
+func (b binding) UnbindDeviceFromVFIO(ctx context.Context, bdf string) error {
+	if !bdfRE.MatchString(bdf) {
+		return ErrInvalidBDF
+	}
+	dev := pciDevices + "/" + bdf
+	script := `echo ` + bdf + ` > ` + vfioDriver + `/unbind &&
+echo > ` + dev + `/driver_override &&
+echo ` + bdf + ` > /sys/bus/pci/drivers_probe`
+	if _, err := callStdout(ctx, b.posixShell(script)); err != nil {
+		return log.Errf(ctx, err, "Could not unbind %s from vfio-pci", bdf)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestParsePCIeLink(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		speed, width string
+		gen, lanes   int
+		bandwidth    float64
+	}{
+		{"2.5 GT/s PCIe", "1", 1, 1, 0.25},
+		{"5.0 GT/s PCIe", "4", 2, 4, 2},
+		{"8.0 GT/s PCIe", "16", 3, 16, 15.754},
+		{"16.0 GT/s PCIe", "16", 4, 16, 31.508},
+		{"32.0 GT/s PCIe", "8", 5, 8, 31.508},
+	} {
+		info, err := parsePCIeLink(test.speed, test.width)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "%v gen", test.speed).ThatInteger(info.Gen).Equals(test.gen)
+		assert.For(ctx, "%v width", test.speed).ThatInteger(info.Width).Equals(test.lanes)
+		assert.For(ctx, "%v bandwidth", test.speed).ThatFloat(info.TheoreticalBandwidthGBps).Equals(test.bandwidth, 0.001)
+	}
+
+	_, err := parsePCIeLink("Unknown", "16")
+	assert.For(ctx, "unknown speed").ThatError(err).Failed()
+}
+
+func TestParseIommuGroups(t *testing.T) {
+	ctx := log.Testing(t)
+
+	devices := parsePCIIDs(`/sys/bus/pci/devices/0000:00:02.0/vendor:0x8086
+/sys/bus/pci/devices/0000:00:02.0/device:0x3e92
+/sys/bus/pci/devices/0000:01:00.0/vendor:0x10de
+/sys/bus/pci/devices/0000:01:00.0/device:0x2206
+/sys/bus/pci/devices/0000:01:00.1/vendor:0x10de
+/sys/bus/pci/devices/0000:01:00.1/device:0x1aef
+`)
+	groups := parseIommuGroups(`/sys/kernel/iommu_groups/12/devices/0000:01:00.1
+/sys/kernel/iommu_groups/12/devices/0000:01:00.0
+/sys/kernel/iommu_groups/1/devices/0000:00:02.0
+`, devices)
+	assert.For(ctx, "groups").That(groups).DeepEquals([]*IommuGroup{
+		{ID: 1, Devices: []PCIDevice{{BDF: "0000:00:02.0", VendorID: "0x8086", DeviceID: "0x3e92"}}},
+		{ID: 12, Devices: []PCIDevice{
+			{BDF: "0000:01:00.0", VendorID: "0x10de", DeviceID: "0x2206"},
+			{BDF: "0000:01:00.1", VendorID: "0x10de", DeviceID: "0x1aef"},
+		}},
+	})
+}
+
+func TestParseVFIODevices(t *testing.T) {
+	ctx := log.Testing(t)
+
+	devices := parsePCIIDs(`/sys/bus/pci/devices/0000:01:00.0/vendor:0x10de
+/sys/bus/pci/devices/0000:01:00.0/device:0x2206
+`)
+	list := parseVFIODevices("0000:02:00.0 15\n0000:01:00.0 12\n", devices)
+	assert.For(ctx, "devices").That(list).DeepEquals([]*VFIODevice{
+		{BDF: "0000:01:00.0", VendorID: "0x10de", DeviceID: "0x2206", GroupID: 12},
+		{BDF: "0000:02:00.0", GroupID: 15},
+	})
+}
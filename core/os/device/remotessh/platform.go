@@ -0,0 +1,461 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+const (
+	// ErrRASDaemonNotFound is returned by GetRASEvents when neither rasdaemon
+	// nor the EDAC driver is available on the remote machine.
+	ErrRASDaemonNotFound = fault.Const("rasdaemon not found")
+
+	edacRoot = "/sys/devices/system/edac/mc"
+	dmiRoot  = "/sys/class/dmi/id"
+)
+
+// SecurityFeatures describes the platform security features of the remote
+// machine that can affect trace injection.
+type SecurityFeatures struct {
+	// SecureBoot is true if UEFI Secure Boot is enabled.
+	SecureBoot bool
+	// KernelLockdown is true if the kernel lockdown LSM is active.
+	KernelLockdown bool
+	// LockdownMode is the active lockdown mode, for example "integrity" or
+	// "confidentiality". It is empty if lockdown is not supported.
+	LockdownMode string
+	// TPMVersion is the version of the TPM, for example "2.0". It is empty if
+	// there is no TPM.
+	TPMVersion string
+}
+
+// parseLockdownMode returns the selected mode from the contents of
+// /sys/kernel/security/lockdown, which is formatted as
+// "none [integrity] confidentiality".
+func parseLockdownMode(s string) string {
+	start, end := strings.Index(s, "["), strings.Index(s, "]")
+	if start < 0 || end < start {
+		return ""
+	}
+	return s[start+1 : end]
+}
+
+// GetPlatformSecurityFeatures returns the state of Secure Boot, kernel
+// lockdown and the TPM on the remote machine.
+func (b binding) GetPlatformSecurityFeatures(ctx context.Context) (*SecurityFeatures, error) {
+	f := &SecurityFeatures{}
+	if out, err := b.Shell("mokutil", "--sb-state").Call(ctx); err == nil {
+		f.SecureBoot = strings.Contains(out, "SecureBoot enabled")
+	}
+	if out, err := b.FileContents(ctx, "/sys/kernel/security/lockdown"); err == nil {
+		f.LockdownMode = parseLockdownMode(out)
+		f.KernelLockdown = f.LockdownMode != "" && f.LockdownMode != "none"
+	}
+	if isDir, _ := b.IsDirectory(ctx, "/sys/class/tpm/tpm0"); isDir {
+		// tpm_version_major only exists on kernels that support TPM 2.0.
+		if major, err := b.FileContents(ctx, "/sys/class/tpm/tpm0/tpm_version_major"); err == nil {
+			f.TPMVersion = major + ".0"
+		} else {
+			f.TPMVersion = "1.2"
+		}
+	}
+	return f, nil
+}
+
+// RASEvent is a hardware error reported by the reliability, availability and
+// serviceability (RAS) subsystem.
+type RASEvent struct {
+	Timestamp time.Time
+	// Type is the kind of error, for example "Corrected" or "Uncorrected".
+	Type  string
+	Count int
+	// Location identifies the failing component, for example a memory
+	// controller, channel or DIMM.
+	Location string
+}
+
+// parseRASMcCtlErrors parses the memory controller events listed by
+// ras-mc-ctl --errors, which are formatted as:
+// 1 2018-06-01 12:00:00 +0000 1 Corrected error(s): ... location: 0:1:-1:-1, ...
+func parseRASMcCtlErrors(out string, since time.Time) []RASEvent {
+	events := []RASEvent{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		timestamp, err := time.Parse("2006-01-02 15:04:05 -0700", strings.Join(fields[1:4], " "))
+		if err != nil || timestamp.Before(since) {
+			continue
+		}
+		count, err := strconv.Atoi(fields[4])
+		if err != nil {
+			continue
+		}
+		rest := strings.Join(fields[5:], " ")
+		e := RASEvent{Timestamp: timestamp, Count: count}
+		if i := strings.Index(rest, " error(s)"); i >= 0 {
+			e.Type = rest[:i]
+		}
+		if i := strings.Index(rest, "location: "); i >= 0 {
+			e.Location = strings.TrimSpace(strings.SplitN(rest[i+len("location: "):], ",", 2)[0])
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// parseEDACCounts parses the output of grep -H . over the EDAC ce_count and
+// ue_count files, where each line is formatted as "<path>:<count>".
+func parseEDACCounts(out string, now time.Time) []RASEvent {
+	events := []RASEvent{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count == 0 {
+			continue
+		}
+		e := RASEvent{Timestamp: now, Count: count, Location: path.Base(path.Dir(parts[0]))}
+		switch path.Base(parts[0]) {
+		case "ce_count":
+			e.Type = "Corrected"
+		case "ue_count":
+			e.Type = "Uncorrected"
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// GetRASEvents returns the hardware errors reported since the given time.
+// The events are read from the rasdaemon database when rasdaemon is
+// installed. Otherwise the EDAC error counters are used, which have no
+// timestamps, so any non-zero counter is reported as an event at the current
+// time.
+func (b binding) GetRASEvents(ctx context.Context, since time.Time) ([]RASEvent, error) {
+	if b.hasCommand(ctx, "ras-mc-ctl") {
+		out, err := callStdout(ctx, b.Shell("ras-mc-ctl", "--errors"))
+		if err != nil {
+			return nil, err
+		}
+		return parseRASMcCtlErrors(out, since), nil
+	}
+	if isDir, _ := b.IsDirectory(ctx, edacRoot); isDir {
+		out, _ := b.posixShell("grep -H . " + edacRoot + "/mc*/ce_count " + edacRoot + "/mc*/ue_count 2>/dev/null").Call(ctx)
+		return parseEDACCounts(out, time.Now()), nil
+	}
+	return nil, ErrRASDaemonNotFound
+}
+
+// SMBIOSInfo identifies the hardware platform of the remote machine.
+type SMBIOSInfo struct {
+	BIOSVersion  string
+	Manufacturer string
+	ProductName  string
+	// ChassisType is the SMBIOS chassis type, for example "Desktop" or
+	// "Rack Mount Chassis".
+	ChassisType string
+}
+
+// smbiosChassisTypes are the names of the SMBIOS chassis type values.
+var smbiosChassisTypes = []string{
+	1: "Other", 2: "Unknown", 3: "Desktop", 4: "Low Profile Desktop",
+	5: "Pizza Box", 6: "Mini Tower", 7: "Tower", 8: "Portable", 9: "Laptop",
+	10: "Notebook", 11: "Hand Held", 12: "Docking Station", 13: "All in One",
+	14: "Sub Notebook", 15: "Space-saving", 16: "Lunch Box",
+	17: "Main Server Chassis", 18: "Expansion Chassis", 19: "SubChassis",
+	20: "Bus Expansion Chassis", 21: "Peripheral Chassis", 22: "RAID Chassis",
+	23: "Rack Mount Chassis", 24: "Sealed-case PC", 25: "Multi-system Chassis",
+	26: "Compact PCI", 27: "Advanced TCA", 28: "Blade", 29: "Blade Enclosure",
+	30: "Tablet", 31: "Convertible", 32: "Detachable", 33: "IoT Gateway",
+	34: "Embedded PC", 35: "Mini PC", 36: "Stick PC",
+}
+
+// parseDMI parses the output of grep -H over the /sys/class/dmi/id files,
+// where each line is formatted as "<path>:<value>".
+func parseDMI(out string) *SMBIOSInfo {
+	info := &SMBIOSInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch path.Base(parts[0]) {
+		case "bios_version":
+			info.BIOSVersion = value
+		case "sys_vendor":
+			info.Manufacturer = value
+		case "product_name":
+			info.ProductName = value
+		case "chassis_type":
+			if i, err := strconv.Atoi(value); err == nil && i > 0 && i < len(smbiosChassisTypes) {
+				info.ChassisType = smbiosChassisTypes[i]
+			} else {
+				info.ChassisType = value
+			}
+		}
+	}
+	return info
+}
+
+// parseIORegPlatform parses the properties of the IOPlatformExpertDevice
+// printed by ioreg, which are formatted as "product-name" = <"MacBookPro15,1">.
+func parseIORegPlatform(out string) *SMBIOSInfo {
+	info := &SMBIOSInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.Trim(strings.TrimSpace(parts[0]), `|" `)
+		value := strings.Trim(strings.TrimSpace(parts[1]), `<>"`)
+		// Strings are null terminated.
+		value = strings.TrimRight(value, "\x00")
+		switch key {
+		case "version":
+			info.BIOSVersion = value
+		case "manufacturer":
+			info.Manufacturer = value
+		case "product-name":
+			info.ProductName = value
+		}
+	}
+	return info
+}
+
+// GetSMBIOSInfo returns the BIOS version, manufacturer, product name and
+// chassis type of the remote machine.
+func (b binding) GetSMBIOSInfo(ctx context.Context) (*SMBIOSInfo, error) {
+	switch b.os {
+	case device.Linux:
+		files := []string{}
+		for _, f := range []string{"bios_version", "sys_vendor", "product_name", "chassis_type"} {
+			files = append(files, dmiRoot+"/"+f)
+		}
+		// Some of the files may not exist on virtual machines.
+		out, _ := b.Shell("grep", append([]string{"-H", "."}, files...)...).Call(ctx)
+		return parseDMI(out), nil
+	case device.OSX:
+		out, err := callStdout(ctx, b.Shell("ioreg", "-l", "-d2", "-c", "IOPlatformExpertDevice"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run ioreg")
+		}
+		return parseIORegPlatform(out), nil
+	default:
+		return nil, log.Errf(ctx, nil, "SMBIOS information is not supported on %v", b.os)
+	}
+}
+
+// TaintStatus describes why the kernel of the remote machine is tainted.
+type TaintStatus struct {
+	Tainted bool
+	// Mask is the raw value of /proc/sys/kernel/tainted.
+	Mask uint64
+	// Reasons describes each set taint bit.
+	Reasons []string
+}
+
+const (
+	taintProprietaryModule = 0
+	taintOutOfTreeModule   = 12
+)
+
+// kernelTaints describes the taint bits, as documented in the kernel's
+// admin-guide/tainted-kernels.
+var kernelTaints = []string{
+	"proprietary module was loaded",
+	"module was force loaded",
+	"kernel running on an out of specification system",
+	"module was force unloaded",
+	"processor reported a Machine Check Exception",
+	"bad page referenced or some unexpected page flags",
+	"taint requested by userspace application",
+	"kernel died recently, i.e. there was an OOPS or BUG",
+	"ACPI table overridden by user",
+	"kernel issued warning",
+	"staging driver was loaded",
+	"workaround for bug in platform firmware applied",
+	"externally-built (out-of-tree) module was loaded",
+	"unsigned module was loaded",
+	"soft lockup occurred",
+	"kernel has been live patched",
+	"auxiliary taint, defined for and used by distros",
+	"kernel was built with the struct randomization plugin",
+	"an in-kernel test has been run",
+}
+
+// HasDriverTaint returns true if a proprietary or out-of-tree module, such as
+// a vendor GPU driver, has been loaded.
+func (s *TaintStatus) HasDriverTaint() bool {
+	return s.Mask&(1<<taintProprietaryModule|1<<taintOutOfTreeModule) != 0
+}
+
+func parseKernelTaint(out string) (*TaintStatus, error) {
+	mask, err := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid taint mask %q", out)
+	}
+	status := &TaintStatus{Tainted: mask != 0, Mask: mask, Reasons: []string{}}
+	for bit := uint(0); bit < 64; bit++ {
+		if mask&(1<<bit) == 0 {
+			continue
+		}
+		if int(bit) < len(kernelTaints) {
+			status.Reasons = append(status.Reasons, kernelTaints[bit])
+		} else {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("unknown taint bit %d", bit))
+		}
+	}
+	return status, nil
+}
+
+// GetKernelTaintStatus returns whether the kernel of the remote machine is
+// tainted, and why.
+func (b binding) GetKernelTaintStatus(ctx context.Context) (*TaintStatus, error) {
+	out, err := b.FileContents(ctx, "/proc/sys/kernel/tainted")
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read /proc/sys/kernel/tainted")
+	}
+	return parseKernelTaint(out)
+}
+
+// infoCache holds the properties of the remote machine that do not change,
+// such as its versions and hostname, once they have been read. A nil
+// infoCache does not keep them.
+type infoCache struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+// get returns the property called name, calling read the first time.
+func (c *infoCache) get(name string, read func() (string, error)) (string, error) {
+	if c != nil {
+		c.mutex.Lock()
+		v, ok := c.values[name]
+		c.mutex.Unlock()
+		if ok {
+			return v, nil
+		}
+	}
+	v, err := read()
+	if err != nil {
+		return v, err
+	}
+	c.set(name, v)
+	return v, nil
+}
+
+// set remembers the property called name, replacing any previous value.
+func (c *infoCache) set(name, value string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.values == nil {
+		c.values = map[string]string{}
+	}
+	c.values[name] = value
+}
+
+// parseOSRelease returns the VERSION_ID in the contents of an os-release
+// file, or "" if there is none.
+func parseOSRelease(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "VERSION_ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), `"'`)
+		}
+	}
+	return ""
+}
+
+// GetOSVersion returns the version of the operating system of the remote
+// machine: the VERSION_ID of /etc/os-release on Linux, the product version on
+// macOS, and the version of the kernel on Windows. It is read once, and then
+// remembered by the binding.
+func (b binding) GetOSVersion(ctx context.Context) (string, error) {
+	return b.info.get("os", func() (string, error) {
+		switch b.os {
+		case device.Linux:
+			out, err := b.FileContents(ctx, "/etc/os-release")
+			if err != nil {
+				return "", log.Errf(ctx, err, "Could not read /etc/os-release")
+			}
+			if v := parseOSRelease(out); v != "" {
+				return v, nil
+			}
+			return "", log.Errf(ctx, nil, "No VERSION_ID in /etc/os-release")
+		case device.OSX:
+			out, err := callStdout(ctx, b.Shell("sw_vers", "-productVersion"))
+			if err != nil {
+				return "", log.Errf(ctx, err, "Could not get the macOS version")
+			}
+			return strings.TrimSpace(out), nil
+		case device.Windows:
+			out, err := callStdout(ctx, b.powerShell("[Console]::Out.Write([System.Environment]::OSVersion.Version.ToString())"))
+			if err != nil {
+				return "", log.Errf(ctx, err, "Could not get the Windows version")
+			}
+			return strings.TrimSpace(out), nil
+		}
+		return "", log.Errf(ctx, nil, "Getting the OS version is not supported on %v", b.os)
+	})
+}
+
+// kernelRelease matches the version at the start of the release printed by
+// uname -r, such as 5.15.0 in 5.15.0-91-generic.
+var kernelRelease = regexp.MustCompile(`^\d+(\.\d+)*`)
+
+// GetKernelVersion returns the dotted version of the kernel of the remote
+// machine, as printed by uname -r without the suffix of the distribution. It
+// is read once, and then remembered by the binding.
+func (b binding) GetKernelVersion(ctx context.Context) (string, error) {
+	return b.info.get("kernel", func() (string, error) {
+		if b.os != device.Linux && b.os != device.OSX {
+			return "", log.Errf(ctx, nil, "Getting the kernel version is not supported on %v", b.os)
+		}
+		out, err := callStdout(ctx, b.Shell("uname", "-r"))
+		if err != nil {
+			return "", log.Errf(ctx, err, "Could not get the kernel version")
+		}
+		v := kernelRelease.FindString(strings.TrimSpace(out))
+		if v == "" {
+			return "", log.Errf(ctx, nil, "Could not parse the kernel release %q", strings.TrimSpace(out))
+		}
+		return v, nil
+	})
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseLockdownMode(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for in, mode := range map[string]string{
+		"none [integrity] confidentiality\n": "integrity",
+		"[none] integrity confidentiality":   "none",
+		"":                                   "",
+		"none integrity":                     "",
+	} {
+		assert.For(ctx, "%q", in).ThatString(parseLockdownMode(in)).Equals(mode)
+	}
+}
+
+func TestGetPlatformSecurityFeatures(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	for _, test := range []struct {
+		name       string
+		mokutil    string
+		secureBoot bool
+	}{
+		{"enabled", "echo SecureBoot enabled\n", true},
+		{"disabled", "echo SecureBoot disabled\n", false},
+		{"unsupported", "echo \"This system doesn't support Secure Boot\"\nexit 255\n", false},
+		// A missing tool leaves the feature unknown, rather than failing.
+		{"missing", "echo 'mokutil: not found' >&2\nexit 127\n", false},
+	} {
+		env := fakeCommands(t, dir, map[string]string{"mokutil": test.mokutil})
+		b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+		f, err := b.GetPlatformSecurityFeatures(ctx)
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		if err != nil {
+			continue
+		}
+		assert.For(ctx, "%v SecureBoot", test.name).That(f.SecureBoot).Equals(test.secureBoot)
+		// The lockdown mode and TPM are those of the test machine.
+		lockdown := f.LockdownMode != "" && f.LockdownMode != "none"
+		assert.For(ctx, "%v KernelLockdown", test.name).That(f.KernelLockdown).Equals(lockdown)
+	}
+}
+
+func TestParseRASEvents(t *testing.T) {
+	ctx := log.Testing(t)
+
+	since := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	events := parseRASMcCtlErrors(`Memory controller events:
+1 2018-05-31 23:00:00 +0000 1 Corrected error(s): memory read error at CPU_SrcID#0_Ha#0_Chan#0_DIMM#0 location: 0:0:0:-1, addr 65928, grain 7
+2 2018-06-02 10:30:00 +0000 3 Uncorrected error(s): memory scrubbing error at DIMM_B1 location: 0:1:-1:-1, addr 0x10
+`, since)
+	assert.For(ctx, "ras-mc-ctl").ThatSlice(events).IsLength(1)
+	e := events[0]
+	assert.For(ctx, "Timestamp").That(e.Timestamp.Equal(time.Date(2018, 6, 2, 10, 30, 0, 0, time.UTC))).Equals(true)
+	e.Timestamp = time.Time{}
+	assert.For(ctx, "event").That(e).DeepEquals(RASEvent{Type: "Uncorrected", Count: 3, Location: "0:1:-1:-1"})
+
+	now := time.Now()
+	events = parseEDACCounts(`/sys/devices/system/edac/mc/mc0/ce_count:2
+/sys/devices/system/edac/mc/mc0/ue_count:0
+/sys/devices/system/edac/mc/mc1/ue_count:1
+`, now)
+	assert.For(ctx, "edac").That(events).DeepEquals([]RASEvent{
+		{Timestamp: now, Type: "Corrected", Count: 2, Location: "mc0"},
+		{Timestamp: now, Type: "Uncorrected", Count: 1, Location: "mc1"},
+	})
+}
+
+func TestParseSMBIOSInfo(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info := parseDMI(`/sys/class/dmi/id/bios_version:1.12.0
+/sys/class/dmi/id/sys_vendor:Dell Inc.
+/sys/class/dmi/id/product_name:PowerEdge R740
+/sys/class/dmi/id/chassis_type:23
+`)
+	assert.For(ctx, "dmi").That(info).DeepEquals(&SMBIOSInfo{
+		BIOSVersion:  "1.12.0",
+		Manufacturer: "Dell Inc.",
+		ProductName:  "PowerEdge R740",
+		ChassisType:  "Rack Mount Chassis",
+	})
+
+	info = parseIORegPlatform(`+-o MacBookPro15,1  <class IOPlatformExpertDevice, id 0x100000110, registered>
+    {
+      "manufacturer" = <"Apple Inc.">
+      "product-name" = <"MacBookPro15,1">
+      "version" = <"1.0">
+    }
+`)
+	assert.For(ctx, "ioreg").That(info).DeepEquals(&SMBIOSInfo{
+		BIOSVersion:  "1.0",
+		Manufacturer: "Apple Inc.",
+		ProductName:  "MacBookPro15,1",
+	})
+}
+
+func TestParseKernelTaint(t *testing.T) {
+	ctx := log.Testing(t)
+
+	status, err := parseKernelTaint("0\n")
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "clean").That(status).DeepEquals(&TaintStatus{Reasons: []string{}})
+
+	// Proprietary, out-of-tree and unsigned module, plus an undefined bit.
+	status, err = parseKernelTaint("536883201\n")
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "tainted").That(status.Tainted).Equals(true)
+	assert.For(ctx, "driver").That(status.HasDriverTaint()).Equals(true)
+	assert.For(ctx, "reasons").ThatSlice(status.Reasons).Equals([]string{
+		"proprietary module was loaded",
+		"externally-built (out-of-tree) module was loaded",
+		"unsigned module was loaded",
+		"unknown taint bit 29",
+	})
+
+	status, err = parseKernelTaint("512")
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "warning only").That(status.HasDriverTaint()).Equals(false)
+
+	_, err = parseKernelTaint("bad")
+	assert.For(ctx, "invalid").ThatError(err).Failed()
+}
+
+func TestParseOSRelease(t *testing.T) {
+	ctx := log.Testing(t)
+
+	assert.For(ctx, "quoted").ThatString(parseOSRelease("NAME=\"Ubuntu\"\nVERSION_ID=\"22.04\"\nID=ubuntu\n")).Equals("22.04")
+	assert.For(ctx, "unquoted").ThatString(parseOSRelease("ID=fedora\nVERSION_ID=39\n")).Equals("39")
+	assert.For(ctx, "missing").ThatString(parseOSRelease("NAME=\"Arch Linux\"\nID=arch\n")).Equals("")
+}
+
+func TestGetKernelVersion(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The test server runs commands locally, so a fake uname is put first on
+	// the PATH.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	err = ioutil.WriteFile(filepath.Join(bin, "uname"), []byte("#!/bin/sh\necho 5.15.0-91-generic\n"), 0700)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	env := shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux, info: &infoCache{}}
+
+	v, err := b.GetKernelVersion(ctx)
+	assert.For(ctx, "GetKernelVersion").ThatError(err).Succeeded()
+	assert.For(ctx, "version").ThatString(v).Equals("5.15.0")
+
+	// The version is only read once.
+	assert.For(ctx, "Remove").ThatError(os.Remove(filepath.Join(bin, "uname"))).Succeeded()
+	b.env = shell.NewEnv().Set("PATH", bin)
+	v, err = b.GetKernelVersion(ctx)
+	assert.For(ctx, "cached").ThatError(err).Succeeded()
+	assert.For(ctx, "cached version").ThatString(v).Equals("5.15.0")
+
+	b.os = device.Windows
+	b.info = nil
+	_, err = b.GetKernelVersion(ctx)
+	assert.For(ctx, "windows").ThatError(err).Failed()
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+// ErrProcessNotFound is returned by KillProcess when there is no process
+// with the given PID.
+const ErrProcessNotFound = fault.Const("Process not found")
+
+// IOStats holds the I/O counters of a process, from /proc/<pid>/io.
+type IOStats struct {
+	// ReadBytes and WriteBytes are the bytes read from and written to
+	// storage.
+	ReadBytes  int64
+	WriteBytes int64
+	// SyscR and SyscW are the number of read and write system calls.
+	SyscR int64
+	SyscW int64
+	// CancelledWriteBytes are the written bytes that were never flushed to
+	// storage, for example because the file was truncated.
+	CancelledWriteBytes int64
+	// RChar and WChar are the bytes passed to read and write system calls,
+	// including those served from or to the page cache.
+	RChar int64
+	WChar int64
+}
+
+// IOStatsSample is an IOStats reading taken at Timestamp.
+type IOStatsSample struct {
+	Timestamp time.Time
+	IOStats
+}
+
+func parseProcIO(out string) *IOStats {
+	m := parseMeminfo(out)
+	return &IOStats{
+		ReadBytes:           m["read_bytes"],
+		WriteBytes:          m["write_bytes"],
+		SyscR:               m["syscr"],
+		SyscW:               m["syscw"],
+		CancelledWriteBytes: m["cancelled_write_bytes"],
+		RChar:               m["rchar"],
+		WChar:               m["wchar"],
+	}
+}
+
+// GetProcessIOStats returns the I/O counters of the process with the given
+// PID. Reading the counters of another user's process requires root.
+func (b binding) GetProcessIOStats(ctx context.Context, pid int) (*IOStats, error) {
+	file := fmt.Sprintf("/proc/%d/io", pid)
+	out, err := b.FileContents(ctx, file)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not read %s", file)
+	}
+	return parseProcIO(out), nil
+}
+
+// SampleIOStats reads the I/O counters of the process with the given PID
+// count times, interval apart.
+func (b binding) SampleIOStats(ctx context.Context, pid int, interval time.Duration, count int) ([]*IOStatsSample, error) {
+	samples := make([]*IOStatsSample, 0, count)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return samples, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		stats, err := b.GetProcessIOStats(ctx, pid)
+		if err != nil {
+			return samples, err
+		}
+		samples = append(samples, &IOStatsSample{Timestamp: time.Now(), IOStats: *stats})
+	}
+	return samples, nil
+}
+
+// RemoteProcessInfo describes a process running on the remote machine.
+type RemoteProcessInfo struct {
+	PID int
+	// Name is the name of the executable, without its directory.
+	Name string
+	// User is the name of the user the process runs as.
+	User string
+	// CommandLine is the arguments of the process, joined by spaces. It is
+	// empty for kernel threads.
+	CommandLine string
+}
+
+// listProcScript lists the processes in /proc as tab separated lines of PID,
+// user, name and command line. Processes that exit while the list is made
+// are skipped.
+const listProcScript = `find /proc -mindepth 2 -maxdepth 2 -path '/proc/[0-9]*/cmdline' -printf '%u %h\n' 2>/dev/null |
+while read -r user dir; do
+	read -r comm 2>/dev/null < "$dir/comm" || continue
+	cmd=$(tr '\0\n' '  ' 2>/dev/null < "$dir/cmdline")
+	printf '%s\t%s\t%s\t%s\n' "${dir#/proc/}" "$user" "$comm" "$cmd"
+done`
+
+// parseProcList parses the output of listProcScript.
+func parseProcList(out string) []RemoteProcessInfo {
+	procs := []RemoteProcessInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, RemoteProcessInfo{
+			PID:         pid,
+			Name:        fields[2],
+			User:        fields[1],
+			CommandLine: strings.TrimSpace(fields[3]),
+		})
+	}
+	return procs
+}
+
+// splitFields splits line into its first n-1 whitespace separated fields
+// and the rest of the line, which may hold spaces. It returns nil if line
+// has fewer than n fields.
+func splitFields(line string, n int) []string {
+	fields := make([]string, 0, n)
+	line = strings.TrimSpace(line)
+	for len(fields) < n-1 {
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil
+		}
+		fields = append(fields, line[:i])
+		line = strings.TrimLeft(line[i:], " \t")
+	}
+	return append(fields, line)
+}
+
+// parsePsList parses the output of "ps -axo pid=,user=,command=", and of
+// "ps -axo pid=,comm=" for the names. The names and command lines are listed
+// separately as both may contain spaces.
+func parsePsList(commands, names string) []RemoteProcessInfo {
+	comms := map[int]string{}
+	for _, line := range strings.Split(names, "\n") {
+		fields := splitFields(line, 2)
+		if fields == nil {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[0]); err == nil {
+			comms[pid] = path.Base(fields[1])
+		}
+	}
+	procs := []RemoteProcessInfo{}
+	for _, line := range strings.Split(commands, "\n") {
+		fields := splitFields(line, 3)
+		if fields == nil {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, RemoteProcessInfo{
+			PID:         pid,
+			Name:        comms[pid],
+			User:        fields[1],
+			CommandLine: fields[2],
+		})
+	}
+	return procs
+}
+
+// ListProcesses returns the processes running on the remote machine.
+func (b binding) ListProcesses(ctx context.Context) ([]RemoteProcessInfo, error) {
+	switch b.os {
+	case device.Linux:
+		out, err := callStdout(ctx, b.posixShell(listProcScript))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list processes")
+		}
+		return parseProcList(out), nil
+	case device.OSX:
+		commands, err := callStdout(ctx, b.Shell("ps", "-axo", "pid=,user=,command="))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list processes")
+		}
+		names, err := callStdout(ctx, b.Shell("ps", "-axo", "pid=,comm="))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not list processes")
+		}
+		return parsePsList(commands, names), nil
+	default:
+		return nil, log.Errf(ctx, nil, "Listing processes is not supported on %v", b.os)
+	}
+}
+
+// FindProcess returns the processes running on the remote machine whose
+// executable is called name.
+func (b binding) FindProcess(ctx context.Context, name string) ([]RemoteProcessInfo, error) {
+	procs, err := b.ListProcesses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := []RemoteProcessInfo{}
+	for _, p := range procs {
+		if p.Name == name {
+			found = append(found, p)
+		}
+	}
+	return found, nil
+}
+
+// killSignals maps the signals accepted by KillProcess to their numbers in
+// kill commands. Shells do not agree on the signal names, so numbers are
+// used, and only those that are the same on all POSIX systems.
+var killSignals = map[os.Signal]int{
+	syscall.Signal(0): 0,
+	syscall.SIGHUP:    1,
+	syscall.SIGINT:    2,
+	syscall.SIGQUIT:   3,
+	syscall.SIGABRT:   6,
+	syscall.SIGKILL:   9,
+	syscall.SIGALRM:   14,
+	syscall.SIGTERM:   15,
+}
+
+// KillProcess sends sig to the process with the given PID. Signal 0 only
+// checks that the process exists. On Windows the process is always
+// terminated, whatever sig is. ErrProcessNotFound is returned if there is no
+// such process.
+func (b binding) KillProcess(ctx context.Context, pid int, sig os.Signal) error {
+	cmd := b.Shell("taskkill", "/PID", strconv.Itoa(pid), "/F")
+	if b.os != device.Windows {
+		num, ok := killSignals[sig]
+		if !ok {
+			return log.Errf(ctx, nil, "Unsupported signal %v", sig)
+		}
+		cmd = b.Shell("kill", fmt.Sprintf("-%d", num), strconv.Itoa(pid))
+	}
+	stderr := bytes.Buffer{}
+	if err := cmd.Capture(nil, &stderr).Run(ctx); err != nil {
+		// procps, busybox and the shell builtins report "No such process",
+		// and taskkill that the process was "not found".
+		msg := strings.ToLower(stderr.String())
+		if strings.Contains(msg, "no such process") || strings.Contains(msg, "not found") {
+			return ErrProcessNotFound
+		}
+		return log.Errf(ctx, err, "Could not kill process %d: %s", pid, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
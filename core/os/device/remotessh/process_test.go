@@ -0,0 +1,171 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseProcIO(t *testing.T) {
+	ctx := log.Testing(t)
+
+	stats := parseProcIO(`rchar: 323934931
+wchar: 323929600
+syscr: 632687
+syscw: 632675
+read_bytes: 4096
+write_bytes: 323932160
+cancelled_write_bytes: 8192
+`)
+	assert.For(ctx, "stats").That(stats).DeepEquals(&IOStats{
+		ReadBytes:           4096,
+		WriteBytes:          323932160,
+		SyscR:               632687,
+		SyscW:               632675,
+		CancelledWriteBytes: 8192,
+		RChar:               323934931,
+		WChar:               323929600,
+	})
+}
+
+func TestParseProcList(t *testing.T) {
+	ctx := log.Testing(t)
+
+	procs := parseProcList("1\troot\tsystemd\t/sbin/init splash \n" +
+		"2\troot\tkthreadd\t\n" +
+		"4242\tbuilder\tWeb Content\t/usr/lib/firefox/firefox -contentproc 12 \n" +
+		"not a process\n")
+	assert.For(ctx, "procs").That(procs).DeepEquals([]RemoteProcessInfo{
+		{PID: 1, Name: "systemd", User: "root", CommandLine: "/sbin/init splash"},
+		{PID: 2, Name: "kthreadd", User: "root", CommandLine: ""},
+		{PID: 4242, Name: "Web Content", User: "builder", CommandLine: "/usr/lib/firefox/firefox -contentproc 12"},
+	})
+}
+
+func TestParsePsList(t *testing.T) {
+	ctx := log.Testing(t)
+
+	commands := `    1 root             /sbin/launchd
+  312 builder          /Applications/Google Chrome.app/Contents/MacOS/Google Chrome --flag
+  999 builder          (zombie)
+`
+	names := `    1 /sbin/launchd
+  312 /Applications/Google Chrome.app/Contents/MacOS/Google Chrome
+`
+	procs := parsePsList(commands, names)
+	assert.For(ctx, "procs").That(procs).DeepEquals([]RemoteProcessInfo{
+		{PID: 1, Name: "launchd", User: "root", CommandLine: "/sbin/launchd"},
+		{PID: 312, Name: "Google Chrome", User: "builder", CommandLine: "/Applications/Google Chrome.app/Contents/MacOS/Google Chrome --flag"},
+		{PID: 999, Name: "", User: "builder", CommandLine: "(zombie)"},
+	})
+}
+
+func TestListProcesses(t *testing.T) {
+	ctx := log.Testing(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("the test server runs commands locally, which only lists /proc on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	procs, err := b.ListProcesses(ctx)
+	assert.For(ctx, "ListProcesses").ThatError(err).Succeeded()
+	u, err := user.Current()
+	assert.For(ctx, "user").ThatError(err).Succeeded()
+	found := false
+	for _, p := range procs {
+		if p.PID == os.Getpid() {
+			found = true
+			assert.For(ctx, "User").ThatString(p.User).Equals(u.Username)
+			assert.For(ctx, "CommandLine").ThatString(p.CommandLine).Contains(os.Args[0])
+		}
+	}
+	assert.For(ctx, "found").That(found).Equals(true)
+
+	procs, err = b.FindProcess(ctx, "no-such-process")
+	assert.For(ctx, "FindProcess").ThatError(err).Succeeded()
+	assert.For(ctx, "FindProcess procs").ThatSlice(procs).IsEmpty()
+}
+
+func TestKillProcess(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	script := `trap 'echo hup' HUP; trap 'echo int' INT; echo ready; while :; do sleep 0.1; done`
+	r, w := io.Pipe()
+	p, err := sshShellTarget{&b}.Start(shell.Command("exec", "sh", "-c", script).Capture(w, nil))
+	assert.For(ctx, "Start").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	pid := p.(RemoteProcess).Pid()
+	lines := bufio.NewScanner(r)
+	next := func() string {
+		lines.Scan()
+		return lines.Text()
+	}
+	assert.For(ctx, "ready").ThatString(next()).Equals("ready")
+
+	// Each signal reaches the process as itself.
+	assert.For(ctx, "exists").ThatError(b.KillProcess(ctx, pid, syscall.Signal(0))).Succeeded()
+	assert.For(ctx, "SIGHUP").ThatError(b.KillProcess(ctx, pid, syscall.SIGHUP)).Succeeded()
+	assert.For(ctx, "trapped SIGHUP").ThatString(next()).Equals("hup")
+	assert.For(ctx, "SIGINT").ThatError(b.KillProcess(ctx, pid, syscall.SIGINT)).Succeeded()
+	assert.For(ctx, "trapped SIGINT").ThatString(next()).Equals("int")
+
+	assert.For(ctx, "SIGKILL").ThatError(b.KillProcess(ctx, pid, syscall.SIGKILL)).Succeeded()
+	assert.For(ctx, "Wait").ThatError(p.Wait(ctx)).Failed()
+	assert.For(ctx, "killed").ThatError(b.KillProcess(ctx, pid, syscall.SIGTERM)).Equals(ErrProcessNotFound)
+
+	err = b.KillProcess(ctx, os.Getpid(), syscall.Signal(100))
+	assert.For(ctx, "unsupported").ThatError(err).Failed()
+}
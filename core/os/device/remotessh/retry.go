@@ -0,0 +1,1321 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/device/bind"
+	"github.com/google/gapid/core/os/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryableBinding is a binding whose idempotent methods are retried,
+// following its policy, when they fail because of a transient SSH error, such
+// as a reset connection or a server that is out of channels. If the
+// connection was lost, the binding is replaced by a copy connected again
+// before the method is retried. Failures of the remote commands themselves
+// are not retried.
+// The methods that are retried are those that only query the remote machine,
+// those that copy files to the local machine, and RemoveFile, MkDirAll, Chmod
+// and Chown. The methods that change the remote machine in ways that cannot
+// be safely repeated, such as writing files, running scripts, starting
+// processes or forwarding ports, and those that stream their results as
+// WatchFile does, are not retried. Their documentation says so.
+// The commands built with Shell, and the processes that were running, are
+// lost when the binding is replaced.
+type RetryableBinding struct {
+	policy RetryPolicy
+	// mutex guards binding, which is replaced rather than changed when it
+	// reconnects, so that the copies in use are left unchanged, and closed.
+	mutex   sync.RWMutex
+	binding *binding
+	// closed is true once Close was called, after which the binding is not
+	// reconnected.
+	closed bool
+}
+
+var (
+	_ Device        = &RetryableBinding{}
+	_ SystemInfo    = &RetryableBinding{}
+	_ HardwareInfo  = &RetryableBinding{}
+	_ PCIInfo       = &RetryableBinding{}
+	_ GPUInfo       = &RetryableBinding{}
+	_ MediaInfo     = &RetryableBinding{}
+	_ ProcessInfo   = &RetryableBinding{}
+	_ StorageInfo   = &RetryableBinding{}
+	_ NetworkInfo   = &RetryableBinding{}
+	_ ContainerInfo = &RetryableBinding{}
+)
+
+// WithRetry returns the binding with its idempotent methods retried on
+// transient errors following p. The binding must not be used directly
+// afterwards.
+func (b *binding) WithRetry(p RetryPolicy) *RetryableBinding {
+	return &RetryableBinding{binding: b, policy: p}
+}
+
+// classifyError returns whether err was caused by the SSH connection or
+// transport, rather than by the remote command, and may not happen again,
+// and whether it was caused by the loss of the connection. alive is the
+// context of the binding that failed: if it was cancelled, the errors that
+// are not otherwise known are assumed to come from the loss of the
+// connection.
+func classifyError(err error, alive context.Context) (transient, lost bool) {
+	if err == nil {
+		return false, false
+	}
+	for cause := err; cause != nil; cause = nextCause(cause) {
+		switch e := cause.(type) {
+		case *RemoteError:
+			if e.ExitCode >= 0 {
+				return false, false
+			}
+		case *ssh.OpenChannelError:
+			// The server refused the session, the connection is fine.
+			return true, false
+		}
+		if errors.Is(cause, syscall.ECONNRESET) || errors.Is(cause, syscall.EPIPE) {
+			return true, true
+		}
+		if _, ok := cause.(net.Error); ok {
+			return true, true
+		}
+		switch cause {
+		case ErrConnectionLost, ErrSessionPoolClosed, io.EOF, io.ErrUnexpectedEOF:
+			return true, true
+		}
+	}
+	if alive != nil && alive.Err() != nil {
+		return true, true
+	}
+	// As a last resort, the text of the error is matched: x/crypto/ssh only
+	// formats the error of a channel opened as the connection closes, and
+	// the errors of the connection may reach here as text.
+	for _, msg := range []string{
+		"unexpected packet in response to channel open",
+		"connection reset by peer",
+		"broken pipe",
+	} {
+		if strings.Contains(err.Error(), msg) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// get returns the current binding.
+func (r *RetryableBinding) get() *binding {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.binding
+}
+
+// current returns the binding to make an attempt with, once it has been
+// replaced by one connected again if its connection was lost.
+func (r *RetryableBinding) current(ctx context.Context) (*binding, error) {
+	b := r.get()
+	if b.alive == nil || b.alive.Err() == nil {
+		return b, nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil, ErrSessionPoolClosed
+	}
+	if r.binding != b {
+		// Another attempt reconnected first.
+		return r.binding, nil
+	}
+	next, err := b.reconnected(ctx)
+	if next == nil {
+		return nil, err
+	}
+	if err != nil {
+		log.W(ctx, "%v", err)
+	}
+	r.binding = next
+	return next, nil
+}
+
+// do calls fn until it succeeds, fails with an error that is not transient,
+// or the policy gives up.
+func (r *RetryableBinding) do(ctx context.Context, fn func(b *binding) error) error {
+	var permanent error
+	err := retry(ctx, r.policy, func() error {
+		b, err := r.current(ctx)
+		if err == ErrSessionPoolClosed {
+			permanent = err
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(b)
+		transient, lost := classifyError(err, b.alive)
+		if err != nil && !transient {
+			// Stop retrying.
+			permanent = err
+			return nil
+		}
+		if lost && b.alive != nil {
+			// The loss of the connection is noticed shortly after the
+			// commands fail.
+			select {
+			case <-b.alive.Done():
+			case <-time.After(connectionLostDelay):
+			}
+		}
+		return err
+	})
+	if permanent != nil {
+		return permanent
+	}
+	return err
+}
+
+// Reconnect replaces the binding by a copy connected again to the remote
+// machine, as binding.Reconnect does. Unlike it, it may be called while the
+// binding is in use.
+func (r *RetryableBinding) Reconnect(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	next, err := r.binding.reconnected(ctx)
+	if next != nil {
+		r.binding = next
+		r.closed = false
+	}
+	return err
+}
+
+// Close closes the connection to the remote machine. The binding is not
+// reconnected afterwards, unless Reconnect is called.
+func (r *RetryableBinding) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	return r.binding.Close()
+}
+
+// IsAlive returns true if the remote machine answers a Ping, retrying on
+// transient errors.
+func (r *RetryableBinding) IsAlive(ctx context.Context) bool {
+	return r.Ping(ctx) == nil
+}
+
+// String returns the name of the remote machine.
+func (r *RetryableBinding) String() string {
+	return r.get().String()
+}
+
+// SupportsFeatureSet returns true if the first Vulkan physical device
+// supports all of the required features, along with the names of the
+// features that are not supported. The features are queried retrying on
+// transient errors.
+func (r *RetryableBinding) SupportsFeatureSet(ctx context.Context, required VulkanFeatureSet) (bool, []string) {
+	features, err := r.GetVulkanDeviceFeatures(ctx, 0)
+	if err != nil {
+		log.W(ctx, "Could not query Vulkan features: %v", err)
+		return false, append([]string{}, required...)
+	}
+	missing := features.Missing(required)
+	return len(missing) == 0, missing
+}
+
+// Instance returns the instance information of the current binding.
+func (r *RetryableBinding) Instance() *device.Instance {
+	return r.get().Instance()
+}
+
+// Status returns the last known connected status of the current binding.
+func (r *RetryableBinding) Status() bind.Status {
+	return r.get().Status()
+}
+
+// Shell builds a shell.Cmd that runs on the current binding.
+func (r *RetryableBinding) Shell(name string, args ...string) shell.Cmd {
+	return r.get().Shell(name, args...)
+}
+
+// TempFile creates a temporary file on the remote machine. It returns the path
+// to the file, and a function that can be called to clean it up. It is not
+// retried.
+func (r *RetryableBinding) TempFile(ctx context.Context) (string, func(ctx context.Context), error) {
+	return r.get().TempFile(ctx)
+}
+
+// FileContents returns the contents of a file on the remote machine, retrying
+// on transient errors.
+func (r *RetryableBinding) FileContents(ctx context.Context, path string) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.FileContents(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// RemoveFile removes a file from the remote machine, retrying on transient
+// errors.
+func (r *RetryableBinding) RemoveFile(ctx context.Context, path string) error {
+	return r.do(ctx, func(b *binding) error { return b.RemoveFile(ctx, path) })
+}
+
+// GetEnv returns the default environment of the remote machine, retrying on
+// transient errors.
+func (r *RetryableBinding) GetEnv(ctx context.Context) (*shell.Env, error) {
+	var res *shell.Env
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetEnv(ctx)
+		return err
+	})
+	return res, err
+}
+
+// SetupLocalPort forwards a local port to the remote machine on the remote
+// port, and returns the local port. It is not retried.
+func (r *RetryableBinding) SetupLocalPort(ctx context.Context, remotePort int) (int, error) {
+	return r.get().SetupLocalPort(ctx, remotePort)
+}
+
+// ListExecutables returns the executables in a directory, retrying on
+// transient errors.
+func (r *RetryableBinding) ListExecutables(ctx context.Context, path string) ([]string, error) {
+	var res []string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ListExecutables(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// ListDirectories returns the directories in a directory, retrying on
+// transient errors.
+func (r *RetryableBinding) ListDirectories(ctx context.Context, path string) ([]string, error) {
+	var res []string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ListDirectories(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetURIRoot returns the root URI for the entire system.
+func (r *RetryableBinding) GetURIRoot() string {
+	return r.get().GetURIRoot()
+}
+
+// IsFile returns true if the given path is a file, retrying on transient
+// errors.
+func (r *RetryableBinding) IsFile(ctx context.Context, path string) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.IsFile(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// IsDirectory returns true if the given path is a directory, retrying on
+// transient errors.
+func (r *RetryableBinding) IsDirectory(ctx context.Context, path string) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.IsDirectory(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetWorkingDirectory returns the directory that the remote machine considers
+// the working directory, retrying on transient errors.
+func (r *RetryableBinding) GetWorkingDirectory(ctx context.Context) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetWorkingDirectory(ctx)
+		return err
+	})
+	return res, err
+}
+
+// PushFile transfers the local file at sourcePath to the remote machine at
+// destPath. It is not retried.
+func (r *RetryableBinding) PushFile(ctx context.Context, sourcePath, destPath string, opts ...TransferOption) error {
+	return r.get().PushFile(ctx, sourcePath, destPath, opts...)
+}
+
+// PullFile transfers the remote file at sourcePath to the local machine at
+// destPath, retrying on transient errors.
+func (r *RetryableBinding) PullFile(ctx context.Context, sourcePath, destPath string) error {
+	return r.do(ctx, func(b *binding) error { return b.PullFile(ctx, sourcePath, destPath) })
+}
+
+// RunScript runs a multi-line script in a single session, returning its
+// standard output and standard error. It is not retried.
+func (r *RetryableBinding) RunScript(ctx context.Context, script string) (string, string, error) {
+	return r.get().RunScript(ctx, script)
+}
+
+// RunScriptFile runs a local script file on the remote machine, returning its
+// standard output and standard error. It is not retried.
+func (r *RetryableBinding) RunScriptFile(ctx context.Context, localScriptPath string) (string, string, error) {
+	return r.get().RunScriptFile(ctx, localScriptPath)
+}
+
+// RunLocalScript runs a local executable script on the remote machine with
+// args, returning its standard output and standard error. It is not retried.
+func (r *RetryableBinding) RunLocalScript(ctx context.Context, localPath string, args ...string) (string, string, error) {
+	return r.get().RunLocalScript(ctx, localPath, args...)
+}
+
+// ReadFile writes the contents of the remote file at src to dst as they are
+// received. It is not retried.
+func (r *RetryableBinding) ReadFile(ctx context.Context, src string, dst io.Writer) error {
+	return r.get().ReadFile(ctx, src, dst)
+}
+
+// GetFileSize returns the size in bytes of the remote file at path, or
+// ErrNotFound if it does not exist, retrying on transient errors.
+func (r *RetryableBinding) GetFileSize(ctx context.Context, path string) (int64, error) {
+	var res int64
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetFileSize(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// FileExists returns true if anything exists at the given path, retrying on
+// transient errors.
+func (r *RetryableBinding) FileExists(ctx context.Context, path string) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.FileExists(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// Stat returns information about the remote file at path, retrying on
+// transient errors.
+func (r *RetryableBinding) Stat(ctx context.Context, path string) (RemoteFileInfo, error) {
+	var res RemoteFileInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.Stat(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetFileMetadata returns information about a file on the remote machine,
+// including its owner, following symbolic links, retrying on transient errors.
+func (r *RetryableBinding) GetFileMetadata(ctx context.Context, path string) (*RemoteFileInfo, error) {
+	var res *RemoteFileInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetFileMetadata(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// MkDir creates a directory on the remote machine. It is not retried.
+func (r *RetryableBinding) MkDir(ctx context.Context, path string) error {
+	return r.get().MkDir(ctx, path)
+}
+
+// MkDirAll creates a directory, and any missing parents, on the remote
+// machine, retrying on transient errors.
+func (r *RetryableBinding) MkDirAll(ctx context.Context, path string) error {
+	return r.do(ctx, func(b *binding) error { return b.MkDirAll(ctx, path) })
+}
+
+// CopyFile copies a file within the remote machine. It is not retried.
+func (r *RetryableBinding) CopyFile(ctx context.Context, src, dst string) error {
+	return r.get().CopyFile(ctx, src, dst)
+}
+
+// MoveFile moves a file within the remote machine. It is not retried.
+func (r *RetryableBinding) MoveFile(ctx context.Context, src, dst string) error {
+	return r.get().MoveFile(ctx, src, dst)
+}
+
+// Chmod changes the permissions of a file on the remote machine, retrying on
+// transient errors.
+func (r *RetryableBinding) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return r.do(ctx, func(b *binding) error { return b.Chmod(ctx, path, mode) })
+}
+
+// Chown changes the owner of a file on the remote machine, retrying on
+// transient errors.
+func (r *RetryableBinding) Chown(ctx context.Context, path string, user, group string) error {
+	return r.do(ctx, func(b *binding) error { return b.Chown(ctx, path, user, group) })
+}
+
+// WatchFile reports the changes to a remote file or directory. It is not
+// retried.
+func (r *RetryableBinding) WatchFile(ctx context.Context, path string, events FileEventMask) (<-chan FileEvent, error) {
+	return r.get().WatchFile(ctx, path, events)
+}
+
+// CreateSymlink creates a symbolic link pointing to target. It is not retried.
+func (r *RetryableBinding) CreateSymlink(ctx context.Context, target, link string) error {
+	return r.get().CreateSymlink(ctx, target, link)
+}
+
+// ReadSymlink returns the target of a symbolic link, retrying on transient
+// errors.
+func (r *RetryableBinding) ReadSymlink(ctx context.Context, path string) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ReadSymlink(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// IsSymlink returns true if there is a symbolic link at path, retrying on
+// transient errors.
+func (r *RetryableBinding) IsSymlink(ctx context.Context, path string) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.IsSymlink(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// ListFiles returns the files in a directory on the remote machine, retrying
+// on transient errors.
+func (r *RetryableBinding) ListFiles(ctx context.Context, dir string, opts ListOptions) ([]RemoteFileInfo, error) {
+	var res []RemoteFileInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ListFiles(ctx, dir, opts)
+		return err
+	})
+	return res, err
+}
+
+// MakeTempDir makes a temporary directory, and returns the path, as well as a
+// function to call to clean it up. It is not retried.
+func (r *RetryableBinding) MakeTempDir(ctx context.Context) (string, func(ctx context.Context), error) {
+	return r.get().MakeTempDir(ctx)
+}
+
+// WriteFile writes the given file into the given location on the remote
+// machine. It is not retried.
+func (r *RetryableBinding) WriteFile(ctx context.Context, contents io.Reader, mode os.FileMode, destPath string, opts ...TransferOption) error {
+	return r.get().WriteFile(ctx, contents, mode, destPath, opts...)
+}
+
+// PullDirectory copies the contents of the remote directory remoteDir into the
+// local directory localDir, retrying on transient errors.
+func (r *RetryableBinding) PullDirectory(ctx context.Context, remoteDir, localDir string, opts ...TransferOption) error {
+	return r.do(ctx, func(b *binding) error { return b.PullDirectory(ctx, remoteDir, localDir, opts...) })
+}
+
+// PullDir copies the contents of the remote directory src into the local
+// directory dst, without compressing them, retrying on transient errors.
+func (r *RetryableBinding) PullDir(ctx context.Context, src, dst string, opts ...TransferOption) error {
+	return r.do(ctx, func(b *binding) error { return b.PullDir(ctx, src, dst, opts...) })
+}
+
+// PushDir copies the contents of the local directory src into the remote
+// directory dst. It is not retried.
+func (r *RetryableBinding) PushDir(ctx context.Context, src, dst string, opts ...TransferOption) error {
+	return r.get().PushDir(ctx, src, dst, opts...)
+}
+
+// SetupLocalPortNetwork forwards a local port, opened on network, to the
+// remote machine on the remote port, and returns the local port. It is not
+// retried.
+func (r *RetryableBinding) SetupLocalPortNetwork(ctx context.Context, network string, remotePort int) (int, error) {
+	return r.get().SetupLocalPortNetwork(ctx, network, remotePort)
+}
+
+// SetupLocalPortAt forwards the given local address to the remote machine on
+// the remote port, and returns the local port. It is not retried.
+func (r *RetryableBinding) SetupLocalPortAt(ctx context.Context, remotePort int, localAddr string) (int, error) {
+	return r.get().SetupLocalPortAt(ctx, remotePort, localAddr)
+}
+
+// SetupReversePort forwards the remote port on the remote machine to the local
+// port, until ctx is cancelled. It is not retried.
+func (r *RetryableBinding) SetupReversePort(ctx context.Context, localPort int, remotePort int) error {
+	return r.get().SetupReversePort(ctx, localPort, remotePort)
+}
+
+// SetupSOCKSProxy starts a local SOCKS5 proxy whose connections are made from
+// the remote machine, and returns its port. It is not retried.
+func (r *RetryableBinding) SetupSOCKSProxy(ctx context.Context) (int, error) {
+	return r.get().SetupSOCKSProxy(ctx)
+}
+
+// GetEnvVar returns the value of an environment variable on the remote
+// machine, retrying on transient errors.
+func (r *RetryableBinding) GetEnvVar(ctx context.Context, name string) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetEnvVar(ctx, name)
+		return err
+	})
+	return res, err
+}
+
+// SetEnvVar sets an environment variable for the commands run on the remote
+// machine, and persists it for future sessions. It is not retried.
+func (r *RetryableBinding) SetEnvVar(ctx context.Context, name, value string) error {
+	return r.get().SetEnvVar(ctx, name, value)
+}
+
+// UnsetEnv removes an environment variable set by SetEnvVar. It is not
+// retried.
+func (r *RetryableBinding) UnsetEnv(ctx context.Context, name string) error {
+	return r.get().UnsetEnv(ctx, name)
+}
+
+// ListSocketFiles returns the paths of the UNIX domain sockets under dir,
+// retrying on transient errors.
+func (r *RetryableBinding) ListSocketFiles(ctx context.Context, dir string) ([]string, error) {
+	var res []string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ListSocketFiles(ctx, dir)
+		return err
+	})
+	return res, err
+}
+
+// IsSocketListening returns true if the UNIX domain socket at socketPath is
+// accepting connections, retrying on transient errors.
+func (r *RetryableBinding) IsSocketListening(ctx context.Context, socketPath string) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.IsSocketListening(ctx, socketPath)
+		return err
+	})
+	return res, err
+}
+
+// Done returns a channel that is closed once the connection is closed or lost.
+func (r *RetryableBinding) Done() <-chan struct{} {
+	return r.get().Done()
+}
+
+// Ping checks that the remote machine still runs commands, retrying on
+// transient errors.
+func (r *RetryableBinding) Ping(ctx context.Context) error {
+	return r.do(ctx, func(b *binding) error { return b.Ping(ctx) })
+}
+
+// SetSessionPrealloc sets the number of SSH sessions to open in advance.
+func (r *RetryableBinding) SetSessionPrealloc(n int) {
+	r.get().SetSessionPrealloc(n)
+}
+
+// GetOSVersion returns the version of the operating system, retrying on
+// transient errors.
+func (r *RetryableBinding) GetOSVersion(ctx context.Context) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetOSVersion(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetKernelVersion returns the dotted version of the kernel, retrying on
+// transient errors.
+func (r *RetryableBinding) GetKernelVersion(ctx context.Context) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetKernelVersion(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetKernelTaintStatus returns whether the kernel is tainted, and why,
+// retrying on transient errors.
+func (r *RetryableBinding) GetKernelTaintStatus(ctx context.Context) (*TaintStatus, error) {
+	var res *TaintStatus
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetKernelTaintStatus(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetHostname returns the short hostname of the remote machine, retrying on
+// transient errors.
+func (r *RetryableBinding) GetHostname(ctx context.Context) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetHostname(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetFQDN returns the fully qualified domain name of the remote machine,
+// retrying on transient errors.
+func (r *RetryableBinding) GetFQDN(ctx context.Context) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetFQDN(ctx)
+		return err
+	})
+	return res, err
+}
+
+// SupportsFeature returns true if the remote machine has the feature, retrying
+// on transient errors.
+func (r *RetryableBinding) SupportsFeature(ctx context.Context, f Feature) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.SupportsFeature(ctx, f)
+		return err
+	})
+	return res, err
+}
+
+// ProbeCapabilities returns all the known features of the remote machine,
+// retrying on transient errors.
+func (r *RetryableBinding) ProbeCapabilities(ctx context.Context) (FeatureSet, error) {
+	var res FeatureSet
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ProbeCapabilities(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetPEInfo returns the headers of a Portable Executable binary, retrying on
+// transient errors.
+func (r *RetryableBinding) GetPEInfo(ctx context.Context, path string) (*PEInfo, error) {
+	var res *PEInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetPEInfo(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetDependencyGraph returns the graph of the shared libraries loaded by a
+// binary, retrying on transient errors.
+func (r *RetryableBinding) GetDependencyGraph(ctx context.Context, binary string, opts ...DependencyOption) (*DepGraph, error) {
+	var res *DepGraph
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetDependencyGraph(ctx, binary, opts...)
+		return err
+	})
+	return res, err
+}
+
+// GetCPUInfo returns the number, model, architecture and frequency of the
+// processors, retrying on transient errors.
+func (r *RetryableBinding) GetCPUInfo(ctx context.Context) (*CPUInfo, error) {
+	var res *CPUInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetCPUInfo(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetCPUAffinity returns the CPUs a process may run on, retrying on transient
+// errors.
+func (r *RetryableBinding) GetCPUAffinity(ctx context.Context, pid int) ([]int, error) {
+	var res []int
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetCPUAffinity(ctx, pid)
+		return err
+	})
+	return res, err
+}
+
+// SetCPUAffinity restricts a process to run on the given CPUs. It is not
+// retried.
+func (r *RetryableBinding) SetCPUAffinity(ctx context.Context, pid int, cpus []int) error {
+	return r.get().SetCPUAffinity(ctx, pid, cpus)
+}
+
+// GetOptimalCPUsForGPU returns the CPUs closest to the given PCI device,
+// retrying on transient errors.
+func (r *RetryableBinding) GetOptimalCPUsForGPU(ctx context.Context, gpuBDF string) ([]int, error) {
+	var res []int
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetOptimalCPUsForGPU(ctx, gpuBDF)
+		return err
+	})
+	return res, err
+}
+
+// GetMemoryInfo returns the total, free and available physical memory,
+// retrying on transient errors.
+func (r *RetryableBinding) GetMemoryInfo(ctx context.Context) (*MemoryInfo, error) {
+	var res *MemoryInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetMemoryInfo(ctx)
+		return err
+	})
+	return res, err
+}
+
+// WarnIfLowMemory logs a warning if little memory is available.
+func (r *RetryableBinding) WarnIfLowMemory(ctx context.Context) {
+	r.get().WarnIfLowMemory(ctx)
+}
+
+// GetHugeTLBInfo returns the state of the huge page pool, retrying on
+// transient errors.
+func (r *RetryableBinding) GetHugeTLBInfo(ctx context.Context) (*HugeTLBInfo, error) {
+	var res *HugeTLBInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetHugeTLBInfo(ctx)
+		return err
+	})
+	return res, err
+}
+
+// AllocateHugePages resizes the huge page pool. It is not retried.
+func (r *RetryableBinding) AllocateHugePages(ctx context.Context, count int) error {
+	return r.get().AllocateHugePages(ctx, count)
+}
+
+// FreeHugePages releases the unused pages of the huge page pool. It is not
+// retried.
+func (r *RetryableBinding) FreeHugePages(ctx context.Context) error {
+	return r.get().FreeHugePages(ctx)
+}
+
+// GetPlatformSecurityFeatures returns the state of Secure Boot, kernel
+// lockdown and the TPM, retrying on transient errors.
+func (r *RetryableBinding) GetPlatformSecurityFeatures(ctx context.Context) (*SecurityFeatures, error) {
+	var res *SecurityFeatures
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetPlatformSecurityFeatures(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetRASEvents returns the hardware errors reported since the given time,
+// retrying on transient errors.
+func (r *RetryableBinding) GetRASEvents(ctx context.Context, since time.Time) ([]RASEvent, error) {
+	var res []RASEvent
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetRASEvents(ctx, since)
+		return err
+	})
+	return res, err
+}
+
+// GetSMBIOSInfo returns information identifying the hardware platform,
+// retrying on transient errors.
+func (r *RetryableBinding) GetSMBIOSInfo(ctx context.Context) (*SMBIOSInfo, error) {
+	var res *SMBIOSInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetSMBIOSInfo(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetPowerConsumption returns the current power draw of the CPUs and GPUs,
+// retrying on transient errors.
+func (r *RetryableBinding) GetPowerConsumption(ctx context.Context) ([]PowerMeter, error) {
+	var res []PowerMeter
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetPowerConsumption(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetPCIeBandwidth returns the negotiated PCIe link of the given device,
+// retrying on transient errors.
+func (r *RetryableBinding) GetPCIeBandwidth(ctx context.Context, deviceBDF string) (*PCIeInfo, error) {
+	var res *PCIeInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetPCIeBandwidth(ctx, deviceBDF)
+		return err
+	})
+	return res, err
+}
+
+// GetIommuGroups returns the IOMMU groups and the devices in each, retrying on
+// transient errors.
+func (r *RetryableBinding) GetIommuGroups(ctx context.Context) ([]*IommuGroup, error) {
+	var res []*IommuGroup
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetIommuGroups(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetDeviceIommuGroup returns the IOMMU group of the given device, retrying on
+// transient errors.
+func (r *RetryableBinding) GetDeviceIommuGroup(ctx context.Context, deviceBDF string) (int, error) {
+	var res int
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetDeviceIommuGroup(ctx, deviceBDF)
+		return err
+	})
+	return res, err
+}
+
+// GetVFIODevices returns the PCI devices bound to the vfio-pci driver,
+// retrying on transient errors.
+func (r *RetryableBinding) GetVFIODevices(ctx context.Context) ([]*VFIODevice, error) {
+	var res []*VFIODevice
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetVFIODevices(ctx)
+		return err
+	})
+	return res, err
+}
+
+// BindDeviceToVFIO binds the given PCI device to the vfio-pci driver. It is
+// not retried.
+func (r *RetryableBinding) BindDeviceToVFIO(ctx context.Context, bdf string) error {
+	return r.get().BindDeviceToVFIO(ctx, bdf)
+}
+
+// UnbindDeviceFromVFIO unbinds the given PCI device from the vfio-pci driver.
+// It is not retried.
+func (r *RetryableBinding) UnbindDeviceFromVFIO(ctx context.Context, bdf string) error {
+	return r.get().UnbindDeviceFromVFIO(ctx, bdf)
+}
+
+// GetVulkanDeviceFeatures returns the features of the Vulkan physical device
+// with the given index, retrying on transient errors.
+func (r *RetryableBinding) GetVulkanDeviceFeatures(ctx context.Context, deviceIndex int) (*VulkanFeatures, error) {
+	var res *VulkanFeatures
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetVulkanDeviceFeatures(ctx, deviceIndex)
+		return err
+	})
+	return res, err
+}
+
+// GetVulkanMemoryProperties returns the memory heaps and types of the Vulkan
+// physical device with the given index, retrying on transient errors.
+func (r *RetryableBinding) GetVulkanMemoryProperties(ctx context.Context, deviceIndex int) (*VulkanMemoryProps, error) {
+	var res *VulkanMemoryProps
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetVulkanMemoryProperties(ctx, deviceIndex)
+		return err
+	})
+	return res, err
+}
+
+// GetVulkanQueueFamilies returns the queue families of a Vulkan physical
+// device, retrying on transient errors.
+func (r *RetryableBinding) GetVulkanQueueFamilies(ctx context.Context, deviceIndex int) ([]*VulkanQueueFamily, error) {
+	var res []*VulkanQueueFamily
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetVulkanQueueFamilies(ctx, deviceIndex)
+		return err
+	})
+	return res, err
+}
+
+// GetOpenCLPlatforms returns the installed OpenCL platforms and their devices,
+// retrying on transient errors.
+func (r *RetryableBinding) GetOpenCLPlatforms(ctx context.Context) ([]*OpenCLPlatform, error) {
+	var res []*OpenCLPlatform
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetOpenCLPlatforms(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetROCmInfo returns information about the ROCm installation, retrying on
+// transient errors.
+func (r *RetryableBinding) GetROCmInfo(ctx context.Context) (*ROCmInfo, error) {
+	var res *ROCmInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetROCmInfo(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetCUDAVersion returns information about the CUDA environment, retrying on
+// transient errors.
+func (r *RetryableBinding) GetCUDAVersion(ctx context.Context) (*CUDAInfo, error) {
+	var res *CUDAInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetCUDAVersion(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetMetalVersion returns the Metal support of the GPU on macOS, retrying on
+// transient errors.
+func (r *RetryableBinding) GetMetalVersion(ctx context.Context) (*MetalInfo, error) {
+	var res *MetalInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetMetalVersion(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetDirectXVersion returns the Direct3D support of the display adapters on
+// Windows, retrying on transient errors.
+func (r *RetryableBinding) GetDirectXVersion(ctx context.Context) (*DirectXInfo, error) {
+	var res *DirectXInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetDirectXVersion(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetGPUClock returns the graphics clocks of the GPUs, retrying on transient
+// errors.
+func (r *RetryableBinding) GetGPUClock(ctx context.Context) ([]GPUClock, error) {
+	var res []GPUClock
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetGPUClock(ctx)
+		return err
+	})
+	return res, err
+}
+
+// SetGPUClock locks the graphics clock of the given GPU. It is not retried.
+func (r *RetryableBinding) SetGPUClock(ctx context.Context, deviceIndex, clockMHz int) error {
+	return r.get().SetGPUClock(ctx, deviceIndex, clockMHz)
+}
+
+// ResetGPUClock unlocks the graphics clock of the given GPU. It is not
+// retried.
+func (r *RetryableBinding) ResetGPUClock(ctx context.Context, deviceIndex int) error {
+	return r.get().ResetGPUClock(ctx, deviceIndex)
+}
+
+// StreamGPUMetrics periodically samples the performance counters of the GPUs
+// until ctx is cancelled. It is not retried.
+func (r *RetryableBinding) StreamGPUMetrics(ctx context.Context, interval time.Duration) (<-chan GPUMetricSample, error) {
+	return r.get().StreamGPUMetrics(ctx, interval)
+}
+
+// GetFragmentationStats returns estimates of the VRAM and system memory
+// fragmentation, retrying on transient errors.
+func (r *RetryableBinding) GetFragmentationStats(ctx context.Context) (*FragStats, error) {
+	var res *FragStats
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetFragmentationStats(ctx)
+		return err
+	})
+	return res, err
+}
+
+// ListGPUDebugFSEntries returns the debugfs entries of the GPU driver,
+// retrying on transient errors.
+func (r *RetryableBinding) ListGPUDebugFSEntries(ctx context.Context) ([]string, error) {
+	var res []string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ListGPUDebugFSEntries(ctx)
+		return err
+	})
+	return res, err
+}
+
+// ReadGPUDebugFSEntry returns the contents of a debugfs entry of the GPU
+// driver, retrying on transient errors.
+func (r *RetryableBinding) ReadGPUDebugFSEntry(ctx context.Context, entry string) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ReadGPUDebugFSEntry(ctx, entry)
+		return err
+	})
+	return res, err
+}
+
+// GetAudioDevices returns the audio output devices, retrying on transient
+// errors.
+func (r *RetryableBinding) GetAudioDevices(ctx context.Context) ([]*AudioDevice, error) {
+	var res []*AudioDevice
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetAudioDevices(ctx)
+		return err
+	})
+	return res, err
+}
+
+// SetDefaultAudioSink makes the given PulseAudio sink the default output. It
+// is not retried.
+func (r *RetryableBinding) SetDefaultAudioSink(ctx context.Context, deviceName string) error {
+	return r.get().SetDefaultAudioSink(ctx, deviceName)
+}
+
+// CreateVirtualDisplay starts a headless X11 display, and sets DISPLAY for
+// subsequent commands. It is not retried.
+func (r *RetryableBinding) CreateVirtualDisplay(ctx context.Context, width, height, refreshHz int) (*VirtualDisplay, error) {
+	return r.get().CreateVirtualDisplay(ctx, width, height, refreshHz)
+}
+
+// CreateWaylandDisplay starts a headless Wayland compositor, and sets
+// WAYLAND_DISPLAY for subsequent commands. It is not retried.
+func (r *RetryableBinding) CreateWaylandDisplay(ctx context.Context, width, height int) (*VirtualDisplay, error) {
+	return r.get().CreateWaylandDisplay(ctx, width, height)
+}
+
+// GetDRMFormatModifiers returns the formats and modifiers of the framebuffers
+// being displayed, retrying on transient errors.
+func (r *RetryableBinding) GetDRMFormatModifiers(ctx context.Context) ([]*FormatModifier, error) {
+	var res []*FormatModifier
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetDRMFormatModifiers(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetDisplayRefreshRate returns the refresh rate of an X11 output, retrying on
+// transient errors.
+func (r *RetryableBinding) GetDisplayRefreshRate(ctx context.Context, displayName string) (int, error) {
+	var res int
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetDisplayRefreshRate(ctx, displayName)
+		return err
+	})
+	return res, err
+}
+
+// ListProcesses returns the processes running on the remote machine, retrying
+// on transient errors.
+func (r *RetryableBinding) ListProcesses(ctx context.Context) ([]RemoteProcessInfo, error) {
+	var res []RemoteProcessInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.ListProcesses(ctx)
+		return err
+	})
+	return res, err
+}
+
+// FindProcess returns the running processes with the given name, retrying on
+// transient errors.
+func (r *RetryableBinding) FindProcess(ctx context.Context, name string) ([]RemoteProcessInfo, error) {
+	var res []RemoteProcessInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.FindProcess(ctx, name)
+		return err
+	})
+	return res, err
+}
+
+// KillProcess sends a signal to the process with the given PID. It is not
+// retried.
+func (r *RetryableBinding) KillProcess(ctx context.Context, pid int, sig os.Signal) error {
+	return r.get().KillProcess(ctx, pid, sig)
+}
+
+// GetProcessIOStats returns the I/O counters of a process, retrying on
+// transient errors.
+func (r *RetryableBinding) GetProcessIOStats(ctx context.Context, pid int) (*IOStats, error) {
+	var res *IOStats
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetProcessIOStats(ctx, pid)
+		return err
+	})
+	return res, err
+}
+
+// SampleIOStats repeatedly reads the I/O counters of a process, retrying on
+// transient errors.
+func (r *RetryableBinding) SampleIOStats(ctx context.Context, pid int, interval time.Duration, count int) ([]*IOStatsSample, error) {
+	var res []*IOStatsSample
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.SampleIOStats(ctx, pid, interval, count)
+		return err
+	})
+	return res, err
+}
+
+// GetMMappedFiles returns the shared memory mappings of a process, retrying on
+// transient errors.
+func (r *RetryableBinding) GetMMappedFiles(ctx context.Context, pid int) ([]*SharedMemInfo, error) {
+	var res []*SharedMemInfo
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetMMappedFiles(ctx, pid)
+		return err
+	})
+	return res, err
+}
+
+// GetSHMSegments returns the System V shared memory segments, retrying on
+// transient errors.
+func (r *RetryableBinding) GetSHMSegments(ctx context.Context) ([]*SHMSegment, error) {
+	var res []*SHMSegment
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetSHMSegments(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetDiskUsage returns the size and usage of the filesystem containing a path,
+// retrying on transient errors.
+func (r *RetryableBinding) GetDiskUsage(ctx context.Context, path string) (*DiskUsage, error) {
+	var res *DiskUsage
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetDiskUsage(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetPathSize returns the size of a file or directory tree, retrying on
+// transient errors.
+func (r *RetryableBinding) GetPathSize(ctx context.Context, path string) (int64, error) {
+	var res int64
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetPathSize(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetFileSystemType returns the type of the filesystem containing path,
+// retrying on transient errors.
+func (r *RetryableBinding) GetFileSystemType(ctx context.Context, path string) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetFileSystemType(ctx, path)
+		return err
+	})
+	return res, err
+}
+
+// GetIOScheduler returns the current I/O scheduler of a block device, retrying
+// on transient errors.
+func (r *RetryableBinding) GetIOScheduler(ctx context.Context, device string) (string, error) {
+	var res string
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetIOScheduler(ctx, device)
+		return err
+	})
+	return res, err
+}
+
+// SetIOScheduler changes the I/O scheduler of a block device. It is not
+// retried.
+func (r *RetryableBinding) SetIOScheduler(ctx context.Context, device, scheduler string) error {
+	return r.get().SetIOScheduler(ctx, device, scheduler)
+}
+
+// CreateLVMSnapshot creates a snapshot of an LVM logical volume. It is not
+// retried.
+func (r *RetryableBinding) CreateLVMSnapshot(ctx context.Context, vgName, lvName, snapshotName string, sizeGB int) (*LVMSnapshot, error) {
+	return r.get().CreateLVMSnapshot(ctx, vgName, lvName, snapshotName, sizeGB)
+}
+
+// MountSnapshot mounts an LVM snapshot read-only. It is not retried.
+func (r *RetryableBinding) MountSnapshot(ctx context.Context, snap *LVMSnapshot, mountPoint, fsType string) (func(context.Context), error) {
+	return r.get().MountSnapshot(ctx, snap, mountPoint, fsType)
+}
+
+// GetNetworkInterfaces returns the network interfaces and their addresses,
+// retrying on transient errors.
+func (r *RetryableBinding) GetNetworkInterfaces(ctx context.Context) ([]RemoteInterface, error) {
+	var res []RemoteInterface
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetNetworkInterfaces(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetRDMADevices returns the RDMA network adapters of the remote machine,
+// retrying on transient errors.
+func (r *RetryableBinding) GetRDMADevices(ctx context.Context) ([]*RDMADevice, error) {
+	var res []*RDMADevice
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetRDMADevices(ctx)
+		return err
+	})
+	return res, err
+}
+
+// GetNetworkQoS returns the traffic control configuration of a network
+// interface, retrying on transient errors.
+func (r *RetryableBinding) GetNetworkQoS(ctx context.Context, iface string) (*QoSConfig, error) {
+	var res *QoSConfig
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetNetworkQoS(ctx, iface)
+		return err
+	})
+	return res, err
+}
+
+// SetNetworkRateLimit limits the egress rate of a network interface. It is not
+// retried.
+func (r *RetryableBinding) SetNetworkRateLimit(ctx context.Context, iface string, bitsPerSecond int64) error {
+	return r.get().SetNetworkRateLimit(ctx, iface, bitsPerSecond)
+}
+
+// GetContainerCapabilities returns the Linux capabilities of the given Docker
+// container, retrying on transient errors.
+func (r *RetryableBinding) GetContainerCapabilities(ctx context.Context, containerID string) (*CapabilitySet, error) {
+	var res *CapabilitySet
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetContainerCapabilities(ctx, containerID)
+		return err
+	})
+	return res, err
+}
+
+// HasCapability returns true if the given Docker container has the given
+// capability, retrying on transient errors.
+func (r *RetryableBinding) HasCapability(ctx context.Context, containerID, capability string) (bool, error) {
+	var res bool
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.HasCapability(ctx, containerID, capability)
+		return err
+	})
+	return res, err
+}
+
+// GetContainerMemoryStats returns the memory usage of a Docker container,
+// retrying on transient errors.
+func (r *RetryableBinding) GetContainerMemoryStats(ctx context.Context, containerID string) (*ContainerMemStats, error) {
+	var res *ContainerMemStats
+	err := r.do(ctx, func(b *binding) (err error) {
+		res, err = b.GetContainerMemoryStats(ctx, containerID)
+		return err
+	})
+	return res, err
+}
+
+// MonitorContainerMemory sends an alert when the memory usage of a Docker
+// container rises above a threshold. It is not retried.
+func (r *RetryableBinding) MonitorContainerMemory(ctx context.Context, containerID string, threshold float64) (<-chan MemAlert, error) {
+	return r.get().MonitorContainerMemory(ctx, containerID, threshold)
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClassifyError(t *testing.T) {
+	ctx := log.Testing(t)
+
+	lostCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, test := range []struct {
+		name      string
+		err       error
+		alive     context.Context
+		transient bool
+		lost      bool
+	}{
+		{"connection lost", ErrConnectionLost, nil, true, true},
+		{"pool closed", ErrSessionPoolClosed, nil, true, true},
+		{"channel exhausted", &ssh.OpenChannelError{Reason: ssh.ResourceShortage}, nil, true, false},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, nil, true, true},
+		{"broken pipe", fmt.Errorf("write: %w", os.NewSyscallError("write", syscall.EPIPE)), nil, true, true},
+		{"wrapped", log.Err(ctx, ErrConnectionLost, "Could not run"), nil, true, true},
+		{"alive cancelled", fmt.Errorf("ssh: session failed"), lostCtx, true, true},
+		{"alive", fmt.Errorf("ssh: session failed"), ctx, false, false},
+		{"closing text", fmt.Errorf("ssh: unexpected packet in response to channel open: <nil>"), nil, true, true},
+		{"reset text", fmt.Errorf("read tcp: connection reset by peer"), nil, true, true},
+		{"broken pipe text", fmt.Errorf("write tcp: broken pipe"), nil, true, true},
+		{"exit", newRemoteError("false", "", &ssh.ExitError{Waitmsg: ssh.Waitmsg{}}), lostCtx, false, false},
+		{"not found", ErrNotFound, nil, false, false},
+		{"cancelled", newRemoteError("sleep 1", "", context.Canceled), nil, false, false},
+	} {
+		transient, lost := classifyError(test.err, test.alive)
+		assert.For(ctx, "%v transient", test.name).That(transient).Equals(test.transient)
+		assert.For(ctx, "%v lost", test.name).That(lost).Equals(test.lost)
+	}
+}
+
+func TestRetryableBinding(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := &binding{connection: client, configuration: &c, env: shell.NewEnv().Set("GREETING", "hello"), os: device.Linux}
+	r := b.WithRetry(RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond})
+	reject := func(n int) {
+		server.mutex.Lock()
+		server.rejectSessions = n
+		server.totalSessions = 0
+		server.mutex.Unlock()
+	}
+	sessions := func() int {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return server.totalSessions
+	}
+
+	// A query that fails twice is retried until it succeeds.
+	reject(2)
+	v, err := r.GetEnvVar(ctx, "GREETING")
+	assert.For(ctx, "GetEnvVar").ThatError(err).Succeeded()
+	assert.For(ctx, "value").ThatString(v).Equals("hello")
+	assert.For(ctx, "sessions").ThatInteger(sessions()).Equals(1)
+
+	// The policy gives up after its attempts.
+	reject(3)
+	_, err = r.GetEnvVar(ctx, "GREETING")
+	assert.For(ctx, "given up").ThatError(err).Failed()
+	assert.For(ctx, "given up sessions").ThatInteger(sessions()).Equals(0)
+
+	// Failures of the command are not retried.
+	reject(0)
+	_, err = r.GetEnvVar(ctx, "MISSING")
+	assert.For(ctx, "not set").ThatError(err).Equals(ErrEnvVarNotSet)
+	assert.For(ctx, "not set sessions").ThatInteger(sessions()).Equals(1)
+
+	// Neither are the methods that cannot safely be repeated.
+	reject(1)
+	err = r.WriteFile(ctx, strings.NewReader("data"), 0600, dir+"/file")
+	assert.For(ctx, "WriteFile").ThatError(err).Failed()
+	assert.For(ctx, "WriteFile sessions").ThatInteger(sessions()).Equals(0)
+}
+
+func TestRetryableBindingReconnects(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	b := &binding{configuration: &c, env: shell.NewEnv().Set("GREETING", "hello"), tunnels: &tunnelSet{}, os: device.Linux}
+	err = b.connect(ctx)
+	assert.For(ctx, "connect").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	b.monitorConnection(ctx)
+	r := b.WithRetry(RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond})
+	defer r.Close()
+	conns := func() []*ssh.ServerConn {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return append([]*ssh.ServerConn{}, server.conns...)
+	}
+
+	v, err := r.GetEnvVar(ctx, "GREETING")
+	assert.For(ctx, "GetEnvVar").ThatError(err).Succeeded()
+	assert.For(ctx, "value").ThatString(v).Equals("hello")
+	assert.For(ctx, "connections").ThatSlice(conns()).IsLength(1)
+
+	// The server drops the connection, so the attempts fail until the
+	// binding reconnects.
+	conns()[0].Close()
+	v, err = r.GetEnvVar(ctx, "GREETING")
+	assert.For(ctx, "GetEnvVar after").ThatError(err).Succeeded()
+	assert.For(ctx, "value after").ThatString(v).Equals("hello")
+	assert.For(ctx, "connections after").ThatSlice(conns()).IsLength(2)
+}
+
+func TestRetryableBindingConcurrentReconnect(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	b := &binding{configuration: &c, env: shell.NewEnv().Set("GREETING", "hello"), tunnels: &tunnelSet{}, os: device.Linux}
+	err = b.connect(ctx)
+	assert.For(ctx, "connect").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	b.monitorConnection(ctx)
+	r := b.WithRetry(RetryPolicy{MaxAttempts: 5, InitialDelay: time.Millisecond})
+	defer r.Close()
+
+	// The queries keep running while the binding reconnects, once because
+	// it is asked to and once because the server drops the connection.
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				if _, err := r.GetEnvVar(ctx, "GREETING"); err != nil {
+					errs <- err
+					return
+				}
+				r.Instance()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.For(ctx, "Reconnect").ThatError(r.Reconnect(ctx)).Succeeded()
+	time.Sleep(50 * time.Millisecond)
+	server.mutex.Lock()
+	conn := server.conns[len(server.conns)-1]
+	server.mutex.Unlock()
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	for i := 0; i < cap(errs); i++ {
+		assert.For(ctx, "GetEnvVar").ThatError(<-errs).Succeeded()
+	}
+	server.mutex.Lock()
+	assert.For(ctx, "connections").ThatSlice(server.conns).IsLength(3)
+	server.mutex.Unlock()
+}
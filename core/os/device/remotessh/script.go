@@ -0,0 +1,130 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+// RunScript runs script in a single SSH session, rather than a session per
+// command, and returns what it wrote to standard output and standard error.
+// The script is fed to sh -s on POSIX machines, and to PowerShell on
+// Windows.
+func (b binding) RunScript(ctx context.Context, script string) (string, string, error) {
+	cmd := b.Shell("sh", "-s")
+	if b.os == device.Windows {
+		cmd = b.Shell("powershell", "-NoProfile", "-NonInteractive", "-Command", "-")
+		// PowerShell only runs lines from standard input once they are
+		// terminated.
+		if !strings.HasSuffix(script, "\n") {
+			script += "\n"
+		}
+	}
+	return runCapture(ctx, cmd.Read(strings.NewReader(script)))
+}
+
+// RunScriptFile copies the local script at localScriptPath to a temporary
+// file on the remote machine, runs it as with RunScript, and removes it.
+func (b binding) RunScriptFile(ctx context.Context, localScriptPath string) (string, string, error) {
+	remote, cleanup, err := b.pushScript(ctx, localScriptPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer cleanup(ctx)
+
+	cmd := b.Shell("sh", remote)
+	if b.os == device.Windows {
+		cmd = b.windowsScript(remote)
+	}
+	return runCapture(ctx, cmd)
+}
+
+// RunLocalScript copies the local script at localPath to a temporary file on
+// the remote machine, makes it executable and runs it with args, so that it
+// is run by the interpreter named on its #! line, and removes it. It returns
+// what the script wrote to standard output and standard error.
+// On Windows the script is run by PowerShell, and args are passed on as they
+// are.
+func (b binding) RunLocalScript(ctx context.Context, localPath string, args ...string) (string, string, error) {
+	remote, cleanup, err := b.pushScript(ctx, localPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer cleanup(ctx)
+
+	if err := b.Chmod(ctx, remote, 0700); err != nil {
+		return "", "", err
+	}
+	cmd := b.Shell(remote, args...)
+	if b.os == device.Windows {
+		cmd = b.windowsScript(remote).With(args...)
+	}
+	return runCapture(ctx, cmd)
+}
+
+// pushScript copies the local script at localPath to a temporary file on the
+// remote machine. It returns the path to the file, and a function that
+// removes it.
+func (b binding) pushScript(ctx context.Context, localPath string) (string, func(context.Context), error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	var remote string
+	var cleanup func(context.Context)
+	if b.os == device.Windows {
+		// PowerShell only runs files with the .ps1 extension.
+		dir, cleanupDir, err := b.MakeTempDir(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		remote, cleanup = dir+"/script.ps1", cleanupDir
+	} else {
+		remote, cleanup, err = b.TempFile(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := b.WriteFile(ctx, f, 0700, remote); err != nil {
+		cleanup(ctx)
+		return "", nil, log.Errf(ctx, err, "Could not copy %s to %s", localPath, remote)
+	}
+	return remote, cleanup, nil
+}
+
+// windowsScript returns the command that runs the PowerShell script at
+// remote.
+func (b binding) windowsScript(remote string) shell.Cmd {
+	return b.Shell("powershell", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass",
+		"-File", powerShellQuote(windowsPath(remote)))
+}
+
+// runCapture runs cmd, returning what it wrote to standard output and
+// standard error.
+func runCapture(ctx context.Context, cmd shell.Cmd) (string, string, error) {
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	err := cmd.Capture(&stdout, &stderr).Run(ctx)
+	return stdout.String(), stderr.String(), err
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestRunScript(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv()}
+
+	// All the commands run in one session.
+	stdout, stderr, err := b.RunScript(ctx, "echo one\necho two >&2\nx=3\necho $x\n")
+	assert.For(ctx, "RunScript").ThatError(err).Succeeded()
+	assert.For(ctx, "stdout").ThatString(stdout).Equals("one\n3\n")
+	assert.For(ctx, "stderr").ThatString(stderr).Equals("two\n")
+	server.mutex.Lock()
+	assert.For(ctx, "sessions").ThatInteger(server.totalSessions).Equals(1)
+	server.mutex.Unlock()
+
+	stdout, _, err = b.RunScript(ctx, "echo before\nexit 3\necho after")
+	assert.For(ctx, "failing script").ThatError(err).Failed()
+	assert.For(ctx, "exit status").ThatInteger(exitStatusOf(err)).Equals(3)
+	assert.For(ctx, "failing stdout").ThatString(stdout).Equals("before\n")
+
+	// The script file is copied to the remote machine, run and removed.
+	local := filepath.Join(dir, "setup.sh")
+	script := "echo \"$0\"\necho args $#\n"
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(local, []byte(script), 0600)).Succeeded()
+	stdout, stderr, err = b.RunScriptFile(ctx, local)
+	assert.For(ctx, "RunScriptFile").ThatError(err).Succeeded()
+	assert.For(ctx, "RunScriptFile stderr").ThatString(stderr).Equals("")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	assert.For(ctx, "lines").ThatSlice(lines).IsLength(2)
+	if len(lines) == 2 {
+		assert.For(ctx, "args").ThatString(lines[1]).Equals("args 0")
+		_, err = os.Stat(lines[0])
+		assert.For(ctx, "removed").That(os.IsNotExist(err)).Equals(true)
+	}
+
+	_, _, err = b.RunScriptFile(ctx, filepath.Join(dir, "missing.sh"))
+	assert.For(ctx, "missing script").ThatError(err).Failed()
+}
+
+func TestRunLocalScript(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	// The script is run directly, with its arguments unchanged.
+	local := filepath.Join(dir, "args.sh")
+	script := "#!/bin/sh\necho \"$0\"\nprintf '%s\\n' \"$@\"\necho done >&2\n"
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(local, []byte(script), 0600)).Succeeded()
+	stdout, stderr, err := b.RunLocalScript(ctx, local, "one", "two words", "$(three)")
+	assert.For(ctx, "RunLocalScript").ThatError(err).Succeeded()
+	assert.For(ctx, "stderr").ThatString(stderr).Equals("done\n")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	assert.For(ctx, "lines").ThatSlice(lines).IsLength(4)
+	if len(lines) == 4 {
+		assert.For(ctx, "args").ThatSlice(lines[1:]).Equals([]string{"one", "two words", "$(three)"})
+		_, err = os.Stat(lines[0])
+		assert.For(ctx, "removed").That(os.IsNotExist(err)).Equals(true)
+	}
+
+	_, _, err = b.RunLocalScript(ctx, filepath.Join(dir, "missing.sh"))
+	assert.For(ctx, "missing script").ThatError(err).Failed()
+}
+
+// exitStatusOf returns the exit status in the Cause chain of err, or -1.
+func exitStatusOf(err error) int {
+	if status, ok := exitStatus(err); ok {
+		return status
+	}
+	return -1
+}
@@ -0,0 +1,244 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/gapid/core/app/crash"
+	"github.com/google/gapid/core/fault"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrSessionPoolClosed is returned when a session is requested from a
+// binding that has been closed.
+const ErrSessionPoolClosed = fault.Const("SSH session pool closed")
+
+// defaultMaxOpenSessions is the default number of sessions that may be open
+// at once on a connection. It is the default MaxSessions of OpenSSH
+// servers, which refuse to open more, less the session of the SFTP
+// subsystem that the binding keeps open.
+const defaultMaxOpenSessions = 9
+
+// sessionPool limits the number of SSH sessions open at once on a
+// connection, blocking callers until a session is closed when the limit is
+// reached. An SSH session runs a single command, so sessions cannot be
+// reused once their command has finished. Instead, the pool can open
+// sessions in advance, to hide the latency of opening them from the
+// commands that follow.
+type sessionPool struct {
+	connection *ssh.Client
+	// slots holds a value for each open session.
+	slots chan struct{}
+	// ready holds the sessions opened in advance.
+	ready chan *ssh.Session
+	// done is closed when no more sessions should be opened.
+	done <-chan struct{}
+
+	mutex    sync.Mutex
+	open     map[*ssh.Session]struct{}
+	prealloc int
+	// refilling is true while sessions are being opened in advance.
+	refilling bool
+}
+
+func newSessionPool(connection *ssh.Client, maxOpen int, done <-chan struct{}) *sessionPool {
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenSessions
+	}
+	return &sessionPool{
+		connection: connection,
+		slots:      make(chan struct{}, maxOpen),
+		ready:      make(chan *ssh.Session, maxOpen),
+		done:       done,
+		open:       map[*ssh.Session]struct{}{},
+	}
+}
+
+// get returns a session opened in advance if there is one, or opens a new
+// session, waiting until one of the open sessions is released if there are
+// too many, or until ctx is cancelled.
+func (p *sessionPool) get(ctx context.Context) (*ssh.Session, error) {
+	select {
+	case <-p.done:
+		return nil, ErrSessionPoolClosed
+	default:
+	}
+	select {
+	case session := <-p.ready:
+		return p.takeReady(session)
+	default:
+	}
+	select {
+	case session := <-p.ready:
+		return p.takeReady(session)
+	case p.slots <- struct{}{}:
+	case <-p.done:
+		return nil, ErrSessionPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return p.openSession()
+}
+
+// takeReady returns a session that was opened in advance, and opens another
+// in its place.
+func (p *sessionPool) takeReady(session *ssh.Session) (*ssh.Session, error) {
+	p.mutex.Lock()
+	_, ok := p.open[session]
+	p.mutex.Unlock()
+	if !ok {
+		// The pool was closed, closing the session.
+		return nil, ErrSessionPoolClosed
+	}
+	crash.Go(p.refill)
+	return session, nil
+}
+
+// openSession opens a session in a slot that the caller has taken.
+func (p *sessionPool) openSession() (*ssh.Session, error) {
+	session, err := p.connection.NewSession()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.open == nil {
+		// The pool was closed while the session was opened.
+		session.Close()
+		<-p.slots
+		return nil, ErrSessionPoolClosed
+	}
+	p.open[session] = struct{}{}
+	return session, nil
+}
+
+// put closes a session returned by get, so that another can be opened.
+func (p *sessionPool) put(session *ssh.Session) {
+	session.Close()
+	p.mutex.Lock()
+	if _, ok := p.open[session]; ok {
+		delete(p.open, session)
+		<-p.slots
+	}
+	prealloc := p.prealloc
+	p.mutex.Unlock()
+	if prealloc > 0 {
+		// The released slot may be needed for a session in advance.
+		crash.Go(p.refill)
+	}
+}
+
+// setPrealloc sets the number of sessions to keep open in advance. It is
+// capped to the number of sessions that may be open at once.
+func (p *sessionPool) setPrealloc(n int) {
+	if n > cap(p.slots) {
+		n = cap(p.slots)
+	}
+	p.mutex.Lock()
+	p.prealloc = n
+	p.mutex.Unlock()
+	p.refill()
+}
+
+// refill opens sessions in advance until there are prealloc of them, or as
+// many sessions are open as are allowed. Sessions that are no longer wanted
+// are closed.
+func (p *sessionPool) refill() {
+	p.mutex.Lock()
+	if p.refilling {
+		p.mutex.Unlock()
+		return
+	}
+	p.refilling = true
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		p.refilling = false
+		p.mutex.Unlock()
+	}()
+
+	for {
+		p.mutex.Lock()
+		prealloc := p.prealloc
+		p.mutex.Unlock()
+		if len(p.ready) > prealloc {
+			select {
+			case session := <-p.ready:
+				p.put(session)
+				continue
+			default:
+			}
+		}
+		if len(p.ready) >= prealloc {
+			return
+		}
+		select {
+		case <-p.done:
+			return
+		case p.slots <- struct{}{}:
+		default:
+			// Sessions in use take precedence.
+			return
+		}
+		session, err := p.openSession()
+		if err != nil {
+			return
+		}
+		p.ready <- session
+	}
+}
+
+// close closes all the open sessions. The done channel given to
+// newSessionPool must be closed first, so that no more are opened.
+func (p *sessionPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for session := range p.open {
+		session.Close()
+		<-p.slots
+	}
+	p.open = nil
+}
+
+// newSession opens a session on the connection, through the session pool
+// if the binding has one.
+func (b binding) newSession(ctx context.Context) (*ssh.Session, error) {
+	if b.sessions == nil {
+		return b.connection.NewSession()
+	}
+	return b.sessions.get(ctx)
+}
+
+// SetSessionPrealloc sets the number of SSH sessions to open in advance, so
+// that commands do not wait for their session to open. Each session that is
+// used is replaced by a new one. The sessions count towards MaxOpenSessions.
+// 0, the default, opens sessions only when commands run.
+func (b binding) SetSessionPrealloc(n int) {
+	if b.sessions != nil {
+		b.sessions.setPrealloc(n)
+	}
+}
+
+// releaseSession closes a session returned by newSession.
+func (b binding) releaseSession(session *ssh.Session) {
+	if b.sessions == nil {
+		session.Close()
+		return
+	}
+	b.sessions.put(session)
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestSessionPool(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	alive, cancel := context.WithCancel(context.Background())
+	b := &binding{
+		connection:    client,
+		configuration: &c,
+		env:           shell.NewEnv(),
+		sessions:      newSessionPool(client, 3, alive.Done()),
+		alive:         alive,
+		cancel:        cancel,
+	}
+
+	const calls = 20
+	wg := sync.WaitGroup{}
+	outputs := make([]string, calls)
+	errs := make([]error, calls)
+	for i := 0; i < calls; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[i], errs[i] = b.posixShell("sleep 0.01; echo " + fmt.Sprint(i)).Call(ctx)
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < calls; i++ {
+		assert.For(ctx, "call %d", i).ThatError(errs[i]).Succeeded()
+		assert.For(ctx, "output %d", i).ThatString(outputs[i]).Equals(fmt.Sprint(i))
+	}
+	server.mutex.Lock()
+	assert.For(ctx, "max sessions").ThatInteger(server.maxSessions).IsAtMost(3)
+	server.mutex.Unlock()
+
+	// Once the binding is closed no more sessions are opened.
+	assert.For(ctx, "Close").ThatError(b.Close()).Succeeded()
+	_, err = b.newSession(ctx)
+	assert.For(ctx, "closed").ThatError(err).Equals(ErrSessionPoolClosed)
+}
+
+func TestSessionPoolContext(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	alive, cancel := context.WithCancel(context.Background())
+	b := &binding{
+		connection:    client,
+		configuration: &c,
+		env:           shell.NewEnv(),
+		sessions:      newSessionPool(client, 1, alive.Done()),
+		alive:         alive,
+		cancel:        cancel,
+	}
+	defer b.Close()
+
+	held, err := b.newSession(ctx)
+	assert.For(ctx, "held").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+
+	// With every session in use, commands give up once their context is
+	// done rather than wait forever.
+	cancelled, cancelNow := context.WithCancel(ctx)
+	cancelNow()
+	_, err = b.newSession(cancelled)
+	assert.For(ctx, "cancelled").ThatError(err).Equals(context.Canceled)
+	_, err = b.Shell("true").WithTimeout(50 * time.Millisecond).Call(ctx)
+	assert.For(ctx, "timeout").ThatError(err).Failed()
+
+	b.releaseSession(held)
+	out, err := b.Shell("echo", "released").Call(ctx)
+	assert.For(ctx, "released").ThatError(err).Succeeded()
+	assert.For(ctx, "output").ThatString(out).Equals("released")
+}
+
+// waitForSessions waits until the server has n open sessions.
+func waitForSessions(server *testSSHServer, n int) bool {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		server.mutex.Lock()
+		open := server.sessions
+		server.mutex.Unlock()
+		if open == n {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSessionPrealloc(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	alive, cancel := context.WithCancel(context.Background())
+	b := &binding{
+		connection:    client,
+		configuration: &c,
+		env:           shell.NewEnv(),
+		sessions:      newSessionPool(client, 3, alive.Done()),
+		alive:         alive,
+		cancel:        cancel,
+	}
+
+	b.SetSessionPrealloc(2)
+	assert.For(ctx, "preallocated").That(waitForSessions(server, 2)).Equals(true)
+	for i := 0; i < 5; i++ {
+		out, err := b.Shell("echo", fmt.Sprint(i)).Call(ctx)
+		assert.For(ctx, "call %d", i).ThatError(err).Succeeded()
+		assert.For(ctx, "output %d", i).ThatString(out).Equals(fmt.Sprint(i))
+		// Each session used is replaced.
+		assert.For(ctx, "replaced %d", i).That(waitForSessions(server, 2)).Equals(true)
+	}
+
+	// The sessions opened in advance are limited by MaxOpenSessions, and
+	// do not stop commands from running.
+	b.SetSessionPrealloc(10)
+	assert.For(ctx, "capped").That(waitForSessions(server, 3)).Equals(true)
+	out, err := b.Shell("echo", "capped").Call(ctx)
+	assert.For(ctx, "capped call").ThatError(err).Succeeded()
+	assert.For(ctx, "capped output").ThatString(out).Equals("capped")
+	server.mutex.Lock()
+	assert.For(ctx, "max sessions").ThatInteger(server.maxSessions).IsAtMost(3)
+	server.mutex.Unlock()
+
+	b.SetSessionPrealloc(0)
+	assert.For(ctx, "released").That(waitForSessions(server, 0)).Equals(true)
+
+	b.SetSessionPrealloc(2)
+	assert.For(ctx, "preallocated again").That(waitForSessions(server, 2)).Equals(true)
+	assert.For(ctx, "Close").ThatError(b.Close()).Succeeded()
+	assert.For(ctx, "closed").That(waitForSessions(server, 0)).Equals(true)
+	_, err = b.newSession(ctx)
+	assert.For(ctx, "closed session").ThatError(err).Equals(ErrSessionPoolClosed)
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/google/gapid/core/log"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSFTPClient opens an SFTP session over the connection. It returns nil if
+// the server does not provide the SFTP subsystem, in which case files are
+// transferred through the shell instead.
+func newSFTPClient(ctx context.Context, connection *ssh.Client) *sftp.Client {
+	client, err := sftp.NewClient(connection)
+	if err != nil {
+		log.I(ctx, "SFTP unavailable, falling back to shell file transfers: %v", err)
+		return nil
+	}
+	return client
+}
+
+// sftpWriteFile writes contents to destPath over SFTP, and gives it the
+// permissions of mode. Unlike the shell transfer, the path is used verbatim
+// and errors are reported by the protocol rather than by exit codes. As with
+// the shell transfer, the contents are written to a temporary file that is
+// renamed to destPath once complete.
+func (b binding) sftpWriteFile(ctx context.Context, contents io.Reader, mode os.FileMode, destPath string) error {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := destPath + ".tmp." + hex.EncodeToString(suffix)
+	f, err := b.sftpClient.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return log.Errf(ctx, err, "Could not create %s", destPath)
+	}
+	_, err = f.ReadFrom(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		b.sftpClient.Remove(tmp)
+		return log.Errf(ctx, err, "Could not write %s", destPath)
+	}
+	if err := b.sftpClient.Chmod(tmp, mode.Perm()); err != nil {
+		b.sftpClient.Remove(tmp)
+		return log.Errf(ctx, err, "Could not change the mode of %s", destPath)
+	}
+	// Unlike Rename, PosixRename replaces an existing destPath.
+	if err := b.sftpClient.PosixRename(tmp, destPath); err != nil {
+		b.sftpClient.Remove(tmp)
+		return log.Errf(ctx, err, "Could not rename %s to %s", tmp, destPath)
+	}
+	return nil
+}
+
+// sftpMkDir creates the directory at path over SFTP. See MkDir and MkDirAll.
+func (b binding) sftpMkDir(ctx context.Context, path string, all bool) error {
+	// SFTP servers report most failures with the same generic status, so
+	// check for an existing file first.
+	if info, err := b.sftpClient.Stat(path); err == nil {
+		if all && info.IsDir() {
+			return nil
+		}
+		return ErrAlreadyExists
+	}
+	mkdir := b.sftpClient.Mkdir
+	if all {
+		mkdir = b.sftpClient.MkdirAll
+	}
+	if err := mkdir(path); err != nil {
+		return log.Errf(ctx, err, "Could not create directory %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/pkg/sftp"
+)
+
+// newPipeSFTPClient returns an SFTP client connected to an in-process server
+// serving the local filesystem.
+func newPipeSFTPClient(t *testing.T) (*sftp.Client, func()) {
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{toServer, fromServer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(toClient, fromClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		// Closing the server ends the client's receive loop, which
+		// client.Close waits for.
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestSFTPWriteFile(t *testing.T) {
+	ctx := log.Testing(t)
+
+	client, cleanup := newPipeSFTPClient(t)
+	defer cleanup()
+	b := binding{sftpClient: client}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 3<<20+17)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, name := range []string{
+		"large.bin",
+		"with spaces.bin",
+		`quotes'"and;$(special)&chars.bin`,
+	} {
+		dest := filepath.Join(dir, name)
+		err := b.sftpWriteFile(ctx, bytes.NewReader(data), 0750, dest)
+		assert.For(ctx, "%v err", name).ThatError(err).Succeeded()
+
+		got, err := ioutil.ReadFile(dest)
+		assert.For(ctx, "%v ReadFile", name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v contents", name).That(bytes.Equal(got, data)).Equals(true)
+		info, err := os.Stat(dest)
+		assert.For(ctx, "%v Stat", name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v mode", name).That(info.Mode()).Equals(os.FileMode(0750))
+	}
+
+	err = b.sftpWriteFile(ctx, bytes.NewReader(data), 0644, filepath.Join(dir, "missing", "file"))
+	assert.For(ctx, "missing directory").ThatError(err).Failed()
+}
+
+func TestSFTPMkDir(t *testing.T) {
+	ctx := log.Testing(t)
+
+	client, cleanup := newPipeSFTPClient(t)
+	defer cleanup()
+	b := binding{sftpClient: client}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	single := filepath.Join(dir, "single dir")
+	assert.For(ctx, "MkDir").ThatError(b.MkDir(ctx, single)).Succeeded()
+	assert.For(ctx, "MkDir existing").ThatError(b.MkDir(ctx, single)).Equals(ErrAlreadyExists)
+	assert.For(ctx, "MkDir missing parent").ThatError(b.MkDir(ctx, filepath.Join(dir, "a", "b"))).Failed()
+
+	nested := filepath.Join(dir, "x", "y", "z")
+	assert.For(ctx, "MkDirAll").ThatError(b.MkDirAll(ctx, nested)).Succeeded()
+	assert.For(ctx, "MkDirAll existing").ThatError(b.MkDirAll(ctx, nested)).Succeeded()
+	info, err := os.Stat(nested)
+	assert.For(ctx, "Stat").ThatError(err).Succeeded()
+	assert.For(ctx, "IsDir").That(info.IsDir()).Equals(true)
+
+	file := filepath.Join(dir, "file")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(file, nil, 0644)).Succeeded()
+	assert.For(ctx, "MkDirAll file").ThatError(b.MkDirAll(ctx, file)).Equals(ErrAlreadyExists)
+
+	// WriteFile creates the missing parents of the destination.
+	dest := filepath.Join(dir, "p", "q", "data.bin")
+	err = b.WriteFile(ctx, bytes.NewReader([]byte("data")), 0640, dest)
+	assert.For(ctx, "WriteFile nested").ThatError(err).Succeeded()
+	got, err := ioutil.ReadFile(dest)
+	assert.For(ctx, "ReadFile").ThatError(err).Succeeded()
+	assert.For(ctx, "contents").ThatString(got).Equals("data")
+}
+
+func TestSFTPChmod(t *testing.T) {
+	ctx := log.Testing(t)
+
+	client, cleanup := newPipeSFTPClient(t)
+	defer cleanup()
+	b := binding{sftpClient: client}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "tool")
+	err = b.WriteFile(ctx, bytes.NewReader([]byte("#!/bin/sh")), 0600, dest)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	info, err := os.Stat(dest)
+	assert.For(ctx, "Stat").ThatError(err).Succeeded()
+	assert.For(ctx, "written mode").That(info.Mode()).Equals(os.FileMode(0600))
+
+	assert.For(ctx, "Chmod").ThatError(b.Chmod(ctx, dest, 0755)).Succeeded()
+	info, err = os.Stat(dest)
+	assert.For(ctx, "Stat").ThatError(err).Succeeded()
+	assert.For(ctx, "changed mode").That(info.Mode()).Equals(os.FileMode(0755))
+}
+
+func TestSFTPWriteFileProgress(t *testing.T) {
+	ctx := log.Testing(t)
+
+	client, cleanup := newPipeSFTPClient(t)
+	defer cleanup()
+	b := binding{sftpClient: client}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	source := filepath.Join(dir, "source")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(source, data, 0644)).Succeeded()
+
+	var last, total int64
+	calls := 0
+	progress := WithProgress(func(w, t int64) {
+		assert.For(ctx, "increasing").ThatInteger(int(w)).IsAtLeast(int(last))
+		last, total = w, t
+		calls++
+	})
+
+	// The total of a file is its size.
+	err = b.PushFile(ctx, source, filepath.Join(dir, "pushed"), progress)
+	assert.For(ctx, "PushFile").ThatError(err).Succeeded()
+	assert.For(ctx, "file written").ThatInteger(int(last)).Equals(len(data))
+	assert.For(ctx, "file total").ThatInteger(int(total)).Equals(len(data))
+	assert.For(ctx, "calls").ThatInteger(calls).IsAtLeast(2)
+
+	// The total of other readers is not known.
+	last = 0
+	err = b.WriteFile(ctx, bytes.NewReader(data), 0644, filepath.Join(dir, "written"), progress)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	assert.For(ctx, "reader written").ThatInteger(int(last)).Equals(len(data))
+	assert.For(ctx, "reader total").ThatInteger(int(total)).Equals(-1)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "written"))
+	assert.For(ctx, "ReadFile").ThatError(err).Succeeded()
+	assert.For(ctx, "contents").That(bytes.Equal(got, data)).Equals(true)
+}
@@ -0,0 +1,222 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/google/gapid/core/app/crash"
+	"github.com/google/gapid/core/event/task"
+	"github.com/google/gapid/core/log"
+)
+
+// The parts of RFC 1928 used by the SOCKS5 proxy.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksCommandUnsupported = 7
+	socksAddressUnsupported = 8
+)
+
+// connSet tracks open connections, so that they can all be closed at once.
+type connSet struct {
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// trackedConn is a connection that is removed from its connSet when closed.
+type trackedConn struct {
+	net.Conn
+	set *connSet
+}
+
+func (c trackedConn) Close() error {
+	c.set.mutex.Lock()
+	delete(c.set.conns, c.Conn)
+	c.set.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+// track adds conn to the set, and returns the connection to use in its
+// place. If the set has been closed, conn is closed too.
+func (s *connSet) track(conn net.Conn) net.Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		conn.Close()
+	} else {
+		s.conns[conn] = struct{}{}
+	}
+	return trackedConn{conn, s}
+}
+
+// close closes all the connections in the set, and any added later.
+func (s *connSet) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// SetupSOCKSProxy starts a SOCKS5 proxy on a local TCP port, which makes
+// its connections from the remote machine, as with ssh -D. Only the CONNECT
+// command is supported, without authentication. The local port is
+// returned. The proxy, and all the connections made through it, are closed
+// when ctx is cancelled.
+func (b binding) SetupSOCKSProxy(ctx context.Context) (int, error) {
+	// Without authentication anyone who can reach the proxy can use it, so
+	// it only listens on the loopback interface.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	conns := &connSet{conns: map[net.Conn]struct{}{}}
+	crash.Go(func() {
+		<-task.ShouldStop(ctx)
+		listener.Close()
+		conns.close()
+	})
+	crash.Go(func() {
+		defer listener.Close()
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			local = conns.track(local)
+			crash.Go(func() {
+				remote, err := b.socksConnect(local)
+				if err != nil {
+					log.W(ctx, "SOCKS connection failed: %v", err)
+					local.Close()
+					return
+				}
+				b.bridge(ctx, local, conns.track(remote))
+			})
+		}
+	})
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// socksConnect performs the SOCKS5 handshake with the client conn, and
+// returns the connection made from the remote machine to the requested
+// address.
+func (b binding) socksConnect(conn net.Conn) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksNoAcceptable {
+		return nil, fmt.Errorf("client does not support anonymous SOCKS")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddressUnsupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCommandUnsupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	remote, err := b.connection.Dial("tcp", addr)
+	if err != nil {
+		socksReply(conn, socksGeneralFailure)
+		return nil, fmt.Errorf("could not connect to %s: %v", addr, err)
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
+
+// socksReply sends a reply with the given status. The bound address is not
+// known for connections made through SSH, so it is always left unspecified.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
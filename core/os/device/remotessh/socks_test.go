@@ -0,0 +1,117 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+// socksDial connects to the SOCKS5 proxy on proxyPort, and sends a request
+// with the given command for the address, returning the reply status.
+func socksDial(t *testing.T, proxyPort int, command byte, addr []byte, port int) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksNoAuth {
+		t.Fatalf("handshake failed: %v %v", method, err)
+	}
+	request := append([]byte{socksVersion, command, 0}, addr...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	conn.Write(request)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[1]
+}
+
+func TestSetupSOCKSProxy(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	service := newEchoService(t, "tcp", "127.0.0.1:0")
+	defer service.Close()
+	servicePort := service.Addr().(*net.TCPAddr).Port
+
+	// The tunnel logs the close of the connection as an error, which would
+	// fail the test.
+	proxyCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := binding{connection: client}
+	proxyPort, err := b.SetupSOCKSProxy(proxyCtx)
+	assert.For(ctx, "SetupSOCKSProxy").ThatError(err).Succeeded()
+
+	domain := append([]byte{socksDomain, byte(len("localhost"))}, "localhost"...)
+	conns := []net.Conn{}
+	for _, test := range []struct {
+		name string
+		addr []byte
+	}{
+		{"ipv4", []byte{socksIPv4, 127, 0, 0, 1}},
+		{"domain", domain},
+	} {
+		conn, status := socksDial(t, proxyPort, socksConnect, test.addr, servicePort)
+		defer conn.Close()
+		assert.For(ctx, "%v status", test.name).ThatInteger(int(status)).Equals(socksSucceeded)
+		testEcho(ctx, test.name, conn, test.name)
+		conns = append(conns, conn)
+	}
+	// The connections were made through the SSH server.
+	server.mutex.Lock()
+	assert.For(ctx, "forwards").ThatSlice(server.forwards).Equals([]string{
+		fmt.Sprintf("127.0.0.1:%d", servicePort),
+		fmt.Sprintf("localhost:%d", servicePort),
+	})
+	server.mutex.Unlock()
+
+	conn, status := socksDial(t, proxyPort, 2, []byte{socksIPv4, 127, 0, 0, 1}, servicePort)
+	conn.Close()
+	assert.For(ctx, "bind status").ThatInteger(int(status)).Equals(socksCommandUnsupported)
+
+	// Cancelling the context closes the proxied connections.
+	cancel()
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.For(ctx, "read after cancel").ThatError(err).Equals(io.EOF)
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSSHConfigDepth bounds the nesting of Include directives and ProxyJump
+// hosts, to stop cycles.
+const maxSSHConfigDepth = 16
+
+// sshConfigFiles returns the OpenSSH configuration files of u, in the order
+// they are read.
+func sshConfigFiles(u *user.User) []string {
+	return []string{filepath.Join(u.HomeDir, ".ssh", "config"), "/etc/ssh/ssh_config"}
+}
+
+// LoadSSHConfig returns the configuration for host, which may be an alias,
+// from ~/.ssh/config and /etc/ssh/ssh_config, resolved the way OpenSSH
+// resolves it. Fields that neither file sets are left empty, apart from Host
+// which defaults to host.
+//
+// Match exec criteria are never run, and so never match.
+func LoadSSHConfig(host string) (*Configuration, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	return loadSSHConfig(host, u, sshConfigFiles(u), 0)
+}
+
+func loadSSHConfig(host string, u *user.User, files []string, depth int) (*Configuration, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("ProxyJump for %s is nested too deeply", host)
+	}
+	p := sshConfigParser{host: host, user: u, values: map[string][]string{}}
+	for _, file := range files {
+		// Relative includes are relative to the directory of the top level
+		// file: ~/.ssh or /etc/ssh.
+		p.dir = filepath.Dir(file)
+		if err := p.parseFile(file, true, 0); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p.configuration(files, depth)
+}
+
+// sshConfigParser collects the values that apply to host from OpenSSH
+// configuration files. As in OpenSSH, the first value of each keyword wins.
+type sshConfigParser struct {
+	host   string
+	user   *user.User
+	dir    string
+	values map[string][]string
+}
+
+// get returns the first argument of keyword, or "" if it was not set.
+func (p *sshConfigParser) get(keyword string) string {
+	if args := p.values[keyword]; len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
+
+func (p *sshConfigParser) parseFile(file string, active bool, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return fmt.Errorf("%s: Include is nested too deeply", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			active = p.matchHost(args)
+		case "match":
+			if active, err = p.match(args); err != nil {
+				return fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern, p.user)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(p.dir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %v", file, line, err)
+				}
+				for _, m := range matches {
+					// A Host or Match in the included file does not end
+					// the block of the Include.
+					if err := p.parseFile(m, active, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if _, ok := p.values[keyword]; active && !ok {
+				p.values[keyword] = args
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSSHConfigLine splits line into its lower case keyword and its
+// arguments. The keyword may be separated from the arguments by an equals
+// sign, and arguments may be double quoted.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", line)
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+	args := []string{}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		if rest[0] == '#' {
+			break
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote in %s", line)
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", keyword)
+	}
+	return keyword, args, nil
+}
+
+// matchPatterns returns true if s matches any of patterns, and none of the
+// patterns negated with a leading !.
+func matchPatterns(s string, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		// Only * and ? are special in SSH patterns.
+		pattern = strings.NewReplacer("[", `\[`, `\`, `\\`).Replace(pattern)
+		if ok, _ := path.Match(pattern, strings.ToLower(s)); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPatternList is matchPatterns for a comma separated list of patterns.
+func matchPatternList(s, list string) bool {
+	return matchPatterns(s, strings.Split(list, ","))
+}
+
+func (p *sshConfigParser) matchHost(patterns []string) bool {
+	return matchPatterns(p.host, patterns)
+}
+
+// hostname returns the name of the host to connect to, as far as it is
+// known so far.
+func (p *sshConfigParser) hostname() string {
+	if h := p.get("hostname"); h != "" {
+		return p.expand(h, p.host, "", "")
+	}
+	return p.host
+}
+
+// remoteUser returns the user to log in as, as far as it is known so far.
+func (p *sshConfigParser) remoteUser() string {
+	if u := p.get("user"); u != "" {
+		return u
+	}
+	return p.user.Username
+}
+
+// match evaluates the criteria of a Match line, all of which must match.
+func (p *sshConfigParser) match(args []string) (bool, error) {
+	result := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negated := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		var matched bool
+		switch criterion {
+		case "all":
+			matched = true
+		case "canonical", "final":
+			// Hostnames are not canonicalized, so there is a single pass
+			// that is both the first and the final one.
+			matched = true
+		default:
+			if i+1 == len(args) {
+				return false, fmt.Errorf("missing argument for Match %s", criterion)
+			}
+			i++
+			arg := args[i]
+			switch criterion {
+			case "host":
+				matched = matchPatternList(p.hostname(), arg)
+			case "originalhost":
+				matched = matchPatternList(p.host, arg)
+			case "user":
+				matched = matchPatternList(p.remoteUser(), arg)
+			case "localuser":
+				matched = matchPatternList(p.user.Username, arg)
+			case "exec", "localnetwork":
+				matched = false
+			default:
+				return false, fmt.Errorf("unsupported Match criterion %s", criterion)
+			}
+		}
+		if matched == negated {
+			result = false
+		}
+	}
+	return result, nil
+}
+
+// expandHome replaces a leading ~ in s with the home directory of u.
+func expandHome(s string, u *user.User) string {
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		return u.HomeDir + s[1:]
+	}
+	return s
+}
+
+// expand replaces the ~ and the %-tokens in s: %h is the host, %p the port,
+// %r the remote user, %n the original host, %u the local user and %d its
+// home directory.
+func (p *sshConfigParser) expand(s, host, port, remoteUser string) string {
+	s = expandHome(s, p.user)
+	out := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case '%':
+			out.WriteByte('%')
+		case 'h':
+			out.WriteString(host)
+		case 'p':
+			out.WriteString(port)
+		case 'r':
+			out.WriteString(remoteUser)
+		case 'n':
+			out.WriteString(p.host)
+		case 'u':
+			out.WriteString(p.user.Username)
+		case 'd':
+			out.WriteString(p.user.HomeDir)
+		default:
+			out.WriteByte('%')
+			out.WriteByte(s[i])
+		}
+	}
+	return out.String()
+}
+
+// configuration returns the Configuration for the collected values.
+func (p *sshConfigParser) configuration(files []string, depth int) (*Configuration, error) {
+	c := &Configuration{Name: p.host, Host: p.hostname(), User: p.get("user")}
+	port := "22"
+	if v := p.get("port"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Port %s for %s", v, p.host)
+		}
+		c.Port, port = uint16(n), v
+	}
+	expand := func(keyword string) string {
+		v := p.get(keyword)
+		if strings.EqualFold(v, "none") {
+			return ""
+		}
+		return p.expand(v, c.Host, port, p.remoteUser())
+	}
+	c.Keyfile = expand("identityfile")
+	c.CertFile = expand("certificatefile")
+	c.KnownHosts = expand("userknownhostsfile")
+	// AgentSocket both selects and forwards the agent, so it is only set
+	// when ForwardAgent is.
+	if forward := p.get("forwardagent"); forward != "" && !strings.EqualFold(forward, "no") {
+		socket := forward
+		if strings.EqualFold(forward, "yes") {
+			socket = p.get("identityagent")
+			if socket == "" || socket == "SSH_AUTH_SOCK" {
+				socket = "$SSH_AUTH_SOCK"
+			}
+		}
+		if strings.HasPrefix(socket, "$") {
+			c.AgentSocket = os.Getenv(socket[1:])
+		} else if !strings.EqualFold(socket, "none") {
+			c.AgentSocket = p.expand(socket, c.Host, port, p.remoteUser())
+		}
+	}
+	c.Env = append(c.Env, p.values["setenv"]...)
+	if v := p.get("serveraliveinterval"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerAliveInterval %s for %s", v, p.host)
+		}
+		c.KeepAliveInterval = time.Duration(n) * time.Second
+	}
+	if v := p.get("serveralivecountmax"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerAliveCountMax %s for %s", v, p.host)
+		}
+		c.KeepAliveMaxMissed = n
+	}
+	if v := p.get("connectionattempts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectionAttempts %s for %s", v, p.host)
+		}
+		c.RetryPolicy.MaxAttempts = n
+	}
+	if jump := p.get("proxyjump"); jump != "" && !strings.EqualFold(jump, "none") {
+		for _, hop := range strings.Split(jump, ",") {
+			proxy, err := loadProxyJump(hop, p.user, files, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			// The proxies of a proxy are connected through first.
+			c.ProxyHosts = append(c.ProxyHosts, proxy.ProxyHosts...)
+			proxy.ProxyHosts = nil
+			c.ProxyHosts = append(c.ProxyHosts, *proxy)
+		}
+	}
+	return c, nil
+}
+
+// loadProxyJump returns the configuration of a ProxyJump host, given as
+// [user@]host[:port] or ssh://[user@]host[:port].
+func loadProxyJump(hop string, u *user.User, files []string, depth int) (*Configuration, error) {
+	hop = strings.TrimPrefix(hop, "ssh://")
+	remoteUser := ""
+	if i := strings.LastIndex(hop, "@"); i >= 0 {
+		remoteUser, hop = hop[:i], hop[i+1:]
+	}
+	port := ""
+	if i := strings.LastIndex(hop, ":"); i >= 0 && !strings.HasSuffix(hop, "]") {
+		hop, port = hop[:i], hop[i+1:]
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	c, err := loadSSHConfig(hop, u, files, depth)
+	if err != nil {
+		return nil, err
+	}
+	if remoteUser != "" {
+		c.User = remoteUser
+	}
+	if port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ProxyJump port %s for %s", port, hop)
+		}
+		c.Port = uint16(n)
+	}
+	return c, nil
+}
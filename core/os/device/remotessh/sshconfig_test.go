@@ -0,0 +1,210 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+const testSSHConfig = `
+# Comments and blank lines are ignored.
+Host devbox
+	HostName %h.example.com
+	User builder
+	Port 2222
+	IdentityFile ~/.ssh/%r@%h:%p
+	ServerAliveInterval 15
+	ConnectionAttempts=3
+
+Host farm-* !farm-bastion
+	ProxyJump jumper@farm-bastion:2200
+	UserKnownHostsFile "%d/farm hosts"
+
+Host farm-bastion
+	HostName bastion.example.com
+
+Match host *.example.com user builder
+	CertificateFile %d/.ssh/builder-cert.pub
+
+Match !host *.example.com
+	Include conf.d/*.conf
+
+Host *
+	User fallback
+	Port 22
+`
+
+const testSSHConfigInclude = `
+SetEnv FARM=1
+Host farm-bastion
+	User ignored
+`
+
+func writeTestSSHConfig(t *testing.T) (*user.User, []string, func()) {
+	dir, err := ioutil.TempDir("", "remotessh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config":           testSSHConfig,
+		"conf.d/farm.conf": testSSHConfigInclude,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := &user.User{Username: "me", HomeDir: "/home/me"}
+	return u, []string{filepath.Join(dir, "config")}, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	ctx := log.Testing(t)
+	u, files, cleanup := writeTestSSHConfig(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		host     string
+		expected Configuration
+	}{
+		{"devbox", Configuration{
+			Name:              "devbox",
+			Host:              "devbox.example.com",
+			User:              "builder",
+			Port:              2222,
+			Keyfile:           "/home/me/.ssh/builder@devbox.example.com:2222",
+			CertFile:          "/home/me/.ssh/builder-cert.pub",
+			KeepAliveInterval: 15 * time.Second,
+			RetryPolicy:       RetryPolicy{MaxAttempts: 3},
+		}},
+		{"farm-7", Configuration{
+			Name:       "farm-7",
+			Host:       "farm-7",
+			User:       "fallback",
+			Port:       22,
+			KnownHosts: "/home/me/farm hosts",
+			Env:        []string{"FARM=1"},
+			ProxyHosts: []Configuration{{
+				Name: "farm-bastion",
+				Host: "bastion.example.com",
+				User: "jumper",
+				Port: 2200,
+			}},
+		}},
+		{"unknown", Configuration{
+			Name: "unknown",
+			Host: "unknown",
+			User: "fallback",
+			Port: 22,
+			Env:  []string{"FARM=1"},
+		}},
+	} {
+		c, err := loadSSHConfig(test.host, u, files, 0)
+		assert.For(ctx, "%v err", test.host).ThatError(err).Succeeded()
+		assert.For(ctx, test.host).That(*c).DeepEquals(test.expected)
+	}
+}
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"  # comment", "", nil},
+		{"Host a b", "host", []string{"a", "b"}},
+		{"Port=22", "port", []string{"22"}},
+		{"User = me # comment", "user", []string{"me"}},
+		{`IdentityFile "a b" c`, "identityfile", []string{"a b", "c"}},
+	} {
+		keyword, args, err := splitSSHConfigLine(test.line)
+		assert.For(ctx, "%q err", test.line).ThatError(err).Succeeded()
+		assert.For(ctx, "%q keyword", test.line).ThatString(keyword).Equals(test.keyword)
+		assert.For(ctx, "%q args", test.line).ThatSlice(args).Equals(test.args)
+	}
+	for _, line := range []string{"Host", "User =", `IdentityFile "a`} {
+		_, _, err := splitSSHConfigLine(line)
+		assert.For(ctx, "%q err", line).ThatError(err).Failed()
+	}
+}
+
+func TestReadConfigurationsSSHConfig(t *testing.T) {
+	ctx := log.Testing(t)
+	u, files, cleanup := writeTestSSHConfig(t)
+	defer cleanup()
+
+	// Given fields take precedence over the ones from the SSH config.
+	input := `[{ "Name": "dev", "Host": "devbox", "Port": 22 }]`
+	configs, err := readConfigurations(ctx, bytes.NewReader([]byte(input)), u, files)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "configs").That(configs).DeepEquals([]Configuration{{
+		Name:              "dev",
+		Host:              "devbox.example.com",
+		User:              "builder",
+		Port:              22,
+		Keyfile:           "/home/me/.ssh/builder@devbox.example.com:2222",
+		CertFile:          "/home/me/.ssh/builder-cert.pub",
+		KnownHosts:        "/home/me/.ssh/known_hosts",
+		KeepAliveInterval: 15 * time.Second,
+		RetryPolicy:       RetryPolicy{MaxAttempts: 3},
+	}})
+}
+
+func TestReadConfigurationsBadSSHConfig(t *testing.T) {
+	ctx := log.Testing(t)
+	u, files, cleanup := writeTestSSHConfig(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		name   string
+		config string
+	}{
+		{"Match", "Match host *.example.com nonsense yes\n"},
+		{"Include", "Include \"unterminated\n"},
+		// A directory cannot be read as a file.
+		{"conf.d", ""},
+	} {
+		file := filepath.Join(filepath.Dir(files[0]), test.name)
+		if test.config != "" {
+			assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(file, []byte(test.config), 0600)).Succeeded()
+		}
+		// The devices of the JSON are still read, without the defaults of
+		// the OpenSSH configuration.
+		input := `[{ "Name": "dev", "Host": "devbox" }]`
+		configs, err := readConfigurations(ctx, bytes.NewReader([]byte(input)), u, []string{file})
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v configs", test.name).That(configs).DeepEquals([]Configuration{{
+			Name:       "dev",
+			Host:       "devbox",
+			User:       "me",
+			Port:       22,
+			Keyfile:    "/home/me/.ssh/id_rsa",
+			KnownHosts: "/home/me/.ssh/known_hosts",
+		}})
+	}
+}
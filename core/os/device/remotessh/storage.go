@@ -0,0 +1,300 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+const (
+	// ErrInvalidLVMName is returned when a volume group or logical volume
+	// name contains characters that LVM does not allow.
+	ErrInvalidLVMName = fault.Const("Invalid LVM name")
+	// ErrIOSchedulerNotSupported is returned by SetIOScheduler when the
+	// scheduler is not available for the block device.
+	ErrIOSchedulerNotSupported = fault.Const("I/O scheduler not supported")
+)
+
+var (
+	lvmNameRE     = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+	blockDeviceRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.:-]*$`)
+)
+
+// validLVMName returns true if name is a valid LVM volume group or logical
+// volume name.
+func validLVMName(name string) bool {
+	return lvmNameRE.MatchString(name) && name != "." && name != ".."
+}
+
+// LVMSnapshot is a copy-on-write snapshot of an LVM logical volume.
+type LVMSnapshot struct {
+	// Path is the device path of the snapshot, for example
+	// "/dev/vg0/snap0".
+	Path    string
+	cleanup func(context.Context)
+}
+
+// Close removes the snapshot.
+func (s *LVMSnapshot) Close(ctx context.Context) {
+	s.cleanup(ctx)
+}
+
+// CreateLVMSnapshot creates a snapshot named snapshotName of the logical
+// volume lvName in the volume group vgName. sizeGB is the space reserved for
+// changes made to the origin volume while the snapshot exists. This requires
+// root on the remote machine.
+func (b binding) CreateLVMSnapshot(ctx context.Context, vgName, lvName, snapshotName string, sizeGB int) (*LVMSnapshot, error) {
+	for _, name := range []string{vgName, lvName, snapshotName} {
+		if !validLVMName(name) {
+			return nil, log.Errf(ctx, ErrInvalidLVMName, "%q", name)
+		}
+	}
+	origin := "/dev/" + vgName + "/" + lvName
+	if _, err := callStdout(ctx, b.Shell("lvcreate", "-s", "-L", fmt.Sprintf("%dg", sizeGB), "-n", snapshotName, origin)); err != nil {
+		return nil, log.Errf(ctx, err, "Could not create snapshot of %s", origin)
+	}
+	snap := &LVMSnapshot{Path: "/dev/" + vgName + "/" + snapshotName}
+	snap.cleanup = func(ctx context.Context) {
+		if _, err := callStdout(ctx, b.Shell("lvremove", "-f", snap.Path)); err != nil {
+			log.W(ctx, "Could not remove snapshot %s: %v", snap.Path, err)
+		}
+	}
+	return snap, nil
+}
+
+// MountSnapshot mounts snap read-only at mountPoint, creating it if
+// necessary. The returned function unmounts the snapshot.
+func (b binding) MountSnapshot(ctx context.Context, snap *LVMSnapshot, mountPoint, fsType string) (func(context.Context), error) {
+	options := "ro"
+	if fsType == "xfs" {
+		// XFS refuses to mount a filesystem with the same UUID as one that is
+		// already mounted, which is always the case for a snapshot.
+		options += ",nouuid"
+	}
+	if _, err := callStdout(ctx, b.Shell("mkdir", "-p", mountPoint)); err != nil {
+		return nil, log.Errf(ctx, err, "Could not create mount point %s", mountPoint)
+	}
+	if _, err := callStdout(ctx, b.Shell("mount", "-t", fsType, "-o", options, snap.Path, mountPoint)); err != nil {
+		return nil, log.Errf(ctx, err, "Could not mount %s at %s", snap.Path, mountPoint)
+	}
+	return func(ctx context.Context) {
+		if _, err := callStdout(ctx, b.Shell("umount", mountPoint)); err != nil {
+			log.W(ctx, "Could not unmount %s: %v", mountPoint, err)
+		}
+	}, nil
+}
+
+// parseIOScheduler parses the contents of /sys/block/<device>/queue/scheduler,
+// for example "mq-deadline kyber [bfq] none", where the current scheduler is
+// in brackets.
+func parseIOScheduler(out string) (current string, available []string) {
+	available = []string{}
+	for _, s := range strings.Fields(out) {
+		if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			s = s[1 : len(s)-1]
+			current = s
+		}
+		available = append(available, s)
+	}
+	return current, available
+}
+
+func (b binding) readIOScheduler(ctx context.Context, device string) (current string, available []string, err error) {
+	if !blockDeviceRE.MatchString(device) {
+		return "", nil, fmt.Errorf("Invalid block device %q", device)
+	}
+	out, err := b.FileContents(ctx, "/sys/block/"+device+"/queue/scheduler")
+	if err != nil {
+		return "", nil, log.Errf(ctx, err, "Could not read I/O scheduler of %s", device)
+	}
+	current, available = parseIOScheduler(out)
+	return current, available, nil
+}
+
+// GetIOScheduler returns the current I/O scheduler of the given block device,
+// for example "mq-deadline" for "sda".
+func (b binding) GetIOScheduler(ctx context.Context, device string) (string, error) {
+	current, _, err := b.readIOScheduler(ctx, device)
+	return current, err
+}
+
+// SetIOScheduler changes the I/O scheduler of the given block device. This
+// requires root on the remote machine.
+func (b binding) SetIOScheduler(ctx context.Context, device, scheduler string) error {
+	_, available, err := b.readIOScheduler(ctx, device)
+	if err != nil {
+		return err
+	}
+	supported := false
+	for _, s := range available {
+		supported = supported || s == scheduler
+	}
+	if !supported {
+		return log.Errf(ctx, ErrIOSchedulerNotSupported, "%s is not one of %v", scheduler, available)
+	}
+	if _, err := callStdout(ctx, b.posixShell("echo "+scheduler+" > /sys/block/"+device+"/queue/scheduler")); err != nil {
+		return log.Errf(ctx, err, "Could not set I/O scheduler of %s", device)
+	}
+	return nil
+}
+
+// parseDfType returns the filesystem type from the output of df -T, which is
+// the second column of the line following the header.
+func parseDfType(out string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return "", fmt.Errorf("Unexpected df output %q", out)
+	}
+	// Long device names make df wrap the line.
+	fields := strings.Fields(strings.Join(lines[1:], " "))
+	if len(fields) < 2 {
+		return "", fmt.Errorf("Unexpected df output %q", out)
+	}
+	return fields[1], nil
+}
+
+// GetFileSystemType returns the type of the filesystem containing path, for
+// example "ext4", "xfs", "tmpfs" or "nfs".
+func (b binding) GetFileSystemType(ctx context.Context, path string) (string, error) {
+	out, err := callStdout(ctx, b.Shell("stat", "-f", "-c", "%T", path))
+	// stat cannot tell ext2, ext3 and ext4 apart, as they share the same
+	// magic number.
+	if fsType := strings.TrimSpace(out); err == nil && fsType != "ext2/ext3" {
+		return fsType, nil
+	}
+	out, err = callStdout(ctx, b.Shell("df", "-T", path))
+	if err != nil {
+		return "", log.Errf(ctx, err, "Could not get the filesystem type of %s", path)
+	}
+	return parseDfType(out)
+}
+
+// DiskUsage describes the space of a filesystem, in bytes.
+type DiskUsage struct {
+	Total int64
+	Used  int64
+	// Free is the space available to unprivileged users, which excludes
+	// the blocks reserved for root.
+	Free int64
+}
+
+// parseDfUsage parses the output of df -P, whose header gives the block
+// size the sizes are counted in, for example "1024-blocks" or "512-blocks".
+func parseDfUsage(out string) (*DiskUsage, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("Unexpected df output %q", out)
+	}
+	header := strings.Fields(lines[0])
+	if len(header) < 2 {
+		return nil, fmt.Errorf("Unexpected df output %q", out)
+	}
+	blockSize := int64(512)
+	if unit := strings.SplitN(header[1], "-", 2)[0]; unit == "1K" || unit == "1024" {
+		blockSize = 1024
+	}
+	// Long device names make df wrap the line.
+	fields := strings.Fields(strings.Join(lines[1:], " "))
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("Unexpected df output %q", out)
+	}
+	sizes := make([]int64, 3)
+	for i := range sizes {
+		n, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected df output %q", out)
+		}
+		sizes[i] = n * blockSize
+	}
+	return &DiskUsage{Total: sizes[0], Used: sizes[1], Free: sizes[2]}, nil
+}
+
+// parseInts parses the whitespace separated integers of out.
+func parseInts(out string) ([]int64, error) {
+	fields := strings.Fields(out)
+	ints := make([]int64, len(fields))
+	for i, f := range fields {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %q", f)
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+// GetDiskUsage returns the size and usage of the filesystem containing path.
+func (b binding) GetDiskUsage(ctx context.Context, path string) (*DiskUsage, error) {
+	if b.os == device.Windows {
+		out, err := callStdout(ctx, b.powerShell("$d = (Get-Item -Force "+literalPath(path)+").PSDrive; $d.Used; $d.Free"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not get the disk usage of %s", path)
+		}
+		sizes, err := parseInts(out)
+		if err != nil || len(sizes) != 2 {
+			return nil, fmt.Errorf("Unexpected drive information %q", out)
+		}
+		return &DiskUsage{Total: sizes[0] + sizes[1], Used: sizes[0], Free: sizes[1]}, nil
+	}
+	// -P keeps each filesystem on one line, with the same columns on all
+	// systems, and -k makes most count in KiB.
+	out, err := callStdout(ctx, b.Shell("df", "-P", "-k", path))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not get the disk usage of %s", path)
+	}
+	return parseDfUsage(out)
+}
+
+// GetPathSize returns the size of the file, or of all the files in the
+// directory tree, at path. On macOS the size is the disk space used, rounded
+// up to whole KiB blocks, as du cannot count bytes there.
+func (b binding) GetPathSize(ctx context.Context, path string) (int64, error) {
+	var cmd shell.Cmd
+	scale := int64(1)
+	switch b.os {
+	case device.Windows:
+		cmd = b.powerShell("$i = Get-Item -Force " + literalPath(path) + "; " +
+			"if (!$i.PSIsContainer) { $i.Length } else { " +
+			"$s = (Get-ChildItem -Recurse -Force -File " + literalPath(path) + " | Measure-Object -Sum Length).Sum; " +
+			"if ($s) { $s } else { 0 } }")
+	case device.OSX:
+		cmd, scale = b.Shell("du", "-sk", path), 1024
+	default:
+		cmd = b.Shell("du", "-sb", path)
+	}
+	out, err := callStdout(ctx, cmd)
+	if err != nil {
+		return 0, log.Errf(ctx, err, "Could not get the size of %s", path)
+	}
+	// du prints the size followed by the path.
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Unexpected size output %q", out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected size output %q", out)
+	}
+	return size * scale, nil
+}
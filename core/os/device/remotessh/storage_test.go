@@ -0,0 +1,158 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestValidLVMName(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		name  string
+		valid bool
+	}{
+		{"vg0", true},
+		{"root_lv", true},
+		{"gapid-snap.1", true},
+		{"", false},
+		{"..", false},
+		{"-snap", false},
+		{"snap; rm -rf /", false},
+		{"a/b", false},
+	} {
+		assert.For(ctx, "%q", test.name).That(validLVMName(test.name)).Equals(test.valid)
+	}
+}
+
+func TestParseIOScheduler(t *testing.T) {
+	ctx := log.Testing(t)
+
+	current, available := parseIOScheduler("mq-deadline kyber [bfq] none\n")
+	assert.For(ctx, "current").ThatString(current).Equals("bfq")
+	assert.For(ctx, "available").ThatSlice(available).Equals([]string{"mq-deadline", "kyber", "bfq", "none"})
+
+	current, available = parseIOScheduler("[none] \n")
+	assert.For(ctx, "current").ThatString(current).Equals("none")
+	assert.For(ctx, "available").ThatSlice(available).Equals([]string{"none"})
+}
+
+func TestParseDfType(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		out      string
+		expected string
+	}{
+		{`Filesystem     Type 1K-blocks     Used Available Use% Mounted on
+/dev/nvme0n1p2 ext4 479151816 98274124 356441304  22% /
+`, "ext4"},
+		{`Filesystem                               Type 1K-blocks  Used Available Use% Mounted on
+fileserver.example.com:/exports/very/long/path
+                                         nfs4  10255636 36888  10218748   1% /mnt/traces
+`, "nfs4"},
+	} {
+		fsType, err := parseDfType(test.out)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "type").ThatString(fsType).Equals(test.expected)
+	}
+
+	_, err := parseDfType("df: /missing: No such file or directory")
+	assert.For(ctx, "invalid").ThatError(err).Failed()
+}
+
+func TestParseDfUsage(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		out      string
+		expected DiskUsage
+	}{
+		{`Filesystem     1024-blocks     Used Available Capacity Mounted on
+/dev/nvme0n1p2   479151816 98274124 356441304      22% /
+`, DiskUsage{479151816 * 1024, 98274124 * 1024, 356441304 * 1024}},
+		{`Filesystem    512-blocks      Used Available Capacity  Mounted on
+/dev/disk3s5   965595304 651021104 291390328    70%    /System/Volumes/Data
+`, DiskUsage{965595304 * 512, 651021104 * 512, 291390328 * 512}},
+		{`Filesystem                               1K-blocks  Used Available Use% Mounted on
+fileserver.example.com:/exports/very/long/path
+                                          10255636 36888  10218748   1% /mnt/traces
+`, DiskUsage{10255636 * 1024, 36888 * 1024, 10218748 * 1024}},
+	} {
+		usage, err := parseDfUsage(test.out)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "usage").That(usage).DeepEquals(&test.expected)
+	}
+
+	for _, out := range []string{"", "df: /missing: No such file or directory", "Filesystem 1024-blocks\n/dev/sda1 x y z 1% /"} {
+		_, err := parseDfUsage(out)
+		assert.For(ctx, "%q", out).ThatError(err).Failed()
+	}
+}
+
+func TestGetPathSize(t *testing.T) {
+	ctx := log.Testing(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("the test server runs commands locally, and du -b is Linux only")
+	}
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	tree := filepath.Join(dir, "a tree")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(tree, 0700)).Succeeded()
+	for i, size := range []int{1000, 20000} {
+		err := ioutil.WriteFile(filepath.Join(tree, fmt.Sprint(i)), make([]byte, size), 0600)
+		assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	}
+
+	size, err := b.GetPathSize(ctx, filepath.Join(tree, "1"))
+	assert.For(ctx, "file err").ThatError(err).Succeeded()
+	assert.For(ctx, "file").ThatInteger(int(size)).Equals(20000)
+	size, err = b.GetPathSize(ctx, tree)
+	assert.For(ctx, "tree err").ThatError(err).Succeeded()
+	// du also counts the size of the directory itself.
+	assert.For(ctx, "tree").That(size >= 21000).Equals(true)
+	_, err = b.GetPathSize(ctx, filepath.Join(dir, "missing"))
+	assert.For(ctx, "missing").ThatError(err).Failed()
+
+	usage, err := b.GetDiskUsage(ctx, tree)
+	assert.For(ctx, "GetDiskUsage").ThatError(err).Succeeded()
+	if err == nil {
+		assert.For(ctx, "total").That(usage.Total > 0 && usage.Used+usage.Free <= usage.Total).Equals(true)
+	}
+}
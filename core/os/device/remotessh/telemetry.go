@@ -0,0 +1,521 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gapid/core/app/crash"
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+)
+
+const (
+	// ErrClockInfoUnavailable is returned by GetGPUClock when neither
+	// nvidia-smi nor the amdgpu clock levels are available.
+	ErrClockInfoUnavailable = fault.Const("GPU clock information unavailable")
+	// ErrClockLockingUnsupported is returned by SetGPUClock and ResetGPUClock
+	// for GPUs whose clocks cannot be locked, such as Intel integrated GPUs.
+	ErrClockLockingUnsupported = fault.Const("GPU clock locking unsupported")
+	// ErrPowerInfoUnavailable is returned by GetPowerConsumption when no
+	// power meter can be read.
+	ErrPowerInfoUnavailable = fault.Const("Power consumption information unavailable")
+	// ErrGPUMetricsUnavailable is returned by StreamGPUMetrics when
+	// nvidia-smi is not installed on the remote machine.
+	ErrGPUMetricsUnavailable = fault.Const("GPU metrics unavailable")
+
+	drmClass = "/sys/class/drm"
+	powercap = "/sys/class/powercap"
+
+	pciVendorAMD = "0x1002"
+)
+
+// GPUClock holds the graphics clock frequencies of a GPU.
+type GPUClock struct {
+	// DeviceName is the GPU model for NVIDIA GPUs, or the DRM card name, for
+	// example "card0", for AMD GPUs.
+	DeviceName string
+	CurrentMHz int
+	MaxMHz     int
+	// MinMHz is 0 if the minimum clock is not reported, as with nvidia-smi.
+	MinMHz int
+}
+
+// parseNvidiaSmiCSV splits the output of nvidia-smi --format=csv,noheader
+// into rows of trimmed fields.
+func parseNvidiaSmiCSV(out string) [][]string {
+	rows := [][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		rows = append(rows, fields)
+	}
+	return rows
+}
+
+// parseNvidiaSmiClocks parses the output of
+// nvidia-smi --query-gpu=name,clocks.current.graphics,clocks.max.graphics
+// --format=csv,noheader,nounits
+func parseNvidiaSmiClocks(out string) []GPUClock {
+	clocks := []GPUClock{}
+	for _, row := range parseNvidiaSmiCSV(out) {
+		if len(row) != 3 {
+			continue
+		}
+		c := GPUClock{DeviceName: row[0]}
+		c.CurrentMHz, _ = strconv.Atoi(row[1])
+		c.MaxMHz, _ = strconv.Atoi(row[2])
+		clocks = append(clocks, c)
+	}
+	return clocks
+}
+
+// dpmLevel is one of the clock levels listed in an amdgpu pp_dpm_* file.
+type dpmLevel struct {
+	index   int
+	mhz     int
+	current bool
+}
+
+// parseDPMLevels parses the contents of an amdgpu pp_dpm_sclk file, where
+// each line is formatted as "<index>: <clock>Mhz", with a trailing "*" on
+// the current level.
+func parseDPMLevels(out string) []dpmLevel {
+	levels := []dpmLevel{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+		mhz, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(fields[0]), "mhz"))
+		if err != nil {
+			continue
+		}
+		levels = append(levels, dpmLevel{index, mhz, fields[len(fields)-1] == "*"})
+	}
+	return levels
+}
+
+// parseAMDClocks parses the output of grep -H over the pp_dpm_sclk files of
+// the DRM cards, where each line is formatted as "<path>:<level>".
+func parseAMDClocks(out string) []GPUClock {
+	cards := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		card := path.Base(path.Dir(path.Dir(parts[0])))
+		cards[card] += parts[1] + "\n"
+	}
+	clocks := []GPUClock{}
+	for card, levels := range cards {
+		c := GPUClock{DeviceName: card}
+		for i, l := range parseDPMLevels(levels) {
+			if i == 0 || l.mhz < c.MinMHz {
+				c.MinMHz = l.mhz
+			}
+			if l.mhz > c.MaxMHz {
+				c.MaxMHz = l.mhz
+			}
+			if l.current {
+				c.CurrentMHz = l.mhz
+			}
+		}
+		clocks = append(clocks, c)
+	}
+	sort.Slice(clocks, func(i, j int) bool { return clocks[i].DeviceName < clocks[j].DeviceName })
+	return clocks
+}
+
+// GetGPUClock returns the graphics clocks of the NVIDIA and AMD GPUs of the
+// remote machine.
+func (b binding) GetGPUClock(ctx context.Context) ([]GPUClock, error) {
+	clocks := []GPUClock{}
+	found := false
+	if b.hasCommand(ctx, "nvidia-smi") {
+		out, err := callStdout(ctx, b.Shell("nvidia-smi",
+			"--query-gpu=name,clocks.current.graphics,clocks.max.graphics", "--format=csv,noheader,nounits"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run nvidia-smi")
+		}
+		clocks = append(clocks, parseNvidiaSmiClocks(out)...)
+		found = true
+	}
+	if out, err := b.posixShell("grep -H . " + drmClass + "/card*/device/pp_dpm_sclk 2>/dev/null").Call(ctx); err == nil {
+		clocks = append(clocks, parseAMDClocks(out)...)
+		found = true
+	}
+	if !found {
+		return nil, ErrClockInfoUnavailable
+	}
+	return clocks, nil
+}
+
+// closestDPMLevel returns the index of the clock level closest to mhz, or -1
+// if there are no levels.
+func closestDPMLevel(levels []dpmLevel, mhz int) int {
+	best, bestDiff := -1, 0
+	for _, l := range levels {
+		diff := l.mhz - mhz
+		if diff < 0 {
+			diff = -diff
+		}
+		if best < 0 || diff < bestDiff {
+			best, bestDiff = l.index, diff
+		}
+	}
+	return best
+}
+
+// amdCard returns the sysfs device directory of the DRM card with the given
+// index if it is an AMD GPU. ErrClockLockingUnsupported is returned for any
+// other GPU.
+func (b binding) amdCard(ctx context.Context, deviceIndex int) (string, error) {
+	dir := fmt.Sprintf("%s/card%d/device", drmClass, deviceIndex)
+	vendor, err := b.FileContents(ctx, dir+"/vendor")
+	if err != nil {
+		return "", log.Errf(ctx, err, "Could not read vendor of card%d", deviceIndex)
+	}
+	if strings.TrimSpace(vendor) != pciVendorAMD {
+		return "", ErrClockLockingUnsupported
+	}
+	return dir, nil
+}
+
+// SetGPUClock locks the graphics clock of a GPU to clockMHz. If nvidia-smi is
+// installed, deviceIndex is the nvidia-smi GPU index. Otherwise it is the
+// index of the DRM card, which must be an AMD GPU; the clock is locked to
+// the closest available level. This requires root on the remote machine.
+func (b binding) SetGPUClock(ctx context.Context, deviceIndex, clockMHz int) error {
+	if b.hasCommand(ctx, "nvidia-smi") {
+		_, err := callStdout(ctx, b.Shell("nvidia-smi", "-i", strconv.Itoa(deviceIndex),
+			fmt.Sprintf("--lock-gpu-clocks=%d,%d", clockMHz, clockMHz)))
+		if err != nil {
+			return log.Errf(ctx, err, "Could not lock clocks of GPU %d", deviceIndex)
+		}
+		return nil
+	}
+	dir, err := b.amdCard(ctx, deviceIndex)
+	if err != nil {
+		return err
+	}
+	levels, err := b.FileContents(ctx, dir+"/pp_dpm_sclk")
+	if err != nil {
+		return log.Errf(ctx, err, "Could not read clock levels of card%d", deviceIndex)
+	}
+	level := closestDPMLevel(parseDPMLevels(levels), clockMHz)
+	if level < 0 {
+		return ErrClockLockingUnsupported
+	}
+	script := fmt.Sprintf("echo manual > %s/power_dpm_force_performance_level && echo %d > %s/pp_dpm_sclk", dir, level, dir)
+	if _, err := callStdout(ctx, b.posixShell(script)); err != nil {
+		return log.Errf(ctx, err, "Could not lock clocks of card%d", deviceIndex)
+	}
+	return nil
+}
+
+// ResetGPUClock undoes SetGPUClock, letting the driver manage the graphics
+// clock of the GPU again.
+func (b binding) ResetGPUClock(ctx context.Context, deviceIndex int) error {
+	if b.hasCommand(ctx, "nvidia-smi") {
+		_, err := callStdout(ctx, b.Shell("nvidia-smi", "-i", strconv.Itoa(deviceIndex), "--reset-gpu-clocks"))
+		if err != nil {
+			return log.Errf(ctx, err, "Could not reset clocks of GPU %d", deviceIndex)
+		}
+		return nil
+	}
+	dir, err := b.amdCard(ctx, deviceIndex)
+	if err != nil {
+		return err
+	}
+	if _, err := callStdout(ctx, b.posixShell("echo auto > "+dir+"/power_dpm_force_performance_level")); err != nil {
+		return log.Errf(ctx, err, "Could not reset clocks of card%d", deviceIndex)
+	}
+	return nil
+}
+
+// PowerMeter is a power consumption reading.
+type PowerMeter struct {
+	// Name identifies the meter, for example the RAPL zone "package-0", the
+	// NVIDIA GPU model or the DRM card name.
+	Name string
+	// Domain is either "cpu" for Intel RAPL zones, or "gpu".
+	Domain   string
+	WattsNow float64
+}
+
+// raplSample is a reading of the energy counter of a RAPL zone.
+type raplSample struct {
+	energyUJ, maxEnergyUJ int64
+}
+
+// parseRAPLSamples parses lines of the form
+// "<zone> <name> <energy_uj> <max_energy_range_uj>", keyed by zone.
+func parseRAPLSamples(out string) (zones []string, names map[string]string, samples map[string]raplSample) {
+	names, samples = map[string]string{}, map[string]raplSample{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			continue
+		}
+		energy, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		max, _ := strconv.ParseInt(fields[3], 10, 64)
+		zones = append(zones, fields[0])
+		names[fields[0]] = fields[1]
+		samples[fields[0]] = raplSample{energy, max}
+	}
+	return zones, names, samples
+}
+
+// parseRAPLPower computes the average power of each RAPL zone from two
+// samples taken elapsedNS nanoseconds apart.
+func parseRAPLPower(before, after string, elapsedNS int64) []PowerMeter {
+	meters := []PowerMeter{}
+	if elapsedNS <= 0 {
+		return meters
+	}
+	_, _, first := parseRAPLSamples(before)
+	zones, names, second := parseRAPLSamples(after)
+	for _, zone := range zones {
+		a, ok := first[zone]
+		if !ok {
+			continue
+		}
+		b := second[zone]
+		delta := b.energyUJ - a.energyUJ
+		if delta < 0 {
+			// The counter wrapped around.
+			delta += b.maxEnergyUJ
+		}
+		meters = append(meters, PowerMeter{
+			Name:   names[zone],
+			Domain: "cpu",
+			// µJ/ns is kW.
+			WattsNow: float64(delta) * 1000 / float64(elapsedNS),
+		})
+	}
+	return meters
+}
+
+// parseHwmonPower parses the output of grep -H over the power1_input or
+// power1_average hwmon files of the DRM cards, which are in microwatts.
+func parseHwmonPower(out string) []PowerMeter {
+	meters := []PowerMeter{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		uw, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		// <drm>/<card>/device/hwmon/<hwmon>/power1_input
+		card := path.Base(path.Dir(path.Dir(path.Dir(path.Dir(parts[0])))))
+		if seen[card] {
+			continue
+		}
+		seen[card] = true
+		meters = append(meters, PowerMeter{Name: card, Domain: "gpu", WattsNow: float64(uw) / 1e6})
+	}
+	return meters
+}
+
+// raplSampleScript prints a RAPL sample, then after a short delay the time
+// taken in nanoseconds, followed by a second sample.
+const raplSampleScript = `sample() {
+	for z in ` + powercap + `/intel-rapl:*; do
+		[ -r "$z/energy_uj" ] || continue
+		echo "$(basename "$z") $(cat "$z/name") $(cat "$z/energy_uj") $(cat "$z/max_energy_range_uj")"
+	done
+}
+start=$(date +%s%N); sample; echo ---; sleep 0.5; sample; echo ---; echo $(( $(date +%s%N) - start ))`
+
+// GetPowerConsumption returns the current power draw of the Intel RAPL zones,
+// NVIDIA GPUs and AMD GPUs of the remote machine. The RAPL power is averaged
+// over half a second.
+func (b binding) GetPowerConsumption(ctx context.Context) ([]PowerMeter, error) {
+	meters := []PowerMeter{}
+	if out, err := callStdout(ctx, b.posixShell(raplSampleScript)); err == nil {
+		if parts := strings.Split(out, "---\n"); len(parts) == 3 {
+			elapsed, _ := strconv.ParseInt(strings.TrimSpace(parts[2]), 10, 64)
+			meters = append(meters, parseRAPLPower(parts[0], parts[1], elapsed)...)
+		}
+	}
+	if b.hasCommand(ctx, "nvidia-smi") {
+		out, err := callStdout(ctx, b.Shell("nvidia-smi", "--query-gpu=name,power.draw", "--format=csv,noheader,nounits"))
+		if err != nil {
+			return nil, log.Errf(ctx, err, "Could not run nvidia-smi")
+		}
+		for _, row := range parseNvidiaSmiCSV(out) {
+			if len(row) != 2 {
+				continue
+			}
+			// Unsupported GPUs report "[N/A]".
+			if w, err := strconv.ParseFloat(row[1], 64); err == nil {
+				meters = append(meters, PowerMeter{Name: row[0], Domain: "gpu", WattsNow: w})
+			}
+		}
+	}
+	if out, err := b.posixShell("grep -H . " +
+		drmClass + "/card*/device/hwmon/hwmon*/power1_input " +
+		drmClass + "/card*/device/hwmon/hwmon*/power1_average 2>/dev/null").Call(ctx); err == nil {
+		meters = append(meters, parseHwmonPower(out)...)
+	}
+	if len(meters) == 0 {
+		return nil, ErrPowerInfoUnavailable
+	}
+	return meters, nil
+}
+
+// GPUMetricSample is a reading of the performance counters of a GPU.
+type GPUMetricSample struct {
+	Timestamp time.Time
+	// GPUIndex is the nvidia-smi index of the GPU.
+	GPUIndex       int
+	ClockMHz       int
+	UtilizationPct int
+	TempC          int
+	PowerW         float64
+	VRAMUsedMB     int64
+}
+
+// dmonParser parses the output of nvidia-smi dmon. The columns depend on
+// the selected metrics and the driver version, so they are taken from the
+// header line.
+type dmonParser struct {
+	columns map[string]int
+}
+
+// parse parses a single line of output, returning false for header lines
+// and lines that cannot be parsed. Unavailable values ("-") are left as 0.
+func (p *dmonParser) parse(line string, now time.Time) (GPUMetricSample, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return GPUMetricSample{}, false
+	}
+	if fields[0] == "#" {
+		// The first header line names the columns, the second their units.
+		if len(fields) > 1 && fields[1] == "gpu" {
+			p.columns = map[string]int{}
+			for i, name := range fields[1:] {
+				p.columns[name] = i
+			}
+		}
+		return GPUMetricSample{}, false
+	}
+	if p.columns == nil {
+		return GPUMetricSample{}, false
+	}
+	get := func(name string) string {
+		if i, ok := p.columns[name]; ok && i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+	index, err := strconv.Atoi(get("gpu"))
+	if err != nil {
+		return GPUMetricSample{}, false
+	}
+	s := GPUMetricSample{Timestamp: now, GPUIndex: index}
+	s.ClockMHz, _ = strconv.Atoi(get("pclk"))
+	s.UtilizationPct, _ = strconv.Atoi(get("sm"))
+	s.TempC, _ = strconv.Atoi(get("gtemp"))
+	s.PowerW, _ = strconv.ParseFloat(get("pwr"), 64)
+	s.VRAMUsedMB, _ = strconv.ParseInt(get("fb"), 10, 64)
+	return s, true
+}
+
+// StreamGPUMetrics samples the NVIDIA GPUs of the remote machine every
+// interval, rounded up to a whole second, and sends the samples on the
+// returned channel. Sampling stops and the channel is closed when ctx is
+// cancelled.
+func (b binding) StreamGPUMetrics(ctx context.Context, interval time.Duration) (<-chan GPUMetricSample, error) {
+	if !b.hasCommand(ctx, "nvidia-smi") {
+		return nil, ErrGPUMetricsUnavailable
+	}
+	seconds := int((interval + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	pr, pw := io.Pipe()
+	cmd := b.Shell("nvidia-smi", "dmon", "-s", "pucvmt", "-d", strconv.Itoa(seconds)).Capture(pw, nil)
+	process, err := sshShellTarget{&b}.StartContext(ctx, cmd)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not start nvidia-smi dmon")
+	}
+
+	exited := make(chan struct{})
+	crash.Go(func() {
+		pw.CloseWithError(process.Wait(ctx))
+		close(exited)
+	})
+	crash.Go(func() {
+		select {
+		case <-ctx.Done():
+			process.Kill()
+			if p, ok := process.(*remoteProcess); ok {
+				// Not all SSH servers deliver signals, so also close the
+				// session.
+				p.session.Close()
+			}
+			pr.Close()
+		case <-exited:
+		}
+	})
+
+	samples := make(chan GPUMetricSample)
+	crash.Go(func() {
+		defer close(samples)
+		parser := dmonParser{}
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if s, ok := parser.parse(scanner.Text(), time.Now()); ok {
+				select {
+				case samples <- s:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	})
+	return samples, nil
+}
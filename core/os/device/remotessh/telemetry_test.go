@@ -0,0 +1,103 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestParseGPUClocks(t *testing.T) {
+	ctx := log.Testing(t)
+
+	nvidia := parseNvidiaSmiClocks("NVIDIA GeForce RTX 3080, 210, 2100\nTesla T4, 585, 1590\n")
+	assert.For(ctx, "nvidia").That(nvidia).DeepEquals([]GPUClock{
+		{DeviceName: "NVIDIA GeForce RTX 3080", CurrentMHz: 210, MaxMHz: 2100},
+		{DeviceName: "Tesla T4", CurrentMHz: 585, MaxMHz: 1590},
+	})
+
+	amd := parseAMDClocks(`/sys/class/drm/card1/device/pp_dpm_sclk:0: 500Mhz
+/sys/class/drm/card1/device/pp_dpm_sclk:1: 1200Mhz *
+/sys/class/drm/card1/device/pp_dpm_sclk:2: 1800Mhz
+`)
+	assert.For(ctx, "amd").That(amd).DeepEquals([]GPUClock{
+		{DeviceName: "card1", CurrentMHz: 1200, MaxMHz: 1800, MinMHz: 500},
+	})
+}
+
+func TestClosestDPMLevel(t *testing.T) {
+	ctx := log.Testing(t)
+
+	levels := parseDPMLevels("0: 500Mhz\n1: 1200Mhz *\n2: 1800Mhz\n")
+	for _, test := range []struct {
+		mhz, level int
+	}{
+		{0, 0},
+		{800, 0},
+		{900, 1},
+		{1600, 2},
+		{3000, 2},
+	} {
+		assert.For(ctx, "%v MHz", test.mhz).ThatInteger(closestDPMLevel(levels, test.mhz)).Equals(test.level)
+	}
+	assert.For(ctx, "no levels").ThatInteger(closestDPMLevel(nil, 1000)).Equals(-1)
+}
+
+func TestParsePower(t *testing.T) {
+	ctx := log.Testing(t)
+
+	rapl := parseRAPLPower(
+		"intel-rapl:0 package-0 1000000 262143328850\nintel-rapl:1 dram 262143000000 262143328850\n",
+		"intel-rapl:0 package-0 11000000 262143328850\nintel-rapl:1 dram 1671150 262143328850\n",
+		500000000)
+	assert.For(ctx, "rapl").That(rapl).DeepEquals([]PowerMeter{
+		{Name: "package-0", Domain: "cpu", WattsNow: 20},
+		{Name: "dram", Domain: "cpu", WattsNow: 4},
+	})
+
+	hwmon := parseHwmonPower(`/sys/class/drm/card0/device/hwmon/hwmon3/power1_input:45000000
+/sys/class/drm/card0/device/hwmon/hwmon3/power1_average:44000000
+/sys/class/drm/card1/device/hwmon/hwmon4/power1_average:12500000
+`)
+	assert.For(ctx, "hwmon").That(hwmon).DeepEquals([]PowerMeter{
+		{Name: "card0", Domain: "gpu", WattsNow: 45},
+		{Name: "card1", Domain: "gpu", WattsNow: 12.5},
+	})
+}
+
+func TestParseDmon(t *testing.T) {
+	ctx := log.Testing(t)
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	parser := dmonParser{}
+	samples := []GPUMetricSample{}
+	for _, line := range strings.Split(`# gpu   pwr gtemp mtemp    sm   mem   enc   dec  mclk  pclk pviol tviol    fb  bar1 rxpci txpci
+# Idx     W     C     C     %     %     %     %   MHz   MHz     %  bool    MB    MB  MB/s  MB/s
+    0    25    40     -     3     1     0     0   405   210     0     0   300     5     -     -
+    1   152    71     -    97    45     0     0  9501  1905     0     0  8012     5   120    35
+`, "\n") {
+		if s, ok := parser.parse(line, now); ok {
+			samples = append(samples, s)
+		}
+	}
+	assert.For(ctx, "samples").That(samples).DeepEquals([]GPUMetricSample{
+		{Timestamp: now, GPUIndex: 0, ClockMHz: 210, UtilizationPct: 3, TempC: 40, PowerW: 25, VRAMUsedMB: 300},
+		{Timestamp: now, GPUIndex: 1, ClockMHz: 1905, UtilizationPct: 97, TempC: 71, PowerW: 152, VRAMUsedMB: 8012},
+	})
+}
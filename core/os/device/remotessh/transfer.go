@@ -0,0 +1,560 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gapid/core/app/crash"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+)
+
+// TransferOption is an optional setting for a file transfer.
+type TransferOption func(*transferOptions)
+
+type transferOptions struct {
+	progress func(written, total int64)
+	exclude  []string
+}
+
+// WithProgress returns a TransferOption that calls cb as data is
+// transferred. written is the number of bytes transferred so far, and total
+// is the expected number of bytes, or -1 if it is not known. cb may be called
+// from another goroutine than the one that started the transfer.
+func WithProgress(cb func(written, total int64)) TransferOption {
+	return func(o *transferOptions) { o.progress = cb }
+}
+
+// WithExcludePatterns returns a TransferOption that skips the files and
+// directories matching any of the filepath.Match patterns when pushing a
+// directory. A pattern matches if it matches either the path relative to
+// the pushed directory, using forward slashes, or the base name.
+func WithExcludePatterns(patterns ...string) TransferOption {
+	return func(o *transferOptions) { o.exclude = append(o.exclude, patterns...) }
+}
+
+// excluded returns true if the file at rel, a slash separated path relative
+// to the pushed directory, matches one of the exclude patterns.
+func (o transferOptions) excluded(rel string) bool {
+	for _, pattern := range o.exclude {
+		if m, _ := path.Match(pattern, rel); m {
+			return true
+		}
+		if m, _ := path.Match(pattern, path.Base(rel)); m {
+			return true
+		}
+	}
+	return false
+}
+
+func getTransferOptions(opts []TransferOption) transferOptions {
+	o := transferOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// reader wraps r so that the progress callback, if any, is invoked as
+// data is read.
+func (o transferOptions) reader(r io.Reader, total int64) io.Reader {
+	if o.progress == nil {
+		return r
+	}
+	return &progressReader{r: r, total: total, cb: o.progress}
+}
+
+// progressReader is an io.Reader that reports the number of bytes read
+// through it.
+type progressReader struct {
+	r       io.Reader
+	written int64
+	total   int64
+	cb      func(written, total int64)
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.written += int64(n)
+		p.cb(p.written, p.total)
+	}
+	return n, err
+}
+
+// rateLimiter is a token bucket shared by the uploads of a binding, so that
+// together they stay under its rate. The bucket starts empty, and fills up
+// to a second of data.
+type rateLimiter struct {
+	mutex sync.Mutex
+	// rate is in bytes per second.
+	rate int64
+	// tokens is the number of bytes that may be sent at last. It is negative
+	// while uploads wait for the bytes they have reserved.
+	tokens float64
+	last   time.Time
+	// now and sleep are replaced by the tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: bytesPerSecond, now: time.Now, sleep: sleepContext}
+}
+
+// sleepContext waits for d, or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// wait reserves n bytes, and waits until they may be sent or ctx is
+// cancelled.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	return l.sleep(ctx, delay)
+}
+
+// reader wraps r so that it is read no faster than the rate of l. A nil
+// rateLimiter returns r.
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, l: l}
+}
+
+// rateLimitedReader is an io.Reader that waits for its rateLimiter after
+// each read.
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(buf []byte) (int, error) {
+	// Reads are kept to a second of data, so that concurrent uploads take
+	// turns.
+	if int64(len(buf)) > r.l.rate {
+		buf = buf[:r.l.rate]
+	}
+	n, err := r.r.Read(buf)
+	if n > 0 {
+		if waitErr := r.l.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// PullDirectory copies the contents of remoteDir on the remote machine into
+// localDir. The whole tree is streamed as a single gzip compressed tar
+// archive over one SSH session. Modification times and permissions are
+// maintained across.
+func (b binding) PullDirectory(ctx context.Context, remoteDir, localDir string, opts ...TransferOption) error {
+	return b.pullDir(ctx, remoteDir, localDir, true, getTransferOptions(opts))
+}
+
+// PullDir copies the contents of the remote directory src into the local
+// directory dst. It is the counterpart of PushDir. Unlike PullDirectory,
+// the tar archive is not compressed, which is faster for large trace
+// outputs that do not compress well. Permissions, modification times and
+// the symbolic links within src are maintained across.
+func (b binding) PullDir(ctx context.Context, src, dst string, opts ...TransferOption) error {
+	return b.pullDir(ctx, src, dst, false, getTransferOptions(opts))
+}
+
+// pullDir streams remoteDir as a tar archive, gzip compressed if gzipped is
+// set, and extracts it to localDir.
+func (b binding) pullDir(ctx context.Context, remoteDir, localDir string, gzipped bool, o transferOptions) error {
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+
+	flags := "-cf"
+	if gzipped {
+		flags = "-czf"
+	}
+	// The remote tar is stopped if the archive cannot be extracted, rather
+	// than streaming the rest of it to be discarded.
+	tarCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	stderr := bytes.Buffer{}
+	done := make(chan error, 1)
+	crash.Go(func() {
+		err := b.Shell("tar", flags, "-", "-C", remoteDir, ".").Capture(pw, &stderr).Run(tarCtx)
+		pw.CloseWithError(err)
+		done <- err
+	})
+
+	err := func() error {
+		r := io.Reader(pr)
+		if gzipped {
+			zr, err := gzip.NewReader(pr)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			r = zr
+		}
+		return extractTar(tar.NewReader(o.reader(r, -1)), localDir)
+	}()
+	if err != nil {
+		cancel()
+		pr.CloseWithError(err)
+		<-done
+		return log.Errf(ctx, err, "Could not extract remote directory %s to %s", remoteDir, localDir)
+	}
+	// Drain the padding tar writes after the end of the archive, so that
+	// the remote tar can finish.
+	io.Copy(ioutil.Discard, pr)
+	if err := <-done; err != nil {
+		return log.Errf(ctx, err, "Could not archive remote directory %s: %s", remoteDir, stderr.String())
+	}
+	return nil
+}
+
+// PushDir copies the contents of the local directory src into dst on the
+// remote machine, creating dst if needed. The tree is streamed as a single
+// gzip compressed tar archive over one SSH session, and permissions and
+// modification times are maintained across. On Windows the tree is
+// uploaded as a zip archive and extracted with Expand-Archive.
+func (b binding) PushDir(ctx context.Context, src, dst string, opts ...TransferOption) error {
+	o := getTransferOptions(opts)
+	if err := b.MkDirAll(ctx, dst); err != nil {
+		return err
+	}
+	if b.os == device.Windows {
+		return b.pushDirZip(ctx, src, dst, o)
+	}
+
+	pr, pw := io.Pipe()
+	crash.Go(func() {
+		zw := gzip.NewWriter(pw)
+		err := writeTar(tar.NewWriter(zw), src, o)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	})
+	_, err := callStdout(ctx, b.Shell("tar", "-xzf", "-", "-C", dst).Read(b.limiter.reader(ctx, o.reader(pr, -1))))
+	// Unblock the archive writer if the remote tar stopped reading early.
+	pr.Close()
+	if err != nil {
+		return log.Errf(ctx, err, "Could not push directory %s to %s", src, dst)
+	}
+	return nil
+}
+
+// pushDirZip implements PushDir for Windows targets, which do not all have
+// tar.
+func (b binding) pushDirZip(ctx context.Context, src, dst string, o transferOptions) error {
+	tmp, err := ioutil.TempFile("", "pushdir")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := writeZip(zip.NewWriter(tmp), src, o); err != nil {
+		return log.Errf(ctx, err, "Could not archive %s", src)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dir, cleanup, err := b.MakeTempDir(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx)
+	archive := dir + "/pushdir.zip"
+	if err := b.WriteFile(ctx, o.reader(tmp, size), 0644, archive); err != nil {
+		return err
+	}
+	if _, err := callStdout(ctx, b.powerShell("$ErrorActionPreference = 'Stop'; Expand-Archive -Force "+
+		literalPath(archive)+" -DestinationPath "+powerShellQuote(windowsPath(dst)))); err != nil {
+		return log.Errf(ctx, err, "Could not extract %s to %s", archive, dst)
+	}
+	return nil
+}
+
+// walkPushDir calls fn for each file under src that is not excluded by o,
+// with its path relative to src using forward slashes.
+func walkPushDir(src string, o transferOptions, fn func(file, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if o.excluded(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(file, rel, info)
+	})
+}
+
+// writeTar writes the tree at src to tw, and closes it.
+func writeTar(tw *tar.Writer, src string, o transferOptions) error {
+	err := walkPushDir(src, o, func(file, rel string, info os.FileInfo) error {
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			// Devices, fifos and the like are not supported.
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeZip writes the regular files and directories of the tree at src to
+// zw, and closes it.
+func writeZip(zw *zip.Writer, src string, o transferOptions) error {
+	err := walkPushDir(src, o, func(file, rel string, info os.FileInfo) error {
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// insideDir returns true if path is dir or below it. Both are cleaned.
+func insideDir(dir, path string) bool {
+	dir, path = filepath.Clean(dir), filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// checkNoSymlinks returns an error if path, or any of its existing parents
+// below dir, is a symbolic link, so that nothing is written through a link
+// that an earlier entry, or the local directory, pointed elsewhere.
+func checkNoSymlinks(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link", dir)
+		}
+	}
+	return nil
+}
+
+// extractTar writes all the entries of the tar archive to the local
+// directory dst. Errors identify the entry that could not be extracted.
+// Entries and symbolic links that lead outside of dst are rejected.
+func extractTar(tr *tar.Reader, dst string) error {
+	// Directory permissions and times have to be set after their contents
+	// are written.
+	dirs := []*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if !insideDir(dst, target) {
+			return fmt.Errorf("Archive entry %s is outside of the destination", hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			link := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(link) || strings.HasPrefix(hdr.Linkname, "/") ||
+				!insideDir(dst, filepath.Join(filepath.Dir(target), link)) {
+				return fmt.Errorf("Archive entry %s links outside of the destination", hdr.Name)
+			}
+		}
+		// Directories are written through themselves, other entries replace
+		// whatever is at target.
+		checked := filepath.Dir(target)
+		if hdr.Typeflag == tar.TypeDir {
+			checked = target
+			dirs = append(dirs, hdr)
+		}
+		if err := checkNoSymlinks(dst, checked); err != nil {
+			return fmt.Errorf("Could not extract archive entry %s: %v", hdr.Name, err)
+		}
+		if err := extractTarEntry(tr, hdr, target); err != nil {
+			return fmt.Errorf("Could not extract archive entry %s: %v", hdr.Name, err)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		hdr := dirs[i]
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		// A later entry may have replaced the directory with a link.
+		if err := checkNoSymlinks(dst, target); err != nil {
+			return fmt.Errorf("Could not extract archive entry %s: %v", hdr.Name, err)
+		}
+		if err := os.Chmod(target, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return fmt.Errorf("Could not extract archive entry %s: %v", hdr.Name, err)
+		}
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("Could not extract archive entry %s: %v", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// extractTarEntry writes the archive entry hdr, whose contents are read
+// from tr, to target.
+func extractTarEntry(tr *tar.Reader, hdr *tar.Header, target string) error {
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, 0755)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// Replace a link rather than write to the file it points to.
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+		return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		os.Remove(target)
+		return os.Symlink(hdr.Linkname, target)
+	default:
+		// Devices, fifos and the like are not supported.
+		return nil
+	}
+}
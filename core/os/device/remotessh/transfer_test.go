@@ -0,0 +1,442 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestExtractTar(t *testing.T) {
+	ctx := log.Testing(t)
+
+	modTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}, ""},
+		{tar.Header{Name: "./sub/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: modTime}, ""},
+		{tar.Header{Name: "./sub/tool", Typeflag: tar.TypeReg, Mode: 0750, ModTime: modTime}, "#!/bin/sh"},
+		{tar.Header{Name: "./data.txt", Typeflag: tar.TypeReg, Mode: 0640, ModTime: modTime}, "hello"},
+		{tar.Header{Name: "./sub/link", Typeflag: tar.TypeSymlink, Linkname: "tool", ModTime: modTime}, ""},
+	} {
+		e.hdr.Size = int64(len(e.data))
+		assert.For(ctx, "WriteHeader").ThatError(tw.WriteHeader(&e.hdr)).Succeeded()
+		_, err := tw.Write([]byte(e.data))
+		assert.For(ctx, "Write").ThatError(err).Succeeded()
+	}
+	assert.For(ctx, "Close").ThatError(tw.Close()).Succeeded()
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	err = extractTar(tar.NewReader(&buf), dir)
+	assert.For(ctx, "extractTar").ThatError(err).Succeeded()
+
+	link, err := os.Readlink(filepath.Join(dir, "sub", "link"))
+	assert.For(ctx, "Readlink").ThatError(err).Succeeded()
+	assert.For(ctx, "link").ThatString(link).Equals("tool")
+
+	for _, test := range []struct {
+		path string
+		mode os.FileMode
+		data string
+	}{
+		{"sub", 0700 | os.ModeDir, ""},
+		{"sub/tool", 0750, "#!/bin/sh"},
+		{"data.txt", 0640, "hello"},
+	} {
+		path := filepath.Join(dir, test.path)
+		info, err := os.Stat(path)
+		assert.For(ctx, "Stat(%v)", test.path).ThatError(err).Succeeded()
+		assert.For(ctx, "%v mode", test.path).That(info.Mode()).Equals(test.mode)
+		assert.For(ctx, "%v time", test.path).That(info.ModTime().Equal(modTime)).Equals(true)
+		if !info.IsDir() {
+			data, err := ioutil.ReadFile(path)
+			assert.For(ctx, "ReadFile(%v)", test.path).ThatError(err).Succeeded()
+			assert.For(ctx, "%v data", test.path).ThatString(data).Equals(test.data)
+		}
+	}
+}
+
+func TestExtractTarOutsideDestination(t *testing.T) {
+	ctx := log.Testing(t)
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	err = extractTar(tar.NewReader(&buf), dir)
+	assert.For(ctx, "extractTar").ThatError(err).Failed()
+}
+
+func TestExtractTarSymlinks(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, test := range []struct {
+		name    string
+		entries []tar.Header
+		// existing is a link created in the destination before extracting,
+		// pointing to the outside directory.
+		existing string
+	}{
+		{"absolute link to directory", []tar.Header{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "a/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		}, ""},
+		{"absolute link to file", []tar.Header{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE/passwd"},
+			{Name: "a", Typeflag: tar.TypeReg, Mode: 0644},
+		}, ""},
+		{"relative link", []tar.Header{
+			{Name: "sub/a", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+			{Name: "sub/a/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		}, ""},
+		{"existing link", []tar.Header{
+			{Name: "a/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		}, "a"},
+		{"existing link to directory", []tar.Header{
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+		}, "a"},
+	} {
+		dir, err := ioutil.TempDir("", "remotessh")
+		assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+		defer os.RemoveAll(dir)
+		outside, dst := filepath.Join(dir, "outside"), filepath.Join(dir, "dst")
+		assert.For(ctx, "Mkdir").ThatError(os.Mkdir(outside, 0700)).Succeeded()
+		assert.For(ctx, "Mkdir").ThatError(os.Mkdir(dst, 0700)).Succeeded()
+		passwd := filepath.Join(outside, "passwd")
+		assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(passwd, []byte("root"), 0600)).Succeeded()
+		if test.existing != "" {
+			err := os.Symlink(outside, filepath.Join(dst, test.existing))
+			assert.For(ctx, "Symlink").ThatError(err).Succeeded()
+		}
+
+		buf := bytes.Buffer{}
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range test.entries {
+			hdr.Linkname = strings.Replace(hdr.Linkname, "OUTSIDE", filepath.ToSlash(outside), 1)
+			data := []byte("pwned")
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Size = int64(len(data))
+			}
+			assert.For(ctx, "WriteHeader").ThatError(tw.WriteHeader(&hdr)).Succeeded()
+			if hdr.Typeflag == tar.TypeReg {
+				tw.Write(data)
+			}
+		}
+		assert.For(ctx, "Close").ThatError(tw.Close()).Succeeded()
+
+		err = extractTar(tar.NewReader(&buf), dst)
+		assert.For(ctx, "%v extractTar", test.name).ThatError(err).Failed()
+		data, _ := ioutil.ReadFile(passwd)
+		assert.For(ctx, "%v outside file", test.name).ThatString(string(data)).Equals("root")
+		info, err := os.Stat(outside)
+		assert.For(ctx, "Stat").ThatError(err).Succeeded()
+		assert.For(ctx, "%v outside mode", test.name).That(info.Mode().Perm()).Equals(os.FileMode(0700))
+	}
+}
+
+func TestExtractTarNamesFailingEntry(t *testing.T) {
+	ctx := log.Testing(t)
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "blocker", Typeflag: tar.TypeReg, Mode: 0644})
+	// A file cannot be created inside a regular file.
+	tw.WriteHeader(&tar.Header{Name: "blocker/trace.gfxtrace", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	err = extractTar(tar.NewReader(&buf), dir)
+	assert.For(ctx, "extractTar").ThatError(err).Failed()
+	assert.For(ctx, "message").ThatString(err.Error()).Contains("blocker/trace.gfxtrace")
+}
+
+// writeTestTree creates a small tree to push under a new temporary directory.
+func writeTestTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "remotessh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		path string
+		mode os.FileMode
+		data string
+	}{
+		{"bin/tool", 0750, "#!/bin/sh"},
+		{"data.txt", 0640, "hello"},
+		{"build/out.o", 0644, "object"},
+		{"bin/tool.o", 0644, "object"},
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestWriteTar(t *testing.T) {
+	ctx := log.Testing(t)
+
+	src := writeTestTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dst)
+
+	o := getTransferOptions([]TransferOption{WithExcludePatterns("build", "*.o")})
+	buf := bytes.Buffer{}
+	err = writeTar(tar.NewWriter(&buf), src, o)
+	assert.For(ctx, "writeTar").ThatError(err).Succeeded()
+	err = extractTar(tar.NewReader(&buf), dst)
+	assert.For(ctx, "extractTar").ThatError(err).Succeeded()
+
+	for _, test := range []struct {
+		path string
+		mode os.FileMode
+		data string
+	}{
+		{"bin/tool", 0750, "#!/bin/sh"},
+		{"data.txt", 0640, "hello"},
+	} {
+		path := filepath.Join(dst, filepath.FromSlash(test.path))
+		info, err := os.Stat(path)
+		assert.For(ctx, "Stat(%v)", test.path).ThatError(err).Succeeded()
+		assert.For(ctx, "%v mode", test.path).That(info.Mode()).Equals(test.mode)
+		data, err := ioutil.ReadFile(path)
+		assert.For(ctx, "ReadFile(%v)", test.path).ThatError(err).Succeeded()
+		assert.For(ctx, "%v data", test.path).ThatString(data).Equals(test.data)
+	}
+	for _, excluded := range []string{"build", "bin/tool.o"} {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(excluded)))
+		assert.For(ctx, "%v excluded", excluded).That(os.IsNotExist(err)).Equals(true)
+	}
+}
+
+func TestPullDir(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	b := binding{connection: client, configuration: &c, env: shell.NewEnv(), os: device.Linux}
+
+	src := writeTestTree(t)
+	defer os.RemoveAll(src)
+	assert.For(ctx, "Symlink").ThatError(os.Symlink("tool", filepath.Join(src, "bin", "link"))).Succeeded()
+
+	for _, test := range []struct {
+		name string
+		pull func(ctx context.Context, src, dst string, opts ...TransferOption) error
+	}{
+		{"PullDir", b.PullDir},
+		{"PullDirectory", b.PullDirectory},
+	} {
+		dst := filepath.Join(dir, test.name, "out")
+		err := test.pull(ctx, src, dst)
+		assert.For(ctx, "%v", test.name).ThatError(err).Succeeded()
+
+		for _, f := range []struct {
+			path string
+			mode os.FileMode
+			data string
+		}{
+			{"bin/tool", 0750, "#!/bin/sh"},
+			{"data.txt", 0640, "hello"},
+			{"build/out.o", 0644, "object"},
+		} {
+			path := filepath.Join(dst, filepath.FromSlash(f.path))
+			info, err := os.Stat(path)
+			assert.For(ctx, "%v Stat(%v)", test.name, f.path).ThatError(err).Succeeded()
+			if err == nil {
+				assert.For(ctx, "%v %v mode", test.name, f.path).That(info.Mode()).Equals(f.mode)
+			}
+			data, _ := ioutil.ReadFile(path)
+			assert.For(ctx, "%v %v data", test.name, f.path).ThatString(data).Equals(f.data)
+		}
+		link, err := os.Readlink(filepath.Join(dst, "bin", "link"))
+		assert.For(ctx, "%v Readlink", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v link", test.name).ThatString(link).Equals("tool")
+	}
+
+	err = b.PullDir(ctx, filepath.Join(dir, "missing"), filepath.Join(dir, "out"))
+	assert.For(ctx, "missing").ThatError(err).Failed()
+}
+
+func TestPullDirStopsOnError(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	// The test server runs commands locally, so a fake tar that writes an
+	// archive that cannot be extracted, and then takes a long time to write
+	// the rest of it, is put first on the PATH.
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+	archive := filepath.Join(dir, "archive.tar")
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(archive, buf.Bytes(), 0600)).Succeeded()
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	script := "#!/bin/sh\ncat '" + archive + "'\nexec sleep 30\n"
+	assert.For(ctx, "WriteFile").ThatError(ioutil.WriteFile(filepath.Join(bin, "tar"), []byte(script), 0700)).Succeeded()
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	env := shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+
+	start := time.Now()
+	err = b.PullDir(ctx, dir, filepath.Join(dir, "out"))
+	assert.For(ctx, "PullDir").ThatError(err).Failed()
+	assert.For(ctx, "cause").ThatString(err.Error()).Contains("Could not extract")
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("PullDir took %v, the remote tar was not stopped", elapsed)
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	ctx := log.Testing(t)
+
+	src := writeTestTree(t)
+	defer os.RemoveAll(src)
+
+	o := getTransferOptions([]TransferOption{WithExcludePatterns("build", "*.o")})
+	buf := bytes.Buffer{}
+	err := writeZip(zip.NewWriter(&buf), src, o)
+	assert.For(ctx, "writeZip").ThatError(err).Succeeded()
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.For(ctx, "NewReader").ThatError(err).Succeeded()
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.For(ctx, "names").ThatSlice(names).Equals([]string{"bin/", "bin/tool", "data.txt"})
+}
+
+// fakeClock is a clock whose time only moves when it sleeps.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	ctx := log.Testing(t)
+
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	l := newRateLimiter(100 * 1000)
+	l.now, l.sleep = clock.Now, clock.Sleep
+
+	// 1MB at 100KB/s takes 10 seconds.
+	data := make([]byte, 1000*1000)
+	n, err := io.Copy(ioutil.Discard, l.reader(ctx, bytes.NewReader(data)))
+	assert.For(ctx, "Copy").ThatError(err).Succeeded()
+	assert.For(ctx, "copied").That(n).Equals(int64(len(data)))
+	elapsed := clock.Now().Sub(start)
+	assert.For(ctx, "elapsed").That(elapsed >= 10*time.Second).Equals(true)
+	assert.For(ctx, "not too slow").That(elapsed <= 11*time.Second).Equals(true)
+
+	// Uploads share the limit: the second waits for the bytes of the first.
+	delays := []time.Duration{}
+	l = newRateLimiter(100 * 1000)
+	l.now = func() time.Time { return start }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	l.wait(ctx, 50*1000)
+	l.wait(ctx, 50*1000)
+	assert.For(ctx, "shared").That(delays).DeepEquals([]time.Duration{500 * time.Millisecond, time.Second})
+
+	// Waiting stops when the context is cancelled.
+	l = newRateLimiter(1)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = l.reader(cancelled, bytes.NewReader(data)).Read(make([]byte, 10))
+	assert.For(ctx, "cancelled").ThatError(err).Equals(context.Canceled)
+
+	var none *rateLimiter
+	r := bytes.NewReader(data)
+	assert.For(ctx, "no limit").That(none.reader(ctx, r)).Equals(r)
+}
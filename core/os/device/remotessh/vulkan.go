@@ -0,0 +1,378 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+// VulkanFeatures holds the members of VkPhysicalDeviceFeatures for a Vulkan
+// physical device on the remote machine.
+type VulkanFeatures struct {
+	RobustBufferAccess                      bool `json:"robustBufferAccess"`
+	FullDrawIndexUint32                     bool `json:"fullDrawIndexUint32"`
+	ImageCubeArray                          bool `json:"imageCubeArray"`
+	IndependentBlend                        bool `json:"independentBlend"`
+	GeometryShader                          bool `json:"geometryShader"`
+	TessellationShader                      bool `json:"tessellationShader"`
+	SampleRateShading                       bool `json:"sampleRateShading"`
+	DualSrcBlend                            bool `json:"dualSrcBlend"`
+	LogicOp                                 bool `json:"logicOp"`
+	MultiDrawIndirect                       bool `json:"multiDrawIndirect"`
+	DrawIndirectFirstInstance               bool `json:"drawIndirectFirstInstance"`
+	DepthClamp                              bool `json:"depthClamp"`
+	DepthBiasClamp                          bool `json:"depthBiasClamp"`
+	FillModeNonSolid                        bool `json:"fillModeNonSolid"`
+	DepthBounds                             bool `json:"depthBounds"`
+	WideLines                               bool `json:"wideLines"`
+	LargePoints                             bool `json:"largePoints"`
+	AlphaToOne                              bool `json:"alphaToOne"`
+	MultiViewport                           bool `json:"multiViewport"`
+	SamplerAnisotropy                       bool `json:"samplerAnisotropy"`
+	TextureCompressionETC2                  bool `json:"textureCompressionETC2"`
+	TextureCompressionASTCLDR               bool `json:"textureCompressionASTC_LDR"`
+	TextureCompressionBC                    bool `json:"textureCompressionBC"`
+	OcclusionQueryPrecise                   bool `json:"occlusionQueryPrecise"`
+	PipelineStatisticsQuery                 bool `json:"pipelineStatisticsQuery"`
+	VertexPipelineStoresAndAtomics          bool `json:"vertexPipelineStoresAndAtomics"`
+	FragmentStoresAndAtomics                bool `json:"fragmentStoresAndAtomics"`
+	ShaderTessellationAndGeometryPointSize  bool `json:"shaderTessellationAndGeometryPointSize"`
+	ShaderImageGatherExtended               bool `json:"shaderImageGatherExtended"`
+	ShaderStorageImageExtendedFormats       bool `json:"shaderStorageImageExtendedFormats"`
+	ShaderStorageImageMultisample           bool `json:"shaderStorageImageMultisample"`
+	ShaderStorageImageReadWithoutFormat     bool `json:"shaderStorageImageReadWithoutFormat"`
+	ShaderStorageImageWriteWithoutFormat    bool `json:"shaderStorageImageWriteWithoutFormat"`
+	ShaderUniformBufferArrayDynamicIndexing bool `json:"shaderUniformBufferArrayDynamicIndexing"`
+	ShaderSampledImageArrayDynamicIndexing  bool `json:"shaderSampledImageArrayDynamicIndexing"`
+	ShaderStorageBufferArrayDynamicIndexing bool `json:"shaderStorageBufferArrayDynamicIndexing"`
+	ShaderStorageImageArrayDynamicIndexing  bool `json:"shaderStorageImageArrayDynamicIndexing"`
+	ShaderClipDistance                      bool `json:"shaderClipDistance"`
+	ShaderCullDistance                      bool `json:"shaderCullDistance"`
+	ShaderFloat64                           bool `json:"shaderFloat64"`
+	ShaderInt64                             bool `json:"shaderInt64"`
+	ShaderInt16                             bool `json:"shaderInt16"`
+	ShaderResourceResidency                 bool `json:"shaderResourceResidency"`
+	ShaderResourceMinLod                    bool `json:"shaderResourceMinLod"`
+	SparseBinding                           bool `json:"sparseBinding"`
+	SparseResidencyBuffer                   bool `json:"sparseResidencyBuffer"`
+	SparseResidencyImage2D                  bool `json:"sparseResidencyImage2D"`
+	SparseResidencyImage3D                  bool `json:"sparseResidencyImage3D"`
+	SparseResidency2Samples                 bool `json:"sparseResidency2Samples"`
+	SparseResidency4Samples                 bool `json:"sparseResidency4Samples"`
+	SparseResidency8Samples                 bool `json:"sparseResidency8Samples"`
+	SparseResidency16Samples                bool `json:"sparseResidency16Samples"`
+	SparseResidencyAliased                  bool `json:"sparseResidencyAliased"`
+	VariableMultisampleRate                 bool `json:"variableMultisampleRate"`
+	InheritedQueries                        bool `json:"inheritedQueries"`
+}
+
+// VulkanFeatureSet is a list of VkPhysicalDeviceFeatures member names, as they
+// are spelled in the Vulkan specification. For example "geometryShader".
+type VulkanFeatureSet []string
+
+// Has returns true if the feature with the given VkPhysicalDeviceFeatures
+// member name is supported. Unknown names are reported as unsupported.
+func (f *VulkanFeatures) Has(name string) bool {
+	if v, ok := vulkanFeatureField(reflect.ValueOf(f).Elem(), name); ok {
+		return v.Bool()
+	}
+	return false
+}
+
+// Missing returns the names of the features in required that are not
+// supported.
+func (f *VulkanFeatures) Missing(required VulkanFeatureSet) []string {
+	missing := []string{}
+	for _, name := range required {
+		if !f.Has(name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// vulkanFeatureField returns the field of the VulkanFeatures struct value v
+// that corresponds to the given VkPhysicalDeviceFeatures member name.
+func vulkanFeatureField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("json") == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// parseVulkanFeatures converts the VkPhysicalDeviceFeatures object from the
+// vulkaninfo JSON output into a VulkanFeatures. Depending on the version of
+// vulkaninfo, VkBool32 members are written as either booleans or integers.
+func parseVulkanFeatures(data json.RawMessage) (*VulkanFeatures, error) {
+	members := map[string]interface{}{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	f := &VulkanFeatures{}
+	v := reflect.ValueOf(f).Elem()
+	for name, value := range members {
+		field, ok := vulkanFeatureField(v, name)
+		if !ok {
+			continue
+		}
+		switch value := value.(type) {
+		case bool:
+			field.SetBool(value)
+		case float64:
+			field.SetBool(value != 0)
+		default:
+			return nil, fmt.Errorf("Unexpected value for %s: %v", name, value)
+		}
+	}
+	return f, nil
+}
+
+// VulkanMemoryProps holds the VkPhysicalDeviceMemoryProperties of a Vulkan
+// physical device on the remote machine.
+type VulkanMemoryProps struct {
+	Heaps []VulkanHeap    `json:"memoryHeaps"`
+	Types []VulkanMemType `json:"memoryTypes"`
+}
+
+// VulkanHeap describes a single VkMemoryHeap.
+type VulkanHeap struct {
+	// Size is the size of the heap in bytes.
+	Size int64 `json:"size"`
+	// Flags is the VkMemoryHeapFlags bitmask of the heap.
+	Flags uint32 `json:"flags"`
+}
+
+// VulkanMemType describes a single VkMemoryType.
+type VulkanMemType struct {
+	// HeapIndex is the index of the heap this memory type allocates from.
+	HeapIndex int `json:"heapIndex"`
+	// Flags is the VkMemoryPropertyFlags bitmask of the memory type.
+	Flags uint32 `json:"propertyFlags"`
+}
+
+// Bits of VulkanQueueFamily.Flags, from VkQueueFlagBits.
+const (
+	VulkanQueueGraphics      = 0x1
+	VulkanQueueCompute       = 0x2
+	VulkanQueueTransfer      = 0x4
+	VulkanQueueSparseBinding = 0x8
+)
+
+// VulkanQueueFamily holds the VkQueueFamilyProperties of a queue family of a
+// Vulkan physical device.
+type VulkanQueueFamily struct {
+	// Index is the queue family index.
+	Index int
+	// Count is the number of queues in the family.
+	Count int
+	// Flags is a combination of the VulkanQueue* bits.
+	Flags              uint32
+	TimestampValidBits int
+	// MinImageTransferGranularity is the width, height and depth
+	// granularity of image transfers on the queues.
+	MinImageTransferGranularity [3]uint32
+}
+
+// vulkanQueueFlags is a VkQueueFlags bitmask, which vulkaninfo writes as a
+// number, or as a list of VkQueueFlagBits names in the Vulkan Profiles
+// schema.
+type vulkanQueueFlags uint32
+
+var vulkanQueueFlagNames = map[string]vulkanQueueFlags{
+	"VK_QUEUE_GRAPHICS_BIT":       VulkanQueueGraphics,
+	"VK_QUEUE_COMPUTE_BIT":        VulkanQueueCompute,
+	"VK_QUEUE_TRANSFER_BIT":       VulkanQueueTransfer,
+	"VK_QUEUE_SPARSE_BINDING_BIT": VulkanQueueSparseBinding,
+}
+
+func (f *vulkanQueueFlags) UnmarshalJSON(data []byte) error {
+	names := []string{}
+	if err := json.Unmarshal(data, &names); err != nil {
+		return json.Unmarshal(data, (*uint32)(f))
+	}
+	*f = 0
+	for _, name := range names {
+		*f |= vulkanQueueFlagNames[name]
+	}
+	return nil
+}
+
+// vulkanQueueFamilyProps is a VkQueueFamilyProperties written by vulkaninfo.
+type vulkanQueueFamilyProps struct {
+	QueueCount         int              `json:"queueCount"`
+	QueueFlags         vulkanQueueFlags `json:"queueFlags"`
+	TimestampValidBits int              `json:"timestampValidBits"`
+	Granularity        struct {
+		Width  uint32 `json:"width"`
+		Height uint32 `json:"height"`
+		Depth  uint32 `json:"depth"`
+	} `json:"minImageTransferGranularity"`
+}
+
+// vulkanInfo is the subset of the JSON document written by vulkaninfo that is
+// used by the binding. The fields are those of the devsim schema written by
+// older versions of vulkaninfo.
+type vulkanInfo struct {
+	Features         json.RawMessage          `json:"VkPhysicalDeviceFeatures"`
+	MemoryProperties *VulkanMemoryProps       `json:"VkPhysicalDeviceMemoryProperties"`
+	QueueFamilies    []vulkanQueueFamilyProps `json:"ArrayOfVkQueueFamilyProperties"`
+	// Capabilities is written instead by the versions of vulkaninfo that use
+	// the Vulkan Profiles schema, which has no memory properties.
+	Capabilities struct {
+		Device *struct {
+			Features      map[string]json.RawMessage `json:"features"`
+			QueueFamilies []struct {
+				Properties vulkanQueueFamilyProps `json:"VkQueueFamilyProperties"`
+			} `json:"queueFamiliesProperties"`
+		} `json:"device"`
+	} `json:"capabilities"`
+}
+
+// parseVulkanInfo parses the JSON output of vulkaninfo, in either the devsim
+// or the Vulkan Profiles schema.
+func parseVulkanInfo(out string) (*vulkanInfo, error) {
+	// The loader may print diagnostics before the JSON document starts.
+	if i := strings.Index(out, "{"); i > 0 {
+		out = out[i:]
+	}
+	info := &vulkanInfo{}
+	if err := json.Unmarshal([]byte(out), info); err != nil {
+		return nil, err
+	}
+	if device := info.Capabilities.Device; device != nil {
+		info.Features = device.Features["VkPhysicalDeviceFeatures"]
+		info.QueueFamilies = make([]vulkanQueueFamilyProps, len(device.QueueFamilies))
+		for i, f := range device.QueueFamilies {
+			info.QueueFamilies[i] = f.Properties
+		}
+	}
+	return info, nil
+}
+
+// vulkanInfoCommand returns the command that prints the JSON output of
+// vulkaninfo for the physical device with the given index. The versions
+// that use the Vulkan Profiles schema save it to a file, named with -o,
+// rather than print it. Older versions that do not write the file are run
+// again without -o.
+func (b binding) vulkanInfoCommand(deviceIndex int) shell.Cmd {
+	json := fmt.Sprintf("--json=%d", deviceIndex)
+	if b.os == device.Windows {
+		return b.powerShell("$t = [IO.Path]::GetTempFileName(); try { " +
+			"& vulkaninfo " + json + " -o $t *> $null; " +
+			"if ((Get-Item $t).Length -gt 0) { [Console]::Out.Write([IO.File]::ReadAllText($t)) } " +
+			"else { & vulkaninfo " + json + "; exit $LASTEXITCODE } " +
+			"} finally { Remove-Item -Force $t }")
+	}
+	return b.posixShell(`t=$(mktemp) || exit 1; trap 'rm -f "$t"' EXIT; ` +
+		`if vulkaninfo ` + json + ` -o "$t" > /dev/null 2>&1 && [ -s "$t" ]; then cat "$t"; ` +
+		`else vulkaninfo ` + json + `; fi`)
+}
+
+// getVulkanInfo runs vulkaninfo on the remote machine for the physical device
+// with the given index, and returns the parsed JSON output.
+func (b binding) getVulkanInfo(ctx context.Context, deviceIndex int) (*vulkanInfo, error) {
+	out, err := callStdout(ctx, b.vulkanInfoCommand(deviceIndex))
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not run vulkaninfo")
+	}
+	info, err := parseVulkanInfo(out)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "Could not parse vulkaninfo output")
+	}
+	return info, nil
+}
+
+// GetVulkanDeviceFeatures returns the VkPhysicalDeviceFeatures of the Vulkan
+// physical device with the given index on the remote machine.
+func (b binding) GetVulkanDeviceFeatures(ctx context.Context, deviceIndex int) (*VulkanFeatures, error) {
+	info, err := b.getVulkanInfo(ctx, deviceIndex)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Features) == 0 {
+		return nil, log.Errf(ctx, nil, "vulkaninfo did not report VkPhysicalDeviceFeatures")
+	}
+	return parseVulkanFeatures(info.Features)
+}
+
+// SupportsFeatureSet returns true if the first Vulkan physical device on the
+// remote machine supports all of the required features. The names of the
+// features that are not supported are also returned. If the features cannot
+// be queried then none of the required features are considered supported.
+func (b binding) SupportsFeatureSet(ctx context.Context, required VulkanFeatureSet) (bool, []string) {
+	features, err := b.GetVulkanDeviceFeatures(ctx, 0)
+	if err != nil {
+		log.W(ctx, "Could not query Vulkan features: %v", err)
+		return false, append([]string{}, required...)
+	}
+	missing := features.Missing(required)
+	return len(missing) == 0, missing
+}
+
+// GetVulkanMemoryProperties returns the memory heaps and memory types of the
+// Vulkan physical device with the given index on the remote machine. They
+// are only reported by the versions of vulkaninfo that write the devsim
+// schema.
+func (b binding) GetVulkanMemoryProperties(ctx context.Context, deviceIndex int) (*VulkanMemoryProps, error) {
+	info, err := b.getVulkanInfo(ctx, deviceIndex)
+	if err != nil {
+		return nil, err
+	}
+	if info.MemoryProperties == nil {
+		return nil, log.Errf(ctx, nil, "vulkaninfo did not report VkPhysicalDeviceMemoryProperties")
+	}
+	return info.MemoryProperties, nil
+}
+
+// queueFamilies returns the queue families in info.
+func (info *vulkanInfo) queueFamilies() []*VulkanQueueFamily {
+	families := make([]*VulkanQueueFamily, len(info.QueueFamilies))
+	for i, f := range info.QueueFamilies {
+		families[i] = &VulkanQueueFamily{
+			Index:              i,
+			Count:              f.QueueCount,
+			Flags:              uint32(f.QueueFlags),
+			TimestampValidBits: f.TimestampValidBits,
+			MinImageTransferGranularity: [3]uint32{
+				f.Granularity.Width, f.Granularity.Height, f.Granularity.Depth,
+			},
+		}
+	}
+	return families
+}
+
+// GetVulkanQueueFamilies returns the queue families of the Vulkan physical
+// device with the given index, as reported by vulkaninfo.
+func (b binding) GetVulkanQueueFamilies(ctx context.Context, deviceIndex int) ([]*VulkanQueueFamily, error) {
+	info, err := b.getVulkanInfo(ctx, deviceIndex)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.QueueFamilies) == 0 {
+		return nil, log.Errf(ctx, nil, "vulkaninfo did not report ArrayOfVkQueueFamilyProperties")
+	}
+	return info.queueFamilies(), nil
+}
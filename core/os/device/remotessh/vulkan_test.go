@@ -0,0 +1,246 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseVulkanFeatures(t *testing.T) {
+	ctx := log.Testing(t)
+
+	for _, input := range []string{
+		`{"geometryShader": true, "tessellationShader": false, "textureCompressionASTC_LDR": true, "futureFeature": true}`,
+		`{"geometryShader": 1, "tessellationShader": 0, "textureCompressionASTC_LDR": 1, "futureFeature": 1}`,
+	} {
+		f, err := parseVulkanFeatures(json.RawMessage(input))
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "GeometryShader").That(f.GeometryShader).Equals(true)
+		assert.For(ctx, "TessellationShader").That(f.TessellationShader).Equals(false)
+		assert.For(ctx, "TextureCompressionASTCLDR").That(f.TextureCompressionASTCLDR).Equals(true)
+
+		missing := f.Missing(VulkanFeatureSet{"geometryShader", "tessellationShader", "futureFeature"})
+		assert.For(ctx, "missing").ThatSlice(missing).Equals([]string{"tessellationShader", "futureFeature"})
+	}
+}
+
+func TestParseVulkanInfoMemoryProperties(t *testing.T) {
+	ctx := log.Testing(t)
+
+	input := `WARNING: loader diagnostic
+{
+	"$schema": "https://schema.khronos.org/vulkan/devsim_1_0_0.json#",
+	"VkPhysicalDeviceMemoryProperties": {
+		"memoryHeapCount": 2,
+		"memoryHeaps": [
+			{ "flags": 1, "size": 8589934592 },
+			{ "flags": 0, "size": 25165824000 }
+		],
+		"memoryTypeCount": 3,
+		"memoryTypes": [
+			{ "heapIndex": 1, "propertyFlags": 0 },
+			{ "heapIndex": 0, "propertyFlags": 1 },
+			{ "heapIndex": 1, "propertyFlags": 14 }
+		]
+	}
+}`
+	info, err := parseVulkanInfo(input)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "MemoryProperties").That(info.MemoryProperties).DeepEquals(&VulkanMemoryProps{
+		Heaps: []VulkanHeap{
+			{Size: 8589934592, Flags: 1},
+			{Size: 25165824000, Flags: 0},
+		},
+		Types: []VulkanMemType{
+			{HeapIndex: 1, Flags: 0},
+			{HeapIndex: 0, Flags: 1},
+			{HeapIndex: 1, Flags: 14},
+		},
+	})
+}
+
+func TestParseVulkanInfoQueueFamilies(t *testing.T) {
+	ctx := log.Testing(t)
+
+	input := `{
+	"ArrayOfVkQueueFamilyProperties": [
+		{
+			"minImageTransferGranularity": { "depth": 1, "height": 1, "width": 1 },
+			"queueCount": 16,
+			"queueFlags": 15,
+			"timestampValidBits": 64
+		},
+		{
+			"minImageTransferGranularity": { "depth": 8, "height": 8, "width": 16 },
+			"queueCount": 2,
+			"queueFlags": 12,
+			"timestampValidBits": 0
+		}
+	]
+}`
+	info, err := parseVulkanInfo(input)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "families").That(info.queueFamilies()).DeepEquals([]*VulkanQueueFamily{
+		{
+			Index:                       0,
+			Count:                       16,
+			Flags:                       VulkanQueueGraphics | VulkanQueueCompute | VulkanQueueTransfer | VulkanQueueSparseBinding,
+			TimestampValidBits:          64,
+			MinImageTransferGranularity: [3]uint32{1, 1, 1},
+		},
+		{
+			Index:                       1,
+			Count:                       2,
+			Flags:                       VulkanQueueTransfer | VulkanQueueSparseBinding,
+			MinImageTransferGranularity: [3]uint32{16, 8, 8},
+		},
+	})
+}
+
+// profilesVulkanInfo is the output of vulkaninfo in the Vulkan Profiles
+// schema, trimmed to the members used by the binding.
+const profilesVulkanInfo = `{
+	"$schema": "https://schema.khronos.org/vulkan/profiles-0.8-latest.json#",
+	"capabilities": {
+		"device": {
+			"extensions": { "VK_KHR_swapchain": 70 },
+			"features": {
+				"VkPhysicalDeviceFeatures": {
+					"geometryShader": true,
+					"tessellationShader": false,
+					"textureCompressionASTC_LDR": true
+				},
+				"VkPhysicalDeviceVulkan11Features": { "multiview": true }
+			},
+			"properties": {
+				"VkPhysicalDeviceProperties": { "apiVersion": 4206847 }
+			},
+			"queueFamiliesProperties": [
+				{
+					"VkQueueFamilyProperties": {
+						"minImageTransferGranularity": { "depth": 1, "height": 1, "width": 1 },
+						"queueCount": 16,
+						"queueFlags": [ "VK_QUEUE_GRAPHICS_BIT", "VK_QUEUE_COMPUTE_BIT", "VK_QUEUE_TRANSFER_BIT", "VK_QUEUE_SPARSE_BINDING_BIT" ],
+						"timestampValidBits": 64
+					}
+				},
+				{
+					"VkQueueFamilyProperties": {
+						"minImageTransferGranularity": { "depth": 8, "height": 8, "width": 16 },
+						"queueCount": 2,
+						"queueFlags": [ "VK_QUEUE_TRANSFER_BIT", "VK_QUEUE_SPARSE_BINDING_BIT", "VK_QUEUE_VIDEO_DECODE_BIT_KHR" ],
+						"timestampValidBits": 0
+					}
+				}
+			]
+		}
+	},
+	"profiles": {}
+}`
+
+func TestParseVulkanInfoProfiles(t *testing.T) {
+	ctx := log.Testing(t)
+
+	info, err := parseVulkanInfo(profilesVulkanInfo)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	f, err := parseVulkanFeatures(info.Features)
+	assert.For(ctx, "parseVulkanFeatures").ThatError(err).Succeeded()
+	missing := f.Missing(VulkanFeatureSet{"geometryShader", "tessellationShader", "textureCompressionASTC_LDR"})
+	assert.For(ctx, "missing").ThatSlice(missing).Equals([]string{"tessellationShader"})
+
+	assert.For(ctx, "MemoryProperties").That(info.MemoryProperties == nil).Equals(true)
+	assert.For(ctx, "families").That(info.queueFamilies()).DeepEquals([]*VulkanQueueFamily{
+		{
+			Index:                       0,
+			Count:                       16,
+			Flags:                       VulkanQueueGraphics | VulkanQueueCompute | VulkanQueueTransfer | VulkanQueueSparseBinding,
+			TimestampValidBits:          64,
+			MinImageTransferGranularity: [3]uint32{1, 1, 1},
+		},
+		{
+			Index:                       1,
+			Count:                       2,
+			Flags:                       VulkanQueueTransfer | VulkanQueueSparseBinding,
+			MinImageTransferGranularity: [3]uint32{16, 8, 8},
+		},
+	})
+}
+
+// fakeVulkanInfo saves the Vulkan Profiles output to the file named by -o.
+const fakeVulkanInfo = `#!/bin/sh
+[ "$1" = "--json=1" ] && [ "$2" = "-o" ] || exit 1
+cat "$(dirname "$0")/vulkaninfo.json" > "$3"
+echo "Profile saved to $3"
+`
+
+// fakeDevsimVulkanInfo rejects -o, and prints the devsim output.
+const fakeDevsimVulkanInfo = `#!/bin/sh
+[ "$1" = "--json=1" ] || exit 1
+if [ -n "$2" ]; then echo "Unknown option $2"; exit 1; fi
+echo '{"VkPhysicalDeviceFeatures": {"geometryShader": 0, "tessellationShader": 1}}'
+`
+
+func TestGetVulkanDeviceFeatures(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The test server runs commands locally, so a fake vulkaninfo is put
+	// first on the PATH.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	err = ioutil.WriteFile(filepath.Join(bin, "vulkaninfo.json"), []byte(profilesVulkanInfo), 0600)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	env := shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+
+	for _, test := range []struct {
+		name     string
+		script   string
+		expected bool
+	}{
+		{"profiles", fakeVulkanInfo, true},
+		{"devsim", fakeDevsimVulkanInfo, false},
+	} {
+		err := ioutil.WriteFile(filepath.Join(bin, "vulkaninfo"), []byte(test.script), 0700)
+		assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+		f, err := b.GetVulkanDeviceFeatures(ctx, 1)
+		assert.For(ctx, "%v GetVulkanDeviceFeatures", test.name).ThatError(err).Succeeded()
+		if err == nil {
+			assert.For(ctx, "%v geometryShader", test.name).That(f.GeometryShader).Equals(test.expected)
+			assert.For(ctx, "%v tessellationShader", test.name).That(f.TessellationShader).Equals(!test.expected)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gapid/core/app/crash"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+// FileEventMask selects the changes reported by WatchFile.
+type FileEventMask int
+
+const (
+	// FileCreated reports files created in a watched directory.
+	FileCreated FileEventMask = 1 << iota
+	// FileModified reports writes to files.
+	FileModified
+	// FileClosedWrite reports files closed after being opened for writing,
+	// which usually means that they are complete. On macOS it is reported
+	// as a modification.
+	FileClosedWrite
+	// FileDeleted reports deleted files.
+	FileDeleted
+	// FileMoved reports files moved or renamed.
+	FileMoved
+	// FileAttribChanged reports changes to the permissions, owner or
+	// timestamps of files.
+	FileAttribChanged
+
+	// FileAllEvents reports all the changes.
+	FileAllEvents = FileCreated | FileModified | FileClosedWrite | FileDeleted | FileMoved | FileAttribChanged
+)
+
+// fileEventOps lists the Op of the FileEvents for each flag of
+// FileEventMask, and the names inotifywait and fswatch use for them.
+var fileEventOps = []struct {
+	mask FileEventMask
+	op   string
+	// inotifyEvents is the argument of inotifywait -e, and inotifyFlags the
+	// events it reports.
+	inotifyEvents string
+	inotifyFlags  []string
+	// fswatchFlags are the fswatch events. fswatch cannot tell when files
+	// are closed, so FileClosedWrite is reported for every update.
+	fswatchFlags []string
+}{
+	{FileCreated, "create", "create", []string{"CREATE"}, []string{"Created"}},
+	{FileModified, "modify", "modify", []string{"MODIFY"}, []string{"Updated"}},
+	{FileClosedWrite, "close_write", "close_write", []string{"CLOSE_WRITE"}, []string{"Updated"}},
+	{FileDeleted, "delete", "delete,delete_self", []string{"DELETE", "DELETE_SELF"}, []string{"Removed"}},
+	{FileMoved, "move", "move,move_self", []string{"MOVED_FROM", "MOVED_TO", "MOVE_SELF"}, []string{"Renamed", "MovedFrom", "MovedTo"}},
+	{FileAttribChanged, "attrib", "attrib", []string{"ATTRIB"}, []string{"AttributeModified", "OwnerModified"}},
+}
+
+// FileEvent is a change to a watched file.
+type FileEvent struct {
+	// Path is the path of the file that changed.
+	Path string
+	// Op is the change, one of "create", "modify", "close_write", "delete",
+	// "move" or "attrib".
+	Op string
+	// Time is when the change was received.
+	Time time.Time
+}
+
+// watchCommand returns the command that watches path for the given events,
+// printing a "<path>|<comma separated events>" line for each change.
+func (b binding) watchCommand(path string, events FileEventMask) shell.Cmd {
+	if b.os == device.OSX {
+		args := []string{"--format", "%p|%f", "--event-flag-separator", ","}
+		added := map[string]bool{}
+		for _, e := range fileEventOps {
+			for _, flag := range e.fswatchFlags {
+				if events&e.mask != 0 && !added[flag] {
+					args = append(args, "--event", flag)
+					added[flag] = true
+				}
+			}
+		}
+		return b.Shell("fswatch", append(args, path)...)
+	}
+	list := []string{}
+	for _, e := range fileEventOps {
+		if events&e.mask != 0 {
+			list = append(list, e.inotifyEvents)
+		}
+	}
+	return b.Shell("inotifywait", "-m", "--format", "%w%f|%e", "-e", strings.Join(list, ","), path)
+}
+
+// parseFileEvents parses a line printed by the watch command into the
+// events selected by the mask.
+func parseFileEvents(line string, events FileEventMask, osx bool, now time.Time) []FileEvent {
+	i := strings.LastIndex(line, "|")
+	if i < 0 {
+		return nil
+	}
+	path, flags := line[:i], strings.Split(strings.TrimSpace(line[i+1:]), ",")
+	list := []FileEvent{}
+	for _, e := range fileEventOps {
+		names := e.inotifyFlags
+		if osx {
+			names = e.fswatchFlags
+		}
+		if events&e.mask != 0 && containsAny(flags, names) {
+			list = append(list, FileEvent{Path: path, Op: e.op, Time: now})
+		}
+	}
+	return list
+}
+
+func containsAny(list, values []string) bool {
+	for _, s := range list {
+		for _, v := range values {
+			if s == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchReady signals when inotifywait has established its watches, which
+// it reports on standard error.
+type watchReady struct {
+	mutex  sync.Mutex
+	ready  chan struct{}
+	stderr bytes.Buffer
+}
+
+func (w *watchReady) Write(b []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stderr.Write(b)
+	if strings.Contains(w.stderr.String(), "Watches established") {
+		select {
+		case <-w.ready:
+		default:
+			close(w.ready)
+		}
+	}
+	return len(b), nil
+}
+
+func (w *watchReady) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return strings.TrimSpace(w.stderr.String())
+}
+
+// WatchFile reports the changes to the remote file or directory at path,
+// using inotifywait on Linux and fswatch on macOS, which must be installed.
+// The changes of the files directly in a directory are reported, but not of
+// those in its subdirectories. Watching stops, and the channel is closed,
+// when ctx is cancelled or the watch command fails.
+func (b binding) WatchFile(ctx context.Context, path string, events FileEventMask) (<-chan FileEvent, error) {
+	if events&FileAllEvents == 0 {
+		return nil, fmt.Errorf("No file events to watch")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r, w := io.Pipe()
+	stderr := &watchReady{ready: make(chan struct{})}
+	exited := make(chan error, 1)
+	crash.Go(func() {
+		err := b.watchCommand(path, events).Capture(w, stderr).Run(ctx)
+		w.CloseWithError(err)
+		exited <- err
+	})
+
+	if b.os != device.OSX {
+		// Changes made before the watches are established are missed.
+		select {
+		case <-stderr.ready:
+		case err := <-exited:
+			cancel()
+			return nil, log.Errf(ctx, err, "Could not watch %s: %s", path, stderr)
+		}
+	}
+
+	ch := make(chan FileEvent)
+	crash.Go(func() {
+		defer close(ch)
+		defer cancel()
+		defer r.Close()
+		lines := bufio.NewScanner(r)
+		for lines.Scan() {
+			for _, e := range parseFileEvents(lines.Text(), events, b.os == device.OSX, time.Now()) {
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	})
+	return ch, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/core/os/shell"
+)
+
+func TestParseFileEvents(t *testing.T) {
+	ctx := log.Testing(t)
+	now := time.Now()
+
+	for _, test := range []struct {
+		line     string
+		events   FileEventMask
+		osx      bool
+		expected []FileEvent
+	}{
+		{"/out/trace|CLOSE_WRITE,CLOSE", FileAllEvents, false, []FileEvent{{"/out/trace", "close_write", now}}},
+		{"/out/a|b|MOVED_TO", FileAllEvents, false, []FileEvent{{"/out/a|b", "move", now}}},
+		{"/out/dir|CREATE,ISDIR", FileCreated, false, []FileEvent{{"/out/dir", "create", now}}},
+		{"/out/trace|MODIFY", FileCreated, false, []FileEvent{}},
+		{"/out/trace|Created,IsFile,Updated", FileCreated | FileModified, true, []FileEvent{
+			{"/out/trace", "create", now},
+			{"/out/trace", "modify", now},
+		}},
+		{"/out/trace|Updated,IsFile", FileClosedWrite, true, []FileEvent{{"/out/trace", "close_write", now}}},
+		{"Setting up watches.", FileAllEvents, false, nil},
+	} {
+		events := parseFileEvents(test.line, test.events, test.osx, now)
+		assert.For(ctx, test.line).That(events).DeepEquals(test.expected)
+	}
+}
+
+const fakeInotifywait = `#!/bin/sh
+echo "$@" > "$(dirname "$0")/args"
+echo "Setting up watches." >&2
+echo "Watches established." >&2
+printf '%s\n' '/out/a trace|CREATE' '/out/a trace|CLOSE_WRITE,CLOSE' '/out/old|DELETE'
+exec sleep 1000
+`
+
+func TestWatchFile(t *testing.T) {
+	ctx := log.Testing(t)
+
+	dir, err := ioutil.TempDir("", "remotessh")
+	assert.For(ctx, "TempDir").ThatError(err).Succeeded()
+	defer os.RemoveAll(dir)
+
+	c, server := newTestHost(t, dir, "host")
+	defer server.listener.Close()
+	client, err := dialSSH(ctx, c)
+	assert.For(ctx, "dialSSH").ThatError(err).Succeeded()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// The test server runs commands locally, so a fake inotifywait is put
+	// first on the PATH.
+	bin := filepath.Join(dir, "bin")
+	assert.For(ctx, "Mkdir").ThatError(os.Mkdir(bin, 0700)).Succeeded()
+	err = ioutil.WriteFile(filepath.Join(bin, "inotifywait"), []byte(fakeInotifywait), 0700)
+	assert.For(ctx, "WriteFile").ThatError(err).Succeeded()
+	env := shell.NewEnv().Set("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	b := binding{connection: client, configuration: &c, env: env, os: device.Linux}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	events, err := b.WatchFile(watchCtx, "/out", FileCreated|FileClosedWrite)
+	assert.For(ctx, "WatchFile").ThatError(err).Succeeded()
+	if err != nil {
+		cancel()
+		return
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(bin, "args"))
+	assert.For(ctx, "args").ThatString(strings.TrimSpace(string(args))).Equals("-m --format %w%f|%e -e create,close_write /out")
+
+	for _, expected := range []FileEvent{{"/out/a trace", "create", time.Time{}}, {"/out/a trace", "close_write", time.Time{}}} {
+		select {
+		case e := <-events:
+			assert.For(ctx, "event").That(FileEvent{e.Path, e.Op, time.Time{}}).Equals(expected)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for file events")
+		}
+	}
+
+	// The channel is closed once the watch is cancelled.
+	cancel()
+	select {
+	case e, ok := <-events:
+		assert.For(ctx, "closed").That(ok).Equals(false)
+		assert.For(ctx, "unexpected event").That(e).Equals(FileEvent{})
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watch to stop")
+	}
+
+	b.env = shell.NewEnv().Set("PATH", filepath.Join(dir, "missing"))
+	_, err = b.WatchFile(context.Background(), "/out", FileAllEvents)
+	assert.For(ctx, "missing inotifywait").ThatError(err).Failed()
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/gapid/core/os/shell"
+)
+
+// powerShellQuote quotes s as a single-quoted PowerShell string literal, in
+// which no characters other than the quote itself are special.
+func powerShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// encodePowerShell encodes script for powershell -EncodedCommand, which
+// takes the base64 of its UTF-16LE encoding. This sidesteps the quoting
+// rules of whatever shell the SSH server runs the command with.
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(buf[i*2:], u)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// powerShell returns a command that runs script with PowerShell on a remote
+// Windows machine. It is the Windows counterpart of posixShell.
+func (b binding) powerShell(script string) shell.Cmd {
+	return b.Shell("powershell", "-NoProfile", "-NonInteractive", "-EncodedCommand", encodePowerShell(script))
+}
+
+// windowsPath converts p to use the backslash separators expected by
+// Windows commands.
+func windowsPath(p string) string {
+	return strings.Replace(p, "/", `\`, -1)
+}
+
+// slashPath converts a Windows path to use forward slashes, which Windows
+// also accepts, so that it can be manipulated with the path package.
+func slashPath(p string) string {
+	return strings.Replace(p, `\`, "/", -1)
+}
+
+// literalPath returns the PowerShell -LiteralPath argument for p, so that
+// wildcard characters in p are not expanded.
+func literalPath(p string) string {
+	return "-LiteralPath " + powerShellQuote(windowsPath(p))
+}
+
+// powerShellLines runs script and returns the non-empty lines it printed.
+func (b binding) powerShellLines(ctx context.Context, script string) ([]string, error) {
+	res, err := b.powerShell(script).Call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(res))
+	out := []string{}
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+func (b binding) destroyWindowsDirectory(ctx context.Context, dir string) {
+	_, _ = b.powerShell("Remove-Item -Recurse -Force " + literalPath(dir)).Call(ctx)
+}
+
+func (b binding) createWindowsTempDirectory(ctx context.Context) (string, func(context.Context), error) {
+	dir, err := b.powerShell(
+		"$d = Join-Path ([System.IO.Path]::GetTempPath()) ([System.IO.Path]::GetRandomFileName()); " +
+			"New-Item -ItemType Directory -Path $d | Out-Null; $d").Call(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	dir = slashPath(strings.TrimSpace(dir))
+	return dir, func(ctx context.Context) { b.destroyWindowsDirectory(ctx, dir) }, nil
+}
+
+func (b binding) createWindowsTempFile(ctx context.Context) (string, func(context.Context), error) {
+	res, err := b.powerShell("(New-TemporaryFile).FullName").Call(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	res = slashPath(strings.TrimSpace(res))
+	return res, func(ctx context.Context) { b.removeWindowsFile(ctx, res) }, nil
+}
+
+func (b binding) removeWindowsFile(ctx context.Context, path string) error {
+	_, err := b.powerShell("Remove-Item -Force -ErrorAction SilentlyContinue " + literalPath(path)).Call(ctx)
+	return err
+}
+
+// testWindowsPath returns true if inPath exists and is of the given
+// Test-Path -PathType: Leaf, Container or Any.
+func (b binding) testWindowsPath(ctx context.Context, inPath, pathType string) (bool, error) {
+	res, err := b.powerShell("Test-Path -PathType " + pathType + " " + literalPath(inPath)).Call(ctx)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(res) == "True", nil
+}
+
+func (b binding) listWindowsExecutables(ctx context.Context, inPath string) ([]string, error) {
+	// Windows has no executable bit, a file is executable if its extension
+	// is listed in PATHEXT.
+	return b.powerShellLines(ctx, "$exts = $env:PATHEXT -split ';'; "+
+		"Get-ChildItem -File -ErrorAction SilentlyContinue "+literalPath(inPath)+
+		" | Where-Object { $exts -contains $_.Extension } | ForEach-Object { $_.Name }")
+}
+
+func (b binding) listWindowsDirectories(ctx context.Context, inPath string) ([]string, error) {
+	return b.powerShellLines(ctx, "Get-ChildItem -Directory -ErrorAction SilentlyContinue "+
+		literalPath(inPath)+" | ForEach-Object { $_.Name }")
+}
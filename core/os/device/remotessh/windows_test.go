@@ -0,0 +1,38 @@
+// Copyright (C) 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotessh
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestEncodePowerShell(t *testing.T) {
+	ctx := log.Testing(t)
+
+	// Matches [Convert]::ToBase64String([Text.Encoding]::Unicode.GetBytes('dir'))
+	assert.For(ctx, "ascii").ThatString(encodePowerShell("dir")).Equals("ZABpAHIA")
+	assert.For(ctx, "non-ascii").ThatString(encodePowerShell("é")).Equals("6QA=")
+}
+
+func TestWindowsPaths(t *testing.T) {
+	ctx := log.Testing(t)
+
+	assert.For(ctx, "windowsPath").ThatString(windowsPath("C:/Users/me/AppData")).Equals(`C:\Users\me\AppData`)
+	assert.For(ctx, "slashPath").ThatString(slashPath(`C:\Users\me\AppData\Local\Temp\abc.tmp`)).Equals("C:/Users/me/AppData/Local/Temp/abc.tmp")
+	assert.For(ctx, "literalPath").ThatString(literalPath("C:/it's [here]")).Equals(`-LiteralPath 'C:\it''s [here]'`)
+}
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/gapid/core/log"
 )
@@ -51,6 +52,21 @@ type Cmd struct {
 	Stdin io.Reader
 	// Environment is the processes environment, if set.
 	Environment *Env
+	// Timeout is how long the command may run before it is killed, if set.
+	Timeout time.Duration
+	// Sudo runs the command with elevated privileges through sudo, on the
+	// targets that support it.
+	Sudo bool
+	// SudoPassword is given to sudo on its standard input, if set.
+	// It is never logged.
+	SudoPassword string
+	// Interactive keeps the standard input of the command open after it has
+	// started, so that it can be written to through the Process, on the
+	// targets that support it. It is ignored if Stdin is set.
+	Interactive bool
+	// OutputBuffer is how many bytes of the most recent output of the command
+	// its Process keeps, on the targets that support it, if set.
+	OutputBuffer int
 }
 
 // Command returns a Cmd with the specified command and arguments set.
@@ -95,6 +111,44 @@ func (cmd Cmd) Env(env *Env) Cmd {
 	return cmd
 }
 
+// WithTimeout returns a copy of the Cmd with the Timeout set to d.
+// If the command runs for longer than d, it is killed and Run returns
+// context.DeadlineExceeded.
+func (cmd Cmd) WithTimeout(d time.Duration) Cmd {
+	cmd.Timeout = d
+	return cmd
+}
+
+// AsSudo returns a copy of the Cmd that runs with elevated privileges
+// through sudo, which must not ask for a password.
+func (cmd Cmd) AsSudo() Cmd {
+	cmd.Sudo = true
+	cmd.SudoPassword = ""
+	return cmd
+}
+
+// AsSudoWithPassword returns a copy of the Cmd that runs with elevated
+// privileges through sudo, giving it password if it asks for one.
+func (cmd Cmd) AsSudoWithPassword(password string) Cmd {
+	cmd.Sudo = true
+	cmd.SudoPassword = password
+	return cmd
+}
+
+// AsInteractive returns a copy of the Cmd with the Interactive flag set to
+// true.
+func (cmd Cmd) AsInteractive() Cmd {
+	cmd.Interactive = true
+	return cmd
+}
+
+// WithOutputBuffer returns a copy of the Cmd with the OutputBuffer set to
+// size.
+func (cmd Cmd) WithOutputBuffer(size int) Cmd {
+	cmd.OutputBuffer = size
+	return cmd
+}
+
 // With returns a copy of the Cmd with the args added to the end of Args.
 func (cmd Cmd) With(args ...string) Cmd {
 	old := cmd.Args
@@ -116,6 +170,11 @@ func (cmd Cmd) Run(ctx context.Context) error {
 	if cmd.Dir != "" {
 		ctx = log.V{"Dir": cmd.Dir}.Bind(ctx)
 	}
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
 	// build our stdout and stderr handling
 	var logStdout, logStderr io.WriteCloser
 	if cmd.Verbosity {
@@ -139,7 +198,13 @@ func (cmd Cmd) Run(ctx context.Context) error {
 	if cmd.Verbosity {
 		log.I(ctx, "Exec: %v", cmd)
 	}
-	process, err := cmd.Target.Start(cmd)
+	var process Process
+	var err error
+	if target, ok := cmd.Target.(ContextTarget); ok {
+		process, err = target.StartContext(ctx, cmd)
+	} else {
+		process, err = cmd.Target.Start(cmd)
+	}
 	if err != nil {
 		return log.From(ctx).Err(err, "Failed to start process")
 	}
@@ -172,6 +237,9 @@ func (cmd Cmd) Call(ctx context.Context) (string, error) {
 }
 
 func (cmd Cmd) Format(f fmt.State, c rune) {
+	if cmd.Sudo {
+		fmt.Fprint(f, "sudo ")
+	}
 	fmt.Fprint(f, cmd.Name)
 	for _, arg := range cmd.Args {
 		fmt.Fprint(f, " ")
@@ -19,6 +19,7 @@ package shell_test
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/google/gapid/core/assert"
 	"github.com/google/gapid/core/event/task"
@@ -63,6 +64,15 @@ func TestCommandCancel(t *testing.T) {
    Cause: context canceled`)
 }
 
+func TestCommandTimeout(t *testing.T) {
+	ctx := log.Testing(t)
+	start := time.Now()
+	err := shell.Command("sleep", "5").WithTimeout(50 * time.Millisecond).Run(ctx)
+	assert.For(ctx, "err").ThatError(err).HasMessage(`Process returned error
+   Cause: context deadline exceeded`)
+	assert.For(ctx, "killed").That(time.Since(start) < 5*time.Second).Equals(true)
+}
+
 func TestCommandCaptureStdout(t *testing.T) {
 	const expect = "echo to stdout\n"
 	ctx := log.Testing(t)
@@ -14,9 +14,21 @@
 
 package shell
 
+import "context"
+
 // Target is the interface for an object that supports execution of Commands.
 type Target interface {
 	// Start is invoked to execute the supplied command.
 	// It must return either a Process object that can be used to control the command, or an error.
 	Start(cmd Cmd) (Process, error)
 }
+
+// ContextTarget is implemented by the Targets that may have to wait before
+// they can start a command, so that Run stops waiting when its context is
+// cancelled.
+type ContextTarget interface {
+	Target
+	// StartContext is like Start, but gives up if ctx is cancelled before
+	// the command has started.
+	StartContext(ctx context.Context, cmd Cmd) (Process, error)
+}
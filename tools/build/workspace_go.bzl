@@ -51,6 +51,14 @@ def gapid_go_dependencies():
         importpath = "github.com/google/go-querystring",
     )
 
+    _maybe(_github_go_repository,
+        name = "com_github_kr_fs",
+        organization = "kr",
+        project = "fs",
+        commit = "1455def202f6e05b95cc7bfc7e8ae67ae5141eba",
+        importpath = "github.com/kr/fs",
+    )
+
     _maybe(_github_go_repository,
         name = "com_github_pkg_errors",
         organization = "pkg",
@@ -59,6 +67,14 @@ def gapid_go_dependencies():
         importpath = "github.com/pkg/errors",
     )
 
+    _maybe(_github_go_repository,
+        name = "com_github_pkg_sftp",
+        organization = "pkg",
+        project = "sftp",
+        commit = "669003cef43b4ef0da0894493b012ba9c3d7e313",
+        importpath = "github.com/pkg/sftp",
+    )
+
     _maybe(_github_go_repository,
         name = "org_golang_google_grpc",
         organization = "grpc",